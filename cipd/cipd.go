@@ -453,6 +453,125 @@ func Resolve(jirix *jiri.X, file string) ([]PackageInstance, error) {
 	return parseVersions(versionFile)
 }
 
+// InstanceInfo describes a package instance by the refs and tags attached to
+// it in the cipd backend, which are the human readable names of its version.
+type InstanceInfo struct {
+	Refs []string
+	Tags []string
+}
+
+// Describe runs cipd binary's describe functionality to look up the refs and
+// tags attached to the instance instanceID of package pkg.
+func Describe(jirix *jiri.X, pkg, instanceID string) (InstanceInfo, error) {
+	cipdPath, err := Bootstrap()
+	if err != nil {
+		return InstanceInfo{}, err
+	}
+	jsonFile, err := ioutil.TempFile("", "cipd*.json")
+	if err != nil {
+		return InstanceInfo{}, err
+	}
+	jsonFileName := jsonFile.Name()
+	jsonFile.Close()
+	defer os.Remove(jsonFileName)
+
+	args := []string{"describe", pkg, "-version", instanceID, "-json-output", jsonFileName, "-log-level", "warning"}
+	if jirix != nil {
+		jirix.Logger.Debugf("Invoke cipd with %v", args)
+	}
+	command := exec.Command(cipdPath, args...)
+	command.Env = append(os.Environ(), "CIPD_HTTP_USER_AGENT_PREFIX="+getUserAgent())
+	var stdoutBuf, stderrBuf bytes.Buffer
+	command.Stdout = &stdoutBuf
+	command.Stderr = &stderrBuf
+	if err := command.Run(); err != nil {
+		return InstanceInfo{}, fmt.Errorf("cipd describe %s@%s failed: %v: %s", pkg, instanceID, err, stderrBuf.String())
+	}
+	jsonData, err := ioutil.ReadFile(jsonFileName)
+	if err != nil {
+		return InstanceInfo{}, err
+	}
+	return parseDescription(jsonData)
+}
+
+// parseDescription parses the json output of cipd describe.
+func parseDescription(jsonData []byte) (InstanceInfo, error) {
+	var output struct {
+		Result struct {
+			Refs []struct {
+				Ref string `json:"ref"`
+			} `json:"refs"`
+			Tags []struct {
+				Tag string `json:"tag"`
+			} `json:"tags"`
+		} `json:"result"`
+	}
+	if err := json.Unmarshal(jsonData, &output); err != nil {
+		return InstanceInfo{}, fmt.Errorf("failed to parse cipd describe output: %v", err)
+	}
+	var info InstanceInfo
+	for _, ref := range output.Result.Refs {
+		info.Refs = append(info.Refs, ref.Ref)
+	}
+	for _, tag := range output.Result.Tags {
+		info.Tags = append(info.Tags, tag.Tag)
+	}
+	return info, nil
+}
+
+// Installed returns the packages installed under root by cipd ensure, along
+// with the IDs of their installed instances.  VersionTag is left empty.  cipd
+// keeps one directory per package in root/.cipd/pkgs, with a description.json
+// naming the package and a _current symlink (_current.txt file on Windows)
+// pointing to the directory of the installed instance.
+func Installed(root string) ([]PackageInstance, error) {
+	pkgsDir := path.Join(root, ".cipd", "pkgs")
+	entries, err := ioutil.ReadDir(pkgsDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var installed []PackageInstance
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		dir := path.Join(pkgsDir, entry.Name())
+		data, err := ioutil.ReadFile(path.Join(dir, "description.json"))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		var desc struct {
+			PackageName string `json:"package_name"`
+		}
+		if err := json.Unmarshal(data, &desc); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %v", path.Join(dir, "description.json"), err)
+		}
+		instanceID, err := os.Readlink(path.Join(dir, "_current"))
+		if err != nil {
+			data, err := ioutil.ReadFile(path.Join(dir, "_current.txt"))
+			if err != nil {
+				if os.IsNotExist(err) {
+					// The package is being installed or removed.
+					continue
+				}
+				return nil, err
+			}
+			instanceID = strings.TrimSpace(string(data))
+		}
+		installed = append(installed, PackageInstance{
+			PackageName: desc.PackageName,
+			InstanceID:  path.Base(instanceID),
+		})
+	}
+	return installed, nil
+}
+
 func parseVersions(file string) ([]PackageInstance, error) {
 	versionReader, err := os.Open(file)
 	if err != nil {
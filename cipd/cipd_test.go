@@ -7,11 +7,13 @@ package cipd
 import (
 	"bytes"
 	"encoding/hex"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
 	"reflect"
 	"sort"
+	"strconv"
 	"strings"
 	"testing"
 )
@@ -266,6 +268,71 @@ gn/gn/${platform} git_revision:bdb0fd02324b120cacde634a9235405061c8ea06
 	}
 }
 
+func TestInstalled(t *testing.T) {
+	root, err := ioutil.TempDir("", "jiri-cipd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	if instances, err := Installed(root); err != nil || len(instances) != 0 {
+		t.Errorf("empty root: got %v, %v, want no instances", instances, err)
+	}
+
+	// Lay out packages the way cipd ensure does.
+	want := []PackageInstance{
+		{PackageName: "gn/gn/linux-amd64", InstanceID: "0000000000000000000000000000000000000000"},
+		{PackageName: "fuchsia/clang/linux-amd64", InstanceID: "1111111111111111111111111111111111111111"},
+	}
+	for i, pkg := range want {
+		dir := path.Join(root, ".cipd", "pkgs", strconv.Itoa(i))
+		if err := os.MkdirAll(path.Join(dir, pkg.InstanceID), 0755); err != nil {
+			t.Fatal(err)
+		}
+		desc := fmt.Sprintf(`{"subdir": "prebuilt", "package_name": %q}`, pkg.PackageName)
+		if err := ioutil.WriteFile(path.Join(dir, "description.json"), []byte(desc), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(pkg.InstanceID, path.Join(dir, "_current")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := Installed(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestParseDescription(t *testing.T) {
+	data := `{
+  "result": {
+    "pin": {"package": "gn/gn/linux-amd64", "instance_id": "0uGjKAZkJXPZjtYktgEwHiNbwsut_qRsk7ZCGGxi82IC"},
+    "registered_by": "user:someone@example.com",
+    "refs": [{"ref": "latest", "instance_id": "0uGjKAZkJXPZjtYktgEwHiNbwsut_qRsk7ZCGGxi82IC"}],
+    "tags": [
+      {"tag": "git_revision:bdb0fd02324b120cacde634a9235405061c8ea06"},
+      {"tag": "version:1.2.3"}
+    ]
+  }
+}`
+	got, err := parseDescription([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := InstanceInfo{
+		Refs: []string{"latest"},
+		Tags: []string{"git_revision:bdb0fd02324b120cacde634a9235405061c8ea06", "version:1.2.3"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if _, err := parseDescription([]byte("not json")); err == nil {
+		t.Errorf("expected an error for invalid output")
+	}
+}
+
 func TestExpand(t *testing.T) {
 	platforms := []Platform{
 		Platform{"linux", "amd64"},
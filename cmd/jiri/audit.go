@@ -0,0 +1,160 @@
+// Copyright 2019 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+
+	"github.com/dahlia-os/jiri"
+	"github.com/dahlia-os/jiri/cmdline"
+	"github.com/dahlia-os/jiri/project"
+)
+
+var auditFlags struct {
+	packages   bool
+	strict     bool
+	jsonOutput string
+}
+
+var cmdAudit = &cmdline.Command{
+	Runner: jiri.RunnerFunc(runAudit),
+	Name:   "audit",
+	Short:  "List projects and packages which are not pinned",
+	Long: `
+List the projects which track a remote branch instead of being pinned to a
+revision, either in the manifest or in a lockfile. With -packages, also list
+the cipd packages which are not pinned to instance IDs in a lockfile.
+
+The command does not modify the workspace. With -strict it fails if anything
+is floating, which is useful for release-readiness checks.
+`,
+}
+
+func init() {
+	cmdAudit.Flags.BoolVar(&auditFlags.packages, "packages", false, "Also list cipd packages which are not pinned to instance IDs.")
+	cmdAudit.Flags.BoolVar(&auditFlags.strict, "strict", false, "Fail if any project or package is floating.")
+	cmdAudit.Flags.StringVar(&auditFlags.jsonOutput, "json-output", "", "Path to write the audit result to, in json format.")
+}
+
+// auditResult defines JSON format for 'jiri audit' output.
+type auditResult struct {
+	Projects []auditProject `json:"projects"`
+	Packages []auditPackage `json:"packages,omitempty"`
+}
+
+type auditProject struct {
+	Name         string `json:"name"`
+	Remote       string `json:"remote"`
+	RemoteBranch string `json:"remote_branch"`
+}
+
+type auditPackage struct {
+	Name    string `json:"name"`
+	Path    string `json:"path,omitempty"`
+	Version string `json:"version"`
+}
+
+func runAudit(jirix *jiri.X, args []string) error {
+	if len(args) != 0 {
+		return jirix.UsageErrorf("unexpected number of arguments")
+	}
+	localProjects, err := project.LocalProjects(jirix, project.FastScan)
+	if err != nil {
+		return err
+	}
+	result, err := auditManifest(jirix, localProjects)
+	if err != nil {
+		return err
+	}
+	result.print(jirix.Stdout())
+	if auditFlags.jsonOutput != "" {
+		out, err := json.MarshalIndent(result, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to serialize JSON output: %s\n", err)
+		}
+		if err := ioutil.WriteFile(auditFlags.jsonOutput, out, 0600); err != nil {
+			return fmt.Errorf("failed write JSON output to %s: %s\n", auditFlags.jsonOutput, err)
+		}
+	}
+	if auditFlags.strict && (len(result.Projects) != 0 || len(result.Packages) != 0) {
+		return fmt.Errorf("found %d floating projects and %d floating packages", len(result.Projects), len(result.Packages))
+	}
+	return nil
+}
+
+// auditManifest loads the manifest together with its lockfiles and returns
+// the projects and, if requested, the packages which are not pinned.
+func auditManifest(jirix *jiri.X, localProjects project.Projects) (*auditResult, error) {
+	// Pins in lockfiles count as well, so read them even if they are not
+	// used by 'jiri update'.
+	if jirix.LockfileName != "" {
+		enableLockfile := jirix.LockfileEnabled
+		jirix.LockfileEnabled = true
+		defer func() {
+			jirix.LockfileEnabled = enableLockfile
+		}()
+	}
+	projects, _, pkgs, err := project.LoadManifestFile(jirix, jirix.JiriManifestFile(), localProjects, false /*localManifest*/)
+	if err != nil {
+		return nil, err
+	}
+	result := &auditResult{Projects: []auditProject{}}
+	for _, p := range projects {
+		if pinned, target := projectTarget(p); !pinned {
+			result.Projects = append(result.Projects, auditProject{
+				Name:         p.Name,
+				Remote:       p.Remote,
+				RemoteBranch: target,
+			})
+		}
+	}
+	sort.Slice(result.Projects, func(i, j int) bool {
+		return result.Projects[i].Name < result.Projects[j].Name
+	})
+	if auditFlags.packages {
+		for _, pkg := range pkgs {
+			if len(pkg.Instances) == 0 {
+				result.Packages = append(result.Packages, auditPackage{
+					Name:    pkg.Name,
+					Path:    pkg.Path,
+					Version: pkg.Version,
+				})
+			}
+		}
+		sort.Slice(result.Packages, func(i, j int) bool {
+			if result.Packages[i].Name == result.Packages[j].Name {
+				return result.Packages[i].Path < result.Packages[j].Path
+			}
+			return result.Packages[i].Name < result.Packages[j].Name
+		})
+	}
+	return result, nil
+}
+
+func (r *auditResult) print(w io.Writer) {
+	if len(r.Projects) == 0 {
+		fmt.Fprintln(w, "All projects are pinned")
+	} else {
+		fmt.Fprintln(w, "Floating projects:")
+		for _, p := range r.Projects {
+			fmt.Fprintf(w, "  %s (tracking %s)\n", p.Name, p.RemoteBranch)
+		}
+	}
+	if !auditFlags.packages {
+		return
+	}
+	if len(r.Packages) == 0 {
+		fmt.Fprintln(w, "All packages are pinned")
+	} else {
+		fmt.Fprintln(w, "Floating packages:")
+		for _, pkg := range r.Packages {
+			fmt.Fprintf(w, "  %s (version %s)\n", pkg.Name, pkg.Version)
+		}
+	}
+}
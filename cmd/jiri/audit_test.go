@@ -0,0 +1,142 @@
+// Copyright 2019 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/dahlia-os/jiri/gitutil"
+	"github.com/dahlia-os/jiri/jiritest"
+	"github.com/dahlia-os/jiri/project"
+)
+
+func TestAudit(t *testing.T) {
+	fake, cleanup := jiritest.NewFakeJiriRoot(t)
+	defer cleanup()
+	fake.X.LockfileName = "jiri.lock"
+	auditFlags.packages = true
+	defer func() {
+		auditFlags.packages = false
+		auditFlags.strict = false
+	}()
+
+	revisions := map[string]string{}
+	for _, name := range []string{"pinned", "tracking"} {
+		if err := fake.CreateRemoteProject(name); err != nil {
+			t.Fatal(err)
+		}
+		remote := fake.Projects[name]
+		if err := ioutil.WriteFile(filepath.Join(remote, "README"), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		git := gitutil.New(fake.X, gitutil.UserNameOpt("John Doe"), gitutil.UserEmailOpt("john.doe@example.com"), gitutil.RootDirOpt(remote))
+		if err := git.CommitFile("README", "add README"); err != nil {
+			t.Fatal(err)
+		}
+		rev, err := git.CurrentRevision()
+		if err != nil {
+			t.Fatal(err)
+		}
+		revisions[name] = rev
+		p := project.Project{
+			Name:   name,
+			Path:   filepath.Join(fake.X.Root, name),
+			Remote: remote,
+		}
+		if name == "pinned" {
+			p.Revision = rev
+		}
+		if err := fake.AddProject(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	manifestRev, err := gitutil.New(fake.X, gitutil.RootDirOpt(fake.Projects[jiritest.ManifestProjectName])).CurrentRevision()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Packages are added after the update to avoid fetching them.
+	m, err := fake.ReadJiriManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Packages = []project.Package{
+		{Name: "pkg/locked", Version: "version:1", Path: "locked"},
+		{Name: "pkg/floating", Version: "latest", Path: "floating"},
+	}
+	if err := fake.WriteJiriManifest(m); err != nil {
+		t.Fatal(err)
+	}
+	writeLockfile := func(projectLocks []project.ProjectLock, pkgLocks []project.PackageLock) {
+		projLockMap := make(project.ProjectLocks)
+		for _, l := range projectLocks {
+			projLockMap[l.Key()] = l
+		}
+		pkgLockMap := make(project.PackageLocks)
+		for _, l := range pkgLocks {
+			pkgLockMap[l.Key()] = l
+		}
+		data, err := project.MarshalLockEntries(projLockMap, pkgLockMap)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(fake.X.Root, fake.X.LockfileName), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	projectLocks := []project.ProjectLock{
+		{Remote: fake.Projects[jiritest.ManifestProjectName], Name: jiritest.ManifestProjectName, Revision: manifestRev},
+	}
+	pkgLocks := []project.PackageLock{
+		{PackageName: "pkg/locked", InstanceID: "locked-instance-id"},
+	}
+	writeLockfile(projectLocks, pkgLocks)
+
+	localProjects, err := project.LocalProjects(fake.X, project.FastScan)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Partially floating workspace.
+	result, err := auditManifest(fake.X, localProjects)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &auditResult{
+		Projects: []auditProject{{Name: "tracking", Remote: fake.Projects["tracking"], RemoteBranch: "master"}},
+		Packages: []auditPackage{{Name: "pkg/floating", Path: "floating", Version: "latest"}},
+	}
+	if !reflect.DeepEqual(result, want) {
+		t.Errorf("got %+v, want %+v", result, want)
+	}
+	if fake.X.LockfileEnabled {
+		t.Errorf("lockfile should not stay enabled after audit")
+	}
+	auditFlags.strict = true
+	if err := runAudit(fake.X, nil); err == nil {
+		t.Errorf("audit -strict should fail with floating projects")
+	}
+
+	// Fully pinned workspace.
+	projectLocks = append(projectLocks, project.ProjectLock{Remote: fake.Projects["tracking"], Name: "tracking", Revision: revisions["tracking"]})
+	pkgLocks = append(pkgLocks, project.PackageLock{PackageName: "pkg/floating", InstanceID: "floating-instance-id"})
+	writeLockfile(projectLocks, pkgLocks)
+	result, err = auditManifest(fake.X, localProjects)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Projects) != 0 || len(result.Packages) != 0 {
+		t.Errorf("got %+v, want no floating projects or packages", result)
+	}
+	if err := runAudit(fake.X, nil); err != nil {
+		t.Errorf("audit -strict failed for a fully pinned workspace: %v", err)
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2019 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/dahlia-os/jiri"
+	"github.com/dahlia-os/jiri/cmdline"
+	"github.com/dahlia-os/jiri/gitutil"
+	"github.com/dahlia-os/jiri/project"
+)
+
+var blameFlags struct {
+	revision string
+	lines    string
+}
+
+var cmdBlame = &cmdline.Command{
+	Runner: jiri.RunnerFunc(runBlame),
+	Name:   "blame",
+	Short:  "Show what revision and author last modified each line of a file",
+	Long: `
+Show the commit, author and line number of each line of a file, as reported
+by "git blame". The path may point into any project of the jiri root, the
+command finds the project containing it.
+`,
+	ArgsName: "<path>",
+	ArgsLong: "<path> is the path of the file to annotate.",
+}
+
+func init() {
+	cmdBlame.Flags.StringVar(&blameFlags.revision, "rev", "", "Annotate the file as of this revision instead of the working tree.")
+	cmdBlame.Flags.StringVar(&blameFlags.lines, "L", "", "Only annotate the given range of lines, as <start>,<end>.")
+}
+
+func runBlame(jirix *jiri.X, args []string) error {
+	if len(args) != 1 {
+		return jirix.UsageErrorf("blame requires one argument")
+	}
+	lines, err := blame(jirix, args[0])
+	if err != nil {
+		return err
+	}
+	printBlame(jirix.Stdout(), lines)
+	return nil
+}
+
+// blame runs "git blame" on file in the project containing it.
+func blame(jirix *jiri.X, file string) ([]gitutil.BlameLine, error) {
+	path, err := filepath.Abs(file)
+	if err != nil {
+		return nil, err
+	}
+	localProjects, err := project.LocalProjects(jirix, project.FastScan)
+	if err != nil {
+		return nil, err
+	}
+	p, ok := projectContaining(localProjects, path)
+	if !ok {
+		return nil, jirix.UsageErrorf("%q is not inside any project", file)
+	}
+	rel, err := filepath.Rel(p.Path, path)
+	if err != nil {
+		return nil, err
+	}
+	return gitutil.New(jirix, gitutil.RootDirOpt(p.Path)).Blame(rel,
+		gitutil.BlameRevisionOpt(blameFlags.revision), gitutil.LineRangeOpt(blameFlags.lines))
+}
+
+func printBlame(w io.Writer, lines []gitutil.BlameLine) {
+	for _, line := range lines {
+		fmt.Fprintf(w, "%.8s (%s %d) %s\n", line.Commit, line.Author, line.Line, line.Content)
+	}
+}
+
+// projectContaining returns the innermost project containing path.
+func projectContaining(projects project.Projects, path string) (project.Project, bool) {
+	var found project.Project
+	ok := false
+	for _, p := range projects {
+		if path != p.Path && !strings.HasPrefix(path, p.Path+string(filepath.Separator)) {
+			continue
+		}
+		if !ok || len(p.Path) > len(found.Path) {
+			found, ok = p, true
+		}
+	}
+	return found, ok
+}
@@ -0,0 +1,78 @@
+// Copyright 2019 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dahlia-os/jiri/gitutil"
+	"github.com/dahlia-os/jiri/jiritest"
+)
+
+func TestBlame(t *testing.T) {
+	fake, cleanup := jiritest.NewFakeJiriRoot(t)
+	defer cleanup()
+	projects := makeProjects(t, fake)
+
+	// sub/sub2/r.t2 lives below sub, which is not a project itself.
+	p := projects[4]
+	file := filepath.Join(p.Path, "file")
+	if err := ioutil.WriteFile(file, []byte("one\ntwo\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	git := gitutil.New(fake.X, gitutil.UserNameOpt("John Doe"), gitutil.UserEmailOpt("john.doe@example.com"), gitutil.RootDirOpt(p.Path))
+	if err := git.CommitFile("file", "add file"); err != nil {
+		t.Fatal(err)
+	}
+	rev, err := git.CurrentRevision()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(cwd)
+	if err := os.Chdir(filepath.Join(fake.X.Root, "sub")); err != nil {
+		t.Fatal(err)
+	}
+
+	lines, err := blame(fake.X, "sub2/r.t2/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	printBlame(&buf, lines)
+	want := rev[:8] + " (John Doe 1) one\n" + rev[:8] + " (John Doe 2) two\n"
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	blameFlags.lines = "2,2"
+	defer func() { blameFlags.lines = "" }()
+	if lines, err = blame(fake.X, file); err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 1 || lines[0].Content != "two" {
+		t.Errorf("-L 2,2: got %+v, want line two", lines)
+	}
+
+	if _, err := blame(fake.X, filepath.Join(fake.X.Root, "not-a-project", "file")); err == nil {
+		t.Errorf("expected an error for a path outside of any project")
+	}
+}
+
+func TestPrintBlameShortCommit(t *testing.T) {
+	var buf bytes.Buffer
+	printBlame(&buf, []gitutil.BlameLine{{Commit: "abc", Author: "John Doe", Line: 1, Content: "one"}})
+	if got, want := buf.String(), "abc (John Doe 1) one\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
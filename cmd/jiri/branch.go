@@ -22,12 +22,15 @@ import (
 )
 
 var branchFlags struct {
+	createFlag                bool
 	deleteFlag                bool
 	deleteMergedClsFlag       bool
 	deleteMergedFlag          bool
 	forceDeleteFlag           bool
 	listFlag                  bool
 	overrideProjectConfigFlag bool
+	projectsFlag              string
+	switchFlag                bool
 }
 
 type MultiError []error
@@ -49,10 +52,15 @@ func (m MultiError) String() string {
 var cmdBranch = &cmdline.Command{
 	Runner: jiri.RunnerFunc(runBranch),
 	Name:   "branch",
-	Short:  "Show or delete branches",
+	Short:  "Show, switch or delete branches",
 	Long: `
 Show all the projects having branch <branch> .If -d or -D is passed, <branch>
-is deleted. if <branch> is not passed, show all projects which have branches other than "master"`,
+is deleted. if <branch> is not passed, show all projects which have branches other than "master"
+
+If -switch is passed, <branch> is checked out in every project having it, like
+running 'git switch <branch>' in each of them. With -create, it is also
+created at the current revision of the projects lacking it. -projects limits
+the projects considered, and the result is reported for each project.`,
 	ArgsName: "<branch>",
 	ArgsLong: "<branch> is the name branch",
 }
@@ -64,6 +72,9 @@ func init() {
 	flags.BoolVar(&branchFlags.listFlag, "list", false, "Show only projects with current branch <branch>")
 	flags.BoolVar(&branchFlags.overrideProjectConfigFlag, "override-pc", false, "Overrrides project config's ignore and noupdate flag and deletes the branch.")
 	flags.BoolVar(&branchFlags.deleteMergedFlag, "delete-merged", false, "Delete merged branches. Merged branches are the tracked branches merged with their tracking remote or un-tracked branches merged with the branch specified in manifest(default master). If <branch> is provided, it will only delete branch <branch> if merged.")
+	flags.BoolVar(&branchFlags.switchFlag, "switch", false, "Check out branch <branch> in the projects having it.")
+	flags.BoolVar(&branchFlags.createFlag, "create", false, "With -switch, create branch <branch> in the projects lacking it.")
+	flags.StringVar(&branchFlags.projectsFlag, "projects", "", "With -switch, a comma separated list of regular expressions matching the keys of the projects to switch. By default all projects are used.")
 	flags.BoolVar(&branchFlags.deleteMergedClsFlag, "delete-merged-cl", false, "Implies -delete-merged. It also parses commit messages for ChangeID and checks with gerrit if those changes have been merged and deletes those branches. It will ignore a branch if it differs with remote by more than 10 commits.")
 }
 
@@ -140,6 +151,15 @@ func runBranch(jirix *jiri.X, args []string) error {
 	} else if len(args) == 1 {
 		branch = args[0]
 	}
+	if (branchFlags.createFlag || branchFlags.projectsFlag != "") && !branchFlags.switchFlag {
+		return jirix.UsageErrorf("-create and -projects require -switch")
+	}
+	if branchFlags.switchFlag {
+		if branch == "" {
+			return jirix.UsageErrorf("Please provide branch to switch to")
+		}
+		return switchBranches(jirix, branch)
+	}
 	if branchFlags.deleteFlag || branchFlags.forceDeleteFlag {
 		if branch == "" {
 			return jirix.UsageErrorf("Please provide branch to delete")
@@ -307,7 +327,7 @@ func deleteProjectMergedClsBranches(jirix *jiri.X, local project.Project, remote
 			if rb == "" {
 				rb = "master"
 			}
-			trackingBranch = fmt.Sprintf("remotes/origin/%s", rb)
+			trackingBranch = remote.RemoteRef(rb)
 		} else {
 			trackingBranch = b.Tracking.Name
 		}
@@ -407,7 +427,7 @@ func deleteProjectMergedBranches(jirix *jiri.X, local project.Project, remote pr
 				if rb == "" {
 					rb = "master"
 				}
-				if mbs, err := scm.MergedBranches("remotes/origin/" + rb); err != nil {
+				if mbs, err := scm.MergedBranches(remote.RemoteRef(rb)); err != nil {
 					retErr = append(retErr, fmt.Errorf("Not able to get merged un-tracked branches: %s\n", err))
 					continue
 				} else {
@@ -533,3 +553,90 @@ func deleteBranches(jirix *jiri.X, branchToDelete string) error {
 	}
 	return nil
 }
+
+// switchBranches checks out branch in the projects matching -projects which
+// have it, or in all of them with -create, creating it where it is missing.
+func switchBranches(jirix *jiri.X, branch string) error {
+	var keysRE *regexp.Regexp
+	if branchFlags.projectsFlag != "" {
+		var err error
+		if keysRE, err = projectKeysRegexp(branchFlags.projectsFlag); err != nil {
+			return jirix.UsageErrorf("%v", err)
+		}
+	}
+	localProjects, err := project.LocalProjects(jirix, project.FastScan)
+	if err != nil {
+		return err
+	}
+	cDir, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	states, err := project.GetProjectStates(jirix, localProjects, false)
+	if err != nil {
+		return err
+	}
+
+	jirix.TimerPush("Process")
+	defer jirix.TimerPop()
+	var keys project.ProjectKeys
+	for key := range states {
+		if keysRE == nil || keysRE.MatchString(string(key)) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Sort(keys)
+	projectFound := false
+	for _, key := range keys {
+		state := states[key]
+		localProject := state.Project
+		exists := false
+		for _, b := range state.Branches {
+			if b.Name == branch {
+				exists = true
+				break
+			}
+		}
+		if !exists && !branchFlags.createFlag {
+			continue
+		}
+		projectFound = true
+		relativePath, err := filepath.Rel(cDir, localProject.Path)
+		if err != nil {
+			relativePath = localProject.Path
+		}
+		if !branchFlags.overrideProjectConfigFlag && (localProject.LocalConfig.Ignore || localProject.LocalConfig.NoUpdate) {
+			jirix.Logger.Warningf("Project %s(%s): not switching to branch %q due to it's local-config. Use '-overrride-pc' flag\n\n", localProject.Name, relativePath, branch)
+			continue
+		}
+		fmt.Printf("Project %s(%s): ", localProject.Name, relativePath)
+		scm := gitutil.New(jirix, gitutil.RootDirOpt(localProject.Path))
+		switch {
+		case state.CurrentBranch.Name == branch:
+			fmt.Printf("already on branch %s\n", branch)
+		case exists:
+			if err := scm.CheckoutBranch(branch); err != nil {
+				jirix.IncrementFailures()
+				fmt.Print(jirix.Color.Red("Error while switching to branch: %s\n", err))
+				continue
+			}
+			fmt.Printf("%s\n", jirix.Color.Green("Switched to branch %s", branch))
+		default:
+			if err := scm.CreateAndCheckoutBranch(branch); err != nil {
+				jirix.IncrementFailures()
+				fmt.Print(jirix.Color.Red("Error while creating branch: %s\n", err))
+				continue
+			}
+			fmt.Printf("%s\n", jirix.Color.Green("Switched to new branch %s", branch))
+		}
+	}
+
+	if !projectFound {
+		fmt.Printf("Cannot find any project with branch %q\n", branch)
+		return nil
+	}
+	if jirix.Failures() != 0 {
+		return fmt.Errorf("Branch switch completed with non-fatal errors.")
+	}
+	return nil
+}
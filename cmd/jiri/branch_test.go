@@ -23,12 +23,15 @@ import (
 )
 
 func setDefaultBranchFlags() {
+	branchFlags.createFlag = false
 	branchFlags.deleteFlag = false
 	branchFlags.deleteMergedClsFlag = false
 	branchFlags.deleteMergedFlag = false
 	branchFlags.forceDeleteFlag = false
 	branchFlags.listFlag = false
 	branchFlags.overrideProjectConfigFlag = false
+	branchFlags.projectsFlag = ""
+	branchFlags.switchFlag = false
 }
 
 func createBranchCommits(t *testing.T, fake *jiritest.FakeJiriRoot, localProjects []project.Project) {
@@ -762,3 +765,69 @@ func executeBranch(t *testing.T, fake *jiritest.FakeJiriRoot, args ...string) st
 	}
 	return strings.TrimSpace(strings.Join([]string{stdout, stderr}, " "))
 }
+
+func TestSwitchBranch(t *testing.T) {
+	setDefaultBranchFlags()
+	defer setDefaultBranchFlags()
+	fake, cleanup := jiritest.NewFakeJiriRoot(t)
+	defer cleanup()
+	localProjects := createBranchProjects(t, fake, 4)
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	gitLocals := make([]*gitutil.Git, len(localProjects))
+	for i, localProject := range localProjects {
+		gitLocals[i] = gitutil.New(fake.X, gitutil.RootDirOpt(localProject.Path))
+	}
+	for _, i := range []int{0, 2} {
+		if err := gitLocals[i].CreateBranch("feature"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	currentBranches := func() []string {
+		var branches []string
+		for _, g := range gitLocals {
+			branch, err := g.CurrentBranchName()
+			if err != nil {
+				t.Fatal(err)
+			}
+			branches = append(branches, branch)
+		}
+		return branches
+	}
+	checkBranches := func(want ...string) {
+		t.Helper()
+		if got := currentBranches(); strings.Join(got, " ") != strings.Join(want, " ") {
+			t.Errorf("got current branches %q, want %q", got, want)
+		}
+	}
+
+	// Switch the projects having the branch.
+	branchFlags.switchFlag = true
+	got := executeBranch(t, fake, "feature")
+	if strings.Count(got, "Switched to branch feature") != 2 {
+		t.Errorf("unexpected output: %q", got)
+	}
+	checkBranches("feature", "HEAD", "feature", "HEAD")
+
+	// Create the branch in a matching project lacking it.
+	branchFlags.createFlag = true
+	branchFlags.projectsFlag = "project-[01]"
+	got = executeBranch(t, fake, "feature")
+	if !strings.Contains(got, "project-0") || !strings.Contains(got, "already on branch feature") || !strings.Contains(got, "Switched to new branch feature") {
+		t.Errorf("unexpected output: %q", got)
+	}
+	checkBranches("feature", "feature", "feature", "HEAD")
+
+	branchFlags.createFlag = false
+	branchFlags.projectsFlag = ""
+	if got := executeBranch(t, fake, "missing"); got != `Cannot find any project with branch "missing"` {
+		t.Errorf("unexpected output: %q", got)
+	}
+
+	branchFlags.switchFlag = false
+	branchFlags.createFlag = true
+	if err := runBranch(fake.X, []string{"feature"}); err == nil || !strings.Contains(err.Error(), "require -switch") {
+		t.Errorf("expected -create to require -switch, got %v", err)
+	}
+}
@@ -0,0 +1,804 @@
+// Copyright 2019 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dahlia-os/jiri"
+	"github.com/dahlia-os/jiri/cmdline"
+	"github.com/dahlia-os/jiri/gerrit"
+	"github.com/dahlia-os/jiri/gitutil"
+	"github.com/dahlia-os/jiri/project"
+	"github.com/dahlia-os/jiri/table"
+)
+
+// clStatusCacheFile is the name of the file under the root metadata directory
+// where Gerrit results for "jiri cl status" are cached.
+const clStatusCacheFile = "cl_status_cache.json"
+
+var clCleanupFlags struct {
+	allMerged    bool
+	force        bool
+	remoteBranch string
+}
+
+var clNewFlags struct {
+	from string
+}
+
+var clOwnersFlags struct {
+	context      int
+	maxFiles     int
+	count        int
+	remoteBranch string
+}
+
+var clStatusFlags struct {
+	cacheTTL time.Duration
+}
+
+var cmdCL = &cmdline.Command{
+	Name:     "cl",
+	Short:    "Manage changelists of local branches",
+	Long:     "Manage changelists of local branches.",
+	Children: []*cmdline.Command{cmdCLCleanup, cmdCLNew, cmdCLOwners, cmdCLStatus},
+}
+
+var cmdCLCleanup = &cmdline.Command{
+	Runner: jiri.RunnerFunc(runCLCleanup),
+	Name:   "cleanup",
+	Short:  "Clean up changelists that have been merged",
+	Long: `
+Command "cleanup" checks that the given branches have been merged into the
+corresponding remote branch of each project they exist in, and deletes them.
+A branch which has commits that are not on the remote branch is reported and
+kept, unless -f is given. The branch which is checked out is never deleted.
+
+With -all-merged, no branches are given. Instead, all the local branches of
+every project which are fully merged into its remote branch are deleted,
+except the one which is checked out and the one named after the remote
+branch. Branches without commits of their own since they were created, which
+are trivially merged, are kept as well. Branches which are not merged are
+left untouched, even with -f.
+
+The remote branch of a project is the one given in the manifest, or the one
+given by -remote-branch, without the leading "origin/". The deleted branches
+are listed for each project.
+`,
+	ArgsName: "<branches>",
+	ArgsLong: "<branches> is a list of branches to clean up.",
+}
+
+var cmdCLNew = &cmdline.Command{
+	Runner: jiri.RunnerFunc(runCLNew),
+	Name:   "new",
+	Short:  "Create a new local branch for a changelist",
+	Long: `
+Command "new" creates a new local branch for a changelist in the current
+project and checks it out. By default the branch is forked from the current
+branch, which becomes its upstream, so that the new changelist depends on the
+one of the current branch.
+
+With -from the branch is forked from the given ref instead, without switching
+branches first. A local branch becomes the upstream of the new branch, as does
+a remote-tracking branch such as "origin/master", in which case the new
+changelist has no local parent. Branches forked from any other ref, such as a
+tag or a commit, have no upstream.
+`,
+	ArgsName: "<name>",
+	ArgsLong: "<name> is the changelist name.",
+}
+
+var cmdCLOwners = &cmdline.Command{
+	Runner: jiri.RunnerFunc(runCLOwners),
+	Name:   "owners",
+	Short:  "Suggest reviewers for the changelist of the current branch",
+	Long: `
+Command "owners" suggests reviewers for the changelist of the current branch
+of the current project, which helps when the project has no OWNERS file. The
+changelist is the diff of the branch against its merge base with the remote
+branch of the project, or the one given by -remote-branch.
+
+The lines changed by the changelist, and the -context lines around each change,
+are annotated with "git blame" as of the merge base. Every annotated line
+scores a point for its author, halved for every 180 days since it was written,
+so that frequent and recent authors of the surrounding code rank first.
+Authors of the commits of the changelist itself are not suggested.
+
+To bound the work on large changelists, only the -max-files files with the
+most changed lines are annotated. Files added by the changelist have no
+history and are ignored.
+`,
+}
+
+var cmdCLStatus = &cmdline.Command{
+	Runner: jiri.RunnerFunc(runCLStatus),
+	Name:   "status",
+	Short:  "Show the Gerrit review state of local branches",
+	Long: `
+For each local branch whose last commit has a Change-Id, query the Gerrit host
+of the project and print the change number, its status (NEW, MERGED or
+ABANDONED) and its current Verified and Code-Review labels. Only commits not
+yet in the upstream of the branch are considered, so branches without local
+commits are not shown.
+
+Results are cached under the root metadata directory for the duration given
+by -cache-ttl so that repeated invocations do not query Gerrit again.
+`,
+}
+
+func init() {
+	cmdCLCleanup.Flags.BoolVar(&clCleanupFlags.allMerged, "all-merged", false, "Delete all the branches merged into the remote branch of their project.")
+	cmdCLCleanup.Flags.BoolVar(&clCleanupFlags.force, "f", false, "Ignore unmerged changes.")
+	cmdCLCleanup.Flags.StringVar(&clCleanupFlags.remoteBranch, "remote-branch", "", "Name of the remote branch the CL pertains to, without the leading \"origin/\". Defaults to the remote branch of each project.")
+	cmdCLNew.Flags.StringVar(&clNewFlags.from, "from", "", "Ref to fork the new branch from. Defaults to the current branch.")
+	cmdCLOwners.Flags.IntVar(&clOwnersFlags.context, "context", 3, "Number of lines around each change to annotate.")
+	cmdCLOwners.Flags.IntVar(&clOwnersFlags.maxFiles, "max-files", 20, "Maximum number of changed files to annotate.")
+	cmdCLOwners.Flags.IntVar(&clOwnersFlags.count, "n", 5, "Number of reviewers to suggest.")
+	cmdCLOwners.Flags.StringVar(&clOwnersFlags.remoteBranch, "remote-branch", "", "Name of the remote branch the CL pertains to, without the leading \"origin/\". Defaults to the remote branch of the project.")
+	cmdCLStatus.Flags.DurationVar(&clStatusFlags.cacheTTL, "cache-ttl", 2*time.Minute, "How long Gerrit results are cached. Use 0 to always query Gerrit.")
+}
+
+func runCLCleanup(jirix *jiri.X, args []string) error {
+	if clCleanupFlags.allMerged && len(args) != 0 {
+		return jirix.UsageErrorf("-all-merged cannot be combined with branches")
+	}
+	if !clCleanupFlags.allMerged && len(args) == 0 {
+		return jirix.UsageErrorf("expected branches to clean up, or -all-merged")
+	}
+	localProjects, err := project.LocalProjects(jirix, project.FastScan)
+	if err != nil {
+		return err
+	}
+	var keys project.ProjectKeys
+	for key := range localProjects {
+		keys = append(keys, key)
+	}
+	sort.Sort(keys)
+	for _, key := range keys {
+		local := localProjects[key]
+		relativePath, err := filepath.Rel(jirix.Root, local.Path)
+		if err != nil {
+			relativePath = local.Path
+		}
+		deleted, err := cleanupProjectCLs(jirix, local, relativePath, args)
+		if err != nil {
+			jirix.Logger.Errorf("Not able to clean up branches of project %s(%s): %s\n\n", local.Name, relativePath, err)
+			jirix.IncrementFailures()
+		}
+		if len(deleted) != 0 {
+			fmt.Printf("%s: deleted %s\n", relativePath, strings.Join(deleted, ", "))
+		}
+	}
+	if jirix.Failures() != 0 {
+		return fmt.Errorf("completed with non-fatal errors")
+	}
+	return nil
+}
+
+// cleanupProjectCLs deletes the given branches of local, or with -all-merged
+// all its branches merged into its remote branch, and returns the deleted
+// branches. Unmerged branches are reported and kept unless -f is given.
+func cleanupProjectCLs(jirix *jiri.X, local project.Project, relativePath string, branches []string) ([]string, error) {
+	scm := gitutil.New(jirix, gitutil.RootDirOpt(local.Path))
+	remoteBranch := clCleanupFlags.remoteBranch
+	if remoteBranch == "" {
+		remoteBranch = local.RemoteBranch
+	}
+	if remoteBranch == "" {
+		remoteBranch = "master"
+	}
+	remoteRef := local.RemoteRef(remoteBranch)
+	existing, current, err := scm.GetBranches()
+	if err != nil {
+		return nil, err
+	}
+	exists := make(map[string]bool)
+	for _, b := range existing {
+		exists[b] = true
+	}
+	if clCleanupFlags.allMerged {
+		// The branch named after the remote branch is kept, as "jiri
+		// project -clean-all -keep" does.
+		branches = nil
+		for _, b := range existing {
+			if b != current && b != remoteBranch {
+				branches = append(branches, b)
+			}
+		}
+	}
+	var toDelete []string
+	for _, b := range branches {
+		if !exists[b] {
+			continue
+		}
+		if b == current {
+			if clCleanupFlags.allMerged {
+				continue
+			}
+			jirix.Logger.Errorf("Not deleting branch %s of project %s(%s) as it is checked out\n\n", b, local.Name, relativePath)
+			jirix.IncrementFailures()
+			continue
+		}
+		toDelete = append(toDelete, b)
+	}
+	if len(toDelete) == 0 {
+		return nil, nil
+	}
+	if ok, err := scm.BranchExists("refs/" + remoteRef); err != nil {
+		return nil, err
+	} else if !ok {
+		if clCleanupFlags.allMerged {
+			jirix.Logger.Debugf("Skipping project %s(%s) without remote branch %s", local.Name, relativePath, remoteRef)
+			return nil, nil
+		}
+		if !clCleanupFlags.force {
+			return nil, fmt.Errorf("remote branch %s does not exist", remoteRef)
+		}
+	}
+	merged := make(map[string]bool)
+	if !clCleanupFlags.force || clCleanupFlags.allMerged {
+		mergedBranches, err := scm.MergedBranches(remoteRef)
+		if err != nil {
+			return nil, err
+		}
+		for _, b := range mergedBranches {
+			merged[b] = true
+		}
+	}
+	var deleted []string
+	for _, b := range toDelete {
+		if !merged[b] {
+			if clCleanupFlags.allMerged {
+				continue
+			}
+			if !clCleanupFlags.force {
+				count, err := scm.CountCommits(b, remoteRef)
+				if err != nil {
+					return deleted, err
+				}
+				jirix.Logger.Errorf("Not deleting branch %s of project %s(%s) as it has %d commits not merged into %s, use -f to delete it anyway\n\n", b, local.Name, relativePath, count, remoteRef)
+				jirix.IncrementFailures()
+				continue
+			}
+		}
+		if clCleanupFlags.allMerged {
+			// Branches without commits of their own, such as those
+			// just created, are trivially merged.
+			if empty, err := branchWithoutCommits(scm, b); err != nil {
+				return deleted, err
+			} else if empty {
+				jirix.Logger.Debugf("Keeping branch %s of project %s(%s) as it has no commits", b, local.Name, relativePath)
+				continue
+			}
+		}
+		if err := scm.DeleteBranch(b, gitutil.ForceOpt(true)); err != nil {
+			return deleted, err
+		}
+		deleted = append(deleted, b)
+	}
+	return deleted, nil
+}
+
+// branchWithoutCommits returns true if branch has no commits after the
+// revision it was created at. Branches whose creation is no longer recorded
+// are assumed to have commits.
+func branchWithoutCommits(scm *gitutil.Git, branch string) (bool, error) {
+	base, err := scm.BranchBase(branch)
+	if err != nil || base == "" {
+		return false, err
+	}
+	count, err := scm.CountCommits(branch, base)
+	if err != nil {
+		return false, err
+	}
+	return count == 0, nil
+}
+
+func runCLNew(jirix *jiri.X, args []string) error {
+	if len(args) != 1 {
+		return jirix.UsageErrorf("expected a single changelist name")
+	}
+	branch := args[0]
+	p, err := currentProject(jirix)
+	if err != nil {
+		return err
+	}
+	scm := gitutil.New(jirix, gitutil.RootDirOpt(p.Path))
+	if exists, err := scm.BranchExists("refs/heads/" + branch); err != nil {
+		return err
+	} else if exists {
+		return fmt.Errorf("branch %q already exists in project %s(%s)", branch, p.Name, p.Path)
+	}
+	from := clNewFlags.from
+	if from == "" {
+		if !scm.IsOnBranch() {
+			return fmt.Errorf("project %s(%s) is not on a branch, use -from to give the ref to fork from", p.Name, p.Path)
+		}
+		if from, err = scm.CurrentBranchName(); err != nil {
+			return err
+		}
+	}
+	if exists, err := scm.BranchExists(from); err != nil {
+		return err
+	} else if !exists {
+		return fmt.Errorf("ref %q does not exist in project %s(%s)", from, p.Name, p.Path)
+	}
+	revision, err := scm.CurrentRevisionForRef(from + "^{commit}")
+	if err != nil {
+		return err
+	}
+
+	// Local and remote-tracking branches become the upstream of the new
+	// branch, which records the dependency between changelists.
+	upstream := ""
+	for _, prefix := range []string{"refs/heads/", "refs/remotes/"} {
+		if exists, err := scm.BranchExists(prefix + from); err != nil {
+			return err
+		} else if exists {
+			upstream = from
+			break
+		}
+	}
+	if err := scm.CreateBranchFromRef(branch, revision); err != nil {
+		return err
+	}
+	if upstream != "" {
+		if err := scm.SetUpstream(branch, upstream); err != nil {
+			return err
+		}
+	}
+	if err := scm.CheckoutBranch(branch); err != nil {
+		// Don't leave the unused branch behind, for instance when local
+		// changes conflict with the ref the branch was forked from.
+		if err2 := scm.DeleteBranch(branch, gitutil.ForceOpt(true)); err2 != nil {
+			jirix.Logger.Warningf("Not able to delete branch %q in project %s(%s): %s\n\n", branch, p.Name, p.Path, err2)
+		}
+		return err
+	}
+	fmt.Printf("Created branch %q from %q in project %s(%s)\n", branch, from, p.Name, p.Path)
+	return nil
+}
+
+// ownerHalfLife is the age at which the lines of an author count half in the
+// score of "jiri cl owners".
+const ownerHalfLife = 180 * 24 * time.Hour
+
+// ownerCandidate is a reviewer suggested by "jiri cl owners".
+type ownerCandidate struct {
+	Name  string
+	Email string
+	// Lines is the number of annotated lines written by the candidate.
+	Lines      int
+	LastChange time.Time
+	Score      float64
+}
+
+func runCLOwners(jirix *jiri.X, args []string) error {
+	if len(args) != 0 {
+		return jirix.UsageErrorf("unexpected arguments")
+	}
+	if clOwnersFlags.context < 0 || clOwnersFlags.maxFiles < 1 || clOwnersFlags.count < 1 {
+		return jirix.UsageErrorf("-context must not be negative, and -max-files and -n must be positive")
+	}
+	p, err := currentProject(jirix)
+	if err != nil {
+		return err
+	}
+	scm := gitutil.New(jirix, gitutil.RootDirOpt(p.Path))
+	if !scm.IsOnBranch() {
+		return fmt.Errorf("project %s(%s) is not on a branch", p.Name, p.Path)
+	}
+	remoteBranch := clOwnersFlags.remoteBranch
+	if remoteBranch == "" {
+		remoteBranch = p.RemoteBranch
+	}
+	if remoteBranch == "" {
+		remoteBranch = "master"
+	}
+	base, err := scm.MergeBase(p.RemoteRef(remoteBranch), "HEAD")
+	if err != nil {
+		return err
+	}
+	candidates, err := suggestOwners(scm, base, time.Now())
+	if err != nil {
+		return err
+	}
+	if len(candidates) == 0 {
+		fmt.Printf("No reviewers found for the changes of project %s(%s) since %s\n", p.Name, p.Path, p.RemoteRef(remoteBranch))
+		return nil
+	}
+	if len(candidates) > clOwnersFlags.count {
+		candidates = candidates[:clOwnersFlags.count]
+	}
+	return printOwnerCandidates(os.Stdout, table.Width(jirix.Env()), candidates)
+}
+
+// suggestOwners returns the authors of the lines around the changes between
+// base and HEAD, ranked by decreasing score as described in the help of
+// "jiri cl owners".
+func suggestOwners(scm *gitutil.Git, base string, now time.Time) ([]ownerCandidate, error) {
+	hunks, err := scm.DiffHunks(base, "HEAD")
+	if err != nil {
+		return nil, err
+	}
+	// Annotate the files with the most changed lines first.
+	changed := make(map[string]int)
+	var files []string
+	for _, h := range hunks {
+		if _, ok := changed[h.File]; !ok {
+			files = append(files, h.File)
+		}
+		changed[h.File] += h.Count
+	}
+	sort.SliceStable(files, func(i, j int) bool { return changed[files[i]] > changed[files[j]] })
+	if len(files) > clOwnersFlags.maxFiles {
+		files = files[:clOwnersFlags.maxFiles]
+	}
+
+	var blamed []gitutil.BlameLine
+	for _, file := range files {
+		context := make(map[int]bool)
+		for _, h := range hunks {
+			if h.File != file {
+				continue
+			}
+			first, last := h.Start, h.Start+h.Count-1
+			if h.Count == 0 {
+				// Lines were added after h.Start.
+				first, last = h.Start+1, h.Start
+			}
+			for n := first - clOwnersFlags.context; n <= last+clOwnersFlags.context; n++ {
+				context[n] = true
+			}
+		}
+		lines, err := scm.Blame(file, gitutil.BlameRevisionOpt(base))
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range lines {
+			if context[line.Line] {
+				blamed = append(blamed, line)
+			}
+		}
+	}
+
+	// The authors of the changelist do not review it.
+	selfAuthors := make(map[string]bool)
+	authors, err := scm.Log("HEAD", base, "%ae")
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range authors {
+		if len(a) > 0 {
+			selfAuthors[a[0]] = true
+		}
+	}
+	var commits []string
+	seen := make(map[string]bool)
+	for _, line := range blamed {
+		if !seen[line.Commit] {
+			seen[line.Commit] = true
+			commits = append(commits, line.Commit)
+		}
+	}
+	times, err := scm.CommitTimes(commits...)
+	if err != nil {
+		return nil, err
+	}
+
+	byEmail := make(map[string]*ownerCandidate)
+	for _, line := range blamed {
+		if selfAuthors[line.AuthorMail] {
+			continue
+		}
+		c, ok := byEmail[line.AuthorMail]
+		if !ok {
+			c = &ownerCandidate{Name: line.Author, Email: line.AuthorMail}
+			byEmail[line.AuthorMail] = c
+		}
+		t := times[line.Commit]
+		age := now.Sub(t)
+		if age < 0 {
+			age = 0
+		}
+		c.Lines++
+		c.Score += math.Pow(0.5, float64(age)/float64(ownerHalfLife))
+		if t.After(c.LastChange) {
+			c.LastChange = t
+		}
+	}
+	var candidates []ownerCandidate
+	for _, c := range byEmail {
+		candidates = append(candidates, *c)
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].Score != candidates[j].Score {
+			return candidates[i].Score > candidates[j].Score
+		}
+		return candidates[i].Email < candidates[j].Email
+	})
+	return candidates, nil
+}
+
+func printOwnerCandidates(w io.Writer, width int, candidates []ownerCandidate) error {
+	t := table.New(width, "REVIEWER", "LINES", "LAST CHANGE")
+	for _, c := range candidates {
+		t.AddRow(fmt.Sprintf("%s <%s>", c.Name, c.Email), strconv.Itoa(c.Lines), c.LastChange.Format("2006-01-02"))
+	}
+	return t.Write(w)
+}
+
+// clStatus describes the review state of a single local branch.
+type clStatus struct {
+	Name     string `json:"name"`
+	Path     string `json:"path"`
+	Branch   string `json:"branch"`
+	ChangeID string `json:"change_id"`
+	clReview
+}
+
+// clReview is the Gerrit state of a change, as stored in the cache.
+type clReview struct {
+	// Missing is set when Gerrit has no change with the Change-Id.
+	Missing    bool      `json:"missing,omitempty"`
+	Number     int       `json:"number,omitempty"`
+	Status     string    `json:"status,omitempty"`
+	Verified   string    `json:"verified,omitempty"`
+	CodeReview string    `json:"code_review,omitempty"`
+	Fetched    time.Time `json:"fetched"`
+}
+
+// clReviewCache caches clReviews keyed by Gerrit host and Change-Id.
+type clReviewCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	now     func() time.Time
+	reviews map[string]clReview
+}
+
+func clReviewCacheKey(host, changeID string) string {
+	return host + " " + changeID
+}
+
+func loadCLReviewCache(jirix *jiri.X, ttl time.Duration) *clReviewCache {
+	c := &clReviewCache{ttl: ttl, now: time.Now, reviews: make(map[string]clReview)}
+	if ttl <= 0 {
+		return c
+	}
+	bytes, err := ioutil.ReadFile(filepath.Join(jirix.RootMetaDir(), clStatusCacheFile))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			jirix.Logger.Debugf("Not using cl status cache: %s\n", err)
+		}
+		return c
+	}
+	if err := json.Unmarshal(bytes, &c.reviews); err != nil {
+		jirix.Logger.Debugf("Not using cl status cache: %s\n", err)
+		c.reviews = make(map[string]clReview)
+	}
+	return c
+}
+
+func (c *clReviewCache) get(host, changeID string) (clReview, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r, ok := c.reviews[clReviewCacheKey(host, changeID)]
+	if !ok || c.now().Sub(r.Fetched) >= c.ttl {
+		return clReview{}, false
+	}
+	return r, true
+}
+
+func (c *clReviewCache) put(host, changeID string, r clReview) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reviews[clReviewCacheKey(host, changeID)] = r
+}
+
+// save writes the unexpired entries of the cache back to disk.
+func (c *clReviewCache) save(jirix *jiri.X) error {
+	if c.ttl <= 0 {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, r := range c.reviews {
+		if c.now().Sub(r.Fetched) >= c.ttl {
+			delete(c.reviews, key)
+		}
+	}
+	bytes, err := json.Marshal(c.reviews)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(jirix.RootMetaDir(), clStatusCacheFile), bytes, 0644)
+}
+
+// fetch returns the review state of changeID on host, querying Gerrit when
+// the cache has no fresh entry for it.
+func (c *clReviewCache) fetch(jirix *jiri.X, host, changeID string) (clReview, error) {
+	if r, ok := c.get(host, changeID); ok {
+		return r, nil
+	}
+	hostUrl, err := url.Parse(host)
+	if err != nil {
+		return clReview{}, err
+	}
+	change, err := gerrit.New(jirix, hostUrl).GetChangeByID(changeID)
+	if err != nil {
+		return clReview{}, err
+	}
+	r := clReview{Missing: change == nil, Fetched: c.now()}
+	if change != nil {
+		r.Number = change.Number
+		r.Status = change.Status
+		r.Verified = labelSummary(change.Labels["Verified"])
+		r.CodeReview = labelSummary(change.Labels["Code-Review"])
+	}
+	c.put(host, changeID, r)
+	return r, nil
+}
+
+// labelSummary returns a short description of a Gerrit label as returned by
+// the LABELS query option, in which the strongest vote is reported under
+// "rejected", "approved", "disliked" or "recommended".
+func labelSummary(label map[string]interface{}) string {
+	for _, vote := range []string{"rejected", "approved", "disliked", "recommended"} {
+		if _, ok := label[vote]; ok {
+			return vote
+		}
+	}
+	if v, ok := label["value"].(float64); ok && v != 0 {
+		return fmt.Sprintf("%+d", int(v))
+	}
+	return ""
+}
+
+func runCLStatus(jirix *jiri.X, args []string) error {
+	if len(args) != 0 {
+		return jirix.UsageErrorf("unexpected arguments")
+	}
+	localProjects, err := project.LocalProjects(jirix, project.FastScan)
+	if err != nil {
+		return err
+	}
+	cDir, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	cache := loadCLReviewCache(jirix, clStatusFlags.cacheTTL)
+
+	keys := make(chan project.ProjectKey, len(localProjects))
+	for key, p := range localProjects {
+		if p.GerritHost != "" {
+			keys <- key
+		}
+	}
+	close(keys)
+	var mu sync.Mutex
+	var results []clStatus
+	var wg sync.WaitGroup
+	for i := uint(0); i < jirix.Jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range keys {
+				statuses, err := getCLStatuses(jirix, cache, localProjects[key], cDir)
+				if err != nil {
+					jirix.Logger.Errorf("getting cl status for project %s(%s): %s\n\n", localProjects[key].Name, localProjects[key].Path, err)
+					jirix.IncrementFailures()
+				}
+				mu.Lock()
+				results = append(results, statuses...)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if err := cache.save(jirix); err != nil {
+		jirix.Logger.Warningf("Not able to save cl status cache: %s\n\n", err)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Path != results[j].Path {
+			return results[i].Path < results[j].Path
+		}
+		return results[i].Branch < results[j].Branch
+	})
+	if err := printCLStatuses(os.Stdout, table.Width(jirix.Env()), results); err != nil {
+		return err
+	}
+	if jirix.Failures() != 0 {
+		return fmt.Errorf("completed with non-fatal errors")
+	}
+	return nil
+}
+
+// getCLStatuses returns the review state of every local branch of local whose
+// last commit not in its upstream has a Change-Id.
+func getCLStatuses(jirix *jiri.X, cache *clReviewCache, local project.Project, cDir string) ([]clStatus, error) {
+	relativePath, err := filepath.Rel(cDir, local.Path)
+	if err != nil {
+		relativePath = local.Path
+	}
+	scm := gitutil.New(jirix, gitutil.RootDirOpt(local.Path))
+	branches, err := scm.GetAllBranchesInfo()
+	if err != nil {
+		return nil, err
+	}
+	var statuses []clStatus
+	for _, b := range branches {
+		trackingBranch := ""
+		if b.Tracking == nil {
+			rb := local.RemoteBranch
+			if rb == "" {
+				rb = "master"
+			}
+			trackingBranch = local.RemoteRef(rb)
+		} else {
+			trackingBranch = b.Tracking.Name
+		}
+		extraCommits, err := scm.ExtraCommits(b.Name, trackingBranch)
+		if err != nil {
+			return statuses, err
+		}
+		if len(extraCommits) == 0 {
+			continue
+		}
+		log, err := scm.CommitMsg(b.Name)
+		if err != nil {
+			return statuses, err
+		}
+		changeID := changeIDRE.FindStringSubmatch(log)
+		if len(changeID) != 2 {
+			continue
+		}
+		review, err := cache.fetch(jirix, local.GerritHost, changeID[1])
+		if err != nil {
+			return statuses, fmt.Errorf("can't get change %q for branch %q: %s", changeID[1], b.Name, err)
+		}
+		statuses = append(statuses, clStatus{
+			Name:     local.Name,
+			Path:     relativePath,
+			Branch:   b.Name,
+			ChangeID: changeID[1],
+			clReview: review,
+		})
+	}
+	return statuses, nil
+}
+
+func printCLStatuses(w io.Writer, width int, statuses []clStatus) error {
+	t := table.New(width, "PROJECT", "BRANCH", "CHANGE", "STATUS", "VERIFIED", "CODE-REVIEW")
+	for _, s := range statuses {
+		if s.Missing {
+			t.AddRow(s.Path, s.Branch, s.ChangeID, "not found")
+			continue
+		}
+		t.AddRow(s.Path, s.Branch, strconv.Itoa(s.Number), s.Status, dashIfEmpty(s.Verified), dashIfEmpty(s.CodeReview))
+	}
+	return t.Write(w)
+}
+
+func dashIfEmpty(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
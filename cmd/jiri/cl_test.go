@@ -0,0 +1,384 @@
+// Copyright 2019 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dahlia-os/jiri/gitutil"
+	"github.com/dahlia-os/jiri/jiritest"
+	"github.com/dahlia-os/jiri/tool"
+)
+
+const (
+	clTestChangeID        = "I0123456789abcdef0123456789abcdef01234567"
+	clTestMissingChangeID = "Iffffffffffffffffffffffffffffffffffffffff"
+)
+
+func TestCLStatus(t *testing.T) {
+	queries := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries++
+		fmt.Fprintln(w, ")]}'")
+		if r.URL.Query().Get("q") != clTestChangeID {
+			fmt.Fprintln(w, "[]")
+			return
+		}
+		fmt.Fprintf(w, `[{"change_id": %q, "_number": 1234, "status": "NEW", "labels": {"Verified": {"approved": {}}, "Code-Review": {"value": 1}}}]`, clTestChangeID)
+	}))
+	defer server.Close()
+
+	fake, cleanup := jiritest.NewFakeJiriRoot(t)
+	defer cleanup()
+	localProjects := createProjects(t, fake, 1)
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	local := localProjects[0]
+	local.GerritHost = server.URL
+	git := gitutil.New(fake.X, gitutil.RootDirOpt(local.Path))
+	if err := git.CreateAndCheckoutBranch("feature"); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, fake.X, local.Path, "feature", "feature\n\nChange-Id: "+clTestChangeID)
+	if err := git.CreateAndCheckoutBranch("gone"); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, fake.X, local.Path, "gone", "gone\n\nChange-Id: "+clTestMissingChangeID)
+	if err := git.CheckoutBranch("master"); err != nil {
+		t.Fatal(err)
+	}
+	// A branch without local commits is not reported.
+	if err := git.CreateBranch("empty"); err != nil {
+		t.Fatal(err)
+	}
+
+	cache := loadCLReviewCache(fake.X, time.Minute)
+	statuses, err := getCLStatuses(fake.X, cache, local, fake.X.Root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != 2 {
+		t.Fatalf("got %d statuses, want 2: %+v", len(statuses), statuses)
+	}
+	for _, s := range statuses {
+		switch s.Branch {
+		case "feature":
+			if s.Missing || s.Number != 1234 || s.Status != "NEW" || s.Verified != "approved" || s.CodeReview != "+1" {
+				t.Errorf("unexpected status for branch feature: %+v", s)
+			}
+		case "gone":
+			if !s.Missing || s.ChangeID != clTestMissingChangeID {
+				t.Errorf("unexpected status for branch gone: %+v", s)
+			}
+		default:
+			t.Errorf("unexpected branch %q", s.Branch)
+		}
+	}
+	if queries != 2 {
+		t.Errorf("got %d queries, want 2", queries)
+	}
+
+	// Results are served from the saved cache until they expire.
+	if err := cache.save(fake.X); err != nil {
+		t.Fatal(err)
+	}
+	cache = loadCLReviewCache(fake.X, time.Minute)
+	if _, err := getCLStatuses(fake.X, cache, local, fake.X.Root); err != nil {
+		t.Fatal(err)
+	}
+	if queries != 2 {
+		t.Errorf("got %d queries, want 2 after reading the cache", queries)
+	}
+	cache.now = func() time.Time { return time.Now().Add(time.Hour) }
+	if _, err := getCLStatuses(fake.X, cache, local, fake.X.Root); err != nil {
+		t.Fatal(err)
+	}
+	if queries != 4 {
+		t.Errorf("got %d queries, want 4 after the cache expired", queries)
+	}
+}
+
+func TestPrintCLStatuses(t *testing.T) {
+	var buf bytes.Buffer
+	printCLStatuses(&buf, 0, []clStatus{
+		{Path: "a", Branch: "feature", ChangeID: clTestChangeID, clReview: clReview{Number: 12, Status: "MERGED", Verified: "approved", CodeReview: "approved"}},
+		{Path: "b", Branch: "wip", ChangeID: clTestChangeID, clReview: clReview{Number: 345, Status: "NEW"}},
+		{Path: "b", Branch: "gone", ChangeID: clTestMissingChangeID, clReview: clReview{Missing: true}},
+	})
+	want := strings.Join([]string{
+		"PROJECT  BRANCH   CHANGE                                     STATUS  VERIFIED  CODE-REVIEW",
+		"a        feature  12                                         MERGED  approved  approved",
+		"b        wip      345                                        NEW     -         -",
+		"b        gone     " + clTestMissingChangeID + "  not found",
+		"",
+	}, "\n")
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestCLNew(t *testing.T) {
+	fake, cleanup := jiritest.NewFakeJiriRoot(t)
+	defer cleanup()
+	localProjects := createProjects(t, fake, 1)
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	local := localProjects[0]
+	git := gitutil.New(fake.X, gitutil.RootDirOpt(local.Path))
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(cwd)
+	if err := os.Chdir(local.Path); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { clNewFlags.from = "" }()
+
+	if err := git.CreateAndCheckoutBranch("feature"); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, fake.X, local.Path, "feature", "feature")
+
+	// By default the branch is forked from, and tracks, the current branch.
+	if err := runCLNew(fake.X, []string{"child"}); err != nil {
+		t.Fatal(err)
+	}
+	checkCLBranch(t, git, "child", "feature", "feature")
+
+	// A branch forked from a remote-tracking branch has no local parent.
+	clNewFlags.from = "origin/master"
+	if err := runCLNew(fake.X, []string{"fresh"}); err != nil {
+		t.Fatal(err)
+	}
+	checkCLBranch(t, git, "fresh", "origin/master", "origin/master")
+
+	// Branches forked from a commit have no upstream.
+	featureRev, err := git.CurrentRevisionForRef("feature^{commit}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clNewFlags.from = featureRev
+	if err := runCLNew(fake.X, []string{"detached"}); err != nil {
+		t.Fatal(err)
+	}
+	checkCLBranch(t, git, "detached", "feature", "")
+
+	clNewFlags.from = "no-such-ref"
+	if err := runCLNew(fake.X, []string{"other"}); err == nil || !strings.Contains(err.Error(), `ref "no-such-ref" does not exist`) {
+		t.Errorf("expected an error for a missing ref, got %v", err)
+	}
+	clNewFlags.from = ""
+	if err := runCLNew(fake.X, []string{"fresh"}); err == nil || !strings.Contains(err.Error(), `branch "fresh" already exists`) {
+		t.Errorf("expected an error for an existing branch, got %v", err)
+	}
+}
+
+func TestCLCleanup(t *testing.T) {
+	fake, cleanup := jiritest.NewFakeJiriRoot(t)
+	defer cleanup()
+	localProjects := createProjects(t, fake, 2)
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		clCleanupFlags.allMerged = false
+		clCleanupFlags.force = false
+	}()
+
+	gits := make([]*gitutil.Git, len(localProjects))
+	for i, local := range localProjects {
+		gits[i] = gitutil.New(fake.X, gitutil.RootDirOpt(local.Path))
+		// Land the commit of branch "merged" in the remote.
+		if err := gits[i].CreateAndCheckoutBranch("merged"); err != nil {
+			t.Fatal(err)
+		}
+		writeFile(t, fake.X, local.Path, "merged", "merged")
+		remote := gitutil.New(fake.X, gitutil.RootDirOpt(fake.Projects[local.Name]))
+		if err := remote.Pull(local.Path, "merged"); err != nil {
+			t.Fatal(err)
+		}
+		if err := gits[i].Fetch("origin"); err != nil {
+			t.Fatal(err)
+		}
+		// Branch "fresh" has no commits of its own.
+		for _, b := range []string{"fresh", "current"} {
+			if err := gits[i].CreateBranch(b); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := gits[i].CheckoutBranch("current"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	addFeature := func() {
+		if err := gits[0].CreateAndCheckoutBranch("feature"); err != nil {
+			t.Fatal(err)
+		}
+		writeFile(t, fake.X, localProjects[0].Path, "feature", "feature")
+		if err := gits[0].CheckoutBranch("current"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkBranches := func(git *gitutil.Git, want ...string) {
+		t.Helper()
+		got, _, err := git.GetBranches()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(got, " ") != strings.Join(want, " ") {
+			t.Errorf("got branches %q, want %q", got, want)
+		}
+	}
+	run := func(args ...string) (string, error) {
+		var runErr error
+		stdout, _, err := runfunc(func() { runErr = runCLCleanup(fake.X.Clone(tool.ContextOpts{}), args) })
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stdout, runErr
+	}
+
+	// Unmerged branches are kept unless -f is given.
+	addFeature()
+	if _, err := run("feature"); err == nil {
+		t.Errorf("expected an error for an unmerged branch")
+	}
+	checkBranches(gits[0], "current", "feature", "fresh", "merged")
+	clCleanupFlags.force = true
+	if got, err := run("feature"); err != nil || got != "path-0: deleted feature\n" {
+		t.Errorf("got %q, %v, want feature deleted", got, err)
+	}
+	checkBranches(gits[0], "current", "fresh", "merged")
+
+	// With -all-merged, only merged branches which are not checked out are
+	// deleted, even with -f. Branches without commits and the local master
+	// branch, such as the one of the manifest project, are kept.
+	addFeature()
+	clCleanupFlags.allMerged = true
+	if _, err := run("merged"); err == nil {
+		t.Errorf("expected a usage error for branches with -all-merged")
+	}
+	got, err := run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "path-0: deleted merged\npath-1: deleted merged\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	checkBranches(gits[0], "current", "feature", "fresh")
+	checkBranches(gits[1], "current", "fresh")
+}
+
+// checkCLBranch checks that branch is checked out at the revision of ref and
+// tracks upstream.
+func checkCLBranch(t *testing.T, git *gitutil.Git, branch, ref, upstream string) {
+	t.Helper()
+	if current, err := git.CurrentBranchName(); err != nil {
+		t.Fatal(err)
+	} else if current != branch {
+		t.Errorf("got current branch %q, want %q", current, branch)
+	}
+	want, err := git.CurrentRevisionForRef(ref + "^{commit}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := git.CurrentRevision(); err != nil {
+		t.Fatal(err)
+	} else if got != want {
+		t.Errorf("branch %q: got revision %q, want %q", branch, got, want)
+	}
+	if got, err := git.TrackingBranchFromSymbolicRef("refs/heads/" + branch); err != nil {
+		t.Fatal(err)
+	} else if got != upstream {
+		t.Errorf("branch %q: got upstream %q, want %q", branch, got, upstream)
+	}
+}
+
+func TestCLOwners(t *testing.T) {
+	fake, cleanup := jiritest.NewFakeJiriRoot(t)
+	defer cleanup()
+	localProjects := createProjects(t, fake, 1)
+	local := localProjects[0]
+
+	// Alice writes most of the file, Bob changes a line of it and Carol
+	// changes a line far from the changelist.
+	remote := fake.Projects[local.Name]
+	commitAs := func(name, content string) {
+		if err := ioutil.WriteFile(filepath.Join(remote, "file"), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		git := gitutil.New(fake.X, gitutil.UserNameOpt(name), gitutil.UserEmailOpt(strings.ToLower(name)+"@example.com"), gitutil.RootDirOpt(remote))
+		if err := git.CommitFile("file", "change by "+name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lines := []string{"1", "2", "3", "4", "5", "6", "7", "8", "9", "10", "11", "12", "13", "14", "15", "16", "17", "18", "19", "20"}
+	commitAs("Alice", strings.Join(lines, "\n")+"\n")
+	lines[3] = "4 by Bob"
+	commitAs("Bob", strings.Join(lines, "\n")+"\n")
+	lines[18] = "19 by Carol"
+	commitAs("Carol", strings.Join(lines, "\n")+"\n")
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(cwd)
+	if err := os.Chdir(local.Path); err != nil {
+		t.Fatal(err)
+	}
+	git := gitutil.New(fake.X, gitutil.RootDirOpt(local.Path))
+	if err := git.CreateAndCheckoutBranch("feature"); err != nil {
+		t.Fatal(err)
+	}
+	lines[5] = "6 changed"
+	writeFile(t, fake.X, local.Path, "file", strings.Join(lines, "\n")+"\n")
+
+	base, err := git.MergeBase("origin/master", "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	candidates, err := suggestOwners(git, base, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, c := range candidates {
+		got = append(got, fmt.Sprintf("%s <%s> %d", c.Name, c.Email, c.Lines))
+	}
+	// Lines 3 to 9 are annotated, one of them written by Bob.
+	want := []string{"Alice <alice@example.com> 6", "Bob <bob@example.com> 1"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got candidates %q, want %q", got, want)
+	}
+
+	stdout, _, err := runfunc(func() {
+		if err := runCLOwners(fake.X, nil); err != nil {
+			t.Error(err)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(stdout, "REVIEWER") || !strings.Contains(stdout, "Alice <alice@example.com>") || strings.Contains(stdout, "Carol") {
+		t.Errorf("unexpected output:\n%s", stdout)
+	}
+}
@@ -55,18 +55,24 @@ Command jiri is a multi-purpose tool for multi-repo development.
 `,
 		LookPath: true,
 		Children: []*cmdline.Command{
+			cmdAudit,
+			cmdBlame,
 			cmdBranch,
 			cmdBootstrap,
+			cmdCL,
 			cmdDiff,
 			cmdEdit,
 			cmdFetchPkgs,
+			cmdGC,
 			cmdGenGitModule,
 			cmdGrep,
 			cmdImport,
 			cmdInit,
+			cmdLog,
 			cmdPatch,
 			cmdProject,
 			cmdProjectConfig,
+			cmdMaintenance,
 			cmdManifest,
 			cmdOverride,
 			cmdResolve,
@@ -79,6 +85,7 @@ Command jiri is a multi-purpose tool for multi-repo development.
 			cmdUpdate,
 			cmdUpload,
 			cmdVersion,
+			cmdWhich,
 		},
 		Topics: []cmdline.Topic{
 			topicFileSystem,
@@ -202,6 +209,14 @@ the manifest remote, then the "name" attribute of on the <import> tag should
 match the "name" attribute on the <project>.  Otherwise, jiri will clone the
 manifest repository on every update.
 
+* remotebranch (optional) - The remote branch of the manifest repository to
+follow.  Defaults to "master".  Ignored if "revision" is specified.
+
+* revision (optional) - The specific revision of the manifest repository to
+check out.  If "revision" is specified then the "remotebranch" attribute is
+ignored, and a <project> for the manifest repository itself is synced to it
+as well.
+
 The <project> tags describe the projects to sync, and what state they should
 sync to, accoring to the following attributes:
 
@@ -212,24 +227,89 @@ the jiri root.
 
 * remote (required) - The remote url of the project repository.
 
-* protocol (optional) - The protocol to use when cloning and syncing the repo.
-Currently "git" is the default and only supported protocol.
+* protocol (optional) - The version control system of the project, either
+"git", the default, or "hg" for Mercurial.  'jiri update' clones Mercurial
+projects with "hg clone", pulls their new revisions from "remote" and checks
+out their revision with "hg update", leaving projects with uncommitted changes
+alone unless -force is passed.  For them, "remotebranch" is a Mercurial branch
+and defaults to "default".  Mercurial projects are not cached, and their
+metadata lives in their .hg directory.  The historydepth, partial, gerrithost,
+githooks, verifycommit, gitsubmodules, clonedepth, fetchdepth, fetchrefspec,
+lfs and remotename attributes are only supported for git projects, and so are
+the jiri commands other than 'jiri update' which look into projects, such as
+'jiri branch', 'jiri status' or 'jiri cl'.  Changing the protocol of a project
+which is already checked out is an error.
 
 * remotebranch (optional) - The remote branch that the project will sync to.
 Defaults to "master".  The "remotebranch" attribute is ignored if "revision"
 is specified.
 
+* remotename (optional) - The name of the git remote of the project that points
+to "remote", which its remote-tracking branches live under.  Defaults to
+"origin".  An existing project whose remotename changes has its remote
+renamed on the next update.
+
 * revision (optional) - The specific revision (usually a git SHA) that the
 project will sync to.  If "revision" is  specified then the "remotebranch"
 attribute is ignored.
 
+* historydepth (optional) - The number of commits of history to fetch when
+cloning and fetching the project. The project is a shallow clone if this is
+set.
+
+* clonedepth (optional) - The history depth used only when the project is
+first cloned, instead of "historydepth". Later fetches use "fetchdepth" or
+"historydepth", and fetch all new history if neither is set.
+
+* fetchdepth (optional) - The history depth used when fetching a project that
+is already cloned, instead of "historydepth".
+
 * gerrithost (optional) - The url of the Gerrit host for the project.  If
 specified, then running "jiri cl upload" will upload a CL to this Gerrit host.
 
+* fetchrefspec (optional) - A comma separated list of refspecs fetched from
+the remote, in addition to its branches, whenever the project is cloned or
+fetched, for instance "+refs/changes/*:refs/changes/*". Both sides of each
+refspec must be full ref names starting with "refs/".
+
 * githooks (optional) - The path (relative to [root]) of a directory containing
 git hooks that will be installed in the projects .git/hooks directory during
 each update.
 
+* gitsubmodules (optional) - If "true", 'jiri update' initializes and updates
+the git submodules of the project, recursively, whenever it checks out a new
+revision of the project or finds some of them not initialized. Submodules are
+fetched with the project's "historydepth".
+
+* lfs (optional) - If "true", 'jiri update' sets up Git LFS in the project
+with "git lfs install --local" and runs "git lfs pull" whenever it checks out
+a new revision of the project or finds Git LFS not set up in it, so that LFS
+pointer files are replaced with their content. The git-lfs extension must be
+installed.
+
+* skipbulk (optional) - If "true", the project is skipped by commands run
+across all projects, namely 'jiri runp', 'jiri status' and 'jiri project
+-clean', unless it is named explicitly or -all is passed. 'jiri update' still
+syncs it.
+
+The remote, path, revision, remotebranch and gerrithost attributes of projects
+and overrides can reference environment variables as ${VAR}, which are
+expanded when the manifest is loaded. Referencing an undefined variable is an
+error, and "$$" stands for a literal "$". Variables are only expanded in the
+root manifest, the manifests it imports with <localimport> and the
+.jiri_manifest.local file; manifests imported with <import> cannot read the
+environment, and their attributes are used as they are.
+
+A shallow project can only be synced to a revision within the history that
+was fetched. Jiri does not deepen shallow clones on its own, so pinning a
+project to a revision older than its depth makes 'jiri update' fail for it.
+
+A <remove name="..."/> tag next to the <project> tags of the root manifest
+drops the project with that name, along with its hooks, once all imports are
+loaded, so it can exclude projects contributed by imported manifests. A remove
+which matches no project is only warned about. Projects holding an imported
+manifest cannot be removed.
+
 The <hook> tag describes the hooks that must be executed after every 'jiri update'
 They are configured via the following attributes:
 
@@ -239,5 +319,17 @@ They are configured via the following attributes:
 
 * action (required) - Action to be performed inside the project.
 It is mostly identified by a script
+
+* runafter (optional) - A comma separated list of names of hooks that must
+complete successfully before this hook runs. Hooks run in parallel unless
+ordered this way, and a cycle in these dependencies is an error.
+
+* args (optional) - Space separated arguments passed to the action.
+Arguments containing spaces can be given as <arg> children of the hook
+instead, which are passed after those of this attribute.
+
+* cwd (optional) - The directory the action runs in, relative to the project.
+It must be inside the project, and defaults to the project directory. The
+action itself is always relative to the project.
 `,
 }
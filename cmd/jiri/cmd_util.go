@@ -39,3 +39,14 @@ func currentProject(jirix *jiri.X) (project.Project, error) {
 	}
 	return project.Project{}, fmt.Errorf("directory %q is not contained in a project", dir)
 }
+
+// withoutSkipBulk returns the projects which are not marked skipbulk.
+func withoutSkipBulk(projects project.Projects) project.Projects {
+	result := make(project.Projects)
+	for key, p := range projects {
+		if !p.SkipBulk {
+			result[key] = p
+		}
+	}
+	return result
+}
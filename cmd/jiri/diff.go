@@ -7,6 +7,7 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/url"
 	"os"
 	"sort"
@@ -15,6 +16,7 @@ import (
 	"github.com/dahlia-os/jiri"
 	"github.com/dahlia-os/jiri/cmdline"
 	"github.com/dahlia-os/jiri/gerrit"
+	"github.com/dahlia-os/jiri/gitutil"
 	"github.com/dahlia-os/jiri/log"
 	"github.com/dahlia-os/jiri/project"
 )
@@ -22,6 +24,7 @@ import (
 var diffFlags struct {
 	cls          bool
 	indentOutput bool
+	json         bool
 
 	// Need this to avoid infinite loop
 	maxCls uint
@@ -34,8 +37,10 @@ var cmdDiff = &cmdline.Command{
 	ArgsName: "<snapshot-1> <snapshot-2>",
 	ArgsLong: "<snapshot-1/2> are files or urls containing snapshot",
 	Long: `
-Prints diff between two snapshots in json format. Max CLs returned for a
-project is controlled by flag max-xls and is default by 5. The format of
+Prints diff between two snapshots in json format, or as a human readable
+summary when -json=false is passed. Max CLs returned for a project is
+controlled by flag max-xls and is default by 5. For updated projects present
+locally, the one line log of the new revision is also reported. The format of
 returned json:
 {
 	new_projects: [
@@ -62,6 +67,7 @@ returned json:
 			revision: rev
 			old_revision: old-rev, // if updated
 			old_path: old-path //if moved
+			log: log, // if project is present locally
 			cls:[
 				{
 					number: num,
@@ -82,6 +88,7 @@ func init() {
 	flags := &cmdDiff.Flags
 	flags.BoolVar(&diffFlags.cls, "cls", true, "Return CLs for changed projects")
 	flags.BoolVar(&diffFlags.indentOutput, "indent", true, "Indent json output")
+	flags.BoolVar(&diffFlags.json, "json", true, "Print diff in json format. If false, print a human readable summary")
 	flags.UintVar(&diffFlags.maxCls, "max-cls", 5, "Max number of CLs returned per changed project")
 }
 
@@ -99,6 +106,7 @@ type DiffProject struct {
 	OldPath     string   `json:"old_path,omitempty"`
 	Revision    string   `json:"revision"`
 	OldRevision string   `json:"old_revision,omitempty"`
+	Log         string   `json:"log,omitempty"`
 	Cls         []DiffCl `json:"cls,omitempty"`
 	Error       string   `json:"error,omitempty"`
 	HasMoreCls  bool     `json:"has_more_cls,omitempty"`
@@ -137,6 +145,10 @@ func runDiff(jirix *jiri.X, args []string) error {
 	if err != nil {
 		return err
 	}
+	if !diffFlags.json {
+		printDiff(os.Stdout, d)
+		return nil
+	}
 	e := json.NewEncoder(os.Stdout)
 	if diffFlags.indentOutput {
 		e.SetIndent("", " ")
@@ -144,6 +156,63 @@ func runDiff(jirix *jiri.X, args []string) error {
 	return e.Encode(d)
 }
 
+// printDiff prints a human readable summary of d to w.
+func printDiff(w io.Writer, d *Diff) {
+	if len(d.NewProjects) != 0 {
+		fmt.Fprintln(w, "Added projects:")
+		for _, p := range d.NewProjects {
+			fmt.Fprintf(w, "  %s (%s) %s\n", p.Name, p.Path, p.Revision)
+		}
+	}
+	if len(d.DeletedProjects) != 0 {
+		fmt.Fprintln(w, "Removed projects:")
+		for _, p := range d.DeletedProjects {
+			fmt.Fprintf(w, "  %s (%s) %s\n", p.Name, p.Path, p.Revision)
+		}
+	}
+	if len(d.UpdatedProjects) != 0 {
+		fmt.Fprintln(w, "Updated projects:")
+		for _, p := range d.UpdatedProjects {
+			fmt.Fprintf(w, "  %s (%s)\n", p.Name, p.Path)
+			if p.OldPath != "" {
+				fmt.Fprintf(w, "    moved from %s\n", p.OldPath)
+			}
+			if p.OldRevision != "" {
+				fmt.Fprintf(w, "    %s -> %s\n", p.OldRevision, p.Revision)
+			}
+			if p.Log != "" {
+				fmt.Fprintf(w, "    %s\n", p.Log)
+			}
+			for _, cl := range p.Cls {
+				fmt.Fprintf(w, "    %s %s\n", cl.URL, cl.Subject)
+			}
+			if p.HasMoreCls {
+				fmt.Fprintln(w, "    ...")
+			}
+			if p.Error != "" {
+				fmt.Fprintf(w, "    error: %s\n", p.Error)
+			}
+		}
+	}
+}
+
+// localLog returns the one line log of revision in the first of paths that
+// holds a local project, or "" if there is none or the revision is not
+// available locally.
+func localLog(jirix *jiri.X, revision string, paths ...string) string {
+	for _, path := range paths {
+		if ok, err := project.IsLocalProject(jirix, path); err != nil || !ok {
+			continue
+		}
+		line, err := gitutil.New(jirix, gitutil.RootDirOpt(path)).OneLineLog(revision)
+		if err != nil {
+			continue
+		}
+		return line
+	}
+	return ""
+}
+
 func getDiff(jirix *jiri.X, snapshot1, snapshot2 string) (*Diff, error) {
 	diff := &Diff{
 		NewProjects:     make([]DiffProject, 0),
@@ -154,7 +223,7 @@ func getDiff(jirix *jiri.X, snapshot1, snapshot2 string) (*Diff, error) {
 	defer func() {
 		jirix.Logger = oldLogger
 	}()
-	jirix.Logger = log.NewLogger(log.NoLogLevel, jirix.Color, false, 0, oldLogger.TimeLogThreshold(), nil, nil)
+	jirix.Logger = log.NewLogger(log.NoLogLevel, jirix.Color, log.TextFormat, false, 0, oldLogger.TimeLogThreshold(), nil, nil)
 	projects1, _, _, err := project.LoadSnapshotFile(jirix, snapshot1)
 	if err != nil {
 		return nil, err
@@ -211,6 +280,7 @@ func getDiff(jirix *jiri.X, snapshot1, snapshot2 string) (*Diff, error) {
 		}
 		if p1.Revision != p2.Revision {
 			diffP.OldRevision = p1.Revision
+			diffP.Log = localLog(jirix, p2.Revision, p2.Path, p1.Path)
 			if !diffFlags.cls {
 				// do nothing, prevents nested if/else
 			} else if p2.GerritHost == "" {
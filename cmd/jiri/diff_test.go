@@ -5,6 +5,7 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -12,8 +13,10 @@ import (
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
+	"github.com/dahlia-os/jiri/gitutil"
 	"github.com/dahlia-os/jiri/jiritest"
 	"github.com/dahlia-os/jiri/project"
 )
@@ -175,3 +178,88 @@ func TestDiffSnapshotsUrl(t *testing.T) {
 		t.Fatalf("Error, got: %s\n\nwant:%s", got, want)
 	}
 }
+
+func TestDiffLocalLog(t *testing.T) {
+	fake, cleanup := jiritest.NewFakeJiriRoot(t)
+	defer cleanup()
+	localProjects := createProjects(t, fake, 1)
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	local := localProjects[0]
+	git := gitutil.New(fake.X, gitutil.RootDirOpt(local.Path))
+	writeFile(t, fake.X, local.Path, "file1", "first change")
+	rev1, err := git.CurrentRevision()
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, fake.X, local.Path, "file2", "second change")
+	rev2, err := git.CurrentRevision()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantLog, err := git.OneLineLog(rev2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var files []string
+	for _, revs := range [][]string{{rev1, "revision-1"}, {rev2, "revision-2"}} {
+		m := &project.Manifest{Version: project.ManifestVersion}
+		m.Projects = []project.Project{
+			{Name: local.Name, Path: "path-0", Remote: local.Remote, Revision: revs[0]},
+			// Not present locally, so no log is reported for it.
+			{Name: "remote-only", Path: "remote-only", Remote: "remote-url", Revision: revs[1]},
+		}
+		file := filepath.Join(fake.X.Root, fmt.Sprintf("snapshot-%d", len(files)))
+		if err := m.ToFile(fake.X, file); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, file)
+	}
+
+	diff, err := getDiff(fake.X, files[0], files[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diff.UpdatedProjects) != 2 {
+		t.Fatalf("got %d updated projects, want 2: %+v", len(diff.UpdatedProjects), diff.UpdatedProjects)
+	}
+	for _, p := range diff.UpdatedProjects {
+		want := ""
+		if p.Name == local.Name {
+			want = wantLog
+		}
+		if p.Log != want {
+			t.Errorf("project %s: got log %q, want %q", p.Name, p.Log, want)
+		}
+	}
+}
+
+func TestPrintDiff(t *testing.T) {
+	var buf bytes.Buffer
+	printDiff(&buf, &Diff{
+		NewProjects:     []DiffProject{{Name: "a", Path: "path-a", Revision: "rev-a"}},
+		DeletedProjects: []DiffProject{{Name: "b", Path: "path-b", Revision: "rev-b"}},
+		UpdatedProjects: []DiffProject{
+			{Name: "c", Path: "path-c", OldRevision: "old-c", Revision: "new-c", Log: "new-c message"},
+			{Name: "d", Path: "path-d", OldPath: "old-path-d", Revision: "rev-d"},
+		},
+	})
+	want := strings.Join([]string{
+		"Added projects:",
+		"  a (path-a) rev-a",
+		"Removed projects:",
+		"  b (path-b) rev-b",
+		"Updated projects:",
+		"  c (path-c)",
+		"    old-c -> new-c",
+		"    new-c message",
+		"  d (path-d)",
+		"    moved from old-path-d",
+		"",
+	}, "\n")
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright 2020 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/dahlia-os/jiri"
+	"github.com/dahlia-os/jiri/cmdline"
+	"github.com/dahlia-os/jiri/gitutil"
+	"github.com/dahlia-os/jiri/project"
+)
+
+var gcFlags struct {
+	expireReflogs bool
+	reflogExpiry  string
+	now           bool
+}
+
+var cmdGC = &cmdline.Command{
+	Runner: jiri.RunnerFunc(runGC),
+	Name:   "gc",
+	Short:  "Garbage collect the repositories of all projects",
+	Long: `
+Runs "git gc" in the repositories of all projects, or of the projects given as
+arguments, to pack objects and prune unreachable ones.
+
+Reflog entries keep the objects they refer to alive, so in long-lived
+workspaces gc alone may reclaim little space. With -expire-reflogs the reflog
+entries older than -reflog-expiry, 90 days by default, are expired before gc so
+that the objects only they refer to can be pruned.
+
+With -now all reflog entries are expired and all unreachable objects pruned
+immediately. This reclaims the most space, but commits which are only
+reachable from reflogs, such as those of deleted branches or of rewritten
+history, can no longer be recovered. Expiring reflogs "now" or "all" through
+-reflog-expiry requires -now.
+`,
+	ArgsName: "<project ...>",
+	ArgsLong: "<project ...> is a list of projects to garbage collect. By default all projects are.",
+}
+
+func init() {
+	cmdGC.Flags.BoolVar(&gcFlags.expireReflogs, "expire-reflogs", false, "Expire reflog entries older than -reflog-expiry before gc.")
+	cmdGC.Flags.StringVar(&gcFlags.reflogExpiry, "reflog-expiry", "90.days.ago", "Date before which reflog entries are expired with -expire-reflogs, in a format understood by git.")
+	cmdGC.Flags.BoolVar(&gcFlags.now, "now", false, "Expire all reflog entries and prune all unreachable objects immediately.")
+}
+
+func runGC(jirix *jiri.X, args []string) error {
+	expire, prune := "", ""
+	switch {
+	case gcFlags.now:
+		expire, prune = "all", "now"
+	case gcFlags.reflogExpiry == "now" || gcFlags.reflogExpiry == "all":
+		return jirix.UsageErrorf("use -now to expire all reflog entries")
+	case gcFlags.expireReflogs:
+		expire = gcFlags.reflogExpiry
+	}
+	localProjects, err := project.LocalProjects(jirix, project.FastScan)
+	if err != nil {
+		return err
+	}
+	projects, err := selectProjects(jirix, localProjects, args)
+	if err != nil {
+		return err
+	}
+
+	keys := make(chan project.ProjectKey, len(projects))
+	for key := range projects {
+		keys <- key
+	}
+	close(keys)
+	var mu sync.Mutex
+	gcErrors := make(map[project.ProjectKey]error)
+	var wg sync.WaitGroup
+	for i := uint(0); i < jirix.Jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range keys {
+				if err := gcProject(jirix, projects[key], expire, prune); err != nil {
+					mu.Lock()
+					gcErrors[key] = err
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	var failed []project.Project
+	for key := range gcErrors {
+		failed = append(failed, projects[key])
+	}
+	sort.Sort(project.ProjectsByPath(failed))
+	for _, p := range failed {
+		relativePath, err := filepath.Rel(jirix.Root, p.Path)
+		if err != nil {
+			relativePath = p.Path
+		}
+		jirix.Logger.Errorf("Not able to garbage collect project %s(%s): %s\n\n", p.Name, relativePath, gcErrors[p.Key()])
+		jirix.IncrementFailures()
+	}
+	jirix.Logger.Infof("Garbage collected %d projects\n", len(projects)-len(failed))
+	if jirix.Failures() != 0 {
+		return fmt.Errorf("completed with non-fatal errors")
+	}
+	return nil
+}
+
+// gcProject expires the reflog entries of p older than expire, unless expire
+// is empty, and then runs gc pruning the objects older than prune.
+func gcProject(jirix *jiri.X, p project.Project, expire, prune string) error {
+	scm := gitutil.New(jirix, gitutil.RootDirOpt(p.Path))
+	if expire != "" {
+		if err := scm.ReflogExpire(expire, true); err != nil {
+			return err
+		}
+	}
+	return scm.GC(prune)
+}
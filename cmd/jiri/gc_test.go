@@ -0,0 +1,64 @@
+// Copyright 2020 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/dahlia-os/jiri/gitutil"
+	"github.com/dahlia-os/jiri/jiritest"
+)
+
+func TestGC(t *testing.T) {
+	fake, cleanup := jiritest.NewFakeJiriRoot(t)
+	defer cleanup()
+	defer func() {
+		gcFlags.expireReflogs = false
+		gcFlags.reflogExpiry = "90.days.ago"
+		gcFlags.now = false
+	}()
+	local := createProjects(t, fake, 1)[0]
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+
+	// A commit of a deleted branch is only reachable from reflogs.
+	git := gitutil.New(fake.X, gitutil.RootDirOpt(local.Path))
+	if err := git.CreateAndCheckoutBranch("deleted"); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, fake.X, local.Path, "file", "file")
+	rev, err := git.CurrentRevision()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := git.CheckoutBranch("master"); err != nil {
+		t.Fatal(err)
+	}
+	if err := git.DeleteBranch("deleted", gitutil.ForceOpt(true)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Recent reflog entries are kept by default.
+	gcFlags.expireReflogs = true
+	if err := runGC(fake.X, nil); err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := git.CommitExists(rev); err != nil || !exists {
+		t.Fatalf("commit %s pruned although its reflog entries are recent: %v", rev, err)
+	}
+
+	gcFlags.reflogExpiry = "now"
+	if err := runGC(fake.X, nil); err == nil {
+		t.Errorf("expected a usage error for -reflog-expiry=now without -now")
+	}
+	gcFlags.now = true
+	if err := runGC(fake.X, nil); err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := git.CommitExists(rev); err != nil || exists {
+		t.Errorf("commit %s not pruned with -now: %v", rev, err)
+	}
+}
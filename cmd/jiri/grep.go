@@ -8,6 +8,9 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
 
 	"github.com/dahlia-os/jiri"
 	"github.com/dahlia-os/jiri/cmdline"
@@ -20,7 +23,10 @@ var cmdGrep = &cmdline.Command{
 	Name:   "grep",
 	Short:  "Search across projects.",
 	Long: `
-Run git grep across all projects.
+Run git grep across all projects, or the projects matching -projects.
+Matching lines are prefixed with the path of their project relative to the
+root, and are printed ordered by project. Not finding any match is not an
+error.
 `,
 	ArgsName: "<query> [--] [<pathspec>...]",
 }
@@ -33,6 +39,8 @@ var grepFlags struct {
 	l bool
 	L bool
 	w bool
+
+	projects string
 }
 
 func init() {
@@ -47,6 +55,7 @@ func init() {
 	flags.BoolVar(&grepFlags.l, "files-with-matches", false, "same as -l")
 	flags.BoolVar(&grepFlags.L, "L", false, "Instead of showing every matched line, show only the names of files that do not contain matches")
 	flags.BoolVar(&grepFlags.L, "files-without-match", false, "same as -L")
+	flags.StringVar(&grepFlags.projects, "projects", "", "A Regular expression specifying project keys to search in. By default all projects are searched.")
 }
 
 func buildFlags() []string {
@@ -102,10 +111,26 @@ func doGrep(jirix *jiri.X, args []string) ([]string, error) {
 		return nil, jirix.UsageErrorf("grep requires one argument")
 	}
 
+	var keysRE *regexp.Regexp
+	if grepFlags.projects != "" {
+		var err error
+		if keysRE, err = projectKeysRegexp(grepFlags.projects); err != nil {
+			return nil, err
+		}
+	}
+
 	projects, err := project.LocalProjects(jirix, project.FastScan)
 	if err != nil {
 		return nil, err
 	}
+	var keys project.ProjectKeys
+	for key := range projects {
+		if keysRE == nil || keysRE.MatchString(string(key)) {
+			keys = append(keys, key)
+		}
+	}
+	// Collate the results in a deterministic order.
+	sort.Sort(keys)
 
 	// TODO(ianloic): run in parallel rather than serially.
 	// TODO(ianloic): only run grep on projects under the cwd.
@@ -118,7 +143,8 @@ func doGrep(jirix *jiri.X, args []string) ([]string, error) {
 	if lenArgs == 1 {
 		query = args[0]
 	}
-	for _, project := range projects {
+	for _, key := range keys {
+		project := projects[key]
 		relpath, err := filepath.Rel(jirix.Root, project.Path)
 		if err != nil {
 			return nil, err
@@ -126,7 +152,11 @@ func doGrep(jirix *jiri.X, args []string) ([]string, error) {
 		git := gitutil.New(jirix, gitutil.RootDirOpt(project.Path))
 		lines, err := git.Grep(query, pathSpecs, flags...)
 		if err != nil {
-			continue
+			// git grep fails without any error output if nothing matched.
+			if gitErr, ok := err.(gitutil.GitError); ok && strings.TrimSpace(gitErr.ErrorOutput) == "" {
+				continue
+			}
+			return nil, fmt.Errorf("grep failed for project %s(%s): %v", project.Name, relpath, err)
 		}
 		for _, line := range lines {
 			// TODO(ianloic): higlight the project path part like `repo grep`.
@@ -134,7 +164,6 @@ func doGrep(jirix *jiri.X, args []string) ([]string, error) {
 		}
 	}
 
-	// TODO(ianloic): fail if all of the sub-greps fail
 	return results, nil
 }
 
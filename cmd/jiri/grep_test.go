@@ -8,6 +8,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
 	"sort"
 	"testing"
 
@@ -24,6 +25,7 @@ func setDefaultGrepFlags() {
 	grepFlags.l = false
 	grepFlags.L = false
 	grepFlags.w = false
+	grepFlags.projects = ""
 }
 
 func makeProjects(t *testing.T, fake *jiritest.FakeJiriRoot) []*project.Project {
@@ -195,3 +197,53 @@ func TestLFlagGrep(t *testing.T) {
 		"sub/sub2/r.t2/file.txt",
 	})
 }
+
+func TestProjectsFlagGrep(t *testing.T) {
+	fake, cleanup := jiritest.NewFakeJiriRoot(t)
+	defer cleanup()
+
+	setup(t, fake)
+	setDefaultGrepFlags()
+	grepFlags.projects = "r.b,sub/"
+	expectGrep(t, fake, []string{"e"}, []string{
+		"r.b/file.txt:Thou art more lovely and more temperate:",
+		"sub/r.t1/file.txt:Sometime too hot the eye of heaven shines,",
+		"sub/sub2/r.t2/file.txt:line with -hyphen",
+	})
+}
+
+func TestGrepOrder(t *testing.T) {
+	fake, cleanup := jiritest.NewFakeJiriRoot(t)
+	defer cleanup()
+
+	setup(t, fake)
+	setDefaultGrepFlags()
+	grepFlags.l = true
+	want, err := doGrep(fake.X, []string{"e"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(want) == 0 {
+		t.Fatalf("grep returned no results")
+	}
+	for i := 0; i < 5; i++ {
+		got, err := doGrep(fake.X, []string{"e"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("grep results are not deterministic: got %v, want %v", got, want)
+		}
+	}
+}
+
+func TestGrepError(t *testing.T) {
+	fake, cleanup := jiritest.NewFakeJiriRoot(t)
+	defer cleanup()
+
+	setup(t, fake)
+	setDefaultGrepFlags()
+	if _, err := doGrep(fake.X, []string{"a\\{"}); err == nil {
+		t.Fatalf("grep with an invalid pattern should fail")
+	}
+}
@@ -31,7 +31,7 @@ var (
 func init() {
 	cmdImport.Flags.StringVar(&flagImportName, "name", "manifest", `The name of the remote manifest project.`)
 	cmdImport.Flags.StringVar(&flagImportRemoteBranch, "remote-branch", "master", `The branch of the remote manifest project to track, without the leading "origin/".`)
-	cmdImport.Flags.StringVar(&flagImportRevision, "revision", "", `Revision to check out for the remote.`)
+	cmdImport.Flags.StringVar(&flagImportRevision, "revision", "", `Revision to check out for the remote.  Takes precedence over -remote-branch.`)
 	cmdImport.Flags.StringVar(&flagImportRoot, "root", "", `Root to store the manifest project locally.`)
 
 	cmdImport.Flags.BoolVar(&flagImportOverwrite, "overwrite", false, `Write a new .jiri_manifest file with the given specification.  If it already exists, the existing content will be ignored and the file will be overwritten.`)
@@ -57,6 +57,11 @@ import repository.
 Example:
   $ jiri import myfile https://foo.com/bar.git
 
+Use -revision to pin the remote manifest repository to a specific revision.
+The revision takes precedence over -remote-branch, just as it does for regular
+projects, so "jiri update" will check out that revision of the manifest
+repository instead of following the branch.
+
 Run "jiri help manifest" for details on manifests.
 `,
 	ArgsName: "<manifest> <remote>",
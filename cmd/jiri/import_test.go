@@ -72,6 +72,18 @@ func TestImport(t *testing.T) {
     <import manifest="foo" name="manifest" remote="https://github.com/new.git"/>
   </imports>
 </manifest>
+`,
+		},
+		{
+			SetFlags: func() {
+				flagImportRevision = "c9c5cd4b4bb1b1cbd4e2b1c3b1e9d2b0a5b7b3c1"
+			},
+			Args: []string{"foo", "https://github.com/new.git"},
+			Want: `<manifest>
+  <imports>
+    <import manifest="foo" name="manifest" remote="https://github.com/new.git" revision="c9c5cd4b4bb1b1cbd4e2b1c3b1e9d2b0a5b7b3c1"/>
+  </imports>
+</manifest>
 `,
 		},
 		{
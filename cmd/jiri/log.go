@@ -0,0 +1,89 @@
+// Copyright 2020 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/dahlia-os/jiri"
+	"github.com/dahlia-os/jiri/cmdline"
+	"github.com/dahlia-os/jiri/gitutil"
+	"github.com/dahlia-os/jiri/project"
+)
+
+var logFlags struct {
+	graph bool
+	limit int
+}
+
+var cmdLog = &cmdline.Command{
+	Runner: jiri.RunnerFunc(runLog),
+	Name:   "log",
+	Short:  "Show the recent history of projects",
+	Long: `
+Show the most recent commits of the given projects, one line per commit, as
+reported by "git log --oneline --decorate". Without arguments, the history of
+the project containing the current directory is shown.
+`,
+	ArgsName: "<project ...>",
+	ArgsLong: "<project ...> is a list of projects to show the history of.",
+}
+
+func init() {
+	cmdLog.Flags.BoolVar(&logFlags.graph, "graph", false, "Draw the commit graph, which helps untangling stacked changes and merges.")
+	cmdLog.Flags.IntVar(&logFlags.limit, "n", 10, "Number of commits to show per project, 0 shows all of them.")
+}
+
+func runLog(jirix *jiri.X, args []string) error {
+	var projects []project.Project
+	if len(args) == 0 {
+		p, err := project.CurrentProject(jirix)
+		if err != nil {
+			return err
+		}
+		if p == nil {
+			return jirix.UsageErrorf("not inside a project, name the projects to show the history of")
+		}
+		projects = append(projects, *p)
+	} else {
+		localProjects, err := project.LocalProjects(jirix, project.FastScan)
+		if err != nil {
+			return err
+		}
+		for _, arg := range args {
+			p, err := localProjects.FindUnique(arg)
+			if err != nil {
+				return err
+			}
+			projects = append(projects, p)
+		}
+	}
+	for _, p := range projects {
+		out, err := projectLog(jirix, p)
+		if err != nil {
+			return err
+		}
+		if len(projects) > 1 {
+			relativePath, err := filepath.Rel(jirix.Root, p.Path)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(jirix.Stdout(), "%s:\n", jirix.Color.Yellow(relativePath))
+		}
+		fmt.Fprint(jirix.Stdout(), out)
+	}
+	return nil
+}
+
+// projectLog returns the recent history of HEAD in p, drawn as a graph with
+// -graph.
+func projectLog(jirix *jiri.X, p project.Project) (string, error) {
+	git := gitutil.New(jirix, gitutil.RootDirOpt(p.Path))
+	if logFlags.graph {
+		return git.LogGraph("HEAD", logFlags.limit)
+	}
+	return git.LogOneline("HEAD", logFlags.limit)
+}
@@ -0,0 +1,61 @@
+// Copyright 2020 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/dahlia-os/jiri/gitutil"
+	"github.com/dahlia-os/jiri/jiritest"
+)
+
+func TestLog(t *testing.T) {
+	fake, cleanup := jiritest.NewFakeJiriRoot(t)
+	defer cleanup()
+	projects := makeProjects(t, fake)
+
+	p := *projects[0]
+	git := gitutil.New(fake.X, gitutil.UserNameOpt("John Doe"), gitutil.UserEmailOpt("john.doe@example.com"), gitutil.RootDirOpt(p.Path))
+	for _, subject := range []string{"first", "second"} {
+		if err := git.CommitWithMessage(subject); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	defer func() { logFlags.graph, logFlags.limit = false, 10 }()
+	logFlags.limit = 2
+	out, err := projectLog(fake.X, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(out), "\n"); len(lines) != 2 || !strings.HasSuffix(lines[0], "second") || !strings.HasSuffix(lines[1], "first") {
+		t.Errorf("got %q, want the two last commits", out)
+	}
+	if strings.Contains(out, "* ") {
+		t.Errorf("got a graph without -graph: %q", out)
+	}
+
+	logFlags.graph = true
+	if out, err = projectLog(fake.X, p); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Count(out, "* "); got != 2 {
+		t.Errorf("-graph: got %d commits, want 2: %q", got, out)
+	}
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(cwd)
+	if err := os.Chdir(fake.X.Root); err != nil {
+		t.Fatal(err)
+	}
+	if err := runLog(fake.X, nil); err == nil {
+		t.Errorf("expected an error outside of any project")
+	}
+}
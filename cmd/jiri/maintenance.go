@@ -0,0 +1,96 @@
+// Copyright 2020 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+
+	"github.com/dahlia-os/jiri"
+	"github.com/dahlia-os/jiri/cmdline"
+	"github.com/dahlia-os/jiri/gitutil"
+	"github.com/dahlia-os/jiri/project"
+)
+
+var cmdMaintenance = &cmdline.Command{
+	Name:  "maintenance",
+	Short: "Manage git background maintenance of projects",
+	Long: `
+Manage git background maintenance of all projects. Registered projects are
+kept healthy by git's scheduler, which runs tasks such as updating the commit
+graph and packing objects in the background, so that they are not left to
+"git gc" during other commands.
+
+Background maintenance requires git 2.29 or later. The scheduler itself is
+started once per user, with "git maintenance start" in any repository.
+`,
+	Children: []*cmdline.Command{cmdMaintenanceEnable, cmdMaintenanceDisable},
+}
+
+var cmdMaintenanceEnable = &cmdline.Command{
+	Runner: jiri.RunnerFunc(runMaintenanceEnable),
+	Name:   "enable",
+	Short:  "Register all projects for background maintenance",
+	Long: `
+Register all projects for git background maintenance with "git maintenance
+register". Projects created later are not registered automatically; run the
+command again after updates that add projects.
+`,
+}
+
+var cmdMaintenanceDisable = &cmdline.Command{
+	Runner: jiri.RunnerFunc(runMaintenanceDisable),
+	Name:   "disable",
+	Short:  "Unregister all projects from background maintenance",
+	Long: `
+Unregister all projects from git background maintenance with "git maintenance
+unregister". Projects that are not registered are skipped.
+`,
+}
+
+func runMaintenanceEnable(jirix *jiri.X, args []string) error {
+	return runMaintenance(jirix, args, "register", (*gitutil.Git).MaintenanceRegister)
+}
+
+func runMaintenanceDisable(jirix *jiri.X, args []string) error {
+	return runMaintenance(jirix, args, "unregister", (*gitutil.Git).MaintenanceUnregister)
+}
+
+// runMaintenance runs op in every local project, reporting the projects it
+// fails for.
+func runMaintenance(jirix *jiri.X, args []string, name string, op func(*gitutil.Git) error) error {
+	if len(args) != 0 {
+		return jirix.UsageErrorf("unexpected number of arguments")
+	}
+	localProjects, err := project.LocalProjects(jirix, project.FastScan)
+	if err != nil {
+		return err
+	}
+	var keys project.ProjectKeys
+	for key := range localProjects {
+		keys = append(keys, key)
+	}
+	sort.Sort(keys)
+	count := 0
+	for _, key := range keys {
+		local := localProjects[key]
+		if err := op(gitutil.New(jirix, gitutil.RootDirOpt(local.Path))); err != nil {
+			if err == gitutil.ErrMaintenanceNotSupported {
+				return err
+			}
+			relativePath, _ := filepath.Rel(jirix.Root, local.Path)
+			jirix.Logger.Errorf("Not able to %s project %s(%s) for background maintenance: %s\n\n", name, local.Name, relativePath, err)
+			jirix.IncrementFailures()
+			continue
+		}
+		count++
+	}
+	jirix.Logger.Infof("Ran \"git maintenance %s\" in %d projects\n", name, count)
+	if jirix.Failures() != 0 {
+		return fmt.Errorf("completed with non-fatal errors")
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+// Copyright 2020 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/dahlia-os/jiri/gitutil"
+	"github.com/dahlia-os/jiri/project"
+)
+
+// maintenanceRepos returns the repositories registered for background
+// maintenance in the global git config.
+func maintenanceRepos(t *testing.T) map[string]bool {
+	out, err := exec.Command("git", "config", "--global", "--get-all", "maintenance.repo").Output()
+	if _, ok := err.(*exec.ExitError); err != nil && !ok {
+		t.Fatal(err)
+	}
+	repos := make(map[string]bool)
+	for _, repo := range strings.Fields(string(out)) {
+		repos[repo] = true
+	}
+	return repos
+}
+
+func TestMaintenance(t *testing.T) {
+	// Registering changes the global git config, so use a scratch home.
+	home, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", home)
+
+	_, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	if major, minor, err := gitutil.New(fake.X).Version(); err != nil {
+		t.Fatal(err)
+	} else if major < 2 || (major == 2 && minor < 29) {
+		t.Skip("git maintenance is not supported")
+	}
+	localProjects, err := project.LocalProjects(fake.X, project.FastScan)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runMaintenanceEnable(fake.X, nil); err != nil {
+		t.Fatal(err)
+	}
+	repos := maintenanceRepos(t)
+	for _, p := range localProjects {
+		if !repos[p.Path] {
+			t.Errorf("project %q is not registered, got %v", p.Name, repos)
+		}
+		scm := gitutil.New(fake.X, gitutil.RootDirOpt(p.Path))
+		if got, err := scm.ConfigGetKey("maintenance.strategy"); err != nil || got == "" {
+			t.Errorf("project %q: got maintenance.strategy %q, %v", p.Name, got, err)
+		}
+	}
+	if len(repos) != len(localProjects) {
+		t.Errorf("got %d registered repositories, want %d", len(repos), len(localProjects))
+	}
+
+	// Disabling twice does not fail for projects no longer registered.
+	for i := 0; i < 2; i++ {
+		if err := runMaintenanceDisable(fake.X, nil); err != nil {
+			t.Fatal(err)
+		}
+		if repos := maintenanceRepos(t); len(repos) != 0 {
+			t.Errorf("got registered repositories %v after disable, want none", repos)
+		}
+	}
+}
@@ -92,7 +92,7 @@ func patchProject(jirix *jiri.X, local project.Project, ref, branch, remote stri
 					return false, err
 				}
 				if currentBranch == branch {
-					if err := scm.CheckoutBranch("remotes/origin/"+remote, gitutil.DetachOpt(true)); err != nil {
+					if err := scm.CheckoutBranch(local.RemoteRef(remote), gitutil.DetachOpt(true)); err != nil {
 						return false, err
 					}
 				}
@@ -110,7 +110,7 @@ func patchProject(jirix *jiri.X, local project.Project, ref, branch, remote stri
 	} else {
 		jirix.Logger.Infof("Patching project %s(%s) to ref %q\n", local.Name, local.Path, ref)
 	}
-	if err := scm.FetchRefspec("origin", ref); err != nil {
+	if err := scm.FetchRefspec(local.GitRemoteName(), ref); err != nil {
 		return false, err
 	}
 	branchBase := "FETCH_HEAD"
@@ -130,8 +130,9 @@ func patchProject(jirix *jiri.X, local project.Project, ref, branch, remote stri
 		if err := scm.CreateBranchFromRef(branch, branchBase); err != nil {
 			return false, err
 		}
-		if err := scm.SetUpstream(branch, "origin/"+remote); err != nil {
-			return false, fmt.Errorf("setting upstream to 'origin/%s': %s", remote, err)
+		upstream := local.GitRemoteName() + "/" + remote
+		if err := scm.SetUpstream(branch, upstream); err != nil {
+			return false, fmt.Errorf("setting upstream to '%s': %s", upstream, err)
 		}
 		if err := scm.CheckoutBranch(branch); err != nil {
 			return false, err
@@ -179,12 +180,12 @@ func rebaseProject(jirix *jiri.X, project project.Project, remoteBranch string)
 	}
 	// TODO: provide a way to set username and email
 	scm = gitutil.New(jirix, gitutil.UserNameOpt(name), gitutil.UserEmailOpt(email), gitutil.RootDirOpt(project.Path))
-	if err := scm.FetchRefspec("origin", remoteBranch); err != nil {
+	if err := scm.FetchRefspec(project.GitRemoteName(), remoteBranch); err != nil {
 		jirix.Logger.Errorf("Not able to fetch branch %q: %s", remoteBranch, err)
 		jirix.IncrementFailures()
 		return nil
 	}
-	if err := scm.Rebase("remotes/origin/" + remoteBranch); err != nil {
+	if err := scm.Rebase(project.RemoteRef(remoteBranch)); err != nil {
 		if err2 := scm.RebaseAbort(); err2 != nil {
 			return err2
 		}
@@ -0,0 +1,90 @@
+// Copyright 2020 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/dahlia-os/jiri/isatty"
+)
+
+var (
+	// processGroupKillDelay is how long stopProcessGroup waits for the
+	// processes of a group to exit once signalled, before killing them.
+	processGroupKillDelay = 5 * time.Second
+	// processGroupPollInterval is how often stopProcessGroup checks
+	// whether the processes of a group have exited.
+	processGroupPollInterval = 50 * time.Millisecond
+)
+
+// stopProcessGroup sends sig to the process group pgid, whose leader's exit
+// status is sent on done, and waits for all of its processes to exit. The
+// processes which are left after processGroupKillDelay, including those
+// which ignore sig, are killed. It returns the exit status of the leader.
+func stopProcessGroup(pgid int, sig syscall.Signal, done <-chan error) error {
+	syscall.Kill(-pgid, sig)
+	timeout := time.NewTimer(processGroupKillDelay)
+	defer timeout.Stop()
+	ticker := time.NewTicker(processGroupPollInterval)
+	defer ticker.Stop()
+	var err error
+	for waiting := done; ; {
+		select {
+		case err = <-waiting:
+			waiting = nil
+		case <-ticker.C:
+		case <-timeout.C:
+			syscall.Kill(-pgid, syscall.SIGKILL)
+			if waiting != nil {
+				err = <-waiting
+			}
+			return err
+		}
+		if waiting == nil && syscall.Kill(-pgid, 0) == syscall.ESRCH {
+			return err
+		}
+	}
+}
+
+// foregroundTerminal returns the file descriptor of the terminal jiri
+// controls, that is the terminal of stdout when the process group of jiri
+// is its foreground process group.
+func foregroundTerminal() (int, bool) {
+	if !isatty.IsTerminal() {
+		return 0, false
+	}
+	fd := int(os.Stdout.Fd())
+	pgid, err := terminalProcessGroup(fd)
+	if err != nil || pgid != syscall.Getpgrp() {
+		return 0, false
+	}
+	return fd, true
+}
+
+func terminalProcessGroup(fd int) (int, error) {
+	var pgid int32
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.TIOCGPGRP, uintptr(unsafe.Pointer(&pgid))); errno != 0 {
+		return 0, errno
+	}
+	return int(pgid), nil
+}
+
+// setForegroundProcessGroup makes pgid the foreground process group of the
+// terminal fd.
+func setForegroundProcessGroup(fd, pgid int) error {
+	// Processes which are not in the foreground process group are stopped
+	// by SIGTTOU when they change it, unless they ignore it.
+	signal.Ignore(syscall.SIGTTOU)
+	defer signal.Reset(syscall.SIGTTOU)
+	id := int32(pgid)
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.TIOCSPGRP, uintptr(unsafe.Pointer(&id))); errno != 0 {
+		return errno
+	}
+	return nil
+}
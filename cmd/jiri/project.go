@@ -5,35 +5,70 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"regexp"
 	"sort"
+	"strings"
+	"sync"
 	"text/template"
+	"time"
 
 	"github.com/dahlia-os/jiri"
 	"github.com/dahlia-os/jiri/cmdline"
+	"github.com/dahlia-os/jiri/gitutil"
 	"github.com/dahlia-os/jiri/project"
+	"github.com/dahlia-os/jiri/table"
 )
 
 var (
-	cleanAllFlag   bool
-	cleanupFlag    bool
-	jsonOutputFlag string
-	regexpFlag     bool
-	templateFlag   string
+	allFlag              bool
+	branchesContainsFlag string
+	byAgeFlag            bool
+	cleanAllFlag         bool
+	cleanupFlag          bool
+	fixFlag              bool
+	forceFlag            bool
+	jsonOutputFlag       string
+	keepFlag             string
+	lastUpdateFlag       bool
+	mergedOnlyFlag       bool
+	recoverFlag          bool
+	recreateFlag         bool
+	regexpFlag           bool
+	renameFlag           bool
+	templateFlag         string
+	treeFlag             bool
+	submodulesFlag       bool
+	verifyFlag           bool
 )
 
 func init() {
+	cmdProject.Flags.BoolVar(&allFlag, "all", false, "With -clean, -clean-all or -verify, also include projects marked skipbulk in the manifest when no projects are given.")
+	cmdProject.Flags.BoolVar(&byAgeFlag, "by-age", false, "With -last-update, list the projects which were updated least recently first.")
+	cmdProject.Flags.StringVar(&branchesContainsFlag, "branches-contains", "", "Only show projects where this commit, possibly abbreviated, is on a local or remote branch, and list those branches.")
 	cmdProject.Flags.BoolVar(&cleanAllFlag, "clean-all", false, "Restore jiri projects to their pristine state and delete all branches.")
 	cmdProject.Flags.BoolVar(&cleanupFlag, "clean", false, "Restore jiri projects to their pristine state.")
+	cmdProject.Flags.BoolVar(&fixFlag, "fix", false, "With -verify, offer to re-clone each corrupt project from its remote.")
+	cmdProject.Flags.BoolVar(&forceFlag, "force", false, "With -rename, move the project even if it has local changes or the destination is an existing empty directory.")
 	cmdProject.Flags.StringVar(&jsonOutputFlag, "json-output", "", "Path to write operation results to.")
+	cmdProject.Flags.StringVar(&keepFlag, "keep", "", "With -clean-all, keep branches matching this regular expression, as well as the branch that was checked out and the project's remote branch.")
+	cmdProject.Flags.BoolVar(&lastUpdateFlag, "last-update", false, "List the time at which \"jiri update\" last updated each project.")
+	cmdProject.Flags.BoolVar(&mergedOnlyFlag, "merged-only", false, "With -clean-all, delete only branches merged into the revision the project is reset to. The branch that was checked out and the project's remote branch are kept.")
+	cmdProject.Flags.BoolVar(&recoverFlag, "recover", false, "List branches which were deleted but whose last commit is still recorded in the reflog.")
+	cmdProject.Flags.BoolVar(&recreateFlag, "recreate", false, "With -recover, re-create the deleted branches at their last commit.")
 	cmdProject.Flags.BoolVar(&regexpFlag, "regexp", false, "Use argument as regular expression.")
+	cmdProject.Flags.BoolVar(&renameFlag, "rename", false, "Move the project at <old-path> to <new-path>.")
+	cmdProject.Flags.BoolVar(&submodulesFlag, "submodules", false, "Report the number of git submodules of projects and those which are not initialized or out of date.")
 	cmdProject.Flags.StringVar(&templateFlag, "template", "", "The template for the fields to display.")
+	cmdProject.Flags.BoolVar(&treeFlag, "tree", false, "Display projects as a tree of their paths relative to the root, with branches nested under each project.")
+	cmdProject.Flags.BoolVar(&verifyFlag, "verify", false, "Check the objects of projects with \"git fsck\" and report the corrupt ones.")
 }
 
 // cmdProject represents the "jiri project" command.
@@ -49,30 +84,117 @@ var cmdProject = &cmdline.Command{
 	current directory is used, or if run from outside of a given project,
 	all projects will be used. The information to be displayed can be
 	specified using a Go template, supplied via
-the -template flag.`,
-	ArgsName: "<project ...>",
-	ArgsLong: "<project ...> is a list of projects to clean up or give info about.",
+the -template flag.
+
+With -clean or -clean-all, untracked files are removed unless git ignores
+them. A .jiri-ignore file at the root of a project lists further patterns of
+untracked files to keep, such as build outputs or local notes, one per line in
+.gitignore syntax; blank lines and lines starting with "#" are skipped. The
+patterns are layered on top of git's own ignore rules and are passed to
+"git clean -e", so they are honored even where "git clean -x" would disregard
+.gitignore. The .jiri-ignore file itself is kept as well.
+
+With -branches-contains, only the projects in which the given commit is on a
+local or remote branch are shown, along with these branches. They are also
+available to templates as .ContainingBranches. Projects in which the commit
+does not exist are skipped, so an abbreviated commit hash can be used to find
+the projects a change has landed in.
+
+With -submodules, the git submodules of the projects are reported, along with
+the ones which are not initialized or are checked out at another commit than
+the one recorded in the project. They are available to templates as
+.Submodules, whose Marker method returns "-" for uninitialized and "+" for
+out of date submodules, for use in shell prompts.
+
+With -rename, moves the project checked out at <old-path> to <new-path>,
+along with any projects nested inside it, and updates their metadata and git
+working tree links. Update the project's path in the manifest accordingly so
+that the next "jiri update" leaves it in place.
+
+With -recover, lists the branches of the projects which no longer exist, for
+instance after "jiri project -clean-all", along with the commit they pointed to
+when they were last checked out, as recorded in the reflog of HEAD. With
+-recreate, these branches are created again.
+
+With -verify, checks the git objects of the projects in parallel with
+"git fsck --full" and lists the projects which are corrupt, such as after a
+disk failure or an interrupted garbage collection. Nothing is changed unless
+-fix is given as well, in which case jiri asks, for each corrupt project,
+whether to re-clone it from its remote. Re-cloning replaces the project's git
+directory with a fresh clone at the revision given in the manifest; local
+branches and commits that were not pushed are lost, while the files in the
+working tree are kept.
+
+With -last-update, lists the time at which "jiri update" last updated each
+project successfully, as recorded in its metadata, and how long ago that was,
+to find stale checkouts. Projects are listed by path, or with -by-age from the
+least recently updated. Projects last updated by a version of jiri which did
+not record the time are listed as "unknown", and first with -by-age.`,
+	ArgsName: "<project ...> | -rename <old-path> <new-path>",
+	ArgsLong: "<project ...> is a list of projects to clean up, verify or give info about.",
 }
 
 func runProject(jirix *jiri.X, args []string) (e error) {
-	if cleanupFlag || cleanAllFlag {
+	if recreateFlag && !recoverFlag {
+		return jirix.UsageErrorf("-recreate requires -recover")
+	}
+	if fixFlag && !verifyFlag {
+		return jirix.UsageErrorf("-fix requires -verify")
+	}
+	if byAgeFlag && !lastUpdateFlag {
+		return jirix.UsageErrorf("-by-age requires -last-update")
+	}
+	if renameFlag {
+		return runProjectRename(jirix, args)
+	} else if recoverFlag {
+		return runProjectRecover(jirix, args)
+	} else if verifyFlag {
+		return runProjectVerify(jirix, args)
+	} else if lastUpdateFlag {
+		return runProjectLastUpdate(jirix, args)
+	} else if cleanupFlag || cleanAllFlag || keepFlag != "" || mergedOnlyFlag {
 		return runProjectClean(jirix, args)
 	} else {
 		return runProjectInfo(jirix, args)
 	}
 }
 func runProjectClean(jirix *jiri.X, args []string) (e error) {
+	if (keepFlag != "" || mergedOnlyFlag) && !cleanAllFlag {
+		return jirix.UsageErrorf("-keep and -merged-only require -clean-all")
+	}
+	var keep *regexp.Regexp
+	if keepFlag != "" {
+		var err error
+		if keep, err = regexp.Compile(keepFlag); err != nil {
+			return jirix.UsageErrorf("invalid -keep regular expression %q: %v", keepFlag, err)
+		}
+	}
 	localProjects, err := project.LocalProjects(jirix, project.FullScan)
 	if err != nil {
 		return err
 	}
+	projects, err := selectProjects(jirix, localProjects, args)
+	if err != nil {
+		return err
+	}
+	if err := project.CleanupProjects(jirix, projects, cleanAllFlag, keep, mergedOnlyFlag); err != nil {
+		return err
+	}
+	return nil
+}
+
+// selectProjects returns the local projects given on the command line, by
+// name or, with -regexp, by regular expression. Without arguments, all the
+// projects are returned, leaving out those marked skipbulk unless -all is
+// set.
+func selectProjects(jirix *jiri.X, localProjects project.Projects, args []string) (project.Projects, error) {
 	projects := make(project.Projects)
 	if len(args) > 0 {
 		if regexpFlag {
 			for _, a := range args {
 				re, err := regexp.Compile(a)
 				if err != nil {
-					return fmt.Errorf("failed to compile regexp %v: %v", a, err)
+					return nil, fmt.Errorf("failed to compile regexp %v: %v", a, err)
 				}
 				for _, p := range localProjects {
 					if re.MatchString(p.Name) {
@@ -90,15 +212,293 @@ func runProjectClean(jirix *jiri.X, args []string) (e error) {
 				}
 			}
 		}
-	} else {
+	} else if allFlag {
 		projects = localProjects
+	} else {
+		projects = withoutSkipBulk(localProjects)
+	}
+	return projects, nil
+}
+
+func runProjectRename(jirix *jiri.X, args []string) error {
+	if len(args) != 2 {
+		return jirix.UsageErrorf("-rename requires <old-path> and <new-path>")
+	}
+	if cleanupFlag || cleanAllFlag {
+		return jirix.UsageErrorf("-rename cannot be combined with -clean or -clean-all")
+	}
+	oldPath, err := filepath.Abs(args[0])
+	if err != nil {
+		return err
+	}
+	newPath, err := filepath.Abs(args[1])
+	if err != nil {
+		return err
+	}
+	localProjects, err := project.LocalProjects(jirix, project.FullScan)
+	if err != nil {
+		return err
+	}
+	return project.RenameProject(jirix, localProjects, oldPath, newPath, forceFlag)
+}
+
+func runProjectLastUpdate(jirix *jiri.X, args []string) error {
+	if cleanupFlag || cleanAllFlag || renameFlag || recoverFlag {
+		return jirix.UsageErrorf("-last-update cannot be combined with -clean, -clean-all, -rename or -recover")
+	}
+	localProjects, err := project.LocalProjects(jirix, project.FastScan)
+	if err != nil {
+		return err
+	}
+	projects, err := selectProjects(jirix, localProjects, args)
+	if err != nil {
+		return err
+	}
+	var list []project.Project
+	for _, p := range projects {
+		list = append(list, p)
+	}
+	sort.Sort(project.ProjectsByPath(list))
+	if byAgeFlag {
+		sort.SliceStable(list, func(i, j int) bool {
+			return list[i].LastUpdateTime().Before(list[j].LastUpdateTime())
+		})
+	}
+	return printLastUpdates(jirix, os.Stdout, table.Width(jirix.Env()), list, time.Now())
+}
+
+// printLastUpdates prints the time at which each project was last updated
+// and how long before now that was.
+func printLastUpdates(jirix *jiri.X, w io.Writer, width int, projects []project.Project, now time.Time) error {
+	t := table.New(width, "PROJECT", "PATH", "LAST UPDATE", "AGE")
+	for _, p := range projects {
+		relativePath, err := filepath.Rel(jirix.Root, p.Path)
+		if err != nil {
+			relativePath = p.Path
+		}
+		updated := p.LastUpdateTime()
+		if updated.IsZero() {
+			t.AddRow(p.Name, relativePath, "unknown")
+			continue
+		}
+		t.AddRow(p.Name, relativePath, updated.Local().Format("2006-01-02 15:04:05"), formatAge(now.Sub(updated)))
+	}
+	return t.Write(w)
+}
+
+// formatAge returns d in days, hours or minutes, whichever is the largest
+// unit of which d is at least one.
+func formatAge(d time.Duration) string {
+	switch {
+	case d >= 24*time.Hour:
+		return fmt.Sprintf("%dd", d/(24*time.Hour))
+	case d >= time.Hour:
+		return fmt.Sprintf("%dh", d/time.Hour)
+	default:
+		return fmt.Sprintf("%dm", d/time.Minute)
+	}
+}
+
+func runProjectVerify(jirix *jiri.X, args []string) error {
+	if cleanupFlag || cleanAllFlag || renameFlag || recoverFlag {
+		return jirix.UsageErrorf("-verify cannot be combined with -clean, -clean-all, -rename or -recover")
+	}
+	localProjects, err := project.LocalProjects(jirix, project.FastScan)
+	if err != nil {
+		return err
 	}
-	if err := project.CleanupProjects(jirix, projects, cleanAllFlag); err != nil {
+	projects, err := selectProjects(jirix, localProjects, args)
+	if err != nil {
 		return err
 	}
+
+	keys := make(chan project.ProjectKey, len(projects))
+	for key := range projects {
+		keys <- key
+	}
+	close(keys)
+	var mu sync.Mutex
+	fsckErrors := make(map[project.ProjectKey]error)
+	var wg sync.WaitGroup
+	for i := uint(0); i < jirix.Jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range keys {
+				if err := gitutil.New(jirix, gitutil.RootDirOpt(projects[key].Path)).Fsck(); err != nil {
+					mu.Lock()
+					fsckErrors[key] = err
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	var corrupt []project.Project
+	for key := range fsckErrors {
+		corrupt = append(corrupt, projects[key])
+	}
+	sort.Sort(project.ProjectsByPath(corrupt))
+	var manifestProjects project.Projects
+	if fixFlag && len(corrupt) > 0 {
+		if manifestProjects, _, _, err = project.LoadManifestFile(jirix, jirix.JiriManifestFile(), localProjects, false /*localManifest*/); err != nil {
+			return err
+		}
+	}
+	reader := bufio.NewReader(jirix.Stdin())
+	for _, p := range corrupt {
+		relativePath, err := filepath.Rel(jirix.Root, p.Path)
+		if err != nil {
+			relativePath = p.Path
+		}
+		fmt.Printf("%s\n", relativePath)
+		if remote, ok := manifestProjects[p.Key()]; !ok && fixFlag {
+			jirix.Logger.Warningf("Project %s(%s) is not in the manifest and cannot be re-cloned\n\n", p.Name, relativePath)
+		} else if fixFlag {
+			fmt.Printf("Re-clone project %s(%s) from %s? Local branches and commits which were not pushed are lost. [y/N]: ", p.Name, relativePath, remote.Remote)
+			answer, _ := reader.ReadString('\n')
+			if answer = strings.ToLower(strings.TrimSpace(answer)); answer == "y" || answer == "yes" {
+				remote.Path = p.Path
+				if err := project.RecloneProject(jirix, remote); err != nil {
+					jirix.Logger.Errorf("Not able to re-clone project %s(%s): %s\n\n", p.Name, relativePath, err)
+					jirix.IncrementFailures()
+				}
+				continue
+			}
+		}
+		jirix.Logger.Errorf("Project %s(%s) is corrupt: %s\n\n", p.Name, relativePath, fsckErrors[p.Key()])
+		jirix.IncrementFailures()
+	}
+	if jirix.Failures() != 0 {
+		return fmt.Errorf("completed with non-fatal errors")
+	}
 	return nil
 }
 
+// recoverReflogEntries is the number of HEAD reflog entries searched for
+// deleted branches by "jiri project -recover".
+const recoverReflogEntries = 1000
+
+var (
+	// checkoutReflogRE matches the reflog message of a checkout.
+	checkoutReflogRE = regexp.MustCompile(`^checkout: moving from (\S+) to \S+$`)
+	// detachedHeadRE matches what checkoutReflogRE captures when moving away
+	// from a detached HEAD.
+	detachedHeadRE = regexp.MustCompile(`^[0-9a-f]{40}$`)
+)
+
+// deletedBranch is a branch which no longer exists, and the commit it
+// pointed to when it was last checked out.
+type deletedBranch struct {
+	Name     string
+	Revision string
+	Subject  string
+}
+
+func runProjectRecover(jirix *jiri.X, args []string) error {
+	if cleanupFlag || cleanAllFlag || renameFlag {
+		return jirix.UsageErrorf("-recover cannot be combined with -clean, -clean-all or -rename")
+	}
+	localProjects, err := project.LocalProjects(jirix, project.FastScan)
+	if err != nil {
+		return err
+	}
+	var projects []project.Project
+	if len(args) > 0 {
+		for _, arg := range args {
+			p, err := localProjects.FindUnique(arg)
+			if err != nil {
+				return err
+			}
+			projects = append(projects, p)
+		}
+	} else if currentProject, err := project.CurrentProject(jirix); err != nil {
+		return err
+	} else if currentProject != nil {
+		projects = append(projects, *currentProject)
+	} else {
+		for _, p := range localProjects {
+			projects = append(projects, p)
+		}
+	}
+	sort.Sort(project.ProjectsByPath(projects))
+
+	for _, p := range projects {
+		branches, err := findDeletedBranches(jirix, p)
+		if err != nil {
+			jirix.Logger.Errorf("Not able to recover branches of project %s(%s): %s\n\n", p.Name, p.Path, err)
+			jirix.IncrementFailures()
+			continue
+		}
+		if len(branches) == 0 {
+			continue
+		}
+		relativePath, err := filepath.Rel(jirix.Root, p.Path)
+		if err != nil {
+			relativePath = p.Path
+		}
+		fmt.Printf("%s:\n", relativePath)
+		scm := gitutil.New(jirix, gitutil.RootDirOpt(p.Path))
+		for _, b := range branches {
+			fmt.Printf("  %s %s %s\n", b.Name, b.Revision[:7], b.Subject)
+			if !recreateFlag {
+				continue
+			}
+			if err := scm.CreateBranchFromRef(b.Name, b.Revision); err != nil {
+				jirix.Logger.Errorf("Not able to re-create branch %s of project %s(%s): %s\n\n", b.Name, p.Name, p.Path, err)
+				jirix.IncrementFailures()
+			}
+		}
+	}
+	if jirix.Failures() != 0 {
+		return fmt.Errorf("completed with non-fatal errors")
+	}
+	return nil
+}
+
+// findDeletedBranches returns the branches of p which were checked out
+// according to the reflog of HEAD but no longer exist, most recently checked
+// out first.  The commit a branch pointed to when it was last checked out is
+// the value of HEAD before moving away from it.
+func findDeletedBranches(jirix *jiri.X, p project.Project) ([]deletedBranch, error) {
+	scm := gitutil.New(jirix, gitutil.RootDirOpt(p.Path))
+	entries, err := scm.Reflog("HEAD", recoverReflogEntries)
+	if err != nil {
+		return nil, err
+	}
+	existing, _, err := scm.GetBranches()
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	for _, name := range existing {
+		seen[name] = true
+	}
+	var branches []deletedBranch
+	for i, entry := range entries {
+		m := checkoutReflogRE.FindStringSubmatch(entry.Subject)
+		if m == nil || i+1 == len(entries) || seen[m[1]] {
+			continue
+		}
+		seen[m[1]] = true
+		if m[1] == "HEAD" || detachedHeadRE.MatchString(m[1]) {
+			continue
+		}
+		subject, err := scm.CommitMsg(entries[i+1].Hash)
+		if err != nil {
+			// The commit was garbage collected.
+			continue
+		}
+		branches = append(branches, deletedBranch{
+			Name:     m[1],
+			Revision: entries[i+1].Hash,
+			Subject:  strings.SplitN(subject, "\n", 2)[0],
+		})
+	}
+	return branches, nil
+}
+
 // infoOutput defines JSON format for 'project info' output.
 type infoOutput struct {
 	Name string `json:"name"`
@@ -110,12 +510,86 @@ type infoOutput struct {
 	Revision      string   `json:"revision"`
 	CurrentBranch string   `json:"current_branch,omitempty"`
 	Branches      []string `json:"branches,omitempty"`
+
+	// ContainingBranches are the local and remote branches containing the
+	// commit given by -branches-contains.
+	ContainingBranches []string `json:"containing_branches,omitempty"`
+
+	// Pinned is true if the manifest pins the project to a revision rather
+	// than tracking a remote branch.  Target is that revision or branch.
+	Pinned bool   `json:"pinned"`
+	Target string `json:"target,omitempty"`
+
+	// Submodules is only set with -submodules.
+	Submodules *submoduleInfo `json:"submodules,omitempty"`
+}
+
+// submoduleInfo summarizes the state of the git submodules of a project.
+type submoduleInfo struct {
+	Count int `json:"count"`
+	// Uninitialized and OutOfDate are the paths of the submodules which are
+	// not checked out, or checked out at another commit than the one
+	// recorded in the project.
+	Uninitialized []string `json:"uninitialized,omitempty"`
+	OutOfDate     []string `json:"out_of_date,omitempty"`
+}
+
+// Marker returns a short marker of the submodule state, suitable for shell
+// prompts: "-" if submodules are not initialized, "+" if they are out of
+// date, both if both, and an empty string if all are in sync.
+func (s submoduleInfo) Marker() string {
+	marker := ""
+	if len(s.Uninitialized) != 0 {
+		marker += "-"
+	}
+	if len(s.OutOfDate) != 0 {
+		marker += "+"
+	}
+	return marker
+}
+
+// getSubmoduleInfo returns the state of the submodules of the project at path.
+func getSubmoduleInfo(jirix *jiri.X, path string) (*submoduleInfo, error) {
+	submodules, err := gitutil.New(jirix, gitutil.RootDirOpt(path)).Submodules()
+	if err != nil {
+		return nil, err
+	}
+	info := &submoduleInfo{Count: len(submodules)}
+	for _, s := range submodules {
+		if !s.Initialized {
+			info.Uninitialized = append(info.Uninitialized, s.Path)
+		} else if s.OutOfDate {
+			info.OutOfDate = append(info.OutOfDate, s.Path)
+		}
+	}
+	return info, nil
+}
+
+// projectTarget returns whether the manifest project p is pinned to a
+// revision, and the revision or remote branch it is updated to.
+func projectTarget(p project.Project) (bool, string) {
+	if p.Revision != "" && p.Revision != "HEAD" {
+		return true, p.Revision
+	}
+	if p.RemoteBranch != "" {
+		return false, p.RemoteBranch
+	}
+	return false, "master"
+}
+
+// needsManifestTarget returns whether the output of "jiri project" includes
+// the Pinned and Target fields, which are read from the manifest.
+func needsManifestTarget() bool {
+	return jsonOutputFlag != "" || strings.Contains(templateFlag, ".Pinned") || strings.Contains(templateFlag, ".Target")
 }
 
 // runProjectInfo provides structured info on local projects.
 func runProjectInfo(jirix *jiri.X, args []string) error {
 	var tmpl *template.Template
 	var err error
+	if treeFlag && templateFlag != "" {
+		return jirix.UsageErrorf("-tree and -template cannot be used together")
+	}
 	if templateFlag != "" {
 		tmpl, err = template.New("info").Parse(templateFlag)
 		if err != nil {
@@ -192,6 +666,56 @@ func runProjectInfo(jirix *jiri.X, args []string) error {
 	}
 	sort.Sort(keys)
 
+	containing := map[project.ProjectKey][]string{}
+	if branchesContainsFlag != "" {
+		work := make(chan project.ProjectKey, len(keys))
+		for _, key := range keys {
+			work <- key
+		}
+		close(work)
+		var mu sync.Mutex
+		var errs MultiError
+		var wg sync.WaitGroup
+		for i := uint(0); i < jirix.Jobs; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for key := range work {
+					state := states[key]
+					branches, ok, err := branchesContaining(jirix, state.Project.Path, branchesContainsFlag)
+					mu.Lock()
+					if err != nil {
+						errs = append(errs, fmt.Errorf("failed to list branches of project %s(%s): %v", state.Project.Name, state.Project.Path, err))
+					} else if ok {
+						containing[key] = branches
+					}
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+		if len(errs) != 0 {
+			return errs
+		}
+		var found project.ProjectKeys
+		for _, key := range keys {
+			if _, ok := containing[key]; ok {
+				found = append(found, key)
+			}
+		}
+		keys = found
+	}
+
+	// Loading the manifest is slow, only do it when the pinned state of
+	// projects is output.
+	var manifestProjects project.Projects
+	if needsManifestTarget() {
+		manifestProjects, _, _, err = project.LoadManifestFile(jirix, jirix.JiriManifestFile(), projects, false /*localManifest*/)
+		if err != nil {
+			jirix.Logger.Warningf("Unable to load manifest, pinned state of projects will not be reported: %v\n\n", err)
+		}
+	}
+
 	info := make([]infoOutput, len(keys))
 	for i, key := range keys {
 		state := states[key]
@@ -201,18 +725,31 @@ func runProjectInfo(jirix *jiri.X, args []string) error {
 			panic(err)
 		}
 		info[i] = infoOutput{
-			Name:          state.Project.Name,
-			Path:          state.Project.Path,
-			RelativePath:  rp,
-			Remote:        state.Project.Remote,
-			Revision:      state.Project.Revision,
-			CurrentBranch: state.CurrentBranch.Name,
+			Name:               state.Project.Name,
+			Path:               state.Project.Path,
+			RelativePath:       rp,
+			Remote:             state.Project.Remote,
+			Revision:           state.Project.Revision,
+			CurrentBranch:      state.CurrentBranch.Name,
+			ContainingBranches: containing[key],
 		}
 		for _, b := range state.Branches {
 			info[i].Branches = append(info[i].Branches, b.Name)
 		}
+		if p, ok := manifestProjects[key]; ok {
+			info[i].Pinned, info[i].Target = projectTarget(p)
+		}
+		if submodulesFlag {
+			if info[i].Submodules, err = getSubmoduleInfo(jirix, state.Project.Path); err != nil {
+				return fmt.Errorf("failed to get submodules of project %s(%s): %v", state.Project.Name, state.Project.Path, err)
+			}
+		}
 	}
 
+	if treeFlag {
+		printProjectTree(os.Stdout, info)
+		return nil
+	}
 	for _, i := range info {
 		if templateFlag != "" {
 			out := &bytes.Buffer{}
@@ -243,6 +780,22 @@ func runProjectInfo(jirix *jiri.X, args []string) error {
 			} else {
 				fmt.Printf("  Branches: none\n")
 			}
+			if branchesContainsFlag != "" {
+				fmt.Printf("  Branches containing %s: %s\n", branchesContainsFlag, strings.Join(i.ContainingBranches, ", "))
+			}
+			if i.Submodules != nil {
+				fmt.Printf("  Submodules: %d", i.Submodules.Count)
+				if marker := i.Submodules.Marker(); marker != "" {
+					fmt.Printf(" [%s]", marker)
+				}
+				fmt.Println()
+				if len(i.Submodules.Uninitialized) != 0 {
+					fmt.Printf("    uninitialized: %s\n", strings.Join(i.Submodules.Uninitialized, ", "))
+				}
+				if len(i.Submodules.OutOfDate) != 0 {
+					fmt.Printf("    out of date:   %s\n", strings.Join(i.Submodules.OutOfDate, ", "))
+				}
+			}
 		}
 	}
 
@@ -255,6 +808,36 @@ func runProjectInfo(jirix *jiri.X, args []string) error {
 	return nil
 }
 
+// branchesContaining returns the local and remote branches of the project at
+// path which contain commit. The boolean is false if commit is not a commit
+// of the project or no branch contains it.
+func branchesContaining(jirix *jiri.X, path, commit string) ([]string, bool, error) {
+	scm := gitutil.New(jirix, gitutil.RootDirOpt(path))
+	if _, err := scm.CurrentRevisionForRef(commit + "^{commit}"); err != nil {
+		return nil, false, nil
+	}
+	local, err := scm.ListBranchesContainingRef(commit)
+	if err != nil {
+		return nil, false, err
+	}
+	remote, err := scm.ListRemoteBranchesContainingRef(commit)
+	if err != nil {
+		return nil, false, err
+	}
+	var branches []string
+	for b := range local {
+		branches = append(branches, b)
+	}
+	for b := range remote {
+		// Skip symbolic refs such as "origin/HEAD -> origin/master".
+		if !strings.Contains(b, " -> ") {
+			branches = append(branches, b)
+		}
+	}
+	sort.Strings(branches)
+	return branches, len(branches) > 0, nil
+}
+
 func writeJSONOutput(result interface{}) error {
 	out, err := json.MarshalIndent(&result, "", "  ")
 	if err != nil {
@@ -268,3 +851,83 @@ func writeJSONOutput(result interface{}) error {
 
 	return nil
 }
+
+// projectTreeNode is a directory in the tree printed by "jiri project -tree".
+type projectTreeNode struct {
+	name     string
+	info     *infoOutput
+	children map[string]*projectTreeNode
+}
+
+func newProjectTreeNode(name string) *projectTreeNode {
+	return &projectTreeNode{name: name, children: map[string]*projectTreeNode{}}
+}
+
+// printProjectTree prints projects indented by the directory hierarchy of their
+// paths relative to the root. Directories which are not projects themselves
+// are only printed where paths diverge, and projects outside of the root are
+// printed at the top level using their full relative path.
+func printProjectTree(w io.Writer, info []infoOutput) {
+	root := newProjectTreeNode("")
+	for i := range info {
+		rp := filepath.ToSlash(info[i].RelativePath)
+		node := root
+		if rp != "." {
+			components := strings.Split(rp, "/")
+			if components[0] == ".." {
+				components = []string{rp}
+			}
+			for _, c := range components {
+				child, ok := node.children[c]
+				if !ok {
+					child = newProjectTreeNode(c)
+					node.children[c] = child
+				}
+				node = child
+			}
+		}
+		node.info = &info[i]
+	}
+	if root.info != nil {
+		root.name = "."
+		root.print(w, "")
+		return
+	}
+	root.printChildren(w, "")
+}
+
+func (n *projectTreeNode) print(w io.Writer, indent string) {
+	// Collapse chains of directories which contain a single entry and are not
+	// projects themselves.
+	name := n.name
+	for n.info == nil && len(n.children) == 1 {
+		for _, child := range n.children {
+			n = child
+		}
+		name += "/" + n.name
+	}
+	if n.info == nil {
+		fmt.Fprintf(w, "%s%s/\n", indent, name)
+	} else {
+		fmt.Fprintf(w, "%s%s (%s)\n", indent, name, n.info.Name)
+		for _, b := range n.info.Branches {
+			fmt.Fprintf(w, "%s  branch: %s", indent, b)
+			if b == n.info.CurrentBranch {
+				fmt.Fprintf(w, " (current)")
+			}
+			fmt.Fprintln(w)
+		}
+	}
+	n.printChildren(w, indent+"  ")
+}
+
+func (n *projectTreeNode) printChildren(w io.Writer, indent string) {
+	names := make([]string, 0, len(n.children))
+	for name := range n.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		n.children[name].print(w, indent)
+	}
+}
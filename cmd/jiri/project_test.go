@@ -0,0 +1,482 @@
+// Copyright 2019 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dahlia-os/jiri"
+	"github.com/dahlia-os/jiri/gitutil"
+	"github.com/dahlia-os/jiri/jiritest"
+	"github.com/dahlia-os/jiri/project"
+	"github.com/dahlia-os/jiri/tool"
+)
+
+func TestPrintProjectTree(t *testing.T) {
+	info := []infoOutput{
+		{Name: "a", RelativePath: "a"},
+		{Name: "a-c", RelativePath: "a/b/c", Branches: []string{"feature", "master"}, CurrentBranch: "master"},
+		{Name: "a-d", RelativePath: "a/b/d"},
+		{Name: "e-f", RelativePath: "e/f"},
+		{Name: "g", RelativePath: "g"},
+		{Name: "outside", RelativePath: "../outside"},
+	}
+	want := `../outside (outside)
+a (a)
+  b/
+    c (a-c)
+      branch: feature
+      branch: master (current)
+    d (a-d)
+e/f (e-f)
+g (g)
+`
+	var buf bytes.Buffer
+	printProjectTree(&buf, info)
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	// A project at the root contains all other projects.
+	info = append(info, infoOutput{Name: "root", RelativePath: "."})
+	want = `. (root)
+  ../outside (outside)
+  a (a)
+    b/
+      c (a-c)
+        branch: feature
+        branch: master (current)
+      d (a-d)
+  e/f (e-f)
+  g (g)
+`
+	buf.Reset()
+	printProjectTree(&buf, info)
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestProjectInfoPinned(t *testing.T) {
+	fake, cleanup := jiritest.NewFakeJiriRoot(t)
+	defer cleanup()
+
+	revisions := map[string]string{}
+	for _, name := range []string{"pinned", "tracking"} {
+		if err := fake.CreateRemoteProject(name); err != nil {
+			t.Fatal(err)
+		}
+		remote := fake.Projects[name]
+		if err := ioutil.WriteFile(filepath.Join(remote, "README"), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		git := gitutil.New(fake.X, gitutil.UserNameOpt("John Doe"), gitutil.UserEmailOpt("john.doe@example.com"), gitutil.RootDirOpt(remote))
+		if err := git.CommitFile("README", "add README"); err != nil {
+			t.Fatal(err)
+		}
+		rev, err := git.CurrentRevision()
+		if err != nil {
+			t.Fatal(err)
+		}
+		revisions[name] = rev
+	}
+	if err := fake.AddProject(project.Project{
+		Name:     "pinned",
+		Path:     filepath.Join(fake.X.Root, "pinned"),
+		Remote:   fake.Projects["pinned"],
+		Revision: revisions["pinned"],
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.AddProject(project.Project{
+		Name:         "tracking",
+		Path:         filepath.Join(fake.X.Root, "tracking"),
+		Remote:       fake.Projects["tracking"],
+		RemoteBranch: "master",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+
+	jsonFile := filepath.Join(fake.X.Root, "info.json")
+	jsonOutputFlag = jsonFile
+	defer func() {
+		jsonOutputFlag = ""
+	}()
+	if err := runProjectInfo(fake.X, []string{"pinned", "tracking"}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(jsonFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var info []infoOutput
+	if err := json.Unmarshal(data, &info); err != nil {
+		t.Fatal(err)
+	}
+	if len(info) != 2 {
+		t.Fatalf("got info for %d projects, want 2: %+v", len(info), info)
+	}
+	for _, i := range info {
+		switch i.Name {
+		case "pinned":
+			if !i.Pinned || i.Target != revisions["pinned"] {
+				t.Errorf("project %q: got pinned %v target %q, want pinned true target %q", i.Name, i.Pinned, i.Target, revisions["pinned"])
+			}
+		case "tracking":
+			if i.Pinned || i.Target != "master" {
+				t.Errorf("project %q: got pinned %v target %q, want pinned false target %q", i.Name, i.Pinned, i.Target, "master")
+			}
+		}
+	}
+}
+
+func TestProjectCleanSkipBulk(t *testing.T) {
+	fake, cleanup := jiritest.NewFakeJiriRoot(t)
+	defer cleanup()
+	addProjects(t, fake)
+	markSkipBulk(t, fake, "r.b")
+	defer func() {
+		cleanupFlag = false
+		allFlag = false
+	}()
+
+	untracked := map[string]string{}
+	for _, name := range []string{"r.a", "r.b"} {
+		untracked[name] = filepath.Join(fake.X.Root, name, "untracked")
+		if err := ioutil.WriteFile(untracked[name], nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cleanupFlag = true
+	if err := runProject(fake.X, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(untracked["r.a"]); !os.IsNotExist(err) {
+		t.Errorf("expected %s to be removed, got %v", untracked["r.a"], err)
+	}
+	if _, err := os.Stat(untracked["r.b"]); err != nil {
+		t.Errorf("expected skipbulk project r.b not to be cleaned: %v", err)
+	}
+
+	allFlag = true
+	if err := runProject(fake.X, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(untracked["r.b"]); !os.IsNotExist(err) {
+		t.Errorf("expected %s to be removed with -all, got %v", untracked["r.b"], err)
+	}
+}
+
+func TestProjectRecover(t *testing.T) {
+	fake, cleanup := jiritest.NewFakeJiriRoot(t)
+	defer cleanup()
+	projects := addProjects(t, fake)
+	defer func() {
+		recoverFlag = false
+		recreateFlag = false
+	}()
+
+	local := projects[0]
+	git := gitutil.New(fake.X, gitutil.RootDirOpt(local.Path), gitutil.UserNameOpt("John Doe"), gitutil.UserEmailOpt("john.doe@example.com"))
+	if err := git.CreateAndCheckoutBranch("feature"); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, fake.X, local.Path, "feature", "feature work")
+	tip, err := git.CurrentRevision()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := git.CheckoutBranch("master"); err != nil {
+		t.Fatal(err)
+	}
+	// Branches which still exist are not reported.
+	if err := git.CreateBranch("kept"); err != nil {
+		t.Fatal(err)
+	}
+	if err := git.CheckoutBranch("kept"); err != nil {
+		t.Fatal(err)
+	}
+	if err := git.CheckoutBranch("master"); err != nil {
+		t.Fatal(err)
+	}
+	if err := git.DeleteBranch("feature", gitutil.ForceOpt(true)); err != nil {
+		t.Fatal(err)
+	}
+
+	recoverFlag = true
+	run := func() string {
+		var runErr error
+		stdout, _, err := runfunc(func() {
+			runErr = runProject(fake.X, []string{local.Name})
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if runErr != nil {
+			t.Fatal(runErr)
+		}
+		return stdout
+	}
+	want := "r.a:\n  feature " + tip[:7] + " feature work\n"
+	if got := run(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	recreateFlag = true
+	run()
+	if got, err := git.CurrentRevisionForRef("feature"); err != nil || got != tip {
+		t.Errorf("got feature at %q, %v, want %q", got, err, tip)
+	}
+	recreateFlag = false
+	if got := run(); got != "" {
+		t.Errorf("got %q after re-creating the branch, want no output", got)
+	}
+}
+
+func TestProjectVerify(t *testing.T) {
+	fake, cleanup := jiritest.NewFakeJiriRoot(t)
+	defer cleanup()
+	projects := addProjects(t, fake)
+	defer func() {
+		verifyFlag = false
+		fixFlag = false
+	}()
+
+	// Commit a file and lose its content, which is a loose object.
+	corrupt := projects[0]
+	writeFile(t, fake.X, corrupt.Path, "local", "local change")
+	cmd := exec.Command("git", "rev-parse", "HEAD:local")
+	cmd.Dir = corrupt.Path
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob := strings.TrimSpace(string(out))
+	if err := os.Remove(filepath.Join(corrupt.Path, ".git", "objects", blob[:2], blob[2:])); err != nil {
+		t.Fatal(err)
+	}
+
+	verifyFlag = true
+	run := func(stdin string) (string, error) {
+		jirix := fake.X.Clone(tool.ContextOpts{Stdin: strings.NewReader(stdin)})
+		var runErr error
+		stdout, _, err := runfunc(func() { runErr = runProject(jirix, nil) })
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stdout, runErr
+	}
+	if stdout, err := run(""); err == nil {
+		t.Errorf("expected an error for the corrupt project")
+	} else if stdout != "r.a\n" {
+		t.Errorf("got %q, want only the corrupt project r.a to be reported", stdout)
+	}
+
+	// Declining to re-clone leaves the project alone.
+	fixFlag = true
+	if _, err := run("n\n"); err == nil {
+		t.Errorf("expected an error when not re-cloning the corrupt project")
+	}
+	git := gitutil.New(fake.X, gitutil.RootDirOpt(corrupt.Path))
+	if err := git.Fsck(); err == nil {
+		t.Fatalf("expected r.a to still be corrupt")
+	}
+
+	if _, err := run("y\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := git.Fsck(); err != nil {
+		t.Errorf("expected r.a to be fixed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(corrupt.Path, "local")); err != nil {
+		t.Errorf("expected the working tree of r.a to be kept: %v", err)
+	}
+	fixFlag = false
+	if stdout, err := run(""); err != nil || stdout != "" {
+		t.Errorf("got %q, %v after re-cloning, want no corrupt projects", stdout, err)
+	}
+}
+
+func TestProjectInfoBranchesContains(t *testing.T) {
+	fake, cleanup := jiritest.NewFakeJiriRoot(t)
+	defer cleanup()
+	localProjects := createProjects(t, fake, 3)
+	// A change which landed upstream in project-1 only.
+	writeFile(t, fake.X, fake.Projects[localProjects[1].Name], "fix", "upstream fix")
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	upstreamFix, err := gitutil.New(fake.X, gitutil.RootDirOpt(fake.Projects[localProjects[1].Name])).CurrentRevision()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A change on a local branch of project-0.
+	git := gitutil.New(fake.X, gitutil.RootDirOpt(localProjects[0].Path))
+	if err := git.CreateAndCheckoutBranch("fix"); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, fake.X, localProjects[0].Path, "fix", "local fix")
+	localFix, err := git.CurrentRevision()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A change on the detached HEAD of project-2, which no branch contains.
+	writeFile(t, fake.X, localProjects[2].Path, "fix", "detached fix")
+	detachedFix, err := gitutil.New(fake.X, gitutil.RootDirOpt(localProjects[2].Path)).CurrentRevision()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		branchesContainsFlag, templateFlag = "", ""
+	}()
+	templateFlag = "{{.Name}}: {{.ContainingBranches}}"
+	for _, test := range []struct {
+		commit, want string
+	}{
+		{localFix[:7], "project-0: [fix]"},
+		{upstreamFix, "project-1: [origin/master]"},
+		{detachedFix, ""},
+		{"0123456789abcdef", ""},
+	} {
+		branchesContainsFlag = test.commit
+		var runErr error
+		stdout, _, err := runfunc(func() { runErr = runProjectInfo(fake.X, nil) })
+		if err != nil {
+			t.Fatal(err)
+		}
+		if runErr != nil {
+			t.Fatal(runErr)
+		}
+		if got := strings.TrimSpace(stdout); got != test.want {
+			t.Errorf("-branches-contains %s: got %q, want %q", test.commit, got, test.want)
+		}
+	}
+}
+
+func TestProjectInfoSubmodules(t *testing.T) {
+	// Recent versions of git refuse to clone submodules from local paths.
+	for key, value := range map[string]string{
+		"GIT_CONFIG_COUNT":   "1",
+		"GIT_CONFIG_KEY_0":   "protocol.file.allow",
+		"GIT_CONFIG_VALUE_0": "always",
+	} {
+		os.Setenv(key, value)
+		defer os.Unsetenv(key)
+	}
+	fake, cleanup := jiritest.NewFakeJiriRoot(t)
+	defer cleanup()
+	localProjects := createProjects(t, fake, 2)
+	super, sub := localProjects[0], localProjects[1]
+	writeFile(t, fake.X, fake.Projects[sub.Name], "file", "submodule file")
+	git := func(dir string, args ...string) {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v: %s", args, err, out)
+		}
+	}
+	superRemote := fake.Projects[super.Name]
+	git(superRemote, "submodule", "add", "file://"+fake.Projects[sub.Name], "sub")
+	git(superRemote, "-c", "user.name=John Doe", "-c", "user.email=john.doe@example.com", "commit", "-m", "add submodule")
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		submodulesFlag, templateFlag = false, ""
+	}()
+	submodulesFlag = true
+	templateFlag = "{{.Name}} {{.Submodules.Count}} {{.Submodules.Uninitialized}} {{.Submodules.OutOfDate}} {{.Submodules.Marker}}"
+	check := func(want string) {
+		t.Helper()
+		var runErr error
+		stdout, _, err := runfunc(func() { runErr = runProjectInfo(fake.X, []string{super.Name}) })
+		if err != nil {
+			t.Fatal(err)
+		}
+		if runErr != nil {
+			t.Fatal(runErr)
+		}
+		if got := strings.TrimSpace(stdout); got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+
+	// Submodules are not initialized by jiri update without gitsubmodules.
+	check("project-0 1 [sub] [] -")
+	git(super.Path, "submodule", "update", "--init")
+	check("project-0 1 [] []")
+	// A commit in the submodule makes it out of date.
+	writeFile(t, fake.X, filepath.Join(super.Path, "sub"), "file", "changed")
+	check("project-0 1 [] [sub] +")
+}
+
+func TestProjectLastUpdate(t *testing.T) {
+	fake, cleanup := jiritest.NewFakeJiriRoot(t)
+	defer cleanup()
+	projects := addProjects(t, fake)
+	defer func() {
+		lastUpdateFlag = false
+		byAgeFlag = false
+	}()
+
+	metadataFile := func(p *project.Project) string {
+		return filepath.Join(p.Path, jiri.ProjectMetaDir, jiri.ProjectMetaFile)
+	}
+	updated, err := project.ProjectFromFile(fake.X, metadataFile(projects[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if age := time.Since(updated.LastUpdateTime()); age < 0 || age > time.Hour {
+		t.Errorf("got last update %q, want the time of the update", updated.LastUpdate)
+	}
+
+	// Metadata written by older versions of jiri has no update time.
+	for p, lastUpdate := range map[*project.Project]string{
+		projects[1]: "",
+		projects[2]: "2000-01-01T00:00:00Z",
+	} {
+		local, err := project.ProjectFromFile(fake.X, metadataFile(p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		local.LastUpdate = lastUpdate
+		if err := local.ToFile(fake.X, metadataFile(p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lastUpdateFlag = true
+	byAgeFlag = true
+	var runErr error
+	stdout, _, err := runfunc(func() { runErr = runProject(fake.X, []string{"r.a", "r.b", "r.c"}) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runErr != nil {
+		t.Fatal(runErr)
+	}
+	var got []string
+	for _, line := range strings.Split(strings.TrimSpace(stdout), "\n")[1:] {
+		fields := strings.Fields(line)
+		got = append(got, fields[0]+" "+fields[len(fields)-1])
+	}
+	want := []string{"r.b unknown", "r.c " + formatAge(time.Since(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))), "r.a 0m"}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
@@ -5,7 +5,15 @@
 package main
 
 import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
 	"github.com/dahlia-os/jiri"
+	"github.com/dahlia-os/jiri/cipd"
 	"github.com/dahlia-os/jiri/cmdline"
 	"github.com/dahlia-os/jiri/project"
 )
@@ -15,8 +23,13 @@ var resolveFlags struct {
 	localManifestFlag bool
 	enablePackageLock bool
 	enableProjectLock bool
+	dryRun            bool
 }
 
+// describeInstance looks up the refs and tags of a cipd package instance. It
+// is replaced in tests.
+var describeInstance = cipd.Describe
+
 var cmdResolve = &cmdline.Command{
 	Runner: jiri.RunnerFunc(runResolve),
 	Name:   "resolve",
@@ -24,6 +37,14 @@ var cmdResolve = &cmdline.Command{
 	Long: `
 Generate jiri lockfile in json format for <manifest ...>. If no manifest
 provided, jiri will use .jiri_manifest by default.
+
+With -dry-run, the lockfile is not written. Instead, the changes to the
+existing lockfile at the -output path are printed: the projects whose
+revisions change and the packages whose instance IDs change, along with the
+packages and projects that are added or removed. Where cipd can describe them,
+the refs and tags attached to the old and new instances of a package, such as
+"latest" or "version:1.2.3", are printed next to their IDs, so that the change
+can be understood without looking the IDs up.
 `,
 	ArgsName: "<manifest ...>",
 	ArgsLong: "<manifest ...> is a list of manifest files for lockfile generation",
@@ -35,6 +56,7 @@ func init() {
 	flags.BoolVar(&resolveFlags.localManifestFlag, "local-manifest", false, "Use local manifest")
 	flags.BoolVar(&resolveFlags.enablePackageLock, "enable-package-lock", true, "Enable resolving packages in lockfile")
 	flags.BoolVar(&resolveFlags.enableProjectLock, "enable-project-lock", false, "Enable resolving projects in lockfile")
+	flags.BoolVar(&resolveFlags.dryRun, "dry-run", false, "Print the changes to the lockfile instead of writing it")
 }
 
 func runResolve(jirix *jiri.X, args []string) error {
@@ -55,5 +77,103 @@ func runResolve(jirix *jiri.X, args []string) error {
 	// Jiri will halt when detecting conflicts in locks. So to make it work,
 	// we need to temporarily disable the conflicts detection.
 	jirix.IgnoreLockConflicts = true
+	if resolveFlags.dryRun {
+		return runResolveDryRun(jirix, manifestFiles)
+	}
 	return project.GenerateJiriLockFile(jirix, manifestFiles, resolveFlags.lockFilePath, resolveFlags.enableProjectLock, resolveFlags.enablePackageLock, resolveFlags.localManifestFlag)
 }
+
+func runResolveDryRun(jirix *jiri.X, manifestFiles []string) error {
+	projectLocks, pkgLocks, err := project.ResolveLocks(jirix, manifestFiles, resolveFlags.enableProjectLock, resolveFlags.enablePackageLock, resolveFlags.localManifestFlag)
+	if err != nil {
+		return err
+	}
+	var oldProjectLocks project.ProjectLocks
+	var oldPkgLocks project.PackageLocks
+	if data, err := ioutil.ReadFile(resolveFlags.lockFilePath); err == nil {
+		if oldProjectLocks, oldPkgLocks, err = project.UnmarshalLockEntries(data); err != nil {
+			return fmt.Errorf("failed to parse lockfile %q: %v", resolveFlags.lockFilePath, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if !printLockChanges(jirix, jirix.Stdout(), oldProjectLocks, projectLocks, oldPkgLocks, pkgLocks) {
+		fmt.Fprintf(jirix.Stdout(), "No changes to %s\n", resolveFlags.lockFilePath)
+	}
+	return nil
+}
+
+// printLockChanges prints the differences between the old and new locks to
+// w, projects first and then packages, each sorted by name. It returns false
+// if there are none.
+func printLockChanges(jirix *jiri.X, w io.Writer, oldProjectLocks, newProjectLocks project.ProjectLocks, oldPkgLocks, newPkgLocks project.PackageLocks) bool {
+	changed := false
+	var projectKeys []string
+	for key := range oldProjectLocks {
+		projectKeys = append(projectKeys, string(key))
+	}
+	for key := range newProjectLocks {
+		if _, ok := oldProjectLocks[key]; !ok {
+			projectKeys = append(projectKeys, string(key))
+		}
+	}
+	sort.Strings(projectKeys)
+	for _, key := range projectKeys {
+		oldLock, inOld := oldProjectLocks[project.ProjectLockKey(key)]
+		newLock, inNew := newProjectLocks[project.ProjectLockKey(key)]
+		switch {
+		case !inOld:
+			fmt.Fprintf(w, "project %s: added at %s\n", newLock.Name, newLock.Revision)
+		case !inNew:
+			fmt.Fprintf(w, "project %s: removed, was at %s\n", oldLock.Name, oldLock.Revision)
+		case oldLock.Revision != newLock.Revision:
+			fmt.Fprintf(w, "project %s: %s -> %s\n", newLock.Name, oldLock.Revision, newLock.Revision)
+		default:
+			continue
+		}
+		changed = true
+	}
+
+	var pkgKeys []string
+	for key := range oldPkgLocks {
+		pkgKeys = append(pkgKeys, string(key))
+	}
+	for key := range newPkgLocks {
+		if _, ok := oldPkgLocks[key]; !ok {
+			pkgKeys = append(pkgKeys, string(key))
+		}
+	}
+	sort.Strings(pkgKeys)
+	for _, key := range pkgKeys {
+		oldLock, inOld := oldPkgLocks[project.PackageLockKey(key)]
+		newLock, inNew := newPkgLocks[project.PackageLockKey(key)]
+		switch {
+		case !inOld:
+			fmt.Fprintf(w, "package %s: added %s\n", key, describePackageLock(jirix, newLock))
+		case !inNew:
+			fmt.Fprintf(w, "package %s: removed %s\n", key, describePackageLock(jirix, oldLock))
+		case oldLock.InstanceID != newLock.InstanceID:
+			fmt.Fprintf(w, "package %s: %s -> %s\n", key, describePackageLock(jirix, oldLock), describePackageLock(jirix, newLock))
+		default:
+			continue
+		}
+		changed = true
+	}
+	return changed
+}
+
+// describePackageLock returns the instance ID of lock followed by the refs
+// and tags attached to the instance, or only the instance ID if cipd cannot
+// describe it.
+func describePackageLock(jirix *jiri.X, lock project.PackageLock) string {
+	info, err := describeInstance(jirix, lock.PackageName, lock.InstanceID)
+	if err != nil {
+		jirix.Logger.Debugf("Not able to describe instance %s of package %s: %s", lock.InstanceID, lock.PackageName, err)
+		return lock.InstanceID
+	}
+	names := append(append([]string{}, info.Refs...), info.Tags...)
+	if len(names) == 0 {
+		return lock.InstanceID
+	}
+	return fmt.Sprintf("%s (%s)", lock.InstanceID, strings.Join(names, ", "))
+}
@@ -5,9 +5,13 @@
 package main
 
 import (
+	"bytes"
+	"fmt"
 	"io/ioutil"
 	"testing"
 
+	"github.com/dahlia-os/jiri"
+	"github.com/dahlia-os/jiri/cipd"
 	"github.com/dahlia-os/jiri/jiritest"
 	"github.com/dahlia-os/jiri/project"
 )
@@ -110,3 +114,73 @@ func TestResolvePackages(t *testing.T) {
 		}
 	}
 }
+
+func TestResolveDryRunChangelog(t *testing.T) {
+	fake, cleanup := jiritest.NewFakeJiriRoot(t)
+	defer cleanup()
+
+	// The mock cipd client knows both instances of gn, but not the one of
+	// clang.
+	descriptions := map[string]cipd.InstanceInfo{
+		"gn/gn/linux-amd64@old": {Tags: []string{"version:1.0"}},
+		"gn/gn/linux-amd64@new": {Refs: []string{"latest"}, Tags: []string{"version:1.1"}},
+	}
+	defer func(describe func(*jiri.X, string, string) (cipd.InstanceInfo, error)) {
+		describeInstance = describe
+	}(describeInstance)
+	describeInstance = func(jirix *jiri.X, pkg, instanceID string) (cipd.InstanceInfo, error) {
+		info, ok := descriptions[pkg+"@"+instanceID]
+		if !ok {
+			return cipd.InstanceInfo{}, fmt.Errorf("instance %s of %s not found", instanceID, pkg)
+		}
+		return info, nil
+	}
+
+	pkgLocks := func(locks ...project.PackageLock) project.PackageLocks {
+		result := make(project.PackageLocks)
+		for _, lock := range locks {
+			result[lock.Key()] = lock
+		}
+		return result
+	}
+	projectLocks := func(locks ...project.ProjectLock) project.ProjectLocks {
+		result := make(project.ProjectLocks)
+		for _, lock := range locks {
+			result[lock.Key()] = lock
+		}
+		return result
+	}
+	oldPkgs := pkgLocks(
+		project.PackageLock{PackageName: "gn/gn/linux-amd64", InstanceID: "old"},
+		project.PackageLock{PackageName: "fuchsia/clang/linux-amd64", InstanceID: "clang-old"},
+		project.PackageLock{PackageName: "unchanged/linux-amd64", InstanceID: "same"},
+	)
+	newPkgs := pkgLocks(
+		project.PackageLock{PackageName: "gn/gn/linux-amd64", InstanceID: "new"},
+		project.PackageLock{PackageName: "fuchsia/clang/linux-amd64", InstanceID: "clang-new"},
+		project.PackageLock{PackageName: "unchanged/linux-amd64", InstanceID: "same"},
+	)
+	oldProjects := projectLocks(project.ProjectLock{Remote: "https://example.com/a", Name: "a", Revision: "1111"})
+	newProjects := projectLocks(
+		project.ProjectLock{Remote: "https://example.com/a", Name: "a", Revision: "2222"},
+		project.ProjectLock{Remote: "https://example.com/b", Name: "b", Revision: "3333"},
+	)
+
+	var buf bytes.Buffer
+	if !printLockChanges(fake.X, &buf, oldProjects, newProjects, oldPkgs, newPkgs) {
+		t.Fatalf("expected changes to be reported")
+	}
+	want := `project a: 1111 -> 2222
+project b: added at 3333
+package fuchsia/clang/linux-amd64: clang-old -> clang-new
+package gn/gn/linux-amd64: old (version:1.0) -> new (latest, version:1.1)
+`
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	buf.Reset()
+	if printLockChanges(fake.X, &buf, newProjects, newProjects, newPkgs, newPkgs) || buf.Len() != 0 {
+		t.Errorf("got changes %q for identical locks, want none", buf.String())
+	}
+}
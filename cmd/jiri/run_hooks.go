@@ -5,6 +5,8 @@
 package main
 
 import (
+	"time"
+
 	"github.com/dahlia-os/jiri"
 	"github.com/dahlia-os/jiri/cmdline"
 	"github.com/dahlia-os/jiri/project"
@@ -14,7 +16,9 @@ var runHooksFlags struct {
 	localManifest bool
 	hookTimeout   uint
 	attempts      uint
+	retryBackoff  time.Duration
 	fetchPackages bool
+	logHooks      bool
 }
 
 var cmdRunHooks = &cmdline.Command{
@@ -24,6 +28,10 @@ var cmdRunHooks = &cmdline.Command{
 	Long: `
 Run hooks using local manifest JIRI_HEAD version if -local-manifest flag is
 false, else it runs hooks using current manifest checkout version.
+
+With -log-hooks the combined output of each hook is also written to
+.jiri_root/hook_logs/<project>/<hook>.log. The logs of the previous run are
+removed first.
 `,
 }
 
@@ -31,7 +39,9 @@ func init() {
 	cmdRunHooks.Flags.BoolVar(&runHooksFlags.localManifest, "local-manifest", false, "Use local checked out manifest.")
 	cmdRunHooks.Flags.UintVar(&runHooksFlags.hookTimeout, "hook-timeout", project.DefaultHookTimeout, "Timeout in minutes for running the hooks operation.")
 	cmdRunHooks.Flags.UintVar(&runHooksFlags.attempts, "attempts", 1, "Number of attempts before failing.")
+	cmdRunHooks.Flags.DurationVar(&runHooksFlags.retryBackoff, "retry-backoff", jiri.DefaultRetryBackoff, "Delay before the first retry of a failed network operation, doubling for every further retry.")
 	cmdRunHooks.Flags.BoolVar(&runHooksFlags.fetchPackages, "fetch-packages", true, "Use fetching packages using jiri.")
+	cmdRunHooks.Flags.BoolVar(&runHooksFlags.logHooks, "log-hooks", false, "Write the output of each hook to .jiri_root/hook_logs/<project>/<hook>.log.")
 }
 
 func runHooks(jirix *jiri.X, args []string) (err error) {
@@ -43,6 +53,8 @@ func runHooks(jirix *jiri.X, args []string) (err error) {
 		return jirix.UsageErrorf("Number of attempts should be >= 1")
 	}
 	jirix.Attempts = runHooksFlags.attempts
+	jirix.RetryBackoff = runHooksFlags.retryBackoff
+	jirix.LogHooks = runHooksFlags.logHooks
 
 	// Get hooks.
 	var hooks project.Hooks
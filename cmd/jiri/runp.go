@@ -6,16 +6,20 @@ package main
 
 import (
 	"bufio"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"os/signal"
+	"path/filepath"
 	"regexp"
 	"sort"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/dahlia-os/jiri"
 	"github.com/dahlia-os/jiri/cmdline"
@@ -40,6 +44,12 @@ var runpFlags struct {
 	collateOutput  bool
 	branch         string
 	remote         string
+	cwd            string
+	manifestRepos  bool
+	timestamp      string
+	all            bool
+	jsonOutput     string
+	jobs           uint
 }
 
 var cmdRunP = &cmdline.Command{
@@ -49,6 +59,37 @@ var cmdRunP = &cmdline.Command{
 	Long: `Run a command in parallel across one or more jiri projects. Commands are run
 using the shell specified by the users $SHELL environment variable, or "sh"
 if that's not set. Thus commands are run as $SHELL -c "args..."
+
+With -include-manifest-repos, the repositories holding the manifests that
+.jiri_manifest imports are added to the projects, following <import> tags
+through every imported manifest. These repositories are usually declared as
+projects as well; the flag matters when they are not, but are still checked
+out under the root, e.g. by an earlier 'jiri update'. Imported repositories
+which are not checked out are skipped with a warning, together with the
+manifests they import, as runp never clones anything. Files pulled in with
+<localimport> live in repositories that are already included and add nothing.
+
+With -json-output, the result of the command in each project is also written
+to the given file as a JSON array, sorted by project key. Each entry holds
+the name, key and path of the project, the command line, its exit code and
+duration in milliseconds, and the last 64KiB of its stdout and stderr. The
+output is captured in addition to being printed as usual, except with
+-interactive, where only exit codes and durations are recorded.
+
+With -jobs, at most the given number of commands run at once, which keeps
+CPU-heavy commands such as builds from overwhelming the machine. It defaults
+to the global -j flag. Output is collated or prefixed as usual regardless.
+With -exit-on-error, the commands still running are stopped once one fails,
+and those of the remaining projects are not started.
+
+Each command runs in its own process group. When runp is interrupted, or
+terminated with SIGTERM, the signal is forwarded to the process groups of the
+commands which are running, along with all the processes they started.
+Processes still running 5 seconds later, such as those which ignore the
+signal, are killed. Commands stopped for -exit-on-error get SIGTERM. With
+-interactive, the command is brought to the foreground of the terminal, which
+then sends the signals typed by the user to it; interrupting it interrupts
+runp as well.
  `,
 	ArgsName: "<command line>",
 	ArgsLong: `A command line to be run in each project specified by the supplied command
@@ -73,6 +114,12 @@ func init() {
 	cmdRunP.Flags.BoolVar(&runpFlags.exitOnError, "exit-on-error", false, "If set, all commands will killed as soon as one reports an error, otherwise, each will run to completion.")
 	cmdRunP.Flags.StringVar(&runpFlags.branch, "branch", "", "A regular expression specifying branch names to use in matching projects. A project will match if the specified branch exists, even if it is not checked out.")
 	cmdRunP.Flags.StringVar(&runpFlags.remote, "remote", "", "A Regular expression specifying projects to run commands in by matching against their remote URLs.")
+	cmdRunP.Flags.BoolVar(&runpFlags.manifestRepos, "include-manifest-repos", false, "Also run the command in the manifest repositories imported by .jiri_manifest, directly or through other manifests, even if they are not declared as projects.")
+	cmdRunP.Flags.StringVar(&runpFlags.timestamp, "timestamp", "", "Begin each line of prefixed output with the time it was emitted, either \"rfc3339\" for the wall clock time or \"elapsed\" for the time since runp started. This flag requires -show-name-prefix, -show-path-prefix or -show-key-prefix.")
+	cmdRunP.Flags.BoolVar(&runpFlags.all, "all", false, "Also match projects marked skipbulk in the manifest. Such projects are otherwise only used when -projects names them, by name or key, rather than just matching them.")
+	cmdRunP.Flags.StringVar(&runpFlags.jsonOutput, "json-output", "", "Path to write the exit code, duration and output of the command in each project to, in JSON format.")
+	cmdRunP.Flags.UintVar(&runpFlags.jobs, "jobs", 0, "The maximum number of commands to run at once. Defaults to the value of the global -j flag.")
+	cmdRunP.Flags.StringVar(&runpFlags.cwd, "cwd", "", "A path relative to each project's root to run the command in. Projects that do not contain this directory are skipped.")
 }
 
 type mapInput struct {
@@ -102,6 +149,32 @@ func projectNames(mapInputs map[project.ProjectKey]*mapInput) []string {
 	return n
 }
 
+// projectKeysRegexp compiles the value of a -projects flag, a comma separated
+// list of regular expressions matching project keys.
+func projectKeysRegexp(projects string) (*regexp.Regexp, error) {
+	re := ""
+	for _, pre := range strings.Split(projects, ",") {
+		re += pre + "|"
+	}
+	re = strings.TrimRight(re, "|")
+	keysRE, err := regexp.Compile(re)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile projects regexp: %q: %v", projects, err)
+	}
+	return keysRE, nil
+}
+
+// namedIn returns true if one of the comma separated entries of a -projects
+// flag is the name or the key of p, rather than a pattern matching it.
+func namedIn(projects string, p project.Project) bool {
+	for _, name := range strings.Split(projects, ",") {
+		if name == p.Name || name == string(p.Key()) {
+			return true
+		}
+	}
+	return false
+}
+
 func projectKeys(mapInputs map[project.ProjectKey]*mapInput) []string {
 	n := []string{}
 	for key := range mapInputs {
@@ -111,10 +184,109 @@ func projectKeys(mapInputs map[project.ProjectKey]*mapInput) []string {
 	return n
 }
 
+// runpOutputLimit is the number of bytes of stdout and stderr kept for each
+// project in the -json-output file.
+const runpOutputLimit = 64 << 10
+
+// runpResult is the result of running the command in one project, as written
+// to the -json-output file. Its fields are a stable format for tools consuming
+// that file.
+type runpResult struct {
+	Name    string `json:"name"`
+	Key     string `json:"key"`
+	Path    string `json:"path"`
+	Command string `json:"command"`
+	// ExitCode is -1 if the command could not be run or was killed, in
+	// which case Error describes why.
+	ExitCode        int    `json:"exit_code"`
+	Error           string `json:"error,omitempty"`
+	DurationMs      int64  `json:"duration_ms"`
+	Stdout          string `json:"stdout"`
+	Stderr          string `json:"stderr"`
+	StdoutTruncated bool   `json:"stdout_truncated,omitempty"`
+	StderrTruncated bool   `json:"stderr_truncated,omitempty"`
+}
+
+// tailBuffer is an io.Writer keeping the last limit bytes written to it.
+type tailBuffer struct {
+	limit     int
+	buf       []byte
+	truncated bool
+}
+
+func (b *tailBuffer) Write(d []byte) (int, error) {
+	b.buf = append(b.buf, d...)
+	if over := len(b.buf) - b.limit; over > 0 {
+		b.buf = append(b.buf[:0], b.buf[over:]...)
+		b.truncated = true
+	}
+	return len(d), nil
+}
+
+// exitCode returns the exit code of a command that completed with err.
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() >= 0 {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
+
+// writeRunpResults writes results to path as a JSON array.
+func writeRunpResults(path string, results []*runpResult) error {
+	sort.Slice(results, func(i, j int) bool { return results[i].Key < results[j].Key })
+	if results == nil {
+		results = []*runpResult{}
+	}
+	out, err := json.MarshalIndent(results, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to serialize JSON output: %s", err)
+	}
+	if err := ioutil.WriteFile(path, out, 0644); err != nil {
+		return fmt.Errorf("failed to write JSON output to %s: %s", path, err)
+	}
+	return nil
+}
+
 type runner struct {
 	args                 []string
 	serializedWriterLock sync.Mutex
 	collatedOutputLock   sync.Mutex
+	// timestamp, if not nil, returns the timestamp to begin each line of
+	// prefixed output with.
+	timestamp func() string
+	// results collects the result of each project when -json-output is
+	// set.
+	resultsLock sync.Mutex
+	results     []*runpResult
+	// signal is the signal which interrupted runp, if any.
+	signalLock sync.Mutex
+	signal     syscall.Signal
+}
+
+// interrupt records that runp was interrupted by sig and cancels mr, which
+// forwards sig to the commands which are running.
+func (r *runner) interrupt(mr *simplemr.MR, sig syscall.Signal) {
+	r.signalLock.Lock()
+	if r.signal == 0 {
+		r.signal = sig
+	}
+	r.signalLock.Unlock()
+	mr.Cancel()
+}
+
+// stopSignal returns the signal sent to the commands which are running when
+// runp is cancelled: the signal which interrupted runp, or SIGTERM when a
+// command failed with -exit-on-error.
+func (r *runner) stopSignal() syscall.Signal {
+	r.signalLock.Lock()
+	defer r.signalLock.Unlock()
+	if r.signal == 0 {
+		return syscall.SIGTERM
+	}
+	return r.signal
 }
 
 func (r *runner) serializedWriter(w io.Writer) io.Writer {
@@ -132,18 +304,41 @@ func (lw *sharedLockWriter) Write(d []byte) (int, error) {
 	return lw.f.Write(d)
 }
 
-func copyWithPrefix(prefix string, w io.Writer, r io.Reader) {
+// copyWithPrefix copies r to w line by line, beginning each line with prefix.
+// If timestamp is not nil, the prefix is preceded by the timestamp it returns
+// when the line is read.
+func copyWithPrefix(prefix string, timestamp func() string, w io.Writer, r io.Reader) {
 	reader := bufio.NewReader(r)
 	for {
 		line, err := reader.ReadString('\n')
+		linePrefix := prefix
+		if timestamp != nil {
+			linePrefix = timestamp() + " " + prefix
+		}
 		if err != nil {
 			if line != "" {
-				fmt.Fprintf(w, "%v: %v\n", prefix, line)
+				fmt.Fprintf(w, "%v: %v\n", linePrefix, line)
 			}
 			break
 		}
-		fmt.Fprintf(w, "%v: %v", prefix, line)
+		fmt.Fprintf(w, "%v: %v", linePrefix, line)
+	}
+}
+
+// runpTimestamp returns a function producing timestamps in the given format,
+// which is either "rfc3339" or "elapsed" since start.
+func runpTimestamp(format string, start time.Time) (func() string, error) {
+	switch format {
+	case "rfc3339":
+		return func() string {
+			return time.Now().Format("2006-01-02T15:04:05.000Z07:00")
+		}, nil
+	case "elapsed":
+		return func() string {
+			return fmt.Sprintf("+%.3fs", time.Since(start).Seconds())
+		}, nil
 	}
+	return nil, fmt.Errorf("unknown timestamp format %q, want \"rfc3339\" or \"elapsed\"", format)
 }
 
 type mapOutput struct {
@@ -151,10 +346,16 @@ type mapOutput struct {
 	outputFilename string
 	key            string
 	err            error
+	result         *runpResult
 }
 
 func (r *runner) Map(mr *simplemr.MR, key string, val interface{}) error {
 	mi := val.(*mapInput)
+	if mr.IsCancelled() {
+		// A command failed with -exit-on-error, or runp was interrupted,
+		// while this project was waiting for a free job.
+		return nil
+	}
 	output := &mapOutput{
 		key: key,
 		mi:  mi}
@@ -165,13 +366,26 @@ func (r *runner) Map(mr *simplemr.MR, key string, val interface{}) error {
 	}
 	var wg sync.WaitGroup
 	cmd := exec.Command(path, "-c", strings.Join(r.args, " "))
-	cmd.Env = envvar.MapToSlice(jirix.Env())
-	cmd.Dir = mi.Project.Path
+	cmd.Env = envvar.MapToSlice(mi.Project.Environment(jirix.Env()))
+	cmd.Dir = filepath.Join(mi.Project.Path, runpFlags.cwd)
 	cmd.Stdin = mi.jirix.Stdin()
+	// Each command runs in its own process group, so that the signals
+	// which interrupt runp can be forwarded to all the processes it
+	// started, and none are left behind.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 	var stdoutCloser, stderrCloser io.Closer
+	tty, foreground := 0, false
 	if runpFlags.interactive {
 		cmd.Stdout = os.Stdout
 		cmd.Stderr = os.Stderr
+		// An interactive command must be in the foreground process
+		// group of the terminal to read from it. The terminal then
+		// sends the signals typed by the user to the command rather
+		// than to runp.
+		if tty, foreground = foregroundTerminal(); foreground {
+			cmd.SysProcAttr.Foreground = true
+			cmd.SysProcAttr.Ctty = tty
+		}
 	} else {
 		var stdout io.Writer
 		stderr := r.serializedWriter(jirix.Stderr())
@@ -228,25 +442,50 @@ func (r *runner) Map(mr *simplemr.MR, key string, val interface{}) error {
 				prefix = mi.Project.Path
 			}
 			wg.Add(2)
-			go func() { copyWithPrefix(prefix, stdout, stdoutReader); wg.Done() }()
-			go func() { copyWithPrefix(prefix, stderr, stderrReader); wg.Done() }()
+			go func() { copyWithPrefix(prefix, r.timestamp, stdout, stdoutReader); wg.Done() }()
+			go func() { copyWithPrefix(prefix, r.timestamp, stderr, stderrReader); wg.Done() }()
 
 		}
 	}
+	var stdoutTail, stderrTail *tailBuffer
+	if runpFlags.jsonOutput != "" && !runpFlags.interactive {
+		// Capture the output as the child writes it, before any prefix is
+		// added.
+		stdoutTail = &tailBuffer{limit: runpOutputLimit}
+		stderrTail = &tailBuffer{limit: runpOutputLimit}
+		cmd.Stdout = io.MultiWriter(cmd.Stdout, stdoutTail)
+		cmd.Stderr = io.MultiWriter(cmd.Stderr, stderrTail)
+	}
+	start := time.Now()
 	if err := cmd.Start(); err != nil {
 		mi.result = err
-	}
-	done := make(chan error)
-	go func() {
-		done <- cmd.Wait()
-	}()
-	select {
-	case output.err = <-done:
-		if output.err != nil && runpFlags.exitOnError {
+		output.err = err
+		if runpFlags.exitOnError {
 			mr.Cancel()
 		}
-	case <-mr.CancelCh():
-		output.err = cmd.Process.Kill()
+	} else {
+		done := make(chan error, 1)
+		go func() {
+			done <- cmd.Wait()
+		}()
+		select {
+		case output.err = <-done:
+			if foreground {
+				if err := setForegroundProcessGroup(tty, syscall.Getpgrp()); err != nil {
+					jirix.Logger.Warningf("Not able to bring runp back to the foreground: %s\n\n", err)
+				}
+			}
+			if sig, ok := interruptSignal(output.err); ok && foreground {
+				// The user interrupted the command, as they would
+				// have interrupted runp if it was in the foreground.
+				r.interrupt(mr, sig)
+				stopProcessGroup(cmd.Process.Pid, sig, nil)
+			} else if output.err != nil && runpFlags.exitOnError {
+				mr.Cancel()
+			}
+		case <-mr.CancelCh():
+			output.err = stopProcessGroup(cmd.Process.Pid, r.stopSignal(), done)
+		}
 	}
 	for _, closer := range []io.Closer{stdoutCloser, stderrCloser} {
 		if closer != nil {
@@ -254,6 +493,25 @@ func (r *runner) Map(mr *simplemr.MR, key string, val interface{}) error {
 		}
 	}
 	wg.Wait()
+	if runpFlags.jsonOutput != "" {
+		output.result = &runpResult{
+			Name:       mi.Project.Name,
+			Key:        key,
+			Path:       mi.Project.Path,
+			Command:    strings.Join(r.args, " "),
+			ExitCode:   exitCode(output.err),
+			DurationMs: time.Since(start).Nanoseconds() / int64(time.Millisecond),
+		}
+		if output.result.ExitCode == -1 && output.err != nil {
+			output.result.Error = output.err.Error()
+		}
+		if stdoutTail != nil {
+			output.result.Stdout = string(stdoutTail.buf)
+			output.result.StdoutTruncated = stdoutTail.truncated
+			output.result.Stderr = string(stderrTail.buf)
+			output.result.StderrTruncated = stderrTail.truncated
+		}
+	}
 	mr.MapOut(key, output)
 	return nil
 }
@@ -261,6 +519,11 @@ func (r *runner) Map(mr *simplemr.MR, key string, val interface{}) error {
 func (r *runner) Reduce(mr *simplemr.MR, key string, values []interface{}) error {
 	for _, v := range values {
 		mo := v.(*mapOutput)
+		if mo.result != nil {
+			r.resultsLock.Lock()
+			r.results = append(r.results, mo.result)
+			r.resultsLock.Unlock()
+		}
 		if mo.err != nil {
 			fmt.Fprintf(os.Stdout, "FAILED: %v: %s %v\n", mo.key, strings.Join(r.args, " "), mo.err)
 			return nil
@@ -281,6 +544,60 @@ func (r *runner) Reduce(mr *simplemr.MR, key string, values []interface{}) error
 	return nil
 }
 
+// interruptSignal returns the signal which terminated a command whose exit
+// status is err, if it is one of those with which the user interrupts
+// commands.
+func interruptSignal(err error) (syscall.Signal, bool) {
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		return 0, false
+	}
+	status, ok := exitErr.Sys().(syscall.WaitStatus)
+	if !ok || !status.Signaled() {
+		return 0, false
+	}
+	switch sig := status.Signal(); sig {
+	case syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT:
+		return sig, true
+	}
+	return 0, false
+}
+
+// checkRunpCwd returns an error if dir is not a path that stays within the
+// project it is joined to.
+func checkRunpCwd(dir string) error {
+	if filepath.IsAbs(dir) {
+		return fmt.Errorf("-cwd must be relative to the project root: %q", dir)
+	}
+	clean := filepath.Clean(dir)
+	if clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("-cwd must not point outside of the project: %q", dir)
+	}
+	return nil
+}
+
+// addManifestRepos adds the manifest repositories imported by the
+// .jiri_manifest file to projects.  They are looked up among all the
+// repositories checked out under the root, including those which are no longer
+// declared as projects; the others are skipped with a warning.
+func addManifestRepos(jirix *jiri.X, projects project.Projects) error {
+	onDisk, err := project.LocalProjects(jirix, project.FullScan)
+	if err != nil {
+		return err
+	}
+	imports, err := project.LoadManifestImportProjects(jirix, onDisk)
+	if err != nil {
+		return err
+	}
+	for key, p := range imports {
+		if _, ok := projects[key]; !ok {
+			jirix.Logger.Debugf("Adding manifest repository %s(%s)", p.Name, p.Path)
+			projects[key] = p
+		}
+	}
+	return nil
+}
+
 func runRunp(jirix *jiri.X, args []string) error {
 	if runpFlags.interactive {
 		runpFlags.collateOutput = false
@@ -289,15 +606,26 @@ func runRunp(jirix *jiri.X, args []string) error {
 	var keysRE, branchRE, remoteRE *regexp.Regexp
 	var err error
 
-	if runpFlags.projectKeys != "" {
-		re := ""
-		for _, pre := range strings.Split(runpFlags.projectKeys, ",") {
-			re += pre + "|"
+	var timestamp func() string
+	if runpFlags.timestamp != "" {
+		if !runpFlags.showKeyPrefix && !runpFlags.showNamePrefix && !runpFlags.showPathPrefix {
+			return jirix.UsageErrorf("-timestamp requires -show-name-prefix, -show-path-prefix or -show-key-prefix")
+		}
+		if timestamp, err = runpTimestamp(runpFlags.timestamp, time.Now()); err != nil {
+			return jirix.UsageErrorf("%v", err)
 		}
-		re = strings.TrimRight(re, "|")
-		keysRE, err = regexp.Compile(re)
+	}
+
+	if runpFlags.cwd != "" {
+		if err := checkRunpCwd(runpFlags.cwd); err != nil {
+			return jirix.UsageErrorf("%v", err)
+		}
+	}
+
+	if runpFlags.projectKeys != "" {
+		keysRE, err = projectKeysRegexp(runpFlags.projectKeys)
 		if err != nil {
-			return fmt.Errorf("failed to compile projects regexp: %q: %v", runpFlags.projectKeys, err)
+			return err
 		}
 	}
 
@@ -336,6 +664,11 @@ func runRunp(jirix *jiri.X, args []string) error {
 	if err != nil {
 		return err
 	}
+	if runpFlags.manifestRepos {
+		if err := addManifestRepos(jirix, projects); err != nil {
+			return err
+		}
+	}
 
 	projectStateRequired := branchRE != nil || runpFlags.untracked || runpFlags.noUntracked || runpFlags.uncommitted || runpFlags.noUncommitted
 	var states map[project.ProjectKey]*project.ProjectState
@@ -350,6 +683,9 @@ func runRunp(jirix *jiri.X, args []string) error {
 	var keys project.ProjectKeys
 	for _, localProject := range projects {
 		key := localProject.Key()
+		if localProject.SkipBulk && !runpFlags.all && !namedIn(runpFlags.projectKeys, localProject) {
+			continue
+		}
 		if keysRE != nil {
 			if !keysRE.MatchString(string(key)) {
 				continue
@@ -377,6 +713,13 @@ func runRunp(jirix *jiri.X, args []string) error {
 		if (runpFlags.uncommitted && !state.HasUncommitted) || (runpFlags.noUncommitted && state.HasUncommitted) {
 			continue
 		}
+		if runpFlags.cwd != "" {
+			dir := filepath.Join(localProject.Path, runpFlags.cwd)
+			if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+				jirix.Logger.Warningf("Skipping project %s(%s): directory %q does not exist\n\n", localProject.Name, localProject.Path, runpFlags.cwd)
+				continue
+			}
+		}
 		mapInputs[key] = &mapInput{
 			Project: localProject,
 			jirix:   jirix,
@@ -399,21 +742,25 @@ func runRunp(jirix *jiri.X, args []string) error {
 	}
 
 	runner := &runner{
-		args: args,
+		args:      args,
+		timestamp: timestamp,
 	}
 	mr := simplemr.MR{}
 	if runpFlags.interactive {
 		// Run one mapper at a time.
 		mr.NumMappers = 1
 		sort.Sort(keys)
+	} else if runpFlags.jobs > 0 {
+		mr.NumMappers = int(runpFlags.jobs)
 	} else {
 		mr.NumMappers = int(jirix.Jobs)
 	}
 	in, out := make(chan *simplemr.Record, len(mapInputs)), make(chan *simplemr.Record, len(mapInputs))
-	sigch := make(chan os.Signal)
-	signal.Notify(sigch, os.Interrupt)
+	sigch := make(chan os.Signal, 1)
+	signal.Notify(sigch, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigch)
 	jirix.TimerPush("Map and Reduce")
-	go func() { <-sigch; mr.Cancel() }()
+	go func() { runner.interrupt(&mr, (<-sigch).(syscall.Signal)) }()
 	go mr.Run(in, out, runner, runner)
 	for _, key := range keys {
 		in <- &simplemr.Record{string(key), []interface{}{mapInputs[key]}}
@@ -421,5 +768,10 @@ func runRunp(jirix *jiri.X, args []string) error {
 	close(in)
 	<-out
 	jirix.TimerPop()
+	if runpFlags.jsonOutput != "" {
+		if err := writeRunpResults(runpFlags.jsonOutput, runner.results); err != nil {
+			return err
+		}
+	}
 	return mr.Error()
 }
@@ -5,11 +5,20 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/dahlia-os/jiri/gitutil"
 	"github.com/dahlia-os/jiri/jiritest"
@@ -31,6 +40,12 @@ func setDefaultRunpFlags() {
 	runpFlags.collateOutput = true
 	runpFlags.branch = ""
 	runpFlags.remote = ""
+	runpFlags.cwd = ""
+	runpFlags.manifestRepos = false
+	runpFlags.timestamp = ""
+	runpFlags.all = false
+	runpFlags.jsonOutput = ""
+	runpFlags.jobs = 0
 }
 
 func addProjects(t *testing.T, fake *jiritest.FakeJiriRoot) []*project.Project {
@@ -272,3 +287,423 @@ func TestRunP(t *testing.T) {
 		t.Errorf("got %v, want %v", got, want)
 	}
 }
+
+func TestRunPCwd(t *testing.T) {
+	fake, cleanup := jiritest.NewFakeJiriRoot(t)
+	defer cleanup()
+	projects := addProjects(t, fake)
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(cwd)
+	if err := os.Chdir(fake.X.Root); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only r.a and r.c have the subdirectory.
+	for _, p := range []*project.Project{projects[0], projects[2]} {
+		if err := os.MkdirAll(filepath.Join(p.Path, "build", "out"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	setDefaultRunpFlags()
+	runpFlags.showNamePrefix = true
+	runpFlags.cwd = "build/out"
+	got := executeRunp(t, fake, "basename", "$(dirname $(dirname $PWD))")
+	if want := "r.a: r.a\nr.c: r.c"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	setDefaultRunpFlags()
+	runpFlags.showNamePrefix = true
+	runpFlags.cwd = "missing"
+	if got := executeRunp(t, fake, "echo"); got != "" {
+		t.Errorf("got %q, want no output", got)
+	}
+
+	for _, dir := range []string{"..", "../r.b", "build/../../r.b", "/tmp"} {
+		setDefaultRunpFlags()
+		runpFlags.cwd = dir
+		if err := runRunp(fake.X, []string{"echo"}); err == nil {
+			t.Errorf("-cwd=%q: expected an error", dir)
+		}
+	}
+}
+
+// markSkipBulk sets skipbulk on the named project in the remote manifest and
+// updates the universe.
+func markSkipBulk(t *testing.T, fake *jiritest.FakeJiriRoot, name string) {
+	m, err := fake.ReadRemoteManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range m.Projects {
+		if m.Projects[i].Name == name {
+			m.Projects[i].SkipBulk = true
+		}
+	}
+	if err := fake.WriteRemoteManifest(m); err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRunPSkipBulk(t *testing.T) {
+	fake, cleanup := jiritest.NewFakeJiriRoot(t)
+	defer cleanup()
+	addProjects(t, fake)
+	markSkipBulk(t, fake, "r.b")
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(cwd)
+	if err := os.Chdir(fake.X.Root); err != nil {
+		t.Fatal(err)
+	}
+
+	setDefaultRunpFlags()
+	runpFlags.showNamePrefix = true
+	if got, want := executeRunp(t, fake, "echo"), "manifest: \nr.a: \nr.c: \nsub/r.t1: \nsub/sub2/r.t2:"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	setDefaultRunpFlags()
+	runpFlags.showNamePrefix = true
+	runpFlags.all = true
+	if got, want := executeRunp(t, fake, "echo"), "manifest: \nr.a: \nr.b: \nr.c: \nsub/r.t1: \nsub/sub2/r.t2:"; got != want {
+		t.Errorf("-all: got %q, want %q", got, want)
+	}
+
+	setDefaultRunpFlags()
+	runpFlags.showNamePrefix = true
+	runpFlags.projectKeys = "r.b"
+	if got, want := executeRunp(t, fake, "echo"), "r.b:"; got != want {
+		t.Errorf("-projects: got %q, want %q", got, want)
+	}
+
+	// Patterns which merely match the project leave it out.
+	setDefaultRunpFlags()
+	runpFlags.showNamePrefix = true
+	runpFlags.projectKeys = "r\\..*"
+	if got, want := executeRunp(t, fake, "echo"), "r.a: \nr.c: \nsub/r.t1: \nsub/sub2/r.t2:"; got != want {
+		t.Errorf("-projects=%s: got %q, want %q", runpFlags.projectKeys, got, want)
+	}
+}
+
+func TestRunPProjectEnv(t *testing.T) {
+	fake, cleanup := jiritest.NewFakeJiriRoot(t)
+	defer cleanup()
+	projects := addProjects(t, fake)
+
+	m, err := fake.ReadRemoteManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range m.Projects {
+		if m.Projects[i].Name == projects[1].Name {
+			m.Projects[i].Env = "RUNP_FOO=project,RUNP_BAR=b"
+			m.Projects[i].EnvVars = []project.EnvVar{
+				{Name: "RUNP_BAZ", Value: "x,y"},
+				{Name: "RUNP_PATH", Value: "/project", Merge: "prepend"},
+			}
+		}
+	}
+	if err := fake.WriteRemoteManifest(m); err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(cwd)
+	if err := os.Chdir(fake.X.Root); err != nil {
+		t.Fatal(err)
+	}
+
+	env := fake.X.Env()
+	env["RUNP_FOO"] = "global"
+	env["RUNP_PATH"] = "/global"
+	defer delete(env, "RUNP_FOO")
+	defer delete(env, "RUNP_PATH")
+
+	setDefaultRunpFlags()
+	runpFlags.showNamePrefix = true
+	runpFlags.projectKeys = "r.[ab]"
+	got := executeRunp(t, fake, "echo", "$RUNP_FOO$RUNP_BAR $RUNP_BAZ $RUNP_PATH")
+	if want := "r.a: global /global\nr.b: projectb x,y /project:/global"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestRunPIncludeManifestRepos(t *testing.T) {
+	fake, cleanup := jiritest.NewFakeJiriRoot(t)
+	defer cleanup()
+	addProjects(t, fake)
+
+	// Stop declaring the manifest repository as a project, it is still
+	// imported by .jiri_manifest and left checked out by jiri update.
+	m, err := fake.ReadRemoteManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	projects := m.Projects[:0]
+	for _, p := range m.Projects {
+		if p.Name != jiritest.ManifestProjectName {
+			projects = append(projects, p)
+		}
+	}
+	m.Projects = projects
+	if err := fake.WriteRemoteManifest(m); err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(cwd)
+	if err := os.Chdir(fake.X.Root); err != nil {
+		t.Fatal(err)
+	}
+
+	setDefaultRunpFlags()
+	runpFlags.showNamePrefix = true
+	runpFlags.manifestRepos = true
+	if got, want := executeRunp(t, fake, "echo"), "manifest: \nr.a: \nr.b: \nr.c: \nsub/r.t1: \nsub/sub2/r.t2:"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	setDefaultRunpFlags()
+	runpFlags.manifestRepos = true
+	runpFlags.projectKeys = jiritest.ManifestProjectName
+	if got, want := executeRunp(t, fake, "ls", jiritest.ManifestFileName), jiritest.ManifestFileName; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// Manifest repositories which are not checked out are skipped, rather
+	// than cloned.
+	if err := os.RemoveAll(filepath.Join(fake.X.Root, jiritest.ManifestProjectPath)); err != nil {
+		t.Fatal(err)
+	}
+	setDefaultRunpFlags()
+	runpFlags.showNamePrefix = true
+	runpFlags.manifestRepos = true
+	if got, want := executeRunp(t, fake, "echo"), "r.a: \nr.b: \nr.c: \nsub/r.t1: \nsub/sub2/r.t2:"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestCopyWithPrefix(t *testing.T) {
+	stamps := 0
+	timestamp := func() string {
+		stamps++
+		return fmt.Sprintf("t%d", stamps)
+	}
+	var buf bytes.Buffer
+	copyWithPrefix("p", timestamp, &buf, strings.NewReader("one\ntwo\nthree"))
+	if got, want := buf.String(), "t1 p: one\nt2 p: two\nt3 p: three\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	buf.Reset()
+	copyWithPrefix("p", nil, &buf, strings.NewReader("one\n"))
+	if got, want := buf.String(), "p: one\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestRunPTimestamp(t *testing.T) {
+	fake, cleanup := jiritest.NewFakeJiriRoot(t)
+	defer cleanup()
+	addProjects(t, fake)
+
+	setDefaultRunpFlags()
+	runpFlags.projectKeys = "r.a"
+	runpFlags.timestamp = "elapsed"
+	if err := runRunp(fake.X, []string{"echo", "hello"}); err == nil || !strings.Contains(err.Error(), "-timestamp requires") {
+		t.Errorf("expected -timestamp to require a prefix flag, got %v", err)
+	}
+
+	for format, re := range map[string]string{
+		"elapsed": `^\+\d+\.\d{3}s r\.a: hello$`,
+		"rfc3339": `^\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}\.\d{3}\S+ r\.a: hello$`,
+	} {
+		setDefaultRunpFlags()
+		runpFlags.projectKeys = "r.a"
+		runpFlags.showNamePrefix = true
+		runpFlags.timestamp = format
+		got := executeRunp(t, fake, "echo", "hello")
+		if !regexp.MustCompile(re).MatchString(got) {
+			t.Errorf("%s: got %q, want match for %q", format, got, re)
+		}
+	}
+
+	setDefaultRunpFlags()
+	runpFlags.showNamePrefix = true
+	runpFlags.timestamp = "unknown"
+	if err := runRunp(fake.X, []string{"echo", "hello"}); err == nil || !strings.Contains(err.Error(), "unknown timestamp format") {
+		t.Errorf("expected unknown timestamp format error, got %v", err)
+	}
+}
+
+func TestRunPJSONOutput(t *testing.T) {
+	fake, cleanup := jiritest.NewFakeJiriRoot(t)
+	defer cleanup()
+	projects := addProjects(t, fake)
+	defer setDefaultRunpFlags()
+
+	// The command fails in r.b, where a "fail" file exists.
+	if err := ioutil.WriteFile(filepath.Join(projects[1].Path, "fail"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	jsonFile := filepath.Join(fake.X.Root, "runp.json")
+	setDefaultRunpFlags()
+	runpFlags.projectKeys = "r.a,r.b"
+	runpFlags.showNamePrefix = true
+	runpFlags.jsonOutput = jsonFile
+	got := executeRunp(t, fake, "if [ -f fail ]; then echo bad >&2; sleep 0.1; exit 3; fi; echo ok")
+	if !strings.Contains(got, "r.a: ok") || !strings.Contains(got, "FAILED: "+string(projects[1].Key())) {
+		t.Errorf("unexpected output: %q", got)
+	}
+
+	data, err := ioutil.ReadFile(jsonFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var results []runpResult
+	if err := json.Unmarshal(data, &results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("got %d results, want 2: %s", len(results), data)
+	}
+	byName := map[string]runpResult{}
+	for _, r := range results {
+		byName[r.Name] = r
+	}
+	if r := byName["r.a"]; r.ExitCode != 0 || r.Stdout != "ok\n" || r.Stderr != "" || r.Path != projects[0].Path {
+		t.Errorf("unexpected result for a: %+v", r)
+	}
+	if r := byName["r.b"]; r.ExitCode != 3 || r.Stdout != "" || r.Stderr != "bad\n" || r.DurationMs < 100 {
+		t.Errorf("unexpected result for b: %+v", r)
+	}
+	for _, r := range results {
+		if !strings.Contains(r.Command, "exit 3") || r.Key == "" {
+			t.Errorf("unexpected result: %+v", r)
+		}
+	}
+}
+
+func TestRunPJobs(t *testing.T) {
+	fake, cleanup := jiritest.NewFakeJiriRoot(t)
+	defer cleanup()
+	addProjects(t, fake)
+	defer setDefaultRunpFlags()
+
+	// Each command holds a lock directory while it runs, so that a second
+	// command running at the same time fails to create it.
+	lock := filepath.Join(fake.X.Root, "lock")
+	setDefaultRunpFlags()
+	runpFlags.projectKeys = "r.a,r.b,r.c"
+	runpFlags.jobs = 1
+	got := executeRunp(t, fake, "mkdir "+lock+" || exit 1; sleep 0.05; rmdir "+lock)
+	if strings.Contains(got, "FAILED") {
+		t.Errorf("commands ran concurrently with -jobs=1: %q", got)
+	}
+
+	// Once a command fails, the projects waiting for a job are skipped.
+	ran := filepath.Join(fake.X.Root, "ran")
+	setDefaultRunpFlags()
+	runpFlags.projectKeys = "r.a,r.b,r.c"
+	runpFlags.jobs = 1
+	runpFlags.exitOnError = true
+	executeRunp(t, fake, "echo $PWD >> "+ran+"; exit 1")
+	data, err := ioutil.ReadFile(ran)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(data)), "\n"); len(lines) != 1 {
+		t.Errorf("got the command run in %q, want it run in one project only", lines)
+	}
+}
+
+func TestTailBuffer(t *testing.T) {
+	b := &tailBuffer{limit: 4}
+	b.Write([]byte("ab"))
+	if string(b.buf) != "ab" || b.truncated {
+		t.Errorf("got %q, truncated %v", b.buf, b.truncated)
+	}
+	b.Write([]byte("cdef"))
+	if string(b.buf) != "cdef" || !b.truncated {
+		t.Errorf("got %q, truncated %v, want \"cdef\" truncated", b.buf, b.truncated)
+	}
+}
+
+func TestRunPInterrupt(t *testing.T) {
+	fake, cleanup := jiritest.NewFakeJiriRoot(t)
+	defer cleanup()
+	projects := addProjects(t, fake)
+	defer func(delay time.Duration) { processGroupKillDelay = delay }(processGroupKillDelay)
+	processGroupKillDelay = 100 * time.Millisecond
+
+	// The shell and its child both ignore SIGINT, so they are only stopped
+	// by being killed along with their process group.
+	setDefaultRunpFlags()
+	runpFlags.projectKeys = projects[0].Name
+	pidFile := filepath.Join(projects[0].Path, "pid")
+	done := make(chan error, 1)
+	start := time.Now()
+	go func() {
+		done <- runRunp(fake.X, []string{`trap "" INT; sleep 60 & echo $! > pid; wait`})
+	}()
+	var pid int
+	for pid == 0 {
+		if time.Since(start) > 10*time.Second {
+			t.Fatalf("command did not start")
+		}
+		time.Sleep(10 * time.Millisecond)
+		if data, err := ioutil.ReadFile(pidFile); err == nil {
+			pid, _ = strconv.Atoi(strings.TrimSpace(string(data)))
+		}
+	}
+	if err := syscall.Kill(os.Getpid(), syscall.SIGINT); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Errorf("expected an error from the interrupted runp")
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatalf("runp did not stop after being interrupted")
+	}
+	// The child may take a moment to exit once killed.
+	for start := time.Now(); processRunning(pid); time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 10*time.Second {
+			t.Fatalf("child process %d of the command is still running", pid)
+		}
+	}
+}
+
+// processRunning returns whether the process pid is running and has not
+// become a zombie.
+func processRunning(pid int) bool {
+	if err := syscall.Kill(pid, 0); err != nil {
+		return false
+	}
+	out, err := exec.Command("ps", "-o", "stat=", "-p", strconv.Itoa(pid)).Output()
+	return err == nil && !strings.HasPrefix(strings.TrimSpace(string(out)), "Z")
+}
@@ -5,11 +5,17 @@
 package main
 
 import (
+	"path/filepath"
+
 	"github.com/dahlia-os/jiri"
 	"github.com/dahlia-os/jiri/cmdline"
 	"github.com/dahlia-os/jiri/project"
 )
 
+var snapshotFlags struct {
+	lockfile bool
+}
+
 var cmdSnapshot = &cmdline.Command{
 	Runner: jiri.RunnerFunc(runSnapshot),
 	Name:   "snapshot",
@@ -17,14 +23,39 @@ var cmdSnapshot = &cmdline.Command{
 	Long: `
 The "jiri snapshot <snapshot>" command captures the current project state
 in a manifest.
+
+With -lockfile, a lockfile pinning the cipd packages of the manifest to the
+instances installed in the jiri root is written next to the snapshot. The
+lockfile is named after the configured lockfile name, jiri.lock by default.
+Only packages for the host platform are installed and pinned; the command
+fails if any of them is not installed.
 `,
 	ArgsName: "<snapshot>",
 	ArgsLong: "<snapshot> is the snapshot manifest file.",
 }
 
+func init() {
+	cmdSnapshot.Flags.BoolVar(&snapshotFlags.lockfile, "lockfile", false, "Also write a lockfile pinning cipd packages to the installed instances.")
+}
+
 func runSnapshot(jirix *jiri.X, args []string) error {
 	if len(args) != 1 {
 		return jirix.UsageErrorf("unexpected number of arguments")
 	}
-	return project.CreateSnapshot(jirix, args[0], nil, nil, true)
+	var pkgLocks project.PackageLocks
+	if snapshotFlags.lockfile {
+		// Check the packages before writing anything.
+		var err error
+		if pkgLocks, err = project.InstalledPackageLocks(jirix, true); err != nil {
+			return err
+		}
+	}
+	if err := project.CreateSnapshot(jirix, args[0], nil, nil, true); err != nil {
+		return err
+	}
+	if snapshotFlags.lockfile {
+		lockfile := filepath.Join(filepath.Dir(args[0]), jirix.LockfileName)
+		return project.WritePackageLockFile(jirix, lockfile, pkgLocks)
+	}
+	return nil
 }
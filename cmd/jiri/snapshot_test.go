@@ -10,9 +10,12 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/dahlia-os/jiri"
+	"github.com/dahlia-os/jiri/cipd"
 	"github.com/dahlia-os/jiri/gitutil"
 	"github.com/dahlia-os/jiri/jiritest"
 	"github.com/dahlia-os/jiri/project"
@@ -119,3 +122,101 @@ func TestSnapshot(t *testing.T) {
 		checkReadme(t, fake.X, localProject, "revision 1")
 	}
 }
+
+// installPackage lays out name in the cipd state of root like "cipd ensure"
+// does.
+func installPackage(t *testing.T, root, name, instanceID string) {
+	dir := filepath.Join(root, ".cipd", "pkgs", instanceID[:8])
+	if err := os.MkdirAll(filepath.Join(dir, instanceID), 0755); err != nil {
+		t.Fatal(err)
+	}
+	desc := fmt.Sprintf(`{"subdir": "", "package_name": %q}`, name)
+	if err := ioutil.WriteFile(filepath.Join(dir, "description.json"), []byte(desc), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(instanceID, filepath.Join(dir, "_current")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestSnapshotLockfile tests pinning packages to the installed instances.
+func TestSnapshotLockfile(t *testing.T) {
+	fake, cleanup := jiritest.NewFakeJiriRoot(t)
+	defer cleanup()
+	fake.X.LockfileName = "jiri.lock"
+	snapshotFlags.lockfile = true
+	defer func() { snapshotFlags.lockfile = false }()
+
+	host := cipd.CipdPlatform.String()
+	m, err := fake.ReadJiriManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Packages = []project.Package{
+		{Name: "test/tool/${platform}", Version: "version:1", Path: "tool", Platforms: host},
+		{Name: "test/other/${platform}", Version: "version:1", Path: "other", Platforms: host},
+		// Not installed on this host, so not pinned either.
+		{Name: "test/elsewhere/${platform}", Version: "version:1", Path: "elsewhere", Platforms: "fuchsia-riscv"},
+	}
+	if err := fake.WriteJiriManifest(m); err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "jiri-snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	snapshot := filepath.Join(dir, "snapshot")
+	lockfile := filepath.Join(dir, "jiri.lock")
+
+	toolID := strings.Repeat("a", 40)
+	installPackage(t, fake.X.Root, "test/tool/"+host, toolID)
+	err = runSnapshot(fake.X, []string{snapshot})
+	if err == nil || !strings.Contains(err.Error(), "test/other/"+host) {
+		t.Fatalf("expected an error for the missing package, got %v", err)
+	}
+	for _, file := range []string{snapshot, lockfile} {
+		if _, err := os.Stat(file); !os.IsNotExist(err) {
+			t.Errorf("%s should not have been written", file)
+		}
+	}
+
+	otherID := strings.Repeat("b", 40)
+	installPackage(t, fake.X.Root, "test/other/"+host, otherID)
+
+	// The lockfile is only written once the snapshot is.
+	notFile := filepath.Join(dir, "directory")
+	if err := os.Mkdir(notFile, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := runSnapshot(fake.X, []string{notFile}); err == nil {
+		t.Fatalf("expected an error writing the snapshot to a directory")
+	}
+	if _, err := os.Stat(lockfile); !os.IsNotExist(err) {
+		t.Errorf("%s should not have been written", lockfile)
+	}
+
+	if err := runSnapshot(fake.X, []string{snapshot}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(lockfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, pkgLocks, err := project.UnmarshalLockEntries(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := project.PackageLocks{}
+	for name, id := range map[string]string{"test/tool/" + host: toolID, "test/other/" + host: otherID} {
+		lock := project.PackageLock{PackageName: name, InstanceID: id}
+		want[lock.Key()] = lock
+	}
+	if !reflect.DeepEqual(pkgLocks, want) {
+		t.Errorf("got %+v, want %+v", pkgLocks, want)
+	}
+}
@@ -5,24 +5,33 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/dahlia-os/jiri"
 	"github.com/dahlia-os/jiri/cmdline"
 	"github.com/dahlia-os/jiri/gitutil"
 	"github.com/dahlia-os/jiri/project"
+	"github.com/dahlia-os/jiri/table"
 )
 
 var statusFlags struct {
-	changes   bool
-	checkHead bool
-	branch    string
-	commits   bool
-	deleted   bool
+	changes    bool
+	checkHead  bool
+	branch     string
+	commits    bool
+	deleted    bool
+	summary    bool
+	json       bool
+	noPristine bool
+	all        bool
 }
 
 var cmdStatus = &cmdline.Command{
@@ -33,6 +42,12 @@ var cmdStatus = &cmdline.Command{
 Prints status for the the projects. It runs git status -s across all the projects
 and prints it if there are some changes. It also shows status if the project is on
 a rev other then the one according to manifest(Named as JIRI_HEAD in git)
+
+With -summary, prints a table with one line per project showing its current
+branch, the number of commits it is ahead of and behind its upstream, and
+whether it has uncommitted changes or untracked files. The upstream is the
+tracking branch of the current branch, or the manifest revision when the
+project is not on a branch.
 `,
 }
 
@@ -44,6 +59,10 @@ func init() {
 	flags.StringVar(&statusFlags.branch, "branch", "", "Display all projects only on this branch along with their status.")
 	flags.BoolVar(&statusFlags.deleted, "deleted", false, "List all deleted projects. Other flags would be ignored.")
 	flags.BoolVar(&statusFlags.deleted, "d", false, "Same as -deleted.")
+	flags.BoolVar(&statusFlags.summary, "summary", false, "Display a table summarizing the state of every project.")
+	flags.BoolVar(&statusFlags.json, "json", false, "Implies -summary. Display the summary as JSON.")
+	flags.BoolVar(&statusFlags.all, "all", false, "Also display projects marked skipbulk in the manifest.")
+	flags.BoolVar(&statusFlags.noPristine, "nopristine", false, "With -summary, hide projects without uncommitted changes, untracked files or commits ahead of their upstream.")
 }
 
 func colorFormatGitLog(jirix *jiri.X, log string) string {
@@ -67,10 +86,16 @@ func runStatus(jirix *jiri.X, args []string) error {
 	if err != nil {
 		return err
 	}
+	if !statusFlags.all {
+		localProjects = withoutSkipBulk(localProjects)
+	}
 	cDir, err := os.Getwd()
 	if err != nil {
 		return err
 	}
+	if statusFlags.summary || statusFlags.json {
+		return runStatusSummary(jirix, localProjects, remoteProjects, cDir)
+	}
 	if statusFlags.deleted {
 		for key, localProject := range localProjects {
 			if _, remoteOk := remoteProjects[key]; !remoteOk {
@@ -206,7 +231,7 @@ func getStatus(jirix *jiri.X, local project.Project, remote project.Project, cur
 	}
 
 	if currentBranch.Name != "" && statusFlags.commits {
-		remoteBranch := "remotes/origin/" + remote.RemoteBranch
+		remoteBranch := remote.RemoteRef(remote.RemoteBranch)
 		if currentBranch.Tracking != nil {
 			remoteBranch = currentBranch.Tracking.Name
 		}
@@ -226,3 +251,139 @@ func getStatus(jirix *jiri.X, local project.Project, remote project.Project, cur
 	}
 	return changes, headRev, extraCommits, nil
 }
+
+// statusSummary defines the JSON format for 'status -summary' output.
+type statusSummary struct {
+	Name string `json:"name"`
+	// Path relative to the current directory.
+	Path string `json:"path"`
+	// Branch is empty when the project is not on a branch.
+	Branch      string `json:"branch"`
+	Ahead       int    `json:"ahead"`
+	Behind      int    `json:"behind"`
+	Uncommitted bool   `json:"uncommitted"`
+	Untracked   bool   `json:"untracked"`
+	Error       string `json:"error,omitempty"`
+}
+
+func (s statusSummary) pristine() bool {
+	return !s.Uncommitted && !s.Untracked && s.Ahead == 0 && s.Error == ""
+}
+
+func runStatusSummary(jirix *jiri.X, localProjects, remoteProjects project.Projects, cDir string) error {
+	keys := make(chan project.ProjectKey, len(localProjects))
+	for key := range localProjects {
+		if _, ok := remoteProjects[key]; ok {
+			keys <- key
+		}
+	}
+	close(keys)
+	summaries := make(chan statusSummary, len(localProjects))
+	var wg sync.WaitGroup
+	for i := uint(0); i < jirix.Jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range keys {
+				summaries <- getStatusSummary(jirix, localProjects[key], remoteProjects[key], cDir)
+			}
+		}()
+	}
+	wg.Wait()
+	close(summaries)
+
+	var results []statusSummary
+	for summary := range summaries {
+		if summary.Error != "" {
+			jirix.Logger.Errorf("getting status for project %s(%s) :%s\n\n", summary.Name, summary.Path, summary.Error)
+			jirix.IncrementFailures()
+		}
+		if statusFlags.noPristine && summary.pristine() {
+			continue
+		}
+		if statusFlags.branch != "" && statusFlags.branch != summary.Branch {
+			continue
+		}
+		results = append(results, summary)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Path < results[j].Path
+	})
+	if statusFlags.json {
+		if results == nil {
+			results = []statusSummary{}
+		}
+		out, err := json.MarshalIndent(results, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to serialize JSON output: %s", err)
+		}
+		fmt.Println(string(out))
+	} else {
+		if err := printStatusSummary(os.Stdout, table.Width(jirix.Env()), results); err != nil {
+			return err
+		}
+	}
+	if jirix.Failures() != 0 {
+		return fmt.Errorf("completed with non-fatal errors")
+	}
+	return nil
+}
+
+// getStatusSummary returns the summary of local, with any error recorded in
+// the summary.
+func getStatusSummary(jirix *jiri.X, local, remote project.Project, cDir string) statusSummary {
+	summary := statusSummary{Name: local.Name, Path: local.Path}
+	if rel, err := filepath.Rel(cDir, local.Path); err == nil {
+		summary.Path = rel
+	}
+	scm := gitutil.New(jirix, gitutil.RootDirOpt(local.Path))
+	err := func() error {
+		var err error
+		if scm.IsOnBranch() {
+			if summary.Branch, err = scm.CurrentBranchName(); err != nil {
+				return err
+			}
+			summary.Ahead, summary.Behind, err = scm.AheadBehind("HEAD", "")
+			if err == gitutil.ErrNoUpstream {
+				summary.Ahead, summary.Behind, err = scm.AheadBehind("HEAD", remote.RemoteRef(remote.RemoteBranch))
+			}
+		} else {
+			var upstream string
+			if upstream, err = project.GetHeadRevision(jirix, remote); err != nil {
+				return err
+			}
+			summary.Ahead, summary.Behind, err = scm.AheadBehind("HEAD", upstream)
+		}
+		if err != nil {
+			return err
+		}
+		if summary.Uncommitted, err = scm.HasUncommittedChanges(); err != nil {
+			return err
+		}
+		summary.Untracked, err = scm.HasUntrackedFiles()
+		return err
+	}()
+	if err != nil {
+		summary.Error = err.Error()
+	}
+	return summary
+}
+
+// printStatusSummary prints summaries as a table.
+func printStatusSummary(w io.Writer, width int, summaries []statusSummary) error {
+	t := table.New(width, "PROJECT", "BRANCH", "AHEAD", "BEHIND", "UNCOMMITTED", "UNTRACKED")
+	for _, s := range summaries {
+		branch := s.Branch
+		if branch == "" {
+			branch = "(detached)"
+		}
+		yesNo := func(b bool) string {
+			if b {
+				return "yes"
+			}
+			return "no"
+		}
+		t.AddRow(s.Path, branch, strconv.Itoa(s.Ahead), strconv.Itoa(s.Behind), yesNo(s.Uncommitted), yesNo(s.Untracked))
+	}
+	return t.Write(w)
+}
@@ -5,10 +5,13 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
 	"sort"
 	"strconv"
 	"strings"
@@ -26,6 +29,10 @@ func setDefaultStatusFlags() {
 	statusFlags.branch = ""
 	statusFlags.commits = true
 	statusFlags.deleted = false
+	statusFlags.summary = false
+	statusFlags.json = false
+	statusFlags.noPristine = false
+	statusFlags.all = false
 }
 
 func createCommits(t *testing.T, fake *jiritest.FakeJiriRoot, localProjects []project.Project) ([]string, []string, []string, []string) {
@@ -208,6 +215,114 @@ func TestStatusWhenUserUpdatesGitTree(t *testing.T) {
 	}
 }
 
+func TestStatusSummary(t *testing.T) {
+	setDefaultStatusFlags()
+	defer setDefaultStatusFlags()
+	fake, cleanup := jiritest.NewFakeJiriRoot(t)
+	defer cleanup()
+
+	localProjects := createProjects(t, fake, 3)
+	createCommits(t, fake, localProjects)
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	for _, lp := range localProjects {
+		setDummyUser(t, fake.X, lp.Path)
+	}
+	newfile(t, localProjects[0].Path, "untracked")
+	gitLocal := gitutil.New(fake.X, gitutil.RootDirOpt(localProjects[1].Path))
+	if err := gitLocal.CreateAndCheckoutBranch("local"); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, fake.X, localProjects[1].Path, "local", "local")
+	newfile(t, localProjects[1].Path, "uncommitted")
+	if err := gitLocal.Add("uncommitted"); err != nil {
+		t.Fatal(err)
+	}
+	if err := gitutil.New(fake.X, gitutil.RootDirOpt(localProjects[2].Path)).CheckoutBranch("HEAD~1"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]statusSummary{
+		localProjects[0].Name: {Untracked: true},
+		localProjects[1].Name: {Branch: "local", Ahead: 1, Uncommitted: true},
+		localProjects[2].Name: {Behind: 1},
+		"manifest":            {},
+	}
+	check := func(want map[string]statusSummary) {
+		var got []statusSummary
+		if err := json.Unmarshal([]byte(executeStatus(t, fake)), &got); err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(want) {
+			t.Errorf("got %d projects, want %d: %+v", len(got), len(want), got)
+		}
+		for _, s := range got {
+			w, ok := want[s.Name]
+			if !ok {
+				t.Errorf("unexpected project %+v", s)
+				continue
+			}
+			w.Name, w.Path = s.Name, s.Path
+			if s != w {
+				t.Errorf("got %+v, want %+v", s, w)
+			}
+		}
+	}
+	statusFlags.json = true
+	check(want)
+
+	statusFlags.noPristine = true
+	delete(want, localProjects[2].Name)
+	delete(want, "manifest")
+	check(want)
+}
+
+func TestStatusSkipBulk(t *testing.T) {
+	setDefaultStatusFlags()
+	defer setDefaultStatusFlags()
+	fake, cleanup := jiritest.NewFakeJiriRoot(t)
+	defer cleanup()
+	addProjects(t, fake)
+	markSkipBulk(t, fake, "r.b")
+
+	names := func() []string {
+		var got []statusSummary
+		if err := json.Unmarshal([]byte(executeStatus(t, fake)), &got); err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, s := range got {
+			names = append(names, s.Name)
+		}
+		sort.Strings(names)
+		return names
+	}
+	statusFlags.json = true
+	if got, want := names(), []string{"manifest", "r.a", "r.c", "sub/r.t1", "sub/sub2/r.t2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	statusFlags.all = true
+	if got, want := names(), []string{"manifest", "r.a", "r.b", "r.c", "sub/r.t1", "sub/sub2/r.t2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("-all: got %v, want %v", got, want)
+	}
+}
+
+func TestPrintStatusSummary(t *testing.T) {
+	var buf bytes.Buffer
+	printStatusSummary(&buf, 0, []statusSummary{
+		{Name: "a", Path: "a", Branch: "master", Ahead: 2, Untracked: true},
+		{Name: "b", Path: "long/path/b", Behind: 10, Uncommitted: true},
+	})
+	want := `PROJECT      BRANCH      AHEAD  BEHIND  UNCOMMITTED  UNTRACKED
+a            master      2      0       no           yes
+long/path/b  (detached)  0      10      yes          no
+`
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
 func TestStatusDeleted(t *testing.T) {
 	setDefaultStatusFlags()
 	fake, cleanup := jiritest.NewFakeJiriRoot(t)
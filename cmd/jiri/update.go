@@ -5,12 +5,19 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/dahlia-os/jiri"
 	"github.com/dahlia-os/jiri/cmdline"
+	"github.com/dahlia-os/jiri/gitutil"
 	"github.com/dahlia-os/jiri/project"
 	"github.com/dahlia-os/jiri/retry"
 )
@@ -18,7 +25,9 @@ import (
 var (
 	gcFlag               bool
 	localManifestFlag    bool
+	localManifestsFlag   string
 	attemptsFlag         uint
+	retryBackoffFlag     time.Duration
 	autoupdateFlag       bool
 	forceAutoupdateFlag  bool
 	rebaseUntrackedFlag  bool
@@ -29,6 +38,18 @@ var (
 	rebaseTrackedFlag    bool
 	runHooksFlag         bool
 	fetchPkgsFlag        bool
+	summaryFlag          bool
+	offlineFlag          bool
+	unshallowFlag        bool
+	pruneTagsFlag        bool
+	autostashFlag        bool
+	forceUpdateFlag      bool
+	dryRunFlag           bool
+	updateJSONOutputFlag string
+	updateResultFileFlag string
+	updateJobsFlag       uint
+	skipPrecheckFlag     bool
+	logHooksFlag         bool
 )
 
 const (
@@ -39,7 +60,9 @@ const (
 func init() {
 	cmdUpdate.Flags.BoolVar(&gcFlag, "gc", false, "Garbage collect obsolete repositories.")
 	cmdUpdate.Flags.BoolVar(&localManifestFlag, "local-manifest", false, "Use local manifest")
+	cmdUpdate.Flags.StringVar(&localManifestsFlag, "local-manifest-projects", "", "A comma separated list of names of manifest projects whose local checked out manifests are used, while other imports are read from their remotes.")
 	cmdUpdate.Flags.UintVar(&attemptsFlag, "attempts", 3, "Number of attempts before failing.")
+	cmdUpdate.Flags.DurationVar(&retryBackoffFlag, "retry-backoff", jiri.DefaultRetryBackoff, "Delay before the first retry of a failed network operation, doubling for every further retry.")
 	cmdUpdate.Flags.BoolVar(&autoupdateFlag, "autoupdate", true, "Automatically update to the new version.")
 	cmdUpdate.Flags.BoolVar(&forceAutoupdateFlag, "force-autoupdate", false, "Always update to the current version.")
 	cmdUpdate.Flags.BoolVar(&rebaseUntrackedFlag, "rebase-untracked", false, "Rebase untracked branches onto HEAD.")
@@ -48,8 +71,20 @@ func init() {
 	cmdUpdate.Flags.BoolVar(&rebaseAllFlag, "rebase-all", false, "Rebase all tracked branches. Also rebase all untracked branches if -rebase-untracked is passed")
 	cmdUpdate.Flags.BoolVar(&rebaseCurrentFlag, "rebase-current", false, "Deprecated. Implies -rebase-tracked. Would be removed in future.")
 	cmdUpdate.Flags.BoolVar(&rebaseTrackedFlag, "rebase-tracked", false, "Rebase current tracked branches instead of fast-forwarding them.")
-	cmdUpdate.Flags.BoolVar(&runHooksFlag, "run-hooks", true, "Run hooks after updating sources.")
-	cmdUpdate.Flags.BoolVar(&fetchPkgsFlag, "fetch-packages", true, "Use cipd to fetch packages.")
+	cmdUpdate.Flags.BoolVar(&runHooksFlag, "run-hooks", true, "Run hooks after updating sources. Skipping hooks may leave the files they generate stale.")
+	cmdUpdate.Flags.BoolVar(&fetchPkgsFlag, "fetch-packages", true, "Use cipd to fetch packages. Skipping this may leave prebuilt packages out of date.")
+	cmdUpdate.Flags.BoolVar(&summaryFlag, "summary", true, "Print a summary of the projects that were updated, cloned or removed.")
+	cmdUpdate.Flags.StringVar(&updateJSONOutputFlag, "json-output", "", "File to write the update summary to, in json format.")
+	cmdUpdate.Flags.StringVar(&updateResultFileFlag, "result-file", "", "File to write the outcome of the update to, in json format: the status of every project operation, hook and package, and whether the update succeeded.")
+	cmdUpdate.Flags.BoolVar(&unshallowFlag, "unshallow", false, "Fetch the full history of shallow projects which no longer specify a history depth in the manifest.")
+	cmdUpdate.Flags.BoolVar(&pruneTagsFlag, "prune-tags", false, "Delete the local tags which no longer exist on the remotes of the projects. Tags created locally are deleted too.")
+	cmdUpdate.Flags.BoolVar(&autostashFlag, "autostash", false, "Stash uncommitted changes and untracked files of projects being updated, and restore them afterwards. By default such projects are not updated.")
+	cmdUpdate.Flags.BoolVar(&forceUpdateFlag, "force", false, "Update projects with uncommitted changes, discarding the changes that conflict with the new revision. By default such projects are not updated.")
+	cmdUpdate.Flags.BoolVar(&dryRunFlag, "dry-run", false, "Report which projects would be cloned, moved, updated or deleted without changing anything. Nothing is fetched, so the report is based on the remote state as of the last fetch.")
+	cmdUpdate.Flags.UintVar(&updateJobsFlag, "jobs", 0, "Number of projects to fetch, clone and update simultaneously, overriding the -j and -fetch-jobs flags and the jiri config. Zero keeps those settings.")
+	cmdUpdate.Flags.BoolVar(&logHooksFlag, "log-hooks", false, "Write the output of each hook to .jiri_root/hook_logs/<project>/<hook>.log.")
+	cmdUpdate.Flags.BoolVar(&skipPrecheckFlag, "skip-precheck", false, "Don't check that every remote host can be read before fetching projects.")
+	cmdUpdate.Flags.BoolVar(&offlineFlag, "offline", false, "Update projects using only objects already present locally, without fetching or cloning. Packages are not fetched, and hooks run with "+project.OfflineEnv+"=1 set.")
 }
 
 // cmdUpdate represents the "jiri update" command.
@@ -62,13 +97,49 @@ Updates all projects. The sequence in which the individual updates happen
 guarantees that we end up with a consistent workspace. The set of projects
 to update is described in the manifest.
 
+Once projects are updated, packages are fetched and hooks are run. For a
+quicker update of only the projects, pass -fetch-packages=false and
+-run-hooks=false; files generated by hooks and prebuilt packages may then be
+stale until "jiri run-hooks" and "jiri fetch-packages" are run.
+
+With -dry-run, the projects that would be cloned, moved, updated or deleted
+are reported, separately from those already up-to-date, and nothing is
+changed.
+
+Before fetching, one remote of every remote host is read with "git ls-remote",
+so that missing credentials or unreachable hosts fail the update once with
+instructions, rather than for every project. Pass -skip-precheck to skip this.
+
+With -local-manifest the manifests of all imports are read from the local
+checkouts of their projects, including uncommitted changes, instead of the
+revisions given by the manifest. With -local-manifest-projects only the
+imports of the named manifest projects are read locally, so that local edits
+of one manifest can be tried while every other import is resolved from its
+remote. A project defined both by such a local manifest and by a manifest read
+from its remote must be defined identically in both, otherwise the update
+fails with a duplicate project error.
+
+With -log-hooks the combined output of each hook is also written to
+.jiri_root/hook_logs/<project>/<hook>.log, replacing the logs of the previous
+run.
+
+With -result-file the outcome of the update is written to the given file in
+json format, even when the update fails: whether it succeeded, the operation
+run on every changed project with its old and new revisions, and the status
+of every hook and package. Unlike -json-output, which summarizes the
+revisions of projects, the file records what failed and what was skipped.
+
+When stdout is a terminal, the progress of fetching, creating and updating
+projects is shown as a bar counting the projects done and naming those in
+progress. Otherwise each step is logged on its own line.
+
 Run "jiri help manifest" for details on manifests.
 `,
 	ArgsName: "<file or url>",
 	ArgsLong: "<file or url> points to snapshot to checkout.",
 }
 
-func runUpdate(jirix *jiri.X, args []string) error {
+func runUpdate(jirix *jiri.X, args []string) (e error) {
 	if len(args) > 1 {
 		return jirix.UsageErrorf("unexpected number of arguments")
 	}
@@ -77,8 +148,47 @@ func runUpdate(jirix *jiri.X, args []string) error {
 		return jirix.UsageErrorf("Number of attempts should be >= 1")
 	}
 	jirix.Attempts = attemptsFlag
+	jirix.RetryBackoff = retryBackoffFlag
+	if offlineFlag && unshallowFlag {
+		return jirix.UsageErrorf("-offline and -unshallow cannot be used together")
+	}
+	jirix.Offline = offlineFlag
+	jirix.Unshallow = unshallowFlag
+	jirix.PruneTags = pruneTagsFlag
+	if autostashFlag && forceUpdateFlag {
+		return jirix.UsageErrorf("-autostash and -force cannot be used together")
+	}
+	jirix.Autostash = autostashFlag
+	jirix.ForceUpdate = forceUpdateFlag
+	jirix.DryRun = dryRunFlag
+	jirix.SkipPrecheck = skipPrecheckFlag
+	jirix.LogHooks = logHooksFlag
+	if localManifestsFlag != "" {
+		if localManifestFlag {
+			return jirix.UsageErrorf("-local-manifest and -local-manifest-projects cannot be used together")
+		}
+		for _, name := range strings.Split(localManifestsFlag, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				jirix.LocalManifests = append(jirix.LocalManifests, name)
+			}
+		}
+	}
+	if updateJobsFlag > 0 {
+		jirix.Jobs = updateJobsFlag
+		jirix.FetchJobs = updateJobsFlag
+	}
+	if updateResultFileFlag != "" {
+		jirix.UpdateResult = jiri.NewUpdateResult()
+		start := time.Now()
+		defer func() {
+			jirix.UpdateResult.Finish(time.Since(start), e)
+			if err := jirix.UpdateResult.ToFile(updateResultFileFlag); err != nil && e == nil {
+				e = err
+			}
+		}()
+	}
 
-	if autoupdateFlag {
+	if autoupdateFlag && !offlineFlag && !dryRunFlag {
 		// Try to update Jiri itself.
 		if err := retry.Function(jirix, func() error {
 			return jiri.UpdateAndExecute(forceAutoupdateFlag)
@@ -91,6 +201,12 @@ func runUpdate(jirix *jiri.X, args []string) error {
 		rebaseTrackedFlag = true
 	}
 
+	printSummary := (summaryFlag || updateJSONOutputFlag != "") && !dryRunFlag
+	if printSummary && jirix.UpdateResult == nil {
+		// The summary is computed from the operations run on the projects.
+		jirix.UpdateResult = jiri.NewUpdateResult()
+	}
+
 	if len(args) > 0 {
 		if err := project.CheckoutSnapshot(jirix, args[0], gcFlag, runHooksFlag, fetchPkgsFlag, hookTimeoutFlag, fetchPkgsTimeoutFlag); err != nil {
 			return err
@@ -107,6 +223,9 @@ func runUpdate(jirix *jiri.X, args []string) error {
 
 		err := project.UpdateUniverse(jirix, gcFlag, localManifestFlag,
 			rebaseTrackedFlag, rebaseUntrackedFlag, rebaseAllFlag, runHooksFlag, fetchPkgsFlag, hookTimeoutFlag, fetchPkgsTimeoutFlag)
+		if dryRunFlag {
+			return err
+		}
 		if err2 := project.WriteUpdateHistorySnapshot(jirix, "", nil, nil, localManifestFlag); err2 != nil {
 			if err != nil {
 				return fmt.Errorf("while updating: %s, while writing history: %s", err, err2)
@@ -123,8 +242,118 @@ func runUpdate(jirix *jiri.X, args []string) error {
 		}
 	}
 
+	if printSummary {
+		summary := computeUpdateSummary(jirix, jirix.UpdateResult)
+		if summaryFlag {
+			summary.print(jirix.Stdout())
+		}
+		if updateJSONOutputFlag != "" {
+			if err := summary.toFile(updateJSONOutputFlag); err != nil {
+				return err
+			}
+		}
+	}
+
 	if jirix.Failures() != 0 {
 		return fmt.Errorf("Project update completed with non-fatal errors")
 	}
 	return nil
 }
+
+// projectChange describes how a single project was changed by an update.
+type projectChange struct {
+	Name        string `json:"name"`
+	Path        string `json:"path"`
+	OldRevision string `json:"old_revision,omitempty"`
+	NewRevision string `json:"new_revision,omitempty"`
+	// NewCommits is the number of commits between OldRevision and
+	// NewRevision, or -1 if it could not be determined.
+	NewCommits int `json:"new_commits,omitempty"`
+}
+
+// updateSummary lists the projects changed by an update.
+type updateSummary struct {
+	Updated []projectChange `json:"updated"`
+	Created []projectChange `json:"created"`
+	Deleted []projectChange `json:"deleted"`
+}
+
+// computeUpdateSummary returns the projects changed by the operations
+// recorded in result.
+func computeUpdateSummary(jirix *jiri.X, result *jiri.UpdateResult) *updateSummary {
+	summary := &updateSummary{}
+	for _, p := range result.Projects {
+		if p.Status != jiri.ResultOK {
+			continue
+		}
+		c := projectChange{Name: p.Name, Path: p.Path}
+		switch p.Action {
+		case "create":
+			c.NewRevision = p.NewRevision
+			summary.Created = append(summary.Created, c)
+		case "delete":
+			// Projects with local work are left in place.
+			if _, err := os.Stat(filepath.Join(jirix.Root, p.Path)); os.IsNotExist(err) {
+				c.OldRevision = p.OldRevision
+				summary.Deleted = append(summary.Deleted, c)
+			}
+		default:
+			if p.OldRevision == p.NewRevision {
+				continue
+			}
+			c.OldRevision = p.OldRevision
+			c.NewRevision = p.NewRevision
+			count, err := gitutil.New(jirix, gitutil.RootDirOpt(filepath.Join(jirix.Root, p.Path))).CountCommits(p.NewRevision, p.OldRevision)
+			if err != nil {
+				count = -1
+			}
+			c.NewCommits = count
+			summary.Updated = append(summary.Updated, c)
+		}
+	}
+	for _, changes := range [][]projectChange{summary.Updated, summary.Created, summary.Deleted} {
+		sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	}
+	return summary
+}
+
+func shortRevision(revision string) string {
+	if len(revision) > 7 {
+		return revision[:7]
+	}
+	return revision
+}
+
+func (s *updateSummary) print(w io.Writer) {
+	if len(s.Updated)+len(s.Created)+len(s.Deleted) == 0 {
+		fmt.Fprintln(w, "No projects changed")
+		return
+	}
+	for _, c := range s.Updated {
+		fmt.Fprintf(w, "Updated %s: %s -> %s", c.Path, shortRevision(c.OldRevision), shortRevision(c.NewRevision))
+		switch {
+		case c.NewCommits == 1:
+			fmt.Fprintf(w, " (1 new commit)")
+		case c.NewCommits > 1:
+			fmt.Fprintf(w, " (%d new commits)", c.NewCommits)
+		}
+		fmt.Fprintln(w)
+	}
+	for _, c := range s.Created {
+		fmt.Fprintf(w, "Cloned %s at %s\n", c.Path, shortRevision(c.NewRevision))
+	}
+	for _, c := range s.Deleted {
+		fmt.Fprintf(w, "Removed %s\n", c.Path)
+	}
+}
+
+func (s *updateSummary) toFile(filename string) error {
+	out, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to serialize JSON output: %s\n", err)
+	}
+	if err := ioutil.WriteFile(filename, out, 0600); err != nil {
+		return fmt.Errorf("failed write JSON output to %s: %s\n", filename, err)
+	}
+	return nil
+}
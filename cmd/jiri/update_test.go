@@ -0,0 +1,309 @@
+// Copyright 2019 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/dahlia-os/jiri"
+	"github.com/dahlia-os/jiri/gitutil"
+	"github.com/dahlia-os/jiri/jiritest"
+	"github.com/dahlia-os/jiri/project"
+)
+
+func TestUpdateSummary(t *testing.T) {
+	fake, cleanup := jiritest.NewFakeJiriRoot(t)
+	defer cleanup()
+
+	newProject := func(name string) project.Project {
+		if err := fake.CreateRemoteProject(name); err != nil {
+			t.Fatal(err)
+		}
+		return project.Project{
+			Name:   name,
+			Path:   filepath.Join(fake.X.Root, name),
+			Remote: fake.Projects[name],
+		}
+	}
+	commit := func(name, file string) {
+		remote := fake.Projects[name]
+		if err := ioutil.WriteFile(filepath.Join(remote, file), []byte(file), 0644); err != nil {
+			t.Fatal(err)
+		}
+		git := gitutil.New(fake.X, gitutil.UserNameOpt("John Doe"), gitutil.UserEmailOpt("john.doe@example.com"), gitutil.RootDirOpt(remote))
+		if err := git.CommitFile(file, "add "+file); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, name := range []string{"changed", "same", "removed"} {
+		if err := fake.AddProject(newProject(name)); err != nil {
+			t.Fatal(err)
+		}
+		commit(name, "README")
+	}
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+
+	commit("changed", "file1")
+	commit("changed", "file2")
+	if err := fake.AddProject(newProject("added")); err != nil {
+		t.Fatal(err)
+	}
+	commit("added", "README")
+	m, err := fake.ReadRemoteManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	projects := []project.Project{}
+	for _, p := range m.Projects {
+		if p.Name != "removed" {
+			projects = append(projects, p)
+		}
+	}
+	m.Projects = projects
+	if err := fake.WriteRemoteManifest(m); err != nil {
+		t.Fatal(err)
+	}
+	fake.X.UpdateResult = jiri.NewUpdateResult()
+	if err := fake.UpdateUniverse(true); err != nil {
+		t.Fatal(err)
+	}
+
+	// The manifest project is updated as well.
+	summary := computeUpdateSummary(fake.X, fake.X.UpdateResult)
+	if len(summary.Updated) != 2 || summary.Updated[0].Path != "changed" || summary.Updated[0].NewCommits != 2 || summary.Updated[1].Path != "manifest" {
+		t.Errorf("unexpected updated projects: %+v", summary.Updated)
+	}
+	if len(summary.Created) != 1 || summary.Created[0].Path != "added" {
+		t.Errorf("unexpected created projects: %+v", summary.Created)
+	}
+	if len(summary.Deleted) != 1 || summary.Deleted[0].Path != "removed" {
+		t.Errorf("unexpected deleted projects: %+v", summary.Deleted)
+	}
+
+	var buf bytes.Buffer
+	summary.print(&buf)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 4 ||
+		!strings.HasPrefix(lines[0], "Updated changed: ") || !strings.HasSuffix(lines[0], "(2 new commits)") ||
+		!strings.HasPrefix(lines[1], "Updated manifest: ") ||
+		!strings.HasPrefix(lines[2], "Cloned added at ") ||
+		lines[3] != "Removed removed" {
+		t.Errorf("unexpected summary:\n%s", buf.String())
+	}
+
+	file := filepath.Join(fake.X.Root, "summary.json")
+	if err := summary.toFile(file); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got updateSummary
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&got, summary) {
+		t.Errorf("got %+v, want %+v", got, *summary)
+	}
+
+	fake.X.UpdateResult = jiri.NewUpdateResult()
+	if err := fake.UpdateUniverse(true); err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	computeUpdateSummary(fake.X, fake.X.UpdateResult).print(&buf)
+	if got, want := buf.String(), "No projects changed\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestUpdateSkipHooksAndPackages(t *testing.T) {
+	fake, cleanup := jiritest.NewFakeJiriRoot(t)
+	defer cleanup()
+	defer func(autoupdate, runHooks, fetchPkgs bool) {
+		autoupdateFlag, runHooksFlag, fetchPkgsFlag = autoupdate, runHooks, fetchPkgs
+	}(autoupdateFlag, runHooksFlag, fetchPkgsFlag)
+	autoupdateFlag = false
+
+	p := createProjects(t, fake, 1)[0]
+	remote := fake.Projects[p.Name]
+	script := filepath.Join(remote, "hook.sh")
+	if err := ioutil.WriteFile(script, []byte("#!/bin/sh\ntouch hook.out\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := gitutil.New(fake.X, gitutil.UserNameOpt("John Doe"), gitutil.UserEmailOpt("john.doe@example.com"), gitutil.RootDirOpt(remote)).CommitFile("hook.sh", "add hook.sh"); err != nil {
+		t.Fatal(err)
+	}
+	m, err := fake.ReadRemoteManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Hooks = append(m.Hooks, project.Hook{Name: "hook", Action: "hook.sh", ProjectName: p.Name})
+	// Fetching this package fails, so the update only succeeds if it is not
+	// fetched.
+	m.Packages = append(m.Packages, project.Package{Name: "jiri/test/missing", Version: "version:0", Path: "missing-package"})
+	if err := fake.WriteRemoteManifest(m); err != nil {
+		t.Fatal(err)
+	}
+	hookOut := filepath.Join(p.Path, "hook.out")
+
+	runHooksFlag, fetchPkgsFlag = false, false
+	if err := runUpdate(fake.X, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(hookOut); !os.IsNotExist(err) {
+		t.Errorf("hook ran with -run-hooks=false: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(fake.X.Root, "missing-package")); !os.IsNotExist(err) {
+		t.Errorf("package fetched with -fetch-packages=false: %v", err)
+	}
+
+	runHooksFlag = true
+	if err := runUpdate(fake.X, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(hookOut); err != nil {
+		t.Errorf("hook did not run with -run-hooks=true: %v", err)
+	}
+}
+
+func TestUpdateJobs(t *testing.T) {
+	fake, cleanup := jiritest.NewFakeJiriRoot(t)
+	defer cleanup()
+	defer func(autoupdate bool, jobs uint) {
+		autoupdateFlag, updateJobsFlag = autoupdate, jobs
+	}(autoupdateFlag, updateJobsFlag)
+	autoupdateFlag = false
+
+	projects := createProjects(t, fake, 3)
+	updateJobsFlag = 1
+	if err := runUpdate(fake.X, nil); err != nil {
+		t.Fatal(err)
+	}
+	if fake.X.Jobs != 1 || fake.X.FetchJobs != 1 {
+		t.Errorf("got %d jobs and %d fetch jobs, want 1 and 1", fake.X.Jobs, fake.X.FetchJobs)
+	}
+	for _, p := range projects {
+		if _, err := os.Stat(filepath.Join(p.Path, ".git")); err != nil {
+			t.Errorf("project %q not created: %v", p.Name, err)
+		}
+	}
+}
+
+func TestUpdateResultFile(t *testing.T) {
+	fake, cleanup := jiritest.NewFakeJiriRoot(t)
+	defer cleanup()
+	defer func(autoupdate bool, resultFile string) {
+		autoupdateFlag, updateResultFileFlag = autoupdate, resultFile
+	}(autoupdateFlag, updateResultFileFlag)
+	autoupdateFlag = false
+
+	projects := createProjects(t, fake, 2)
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	git := func(p project.Project) *gitutil.Git {
+		return gitutil.New(fake.X, gitutil.RootDirOpt(p.Path))
+	}
+	oldRev, err := git(projects[0]).CurrentRevision()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Update project-0 with a passing and a failing hook, and add project-2.
+	remote := fake.Projects[projects[0].Name]
+	remoteGit := gitutil.New(fake.X, gitutil.UserNameOpt("John Doe"), gitutil.UserEmailOpt("john.doe@example.com"), gitutil.RootDirOpt(remote))
+	for file, script := range map[string]string{"pass.sh": "#!/bin/sh\nexit 0\n", "fail.sh": "#!/bin/sh\nexit 1\n"} {
+		if err := ioutil.WriteFile(filepath.Join(remote, file), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := remoteGit.CommitFile(file, "add "+file); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fake.CreateRemoteProject("project-2"); err != nil {
+		t.Fatal(err)
+	}
+	added := project.Project{
+		Name:   "project-2",
+		Path:   filepath.Join(fake.X.Root, "path-2"),
+		Remote: fake.Projects["project-2"],
+	}
+	if err := fake.AddProject(added); err != nil {
+		t.Fatal(err)
+	}
+	m, err := fake.ReadRemoteManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Hooks = append(m.Hooks,
+		project.Hook{Name: "pass", Action: "pass.sh", ProjectName: projects[0].Name},
+		project.Hook{Name: "fail", Action: "fail.sh", ProjectName: projects[0].Name})
+	if err := fake.WriteRemoteManifest(m); err != nil {
+		t.Fatal(err)
+	}
+
+	updateResultFileFlag = filepath.Join(fake.X.Root, "result.json")
+	if err := runUpdate(fake.X, nil); err == nil {
+		t.Fatal("expected the update to fail on the failing hook")
+	}
+	data, err := ioutil.ReadFile(updateResultFileFlag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result jiri.UpdateResult
+	if err := json.Unmarshal(data, &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Success || result.Error == "" {
+		t.Errorf("got success %v and error %q, want a failure", result.Success, result.Error)
+	}
+
+	newRev, err := git(projects[0]).CurrentRevision()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addedRev, err := git(added).CurrentRevision()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The manifest project is updated too, but its revisions are not
+	// checked.
+	var gotProjects []jiri.ProjectResult
+	for _, p := range result.Projects {
+		if p.Name == "manifest" {
+			continue
+		}
+		p.DurationMs = 0
+		gotProjects = append(gotProjects, p)
+	}
+	wantProjects := []jiri.ProjectResult{
+		{Name: projects[0].Name, Path: "path-0", Action: "update", Status: jiri.ResultOK, OldRevision: oldRev, NewRevision: newRev},
+		{Name: added.Name, Path: "path-2", Action: "create", Status: jiri.ResultOK, NewRevision: addedRev},
+	}
+	if !reflect.DeepEqual(gotProjects, wantProjects) {
+		t.Errorf("got projects %+v, want %+v", gotProjects, wantProjects)
+	}
+
+	var gotHooks []string
+	for _, h := range result.Hooks {
+		gotHooks = append(gotHooks, h.Name+": "+h.Status)
+	}
+	wantHooks := []string{"fail: " + jiri.ResultFailed, "pass: " + jiri.ResultOK}
+	if !reflect.DeepEqual(gotHooks, wantHooks) {
+		t.Errorf("got hooks %v, want %v", gotHooks, wantHooks)
+	}
+}
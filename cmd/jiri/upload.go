@@ -5,9 +5,11 @@
 package main
 
 import (
+	"crypto/sha1"
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/dahlia-os/jiri"
@@ -24,11 +26,19 @@ var (
 	uploadTopicFlag        string
 	uploadVerifyFlag       bool
 	uploadRebaseFlag       bool
+	uploadAutosquashFlag   bool
+	uploadSquashFlag       bool
+	uploadSquashBaseFlag   string
 	uploadSetTopicFlag     bool
 	uploadMultipartFlag    bool
 	uploadBranchFlag       string
 	uploadRemoteBranchFlag string
 	uploadGitOptions       string
+	uploadWIPFlag          bool
+	uploadReadyFlag        bool
+	uploadSplitByFlag      string
+	uploadProjectFlag      string
+	uploadNoRebaseCheck    bool
 )
 
 type uploadError string
@@ -40,10 +50,32 @@ func (e uploadError) Error() string {
 }
 
 var cmdUpload = &cmdline.Command{
-	Runner:   jiri.RunnerFunc(runUpload),
-	Name:     "upload",
-	Short:    "Upload a changelist for review",
-	Long:     `Command "upload" uploads commits of a local branch to Gerrit.`,
+	Runner: jiri.RunnerFunc(runUpload),
+	Name:   "upload",
+	Short:  "Upload a changelist for review",
+	Long: `
+Command "upload" uploads commits of a local branch to Gerrit.
+
+The experimental -split-by flag uploads the changes of the branch as one
+change per path prefix instead, plus one change for the files outside of all
+prefixes. Each change is a single new commit on top of the merge base with
+the remote branch, or with -squash-base, so the history of the branch is
+rewritten into per-prefix commits. The changes are independent of each other
+and use the message of the oldest commit, with the prefix prepended to the
+subject and a Change-Id derived from the original one, so that uploading
+again updates the same changes. The local branch is left unchanged. Changes
+that depend on each other across prefixes must be submitted together.
+
+By default the project containing the current directory is uploaded. With
+-project, the project with the given name in the manifest is uploaded
+instead, from anywhere in the workspace. It must be checked out and on a
+branch.
+
+Unless -rebase is given, the remote is fetched before uploading and a warning
+is printed when the change is based on a revision which is behind the remote
+branch, with the number of commits it is behind, so that it can be rebased
+before it is reviewed. -no-rebase-check skips this check, and the fetch.
+`,
 	ArgsName: "<ref>",
 	ArgsLong: `
 <ref> is the valid git ref to upload. It is optional and HEAD is used by
@@ -60,11 +92,19 @@ func init() {
 	cmdUpload.Flags.BoolVar(&uploadSetTopicFlag, "set-topic", false, `Set topic. This flag would be ignored if -topic passed.`)
 	cmdUpload.Flags.BoolVar(&uploadVerifyFlag, "verify", true, `Run pre-push git hooks.`)
 	cmdUpload.Flags.BoolVar(&uploadRebaseFlag, "rebase", false, `Run rebase before pushing.`)
+	cmdUpload.Flags.BoolVar(&uploadAutosquashFlag, "autosquash", false, `Squash "fixup!" and "squash!" commits into the commits they amend before pushing.`)
+	cmdUpload.Flags.BoolVar(&uploadSquashFlag, "squash", false, `Squash the commits since the squash base into a single change before pushing. The local branch is left unchanged and the change uses the message of the oldest commit.`)
+	cmdUpload.Flags.StringVar(&uploadSquashBaseFlag, "squash-base", "", `Ref that -squash and -autosquash compute the commits of the change against, e.g. the branch of the parent change for stacked changes. Default is the remote branch.`)
 	cmdUpload.Flags.BoolVar(&uploadMultipartFlag, "multipart", false, `Send multipart CL.  Use -set-topic or -topic flag if you want to set a topic.`)
 	cmdUpload.Flags.StringVar(&uploadBranchFlag, "branch", "", `Used when multipart flag is true and this command is executed from root folder`)
 	cmdUpload.Flags.StringVar(&uploadRemoteBranchFlag, "remoteBranch", "", `Remote branch to upload change to. If this is not specified and branch is untracked,
 change would be uploaded to branch in project manifest`)
 	cmdUpload.Flags.StringVar(&uploadGitOptions, "git-options", "", `Passthrough git options`)
+	cmdUpload.Flags.BoolVar(&uploadWIPFlag, "wip", false, `Mark the change as work in progress.`)
+	cmdUpload.Flags.BoolVar(&uploadReadyFlag, "ready", false, `Mark a work in progress change as ready for review.`)
+	cmdUpload.Flags.BoolVar(&uploadNoRebaseCheck, "no-rebase-check", false, `Do not fetch the remote to warn when the change is based on a revision behind the remote branch.`)
+	cmdUpload.Flags.StringVar(&uploadProjectFlag, "project", "", `Name of the project to upload, as given in the manifest, instead of the project containing the current directory. This cannot be used with -multipart flag.`)
+	cmdUpload.Flags.StringVar(&uploadSplitByFlag, "split-by", "", `Experimental. Comma-separated list of path prefixes to upload the changes of the branch as one change each, plus one change for all other files. The commits are rewritten into a single commit per change.`)
 }
 
 // runUpload is a wrapper that pushes the changes to gerrit for review.
@@ -78,14 +118,34 @@ func runUpload(jirix *jiri.X, args []string) error {
 	if uploadMultipartFlag && refToUpload != "HEAD" {
 		return jirix.UsageErrorf("can only use HEAD as <ref> when using -multipart flag.")
 	}
+	if uploadAutosquashFlag && refToUpload != "HEAD" {
+		return jirix.UsageErrorf("can only use HEAD as <ref> when using -autosquash flag.")
+	}
+	if uploadSquashBaseFlag != "" && !uploadSquashFlag && !uploadAutosquashFlag && uploadSplitByFlag == "" {
+		return jirix.UsageErrorf("-squash-base requires -squash, -autosquash or -split-by.")
+	}
+	if uploadSquashFlag && uploadSplitByFlag != "" {
+		return jirix.UsageErrorf("-squash and -split-by cannot be used together.")
+	}
+	if uploadWIPFlag && uploadReadyFlag {
+		return jirix.UsageErrorf("-wip and -ready cannot be used together.")
+	}
+	if uploadMultipartFlag && uploadProjectFlag != "" {
+		return jirix.UsageErrorf("-multipart and -project cannot be used together.")
+	}
 	dir, err := os.Getwd()
 	if err != nil {
 		return fmt.Errorf("os.Getwd() failed: %s", err)
 	}
 	var p *project.Project
+	if uploadProjectFlag != "" {
+		if p, err = uploadProjectByName(jirix, uploadProjectFlag); err != nil {
+			return err
+		}
+	}
 	// Walk up the path until we find a project at that path, or hit the jirix.Root parent.
 	// Note that we can't just compare path prefixes because of soft links.
-	for dir != filepath.Dir(jirix.Root) && dir != string(filepath.Separator) {
+	for p == nil && dir != filepath.Dir(jirix.Root) && dir != string(filepath.Separator) {
 		if isLocal, err := project.IsLocalProject(jirix, dir); err != nil {
 			return fmt.Errorf("Error while checking for local project at path %q: %s", dir, err)
 		} else if !isLocal {
@@ -184,7 +244,7 @@ func runUpload(jirix *jiri.X, args []string) error {
 			// Just use the full path if an error occurred.
 			relativePath = project.Path
 		}
-		if uploadRebaseFlag {
+		if uploadRebaseFlag || uploadAutosquashFlag {
 			if changes, err := gitutil.New(jirix, gitutil.RootDirOpt(project.Path)).HasUncommittedChanges(); err != nil {
 				return err
 			} else if changes {
@@ -212,11 +272,13 @@ func runUpload(jirix *jiri.X, args []string) error {
 			GitOptions:   uploadGitOptions,
 			Presubmit:    gerrit.PresubmitTestType(uploadPresubmitFlag),
 			RemoteBranch: remoteBranch,
-			Remote:       "origin",
+			Remote:       project.GitRemoteName(),
 			Reviewers:    parseEmails(uploadReviewersFlag),
 			Verify:       uploadVerifyFlag,
 			Topic:        topic,
 			RefToUpload:  refToUpload,
+			WIP:          uploadWIPFlag,
+			Ready:        uploadReadyFlag,
 		}
 
 		if opts.Presubmit == gerrit.PresubmitTestType("") {
@@ -225,14 +287,21 @@ func runUpload(jirix *jiri.X, args []string) error {
 		gerritPushOptions = append(gerritPushOptions, GerritPushOption{project, opts, relativePath})
 	}
 
+	// Warn about changes based on a stale revision, which -rebase fixes
+	if !uploadRebaseFlag && !uploadNoRebaseCheck {
+		for _, gerritPushOption := range gerritPushOptions {
+			checkUploadBase(jirix, gerritPushOption.Project, gerritPushOption.relativePath, gerritPushOption.CLOpts)
+		}
+	}
+
 	// Rebase all projects before pushing
 	if uploadRebaseFlag {
 		for _, gerritPushOption := range gerritPushOptions {
 			scm := gitutil.New(jirix, gitutil.RootDirOpt(gerritPushOption.Project.Path))
-			if err := scm.Fetch("origin"); err != nil {
+			if err := scm.Fetch(gerritPushOption.CLOpts.Remote); err != nil {
 				return err
 			}
-			remoteBranch := "remotes/origin/" + gerritPushOption.CLOpts.RemoteBranch
+			remoteBranch := gerritPushOption.Project.RemoteRef(gerritPushOption.CLOpts.RemoteBranch)
 			if err = scm.Rebase(remoteBranch); err != nil {
 				if err2 := scm.RebaseAbort(); err2 != nil {
 					return err2
@@ -242,6 +311,52 @@ func runUpload(jirix *jiri.X, args []string) error {
 		}
 	}
 
+	// Squash fixup commits of all projects before pushing
+	if uploadAutosquashFlag {
+		for _, gerritPushOption := range gerritPushOptions {
+			scm := gitutil.New(jirix, gitutil.RootDirOpt(gerritPushOption.Project.Path))
+			base, err := scm.MergeBase("HEAD", squashBase(gerritPushOption.CLOpts))
+			if err != nil {
+				return err
+			}
+			if err := scm.RebaseInteractiveScripted(base, nil, gitutil.AutosquashOpt(true)); err != nil {
+				if err2 := scm.RebaseAbort(); err2 != nil {
+					return err2
+				}
+				return fmt.Errorf("For project %s(%s), not able to autosquash the branch, please run \"git rebase -i --autosquash %s\" manually: %s", gerritPushOption.Project.Name, gerritPushOption.relativePath, base, err)
+			}
+		}
+	}
+
+	// Squash the commits of all projects into a single change before pushing
+	if uploadSquashFlag {
+		for i, gerritPushOption := range gerritPushOptions {
+			ref, err := squashCommits(jirix, gerritPushOption.Project.Path, gerritPushOption.CLOpts)
+			if err != nil {
+				return fmt.Errorf("For project %s(%s), not able to squash the branch: %s", gerritPushOption.Project.Name, gerritPushOption.relativePath, err)
+			}
+			gerritPushOptions[i].CLOpts.RefToUpload = ref
+		}
+	}
+
+	// Split the changes of all projects by path before pushing
+	if uploadSplitByFlag != "" {
+		prefixes := parsePrefixes(uploadSplitByFlag)
+		var split []GerritPushOption
+		for _, gerritPushOption := range gerritPushOptions {
+			refs, err := splitCommits(jirix, gerritPushOption.Project.Path, gerritPushOption.CLOpts, prefixes)
+			if err != nil {
+				return fmt.Errorf("For project %s(%s), not able to split the branch: %s", gerritPushOption.Project.Name, gerritPushOption.relativePath, err)
+			}
+			for _, ref := range refs {
+				opts := gerritPushOption.CLOpts
+				opts.RefToUpload = ref
+				split = append(split, GerritPushOption{gerritPushOption.Project, opts, gerritPushOption.relativePath})
+			}
+		}
+		gerritPushOptions = split
+	}
+
 	for _, gerritPushOption := range gerritPushOptions {
 		fmt.Printf("Pushing project %s(%s)\n", gerritPushOption.Project.Name, gerritPushOption.relativePath)
 		if err := gerrit.Push(jirix, gerritPushOption.Project.Path, gerritPushOption.CLOpts); err != nil {
@@ -261,6 +376,188 @@ func runUpload(jirix *jiri.X, args []string) error {
 	return nil
 }
 
+// checkUploadBase fetches the remote of project p and warns if the change
+// described by opts is based on a revision behind the remote branch. Failing
+// to check is not an error, as the change can be uploaded anyway.
+func checkUploadBase(jirix *jiri.X, p project.Project, relativePath string, opts gerrit.CLOpts) {
+	scm := gitutil.New(jirix, gitutil.RootDirOpt(p.Path))
+	if err := scm.Fetch(opts.Remote); err != nil {
+		jirix.Logger.Warningf("Not able to fetch project %s(%s) to check whether the change is based on the latest revision: %s\n\n", p.Name, relativePath, err)
+		return
+	}
+	remoteRef := p.RemoteRef(opts.RemoteBranch)
+	_, behind, err := scm.AheadBehind(opts.RefToUpload, remoteRef)
+	if err != nil {
+		jirix.Logger.Warningf("Not able to check whether the change of project %s(%s) is based on the latest revision: %s\n\n", p.Name, relativePath, err)
+		return
+	}
+	if behind > 0 {
+		jirix.Logger.Warningf("The change of project %s(%s) is based on a revision %d commit(s) behind %s. Consider rebasing it, e.g. with -rebase, before sending it for review.\n\n", p.Name, relativePath, behind, remoteRef)
+	}
+}
+
+// uploadProjectByName returns the local project with the given name in the
+// manifest, which must be checked out and on a branch.
+func uploadProjectByName(jirix *jiri.X, name string) (*project.Project, error) {
+	localProjects, err := project.LocalProjects(jirix, project.FastScan)
+	if err != nil {
+		return nil, err
+	}
+	remoteProjects, _, _, err := project.LoadManifestFile(jirix, jirix.JiriManifestFile(), localProjects, false /*localManifest*/)
+	if err != nil {
+		return nil, err
+	}
+	var matches []project.Project
+	for _, remote := range remoteProjects {
+		if remote.Name == name {
+			matches = append(matches, remote)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("project %q not found in the manifest", name)
+	case 1:
+	default:
+		sort.Sort(project.ProjectsByPath(matches))
+		var paths []string
+		for _, m := range matches {
+			paths = append(paths, m.Path)
+		}
+		return nil, fmt.Errorf("more than one project named %q in the manifest, at %s", name, strings.Join(paths, ", "))
+	}
+	p, ok := localProjects[matches[0].Key()]
+	if !ok {
+		return nil, fmt.Errorf("project %q is not checked out, run \"jiri update\" first", name)
+	}
+	if !gitutil.New(jirix, gitutil.RootDirOpt(p.Path)).IsOnBranch() {
+		return nil, fmt.Errorf("project %q is not on any branch, check out the branch to upload", name)
+	}
+	return &p, nil
+}
+
+// squashBase returns the ref that the change described by opts is computed
+// against.
+func squashBase(opts gerrit.CLOpts) string {
+	if uploadSquashBaseFlag != "" {
+		return uploadSquashBaseFlag
+	}
+	return "remotes/" + opts.Remote + "/" + opts.RemoteBranch
+}
+
+// squashCommits creates a commit with the content of opts.RefToUpload whose
+// parent is the merge base of that ref and the squash base, and returns its
+// hash. The ref is returned as is when it has a single commit on top of the
+// merge base.
+func squashCommits(jirix *jiri.X, dir string, opts gerrit.CLOpts) (string, error) {
+	scm := gitutil.New(jirix, gitutil.RootDirOpt(dir))
+	base, err := scm.MergeBase(opts.RefToUpload, squashBase(opts))
+	if err != nil {
+		return "", err
+	}
+	commits, err := scm.ExtraCommits(opts.RefToUpload, base)
+	if err != nil {
+		return "", err
+	}
+	switch len(commits) {
+	case 0:
+		return "", fmt.Errorf("no commits in %s since %s", opts.RefToUpload, squashBase(opts))
+	case 1:
+		return opts.RefToUpload, nil
+	}
+	// Commits are listed newest first.
+	message, err := scm.CommitMsg(commits[len(commits)-1])
+	if err != nil {
+		return "", err
+	}
+	return scm.CommitTree(opts.RefToUpload, message, base)
+}
+
+// parsePrefixes returns the path prefixes in the comma-separated value.
+func parsePrefixes(value string) []string {
+	var prefixes []string
+	for _, prefix := range strings.Split(value, ",") {
+		if prefix = strings.Trim(strings.TrimSpace(prefix), "/"); prefix != "" {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	return prefixes
+}
+
+// splitCommits creates a commit for each of the prefixes, and one for all
+// other files, with the changes that opts.RefToUpload makes to those files
+// since its merge base with the squash base.  All commits have that merge
+// base as their parent.  The hashes of the commits that change any files are
+// returned.
+func splitCommits(jirix *jiri.X, dir string, opts gerrit.CLOpts, prefixes []string) ([]string, error) {
+	scm := gitutil.New(jirix, gitutil.RootDirOpt(dir))
+	base, err := scm.MergeBase(opts.RefToUpload, squashBase(opts))
+	if err != nil {
+		return nil, err
+	}
+	commits, err := scm.ExtraCommits(opts.RefToUpload, base)
+	if err != nil {
+		return nil, err
+	}
+	if len(commits) == 0 {
+		return nil, fmt.Errorf("no commits in %s since %s", opts.RefToUpload, squashBase(opts))
+	}
+	// Commits are listed newest first.
+	oldest := commits[len(commits)-1]
+	message, err := scm.CommitMsg(oldest)
+	if err != nil {
+		return nil, err
+	}
+
+	rest := []string{"."}
+	for _, prefix := range prefixes {
+		rest = append(rest, ":(exclude)"+prefix)
+	}
+	var refs []string
+	for i := 0; i <= len(prefixes); i++ {
+		label, pathspecs := "", rest
+		if i < len(prefixes) {
+			label, pathspecs = prefixes[i], []string{prefixes[i]}
+		}
+		tree, err := scm.TreeWithPaths(base, opts.RefToUpload, pathspecs...)
+		if err != nil {
+			return nil, err
+		}
+		ref, err := scm.CommitTree(tree, splitMessage(message, label, oldest), base)
+		if err != nil {
+			return nil, err
+		}
+		if files, err := scm.ModifiedFiles(base, ref); err != nil {
+			return nil, err
+		} else if len(files) > 0 {
+			refs = append(refs, ref)
+		}
+	}
+	return refs, nil
+}
+
+// splitMessage returns message with label prepended to its subject and its
+// Change-Id replaced by one derived from the original Change-Id, or from
+// commit if there is none, and label.
+func splitMessage(message, label, commit string) string {
+	lines := strings.Split(strings.TrimRight(message, "\n"), "\n")
+	if label != "" {
+		lines[0] = label + ": " + lines[0]
+	}
+	seed, index := commit, -1
+	for i, line := range lines {
+		if strings.HasPrefix(line, "Change-Id:") {
+			seed, index = strings.TrimSpace(strings.TrimPrefix(line, "Change-Id:")), i
+		}
+	}
+	changeID := fmt.Sprintf("Change-Id: I%x", sha1.Sum([]byte(seed+"\x00"+label)))
+	if index < 0 {
+		lines = append(lines, "", changeID)
+	} else {
+		lines[index] = changeID
+	}
+	return strings.Join(lines, "\n")
+}
+
 // parseEmails input a list of comma separated tokens and outputs a
 // list of email addresses. The tokens can either be email addresses
 // or Google LDAPs in which case the suffix @google.com is appended to
@@ -5,17 +5,21 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/dahlia-os/jiri"
 	"github.com/dahlia-os/jiri/gerrit"
 	"github.com/dahlia-os/jiri/gitutil"
 	"github.com/dahlia-os/jiri/jiritest"
+	"github.com/dahlia-os/jiri/log"
 	"github.com/dahlia-os/jiri/project"
 )
 
@@ -118,10 +122,18 @@ func resetFlags() {
 	uploadTopicFlag = ""
 	uploadVerifyFlag = true
 	uploadRebaseFlag = false
+	uploadAutosquashFlag = false
+	uploadSquashFlag = false
+	uploadSquashBaseFlag = ""
 	uploadMultipartFlag = false
 	uploadBranchFlag = ""
 	uploadRemoteBranchFlag = ""
 	uploadSetTopicFlag = false
+	uploadWIPFlag = false
+	uploadReadyFlag = false
+	uploadSplitByFlag = ""
+	uploadProjectFlag = ""
+	uploadNoRebaseCheck = false
 }
 
 func TestUpload(t *testing.T) {
@@ -170,6 +182,53 @@ func TestUpload(t *testing.T) {
 	assertUploadPushedFilesToRef(t, fake.X, gerritPath, expectedRef, files)
 }
 
+func TestUploadWIP(t *testing.T) {
+	defer resetFlags()
+	fake, localProjects, cleanup := setupUploadTest(t)
+	defer cleanup()
+	currentDir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.Chdir(currentDir); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	if err := os.Chdir(localProjects[1].Path); err != nil {
+		t.Fatal(err)
+	}
+	branch := "my-branch"
+	git := gitutil.New(fake.X, gitutil.UserNameOpt("John Doe"), gitutil.UserEmailOpt("john.doe@example.com"))
+	if err := git.CreateBranchWithUpstream(branch, "origin/master"); err != nil {
+		t.Fatal(err)
+	}
+	if err := git.CheckoutBranch(branch); err != nil {
+		t.Fatal(err)
+	}
+	files := []string{"file1"}
+	commitFiles(t, fake.X, files)
+	gerritPath := fake.Projects[localProjects[1].Name]
+
+	uploadWIPFlag = true
+	uploadReviewersFlag = "a@example.com"
+	uploadTopicFlag = "topic"
+	if err := runUpload(fake.X, []string{}); err != nil {
+		t.Fatal(err)
+	}
+	assertUploadPushedFilesToRef(t, fake.X, gerritPath, "refs/for/master%r=a@example.com,topic=topic,wip", files)
+
+	uploadReadyFlag = true
+	if err := runUpload(fake.X, []string{}); err == nil {
+		t.Fatalf("expected -wip and -ready to be rejected together")
+	}
+	uploadWIPFlag = false
+	if err := runUpload(fake.X, []string{}); err != nil {
+		t.Fatal(err)
+	}
+	assertUploadPushedFilesToRef(t, fake.X, gerritPath, "refs/for/master%r=a@example.com,topic=topic,ready", files)
+}
+
 func TestUploadRef(t *testing.T) {
 	defer resetFlags()
 	fake, localProjects, cleanup := setupUploadTest(t)
@@ -246,6 +305,116 @@ func TestUploadWithOldMetadata(t *testing.T) {
 	assertUploadPushedFilesToRef(t, fake.X, gerritPath, expectedRef, files)
 }
 
+func TestUploadProject(t *testing.T) {
+	defer resetFlags()
+	fake, localProjects, cleanup := setupUploadTest(t)
+	defer cleanup()
+	currentDir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.Chdir(currentDir); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	if err := os.Chdir(localProjects[1].Path); err != nil {
+		t.Fatal(err)
+	}
+	branch := "my-branch"
+	git := gitutil.New(fake.X, gitutil.UserNameOpt("John Doe"), gitutil.UserEmailOpt("john.doe@example.com"))
+	if err := git.CreateBranchWithUpstream(branch, "origin/master"); err != nil {
+		t.Fatal(err)
+	}
+	if err := git.CheckoutBranch(branch); err != nil {
+		t.Fatal(err)
+	}
+	files := []string{"file1"}
+	commitFiles(t, fake.X, files)
+
+	// Upload from the root, which is not in any project.
+	if err := os.Chdir(fake.X.Root); err != nil {
+		t.Fatal(err)
+	}
+	if err := runUpload(fake.X, []string{}); err == nil {
+		t.Fatalf("expected an error uploading from outside of any project")
+	}
+	uploadProjectFlag = localProjects[1].Name
+	if err := runUpload(fake.X, []string{}); err != nil {
+		t.Fatal(err)
+	}
+	assertUploadPushedFilesToRef(t, fake.X, fake.Projects[localProjects[1].Name], "refs/for/master", files)
+
+	uploadProjectFlag = "unknown"
+	if err := runUpload(fake.X, []string{}); err == nil || !strings.Contains(err.Error(), "not found in the manifest") {
+		t.Errorf("expected an error for an unknown project, got %v", err)
+	}
+	uploadProjectFlag = localProjects[2].Name
+	if err := runUpload(fake.X, []string{}); err == nil || !strings.Contains(err.Error(), "not on any branch") {
+		t.Errorf("expected an error for a project which is not on a branch, got %v", err)
+	}
+	uploadProjectFlag = localProjects[1].Name
+	uploadMultipartFlag = true
+	if err := runUpload(fake.X, []string{}); err == nil {
+		t.Errorf("expected a usage error for -multipart with -project")
+	}
+}
+
+func TestUploadStaleBase(t *testing.T) {
+	defer resetFlags()
+	fake, localProjects, cleanup := setupUploadTest(t)
+	defer cleanup()
+	currentDir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.Chdir(currentDir); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	if err := os.Chdir(localProjects[1].Path); err != nil {
+		t.Fatal(err)
+	}
+	git := gitutil.New(fake.X, gitutil.UserNameOpt("John Doe"), gitutil.UserEmailOpt("john.doe@example.com"))
+	if err := git.CreateBranchWithUpstream("my-branch", "origin/master"); err != nil {
+		t.Fatal(err)
+	}
+	if err := git.CheckoutBranch("my-branch"); err != nil {
+		t.Fatal(err)
+	}
+	commitFiles(t, fake.X, []string{"file1"})
+	var buf bytes.Buffer
+	fake.X.Logger = log.NewLogger(log.InfoLevel, fake.X.Color, log.TextFormat, false, 0, 100, &buf, nil)
+
+	if err := runUpload(fake.X, []string{}); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("got warnings for a change based on the latest revision:\n%s", buf.String())
+	}
+
+	// Land two changes on the remote branch.
+	remote := fake.Projects[localProjects[1].Name]
+	writeReadme(t, fake.X, remote, "new readme")
+	writeReadme(t, fake.X, remote, "newer readme")
+	uploadNoRebaseCheck = true
+	if err := runUpload(fake.X, []string{}); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("got warnings with -no-rebase-check:\n%s", buf.String())
+	}
+	uploadNoRebaseCheck = false
+	if err := runUpload(fake.X, []string{}); err != nil {
+		t.Fatal(err)
+	}
+	if want := fmt.Sprintf("project %s(.) is based on a revision 2 commit(s) behind remotes/origin/master", localProjects[1].Name); !strings.Contains(buf.String(), want) {
+		t.Errorf("got warnings:\n%s\nwant a warning containing %q", buf.String(), want)
+	}
+	assertUploadPushedFilesToRef(t, fake.X, remote, "refs/for/master", []string{"file1"})
+}
+
 func TestUploadFromDetachedHead(t *testing.T) {
 	defer resetFlags()
 	fake, localProjects, cleanup := setupUploadTest(t)
@@ -451,6 +620,247 @@ func TestUploadRebase(t *testing.T) {
 	assertUploadPushedFilesToRef(t, fake.X, localProjects[1].Path, branch, remoteFiles)
 }
 
+func TestUploadAutosquash(t *testing.T) {
+	defer resetFlags()
+	fake, localProjects, cleanup := setupUploadTest(t)
+	defer cleanup()
+	currentDir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.Chdir(currentDir); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	if err := os.Chdir(localProjects[1].Path); err != nil {
+		t.Fatal(err)
+	}
+	branch := "my-branch"
+	git := gitutil.New(fake.X, gitutil.UserNameOpt("John Doe"), gitutil.UserEmailOpt("john.doe@example.com"))
+	if err := git.Config("user.email", "john.doe@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := git.Config("user.name", "John Doe"); err != nil {
+		t.Fatal(err)
+	}
+	if err := git.CreateBranchWithUpstream(branch, "origin/master"); err != nil {
+		t.Fatal(err)
+	}
+	if err := git.CheckoutBranch(branch); err != nil {
+		t.Fatal(err)
+	}
+	files := []string{"file1", "file2"}
+	commitFile(t, fake.X, files[0], "first version")
+	commitFile(t, fake.X, files[1], "file2")
+	if err := ioutil.WriteFile(files[0], []byte("fixed version"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := git.CommitFile(files[0], "fixup! Commit "+files[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	gerritPath := fake.Projects[localProjects[1].Name]
+	uploadAutosquashFlag = true
+	if err := runUpload(fake.X, []string{}); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := git.CountCommits("HEAD", "origin/master"); err != nil {
+		t.Fatal(err)
+	} else if n != 2 {
+		t.Fatalf("expected the fixup commit to be squashed, got %d commits", n)
+	}
+	if got, err := git.CommitMsg("HEAD~1"); err != nil {
+		t.Fatal(err)
+	} else if want := "Commit " + files[0]; got != want {
+		t.Fatalf("got commit message %q, want %q", got, want)
+	}
+
+	expectedRef := "refs/for/master"
+	assertUploadPushedFilesToRef(t, fake.X, gerritPath, expectedRef, files)
+	if data, err := ioutil.ReadFile(files[0]); err != nil {
+		t.Fatal(err)
+	} else if string(data) != "fixed version" {
+		t.Fatalf("got %q in %s, want %q", data, files[0], "fixed version")
+	}
+}
+
+func TestUploadSquashBase(t *testing.T) {
+	defer resetFlags()
+	fake, localProjects, cleanup := setupUploadTest(t)
+	defer cleanup()
+	currentDir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.Chdir(currentDir); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	if err := os.Chdir(localProjects[1].Path); err != nil {
+		t.Fatal(err)
+	}
+	git := gitutil.New(fake.X, gitutil.UserNameOpt("John Doe"), gitutil.UserEmailOpt("john.doe@example.com"))
+	if err := git.Config("user.email", "john.doe@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := git.Config("user.name", "John Doe"); err != nil {
+		t.Fatal(err)
+	}
+	if err := git.CreateBranchWithUpstream("parent", "origin/master"); err != nil {
+		t.Fatal(err)
+	}
+	if err := git.CheckoutBranch("parent"); err != nil {
+		t.Fatal(err)
+	}
+	parentFiles := []string{"file1"}
+	commitFiles(t, fake.X, parentFiles)
+	parentRev, err := git.CurrentRevision()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The child branch is stacked on the parent and has two commits.
+	if err := git.CreateAndCheckoutBranch("child"); err != nil {
+		t.Fatal(err)
+	}
+	childFiles := []string{"file2", "file3"}
+	commitFiles(t, fake.X, childFiles)
+	headRev, err := git.CurrentRevision()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uploadSquashFlag = true
+	uploadSquashBaseFlag = "parent"
+	if err := runUpload(fake.X, []string{}); err != nil {
+		t.Fatal(err)
+	}
+	if rev, err := git.CurrentRevision(); err != nil || rev != headRev {
+		t.Fatalf("local branch moved to (%q, %v), want %q", rev, err, headRev)
+	}
+
+	gerritPath := fake.Projects[localProjects[1].Name]
+	expectedRef := "refs/for/master"
+	gerrit := gitutil.New(fake.X, gitutil.RootDirOpt(gerritPath))
+	if parent, err := gerrit.CurrentRevisionForRef(expectedRef + "^"); err != nil || parent != parentRev {
+		t.Fatalf("got parent of uploaded change (%q, %v), want %q", parent, err, parentRev)
+	}
+	if msg, err := gerrit.CommitMsg(expectedRef); err != nil || msg != "Commit "+childFiles[0] {
+		t.Fatalf("got message of uploaded change (%q, %v), want %q", msg, err, "Commit "+childFiles[0])
+	}
+	if files, err := gerrit.ModifiedFiles(expectedRef+"^", expectedRef); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(files, childFiles) {
+		t.Fatalf("got files %v in uploaded change, want %v", files, childFiles)
+	}
+}
+
+func TestUploadSplitBy(t *testing.T) {
+	defer resetFlags()
+	fake, localProjects, cleanup := setupUploadTest(t)
+	defer cleanup()
+	currentDir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.Chdir(currentDir); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	if err := os.Chdir(localProjects[1].Path); err != nil {
+		t.Fatal(err)
+	}
+	git := gitutil.New(fake.X, gitutil.UserNameOpt("John Doe"), gitutil.UserEmailOpt("john.doe@example.com"))
+	if err := git.Config("user.email", "john.doe@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := git.Config("user.name", "John Doe"); err != nil {
+		t.Fatal(err)
+	}
+	if err := git.CreateBranchWithUpstream("my-branch", "origin/master"); err != nil {
+		t.Fatal(err)
+	}
+	if err := git.CheckoutBranch("my-branch"); err != nil {
+		t.Fatal(err)
+	}
+	base, err := git.CurrentRevision()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{"a", "b"} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := []string{"a/file1", "b/file2", "a/file3", "file4"}
+	commitFiles(t, fake.X, files)
+	headRev, err := git.CurrentRevision()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Gerrit creates a new change for every push to refs/for/master, while
+	// the fake gerrit just moves the ref, so its reflog records the pushes.
+	gerritPath := fake.Projects[localProjects[1].Name]
+	gerrit := gitutil.New(fake.X, gitutil.RootDirOpt(gerritPath))
+	if err := gerrit.Config("core.logAllRefUpdates", "always"); err != nil {
+		t.Fatal(err)
+	}
+	uploadGitOptions = "--force"
+	uploadSplitByFlag = "a/, b"
+	if err := runUpload(fake.X, []string{}); err != nil {
+		t.Fatal(err)
+	}
+	if rev, err := git.CurrentRevision(); err != nil || rev != headRev {
+		t.Fatalf("local branch moved to (%q, %v), want %q", rev, err, headRev)
+	}
+
+	entries, err := gerrit.Reflog("refs/for/master", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		subject string
+		files   []string
+	}{
+		// The reflog lists the pushes newest first.
+		{"Commit a/file1", []string{"file4"}},
+		{"b: Commit a/file1", []string{"b/file2"}},
+		{"a: Commit a/file1", []string{"a/file1", "a/file3"}},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("got %d pushes, want %d", len(entries), len(want))
+	}
+	changeIDs := map[string]bool{}
+	for i, w := range want {
+		ref := entries[i].Hash
+		if parent, err := gerrit.CurrentRevisionForRef(ref + "^"); err != nil || parent != base {
+			t.Errorf("got parent of change %d (%q, %v), want %q", i, parent, err, base)
+		}
+		if files, err := gerrit.ModifiedFiles(base, ref); err != nil {
+			t.Fatal(err)
+		} else if !reflect.DeepEqual(files, w.files) {
+			t.Errorf("got files %v in change %d, want %v", files, i, w.files)
+		}
+		msg, err := gerrit.CommitMsg(ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(msg, "\n")
+		if lines[0] != w.subject {
+			t.Errorf("got subject %q for change %d, want %q", lines[0], i, w.subject)
+		}
+		changeID := lines[len(lines)-1]
+		if !strings.HasPrefix(changeID, "Change-Id: I") || changeIDs[changeID] {
+			t.Errorf("got %q as last line of change %d, want a new Change-Id", changeID, i)
+		}
+		changeIDs[changeID] = true
+	}
+}
+
 func TestUploadMultipleCommits(t *testing.T) {
 	defer resetFlags()
 	fake, localProjects, cleanup := setupUploadTest(t)
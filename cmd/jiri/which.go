@@ -0,0 +1,139 @@
+// Copyright 2019 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/dahlia-os/jiri"
+	"github.com/dahlia-os/jiri/cmdline"
+	"github.com/dahlia-os/jiri/project"
+	"github.com/dahlia-os/jiri/version"
+)
+
+var whichFlags struct {
+	manifest   bool
+	jsonOutput string
+	json       bool
+}
+
+var cmdWhich = &cmdline.Command{
+	Runner: cmdline.RunnerFunc(runWhich),
+	Name:   "which",
+	Short:  "Show path to the jiri tool",
+	Long: `
+Show the path to the jiri binary.
+
+With -json, print the jiri root found from the current directory, the path to
+the jiri binary and the jiri version as a json object instead, such as
+{"root": "/path/to/root", "binary": "/path/to/jiri", "version": "..."}.
+This also works outside of a jiri root, in which case the root is empty.
+
+With -manifest, show the root manifest file in effect and the manifests it
+imports, directly or transitively. Each remote import is listed with its
+remote and the revision the manifest was read at; local imports are listed
+by file.
+`,
+}
+
+func init() {
+	cmdWhich.Flags.BoolVar(&whichFlags.manifest, "manifest", false, "Print the root manifest and its import chain.")
+	cmdWhich.Flags.StringVar(&whichFlags.jsonOutput, "json-output", "", "Path to write the import chain to, in json format. Requires -manifest.")
+	cmdWhich.Flags.BoolVar(&whichFlags.json, "json", false, "Print the jiri root, binary path and version as json. Cannot be used with -manifest.")
+}
+
+// whichInfo is the output of "jiri which -json".
+type whichInfo struct {
+	Root    string `json:"root"`
+	Binary  string `json:"binary"`
+	Version string `json:"version"`
+}
+
+// runWhich does not need a jiri root unless -manifest is passed, so that the
+// binary can be found from anywhere.
+func runWhich(env *cmdline.Env, args []string) error {
+	if len(args) != 0 {
+		return env.UsageErrorf("unexpected number of arguments")
+	}
+	if whichFlags.jsonOutput != "" && !whichFlags.manifest {
+		return env.UsageErrorf("-json-output requires -manifest")
+	}
+	if whichFlags.json && whichFlags.manifest {
+		return env.UsageErrorf("-json and -manifest cannot be used together")
+	}
+	if whichFlags.manifest {
+		return jiri.RunnerFunc(runWhichManifest).Run(env, args)
+	}
+	path, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if !whichFlags.json {
+		fmt.Fprintln(env.Stdout, path)
+		return nil
+	}
+	info := whichInfo{
+		Root:    jiri.FindRoot(),
+		Binary:  path,
+		Version: version.FormattedVersion(),
+	}
+	out, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to serialize JSON output: %s\n", err)
+	}
+	fmt.Fprintln(env.Stdout, string(out))
+	return nil
+}
+
+func runWhichManifest(jirix *jiri.X, args []string) error {
+	localProjects, err := project.LocalProjects(jirix, project.FastScan)
+	if err != nil {
+		return err
+	}
+	imports, err := project.LoadManifestImports(jirix, localProjects, false)
+	if err != nil {
+		return err
+	}
+	printManifestImports(jirix.Stdout(), imports)
+	if whichFlags.jsonOutput != "" {
+		out, err := json.MarshalIndent(imports, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to serialize JSON output: %s\n", err)
+		}
+		if err := ioutil.WriteFile(whichFlags.jsonOutput, out, 0600); err != nil {
+			return fmt.Errorf("failed write JSON output to %s: %s\n", whichFlags.jsonOutput, err)
+		}
+	}
+	return nil
+}
+
+func printManifestImports(w io.Writer, imports []project.ManifestImport) {
+	for _, imp := range imports {
+		indent := strings.Repeat("  ", imp.Depth)
+		switch imp.Type {
+		case "root":
+			fmt.Fprintf(w, "%s%s\n", indent, imp.File)
+		case "local":
+			fmt.Fprintf(w, "%slocal import %s", indent, imp.File)
+			if imp.Revision != "" {
+				fmt.Fprintf(w, " at %s", imp.Revision)
+			}
+			fmt.Fprintln(w)
+		default:
+			fmt.Fprintf(w, "%simport %s from %s", indent, imp.File, imp.Remote)
+			if imp.Revision != "" {
+				fmt.Fprintf(w, " at %s", imp.Revision)
+			} else {
+				fmt.Fprintf(w, " (local checkout)")
+			}
+			fmt.Fprintln(w)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright 2019 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/dahlia-os/jiri/cmdline"
+	"github.com/dahlia-os/jiri/gitutil"
+	"github.com/dahlia-os/jiri/jiritest"
+	"github.com/dahlia-os/jiri/project"
+)
+
+func TestWhichManifest(t *testing.T) {
+	fake, cleanup := jiritest.NewFakeJiriRoot(t)
+	defer cleanup()
+
+	// Add a local import to the root manifest.
+	localFile := filepath.Join(fake.X.Root, "local.xml")
+	if err := (&project.Manifest{}).ToFile(fake.X, localFile); err != nil {
+		t.Fatal(err)
+	}
+	m, err := fake.ReadJiriManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.LocalImports = append(m.LocalImports, project.LocalImport{File: "local.xml"})
+	if err := fake.WriteJiriManifest(m); err != nil {
+		t.Fatal(err)
+	}
+
+	localProjects, err := project.LocalProjects(fake.X, project.FastScan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	imports, err := project.LoadManifestImports(fake.X, localProjects, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifestPath := filepath.Join(fake.X.Root, jiritest.ManifestProjectPath)
+	rev, err := gitutil.New(fake.X, gitutil.RootDirOpt(manifestPath)).CurrentRevision()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []project.ManifestImport{
+		{Depth: 0, Type: "root", File: fake.X.JiriManifestFile()},
+		{Depth: 1, Type: "remote", File: jiritest.ManifestFileName, Remote: fake.Projects[jiritest.ManifestProjectName], Revision: rev},
+		{Depth: 1, Type: "local", File: "local.xml"},
+	}
+	if !reflect.DeepEqual(imports, want) {
+		t.Errorf("got %+v, want %+v", imports, want)
+	}
+
+	var buf bytes.Buffer
+	printManifestImports(&buf, imports)
+	wantOut := fake.X.JiriManifestFile() + "\n" +
+		"  import public from " + fake.Projects[jiritest.ManifestProjectName] + " at " + rev + "\n" +
+		"  local import local.xml\n"
+	if got := buf.String(); got != wantOut {
+		t.Errorf("got:\n%s\nwant:\n%s", got, wantOut)
+	}
+}
+
+func TestWhichJSON(t *testing.T) {
+	fake, cleanup := jiritest.NewFakeJiriRoot(t)
+	defer cleanup()
+	defer func() { whichFlags.json = false }()
+	whichFlags.json = true
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(cwd)
+	binary, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	outside, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+
+	for _, test := range []struct {
+		dir, root string
+	}{
+		{filepath.Join(fake.X.Root, jiritest.ManifestProjectPath), fake.X.Root},
+		{outside, ""},
+	} {
+		if err := os.Chdir(test.dir); err != nil {
+			t.Fatal(err)
+		}
+		var stdout bytes.Buffer
+		env := &cmdline.Env{Stdout: &stdout, Stderr: ioutil.Discard, Vars: map[string]string{}}
+		if err := runWhich(env, nil); err != nil {
+			t.Fatalf("%s: %v", test.dir, err)
+		}
+		var got whichInfo
+		if err := json.Unmarshal(stdout.Bytes(), &got); err != nil {
+			t.Fatalf("%s: %v in %q", test.dir, err, stdout.String())
+		}
+		if want := (whichInfo{Root: test.root, Binary: binary}); got != want {
+			t.Errorf("%s: got %+v, want %+v", test.dir, got, want)
+		}
+	}
+}
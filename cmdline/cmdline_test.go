@@ -6,6 +6,7 @@ package cmdline
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
@@ -468,6 +469,7 @@ The cmdrun help flags are:
       full      - Good for cmdline output, shows all global flags.
       godoc     - Good for godoc processing.
       shortonly - Only output short description.
+      json      - Output the command tree, with flags, as JSON.
    Override the default by setting the CMDLINE_STYLE environment variable.
  -width=80
    Format output to this target width in runes, or unlimited if width < 0.
@@ -647,6 +649,7 @@ The onecmd help flags are:
       full      - Good for cmdline output, shows all global flags.
       godoc     - Good for godoc processing.
       shortonly - Only output short description.
+      json      - Output the command tree, with flags, as JSON.
    Override the default by setting the CMDLINE_STYLE environment variable.
  -width=80
    Format output to this target width in runes, or unlimited if width < 0.
@@ -707,6 +710,7 @@ The onecmd help flags are:
       full      - Good for cmdline output, shows all global flags.
       godoc     - Good for godoc processing.
       shortonly - Only output short description.
+      json      - Output the command tree, with flags, as JSON.
    Override the default by setting the CMDLINE_STYLE environment variable.
  -width=80
    Format output to this target width in runes, or unlimited if width < 0.
@@ -921,6 +925,7 @@ The multi help flags are:
       full      - Good for cmdline output, shows all global flags.
       godoc     - Good for godoc processing.
       shortonly - Only output short description.
+      json      - Output the command tree, with flags, as JSON.
    Override the default by setting the CMDLINE_STYLE environment variable.
  -width=80
    Format output to this target width in runes, or unlimited if width < 0.
@@ -1322,6 +1327,7 @@ The toplevelprog help flags are:
       full      - Good for cmdline output, shows all global flags.
       godoc     - Good for godoc processing.
       shortonly - Only output short description.
+      json      - Output the command tree, with flags, as JSON.
    Override the default by setting the CMDLINE_STYLE environment variable.
  -width=80
    Format output to this target width in runes, or unlimited if width < 0.
@@ -1452,6 +1458,7 @@ The toplevelprog echoprog help flags are:
       full      - Good for cmdline output, shows all global flags.
       godoc     - Good for godoc processing.
       shortonly - Only output short description.
+      json      - Output the command tree, with flags, as JSON.
    Override the default by setting the CMDLINE_STYLE environment variable.
  -width=80
    Format output to this target width in runes, or unlimited if width < 0.
@@ -1889,6 +1896,7 @@ The prog1 help flags are:
       full      - Good for cmdline output, shows all global flags.
       godoc     - Good for godoc processing.
       shortonly - Only output short description.
+      json      - Output the command tree, with flags, as JSON.
    Override the default by setting the CMDLINE_STYLE environment variable.
  -width=80
    Format output to this target width in runes, or unlimited if width < 0.
@@ -1983,6 +1991,7 @@ The prog1 prog2 help flags are:
       full      - Good for cmdline output, shows all global flags.
       godoc     - Good for godoc processing.
       shortonly - Only output short description.
+      json      - Output the command tree, with flags, as JSON.
    Override the default by setting the CMDLINE_STYLE environment variable.
  -width=80
    Format output to this target width in runes, or unlimited if width < 0.
@@ -2047,6 +2056,7 @@ The prog1 prog2 prog3 help flags are:
       full      - Good for cmdline output, shows all global flags.
       godoc     - Good for godoc processing.
       shortonly - Only output short description.
+      json      - Output the command tree, with flags, as JSON.
    Override the default by setting the CMDLINE_STYLE environment variable.
  -width=80
    Format output to this target width in runes, or unlimited if width < 0.
@@ -2111,6 +2121,7 @@ The prog1 prog2 prog3 help flags are:
       full      - Good for cmdline output, shows all global flags.
       godoc     - Good for godoc processing.
       shortonly - Only output short description.
+      json      - Output the command tree, with flags, as JSON.
    Override the default by setting the CMDLINE_STYLE environment variable.
  -width=80
    Format output to this target width in runes, or unlimited if width < 0.
@@ -2234,6 +2245,7 @@ The prog1 help flags are:
       full      - Good for cmdline output, shows all global flags.
       godoc     - Good for godoc processing.
       shortonly - Only output short description.
+      json      - Output the command tree, with flags, as JSON.
    Override the default by setting the CMDLINE_STYLE environment variable.
  -width=<terminal width>
    Format output to this target width in runes, or unlimited if width < 0.
@@ -2437,6 +2449,95 @@ The global flags are:
 	hiddenGlobalFlags = nil
 }
 
+func TestHelpJSON(t *testing.T) {
+	sub := &Command{
+		Name:     "sub",
+		Short:    "Short description of sub",
+		Long:     "Long description of sub.",
+		ArgsName: "[args]",
+		ArgsLong: "[args] are ignored.",
+		Runner:   RunnerFunc(runHello),
+	}
+	sub.Flags.Bool("verbose", false, "verbose desc")
+	sub.Flags.Int("count", 3, "count desc")
+	root := &Command{
+		Name:     "root",
+		Short:    "Short description of root",
+		Long:     "Long description of root.",
+		Children: []*Command{sub},
+		Topics:   []Topic{{Name: "topic", Short: "Short topic", Long: "Long topic."}},
+	}
+	root.Flags.String("rstring", "abc", "rstring desc")
+
+	origFlags := flag.CommandLine
+	defer func() { flag.CommandLine = origFlags }()
+	run := func(args ...string) (commandJSON, error) {
+		// Parse merges the root flags into flag.CommandLine.
+		flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+		var stdout, stderr bytes.Buffer
+		env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: baseVars}
+		var got commandJSON
+		runner, args, err := Parse(root, env, args)
+		if err != nil {
+			return got, err
+		}
+		if err := runner.Run(env, args); err != nil {
+			return got, err
+		}
+		if err := json.Unmarshal(stdout.Bytes(), &got); err != nil {
+			t.Fatalf("invalid JSON %q: %v", stdout.String(), err)
+		}
+		return got, nil
+	}
+
+	got, err := run("help", "-style=json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != "root" || got.Path != "root" || got.Long != "Long description of root." {
+		t.Errorf("unexpected root command: %+v", got)
+	}
+	if want := []flagJSON{{"rstring", "string", "abc", "rstring desc"}}; !reflect.DeepEqual(got.Flags, want) {
+		t.Errorf("root flags: got %+v, want %+v", got.Flags, want)
+	}
+	if want := []topicJSON{{"topic", "Short topic", "Long topic."}}; !reflect.DeepEqual(got.Topics, want) {
+		t.Errorf("root topics: got %+v, want %+v", got.Topics, want)
+	}
+	var children []string
+	for _, child := range got.Children {
+		children = append(children, child.Name)
+	}
+	if want := []string{"sub", "help"}; !reflect.DeepEqual(children, want) {
+		t.Fatalf("root children: got %v, want %v", children, want)
+	}
+
+	got, err = run("help", "-style=json", "sub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := commandJSON{
+		Name:     "sub",
+		Path:     "root sub",
+		Short:    "Short description of sub",
+		Long:     "Long description of sub.",
+		ArgsName: "[args]",
+		ArgsLong: "[args] are ignored.",
+		Flags: []flagJSON{
+			{"count", "int", "3", "count desc"},
+			{"rstring", "string", "abc", "rstring desc"},
+			{"verbose", "bool", "false", "verbose desc"},
+		},
+	}
+	got.GlobalFlags = nil
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	if _, err := run("help", "-style=json", "missing"); err == nil {
+		t.Errorf("expected an error for an unknown command")
+	}
+}
+
 func TestRootCommandFlags(t *testing.T) {
 	root := &Command{
 		Name:   "root",
@@ -2671,6 +2772,7 @@ The unlikely help flags are:
       full      - Good for cmdline output, shows all global flags.
       godoc     - Good for godoc processing.
       shortonly - Only output short description.
+      json      - Output the command tree, with flags, as JSON.
    Override the default by setting the CMDLINE_STYLE environment variable.
  -width=80
    Format output to this target width in runes, or unlimited if width < 0.
@@ -2805,6 +2907,7 @@ The unlikely help flags are:
       full      - Good for cmdline output, shows all global flags.
       godoc     - Good for godoc processing.
       shortonly - Only output short description.
+      json      - Output the command tree, with flags, as JSON.
    Override the default by setting the CMDLINE_STYLE environment variable.
  -width=<terminal width>
    Format output to this target width in runes, or unlimited if width < 0.
@@ -142,6 +142,7 @@ const (
 	styleFull                   // Similar to compact but shows all global flags.
 	styleGoDoc                  // Good for godoc processing.
 	styleShortOnly              // Only output short description.
+	styleJSON                   // Machine-readable command tree.
 )
 
 func (s *style) String() string {
@@ -154,6 +155,8 @@ func (s *style) String() string {
 		return "godoc"
 	case styleShortOnly:
 		return "shortonly"
+	case styleJSON:
+		return "json"
 	default:
 		panic(fmt.Errorf("unhandled style %d", *s))
 	}
@@ -170,6 +173,8 @@ func (s *style) Set(value string) error {
 		*s = styleGoDoc
 	case "shortonly":
 		*s = styleShortOnly
+	case "json":
+		*s = styleJSON
 	default:
 		return fmt.Errorf("unknown style %q", value)
 	}
@@ -6,6 +6,7 @@ package cmdline
 
 import (
 	"bytes"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"go/doc"
@@ -48,6 +49,10 @@ type helpConfig struct {
 
 // Run implements the Runner interface method.
 func (h helpRunner) Run(env *Env, args []string) error {
+	if h.style == styleJSON {
+		// JSON must not be wrapped.
+		return runHelpJSON(env, args, h.path, h.helpConfig)
+	}
 	w := textutil.NewUTF8WrapWriter(env.Stdout, h.width)
 	defer w.Flush()
 	return runHelp(w, env, args, h.path, h.helpConfig)
@@ -55,6 +60,10 @@ func (h helpRunner) Run(env *Env, args []string) error {
 
 // usageFunc is used as the implementation of the Env.Usage function.
 func (h helpRunner) usageFunc(env *Env, writer io.Writer) {
+	if h.style == styleJSON {
+		writeCommandJSON(writer, h.path, h.helpConfig)
+		return
+	}
 	w := textutil.NewUTF8WrapWriter(writer, h.width)
 	usage(w, env, h.path, h.helpConfig, h.helpConfig.firstCall)
 	w.Flush()
@@ -89,6 +98,7 @@ The formatting style for help output:
    full      - Good for cmdline output, shows all global flags.
    godoc     - Good for godoc processing.
    shortonly - Only output short description.
+   json      - Output the command tree, with flags, as JSON.
 Override the default by setting the CMDLINE_STYLE environment variable.
 `)
 	help.Flags.IntVar(&h.width, "width", h.width, `
@@ -539,3 +549,112 @@ func HideGlobalFlags(regexps ...*regexp.Regexp) {
 		hiddenGlobalFlags = []*regexp.Regexp{}
 	}
 }
+
+// commandJSON describes a command in the output of the json style.
+type commandJSON struct {
+	Name        string        `json:"name"`
+	Path        string        `json:"path"`
+	Short       string        `json:"short,omitempty"`
+	Long        string        `json:"long,omitempty"`
+	ArgsName    string        `json:"args_name,omitempty"`
+	ArgsLong    string        `json:"args_long,omitempty"`
+	Flags       []flagJSON    `json:"flags,omitempty"`
+	GlobalFlags []flagJSON    `json:"global_flags,omitempty"`
+	Topics      []topicJSON   `json:"topics,omitempty"`
+	Children    []commandJSON `json:"children,omitempty"`
+}
+
+type flagJSON struct {
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Default string `json:"default"`
+	Usage   string `json:"usage"`
+}
+
+type topicJSON struct {
+	Name  string `json:"name"`
+	Short string `json:"short,omitempty"`
+	Long  string `json:"long,omitempty"`
+}
+
+// runHelpJSON implements the help command for the json style, printing the
+// tree of the command named by args.
+func runHelpJSON(env *Env, args []string, path []*Command, config *helpConfig) error {
+	for _, arg := range args {
+		if arg == "..." {
+			break
+		}
+		cmd, next := path[len(path)-1], (*Command)(nil)
+		for _, child := range cmd.Children {
+			if child.Name == arg {
+				next = child
+				break
+			}
+		}
+		if next == nil && arg == helpName {
+			next = helpRunner{path, config}.newCommand()
+		}
+		if next == nil {
+			fn := helpRunner{path, config}.usageFunc
+			return usageErrorf(env, fn, "%s: unknown command %q", pathName(config.prefix, path), arg)
+		}
+		path = append(path, next)
+	}
+	return writeCommandJSON(env.Stdout, path, config)
+}
+
+func writeCommandJSON(w io.Writer, path []*Command, config *helpConfig) error {
+	cmd := commandTreeJSON(path, config)
+	cmd.GlobalFlags = flagsJSON(globalFlags)
+	// Args names like "<path>" are common, keep them readable.
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	return enc.Encode(cmd)
+}
+
+// commandTreeJSON describes the last command in path and its descendants.
+// External commands found through LookPath are not included.
+func commandTreeJSON(path []*Command, config *helpConfig) commandJSON {
+	cmd := path[len(path)-1]
+	out := commandJSON{
+		Name:     cmd.Name,
+		Path:     pathName(config.prefix, path),
+		Short:    cmd.Short,
+		Long:     cmd.Long,
+		ArgsName: cmd.ArgsName,
+		ArgsLong: cmd.ArgsLong,
+		Flags:    flagsJSON(pathFlags(path)),
+	}
+	for _, topic := range cmd.Topics {
+		out.Topics = append(out.Topics, topicJSON{topic.Name, topic.Short, topic.Long})
+	}
+	for _, child := range cmd.Children {
+		out.Children = append(out.Children, commandTreeJSON(append(path, child), config))
+	}
+	if needsHelpChild(cmd) {
+		help := helpRunner{path, config}.newCommand()
+		out.Children = append(out.Children, commandTreeJSON(append(path, help), config))
+	}
+	return out
+}
+
+func flagsJSON(flags *flag.FlagSet) []flagJSON {
+	var out []flagJSON
+	if flags == nil {
+		return out
+	}
+	flags.VisitAll(func(f *flag.Flag) {
+		typ, _ := flag.UnquoteUsage(f)
+		if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() {
+			typ = "bool"
+		}
+		out = append(out, flagJSON{
+			Name:    f.Name,
+			Type:    typ,
+			Default: f.DefValue,
+			Usage:   strings.TrimSpace(f.Usage),
+		})
+	})
+	return out
+}
@@ -75,6 +75,10 @@ type CLOpts struct {
 	Topic string
 	// Verify controls whether git pre-push hooks should be run before uploading.
 	Verify bool
+	// WIP marks the CL as work in progress.
+	WIP bool
+	// Ready marks a work in progress CL as ready for review.
+	Ready bool
 	//Ref to upload. Default is HEAD
 	RefToUpload string
 }
@@ -192,6 +196,7 @@ type Change struct {
 	Number           int `json:"_number"`
 	Owner            Owner
 	Labels           map[string]map[string]interface{}
+	Status           string
 	Submitted        string
 
 	// Custom labels.
@@ -554,6 +559,12 @@ func Reference(opts CLOpts) string {
 	if opts.Topic != "" {
 		params = append(params, "topic="+opts.Topic)
 	}
+	if opts.WIP {
+		params = append(params, "wip")
+	}
+	if opts.Ready {
+		params = append(params, "ready")
+	}
 	if len(params) > 0 {
 		ref = ref + "%" + strings.Join(params, ",")
 	}
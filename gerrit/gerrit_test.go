@@ -358,5 +358,26 @@ func TestParseRefString(t *testing.T) {
 	}
 }
 
+func TestReference(t *testing.T) {
+	testCases := []struct {
+		opts CLOpts
+		want string
+	}{
+		{CLOpts{RemoteBranch: "master"}, "refs/for/master"},
+		{CLOpts{RemoteBranch: "master", Draft: true}, "refs/drafts/master"},
+		{CLOpts{RemoteBranch: "master", WIP: true}, "refs/for/master%wip"},
+		{CLOpts{RemoteBranch: "master", Ready: true}, "refs/for/master%ready"},
+		{
+			CLOpts{RemoteBranch: "main", Reviewers: []string{"a@example.com"}, Ccs: []string{"b@example.com"}, Topic: "t", WIP: true},
+			"refs/for/main%r=a@example.com,cc=b@example.com,topic=t,wip",
+		},
+	}
+	for _, test := range testCases {
+		if got := Reference(test.opts); got != test.want {
+			t.Errorf("Reference(%+v): got %q, want %q", test.opts, got, test.want)
+		}
+	}
+}
+
 // TODO(jsimsa): Add a test for the hostCredentials function that
 // exercises the logic that reads the .netrc and git cookie files.
@@ -6,18 +6,31 @@ package gitutil
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/dahlia-os/jiri"
 	"github.com/dahlia-os/jiri/envvar"
 )
 
+// ErrNoUpstream is returned by AheadBehind if the branch has no upstream
+// configured.
+var ErrNoUpstream = errors.New("no upstream configured")
+
+// ErrLFSNotInstalled is returned by the Git LFS helpers if the git-lfs
+// extension is not installed.
+var ErrLFSNotInstalled = errors.New("git-lfs is not installed; install it from https://git-lfs.github.com and run the command again")
+
 type GitError struct {
 	Root        string
 	Args        []string
@@ -49,12 +62,40 @@ func (ge GitError) Error() string {
 	return result
 }
 
+// permanentErrors are substrings of git error output for failures that
+// retrying the command will not fix.  They are untranslated, so the commands
+// which may fail this way, clone and fetch, run in the C locale.
+var permanentErrors = []string{
+	"authentication failed",
+	"permission denied",
+	"could not read username",
+	"repository not found",
+	"does not appear to be a git repository",
+	"the requested url returned error: 401",
+	"the requested url returned error: 403",
+	"the requested url returned error: 404",
+}
+
+// Permanent reports whether the command failed in a way that retrying it
+// will not fix, like denied authentication or a missing repository.  Other
+// failures, like network errors and timeouts, are considered transient.
+func (ge GitError) Permanent() bool {
+	errorOutput := strings.ToLower(ge.ErrorOutput)
+	for _, s := range permanentErrors {
+		if strings.Contains(errorOutput, s) {
+			return true
+		}
+	}
+	return false
+}
+
 type Git struct {
-	jirix     *jiri.X
-	opts      map[string]string
-	rootDir   string
-	userName  string
-	userEmail string
+	jirix      *jiri.X
+	opts       map[string]string
+	rootDir    string
+	userName   string
+	userEmail  string
+	signingKey string
 }
 
 type gitOpt interface {
@@ -66,9 +107,13 @@ type RootDirOpt string
 type UserNameOpt string
 type UserEmailOpt string
 
+// SigningKeyOpt selects the key used to sign commits and tags.
+type SigningKeyOpt string
+
 func (AuthorDateOpt) gitOpt()    {}
 func (CommitterDateOpt) gitOpt() {}
 func (RootDirOpt) gitOpt()       {}
+func (SigningKeyOpt) gitOpt()    {}
 func (UserNameOpt) gitOpt()      {}
 func (UserEmailOpt) gitOpt()     {}
 
@@ -89,6 +134,10 @@ type BranchName string
 const (
 	RemoteType = "remote"
 	LocalType  = "local"
+
+	// JiriConfigSection is the git config section used to record the config
+	// keys set by jiri.
+	JiriConfigSection = "jiri"
 )
 
 // New is the Git factory.
@@ -96,6 +145,7 @@ func New(jirix *jiri.X, opts ...gitOpt) *Git {
 	rootDir := ""
 	userName := ""
 	userEmail := ""
+	signingKey := ""
 	env := map[string]string{}
 	for _, opt := range opts {
 		switch typedOpt := opt.(type) {
@@ -109,14 +159,17 @@ func New(jirix *jiri.X, opts ...gitOpt) *Git {
 			userName = string(typedOpt)
 		case UserEmailOpt:
 			userEmail = string(typedOpt)
+		case SigningKeyOpt:
+			signingKey = string(typedOpt)
 		}
 	}
 	return &Git{
-		jirix:     jirix,
-		opts:      env,
-		rootDir:   rootDir,
-		userName:  userName,
-		userEmail: userEmail,
+		jirix:      jirix,
+		opts:       env,
+		rootDir:    rootDir,
+		userName:   userName,
+		userEmail:  userEmail,
+		signingKey: signingKey,
 	}
 }
 
@@ -143,7 +196,7 @@ func (g *Git) AddOrReplaceRemote(name, path string) error {
 		return err
 	}
 	configStr = fmt.Sprintf("remote.%s.fetch", name)
-	if err := g.Config(configStr, "+refs/heads/*:refs/remotes/origin/*"); err != nil {
+	if err := g.Config(configStr, fmt.Sprintf("+refs/heads/*:refs/remotes/%s/*", name)); err != nil {
 		return err
 	}
 	return nil
@@ -238,6 +291,83 @@ func (g *Git) CheckoutBranch(branch string, opts ...CheckoutOpt) error {
 	return g.run(args...)
 }
 
+// CheckoutMismatchError is returned by CheckoutRevision if HEAD does not point
+// to the revision after git reported a successful checkout, e.g. because a
+// post-checkout hook moved it.
+type CheckoutMismatchError struct {
+	Revision string
+	Want     string
+	Got      string
+}
+
+func (e CheckoutMismatchError) Error() string {
+	return fmt.Sprintf("HEAD is at %s after checking out %s (%s)", e.Got, e.Revision, e.Want)
+}
+
+// CheckoutRevision detaches HEAD at the given revision.  If the checkout
+// fails, or HEAD does not end up at the revision, HEAD is restored to the
+// branch or revision it pointed to before, so that no half-done checkout is
+// left behind.  Local changes are kept while restoring unless ForceOpt is
+// given, in which case the index and working tree are reset as well.
+func (g *Git) CheckoutRevision(rev string, opts ...CheckoutOpt) error {
+	want, err := g.CurrentRevisionForRef(rev + "^{commit}")
+	if err != nil {
+		return fmt.Errorf("cannot check out unknown revision %q: %v", rev, err)
+	}
+	force := false
+	for _, opt := range opts {
+		if typedOpt, ok := opt.(ForceOpt); ok {
+			force = bool(typedOpt)
+		}
+	}
+	orig, origErr := g.CurrentRevision()
+	branch := ""
+	if origErr == nil && g.IsOnBranch() {
+		if branch, err = g.CurrentBranchName(); err != nil {
+			return err
+		}
+	}
+
+	checkoutErr := g.CheckoutBranch(want, append(opts, DetachOpt(true))...)
+	got, err := g.CurrentRevision()
+	if checkoutErr == nil {
+		if err != nil {
+			checkoutErr = err
+		} else if got == want {
+			return nil
+		} else {
+			checkoutErr = CheckoutMismatchError{rev, want, got}
+		}
+	}
+	// Without a prior HEAD there is nothing to restore.  Without force, a
+	// checkout that left HEAD in place did not touch the working tree.
+	unchanged := err == nil && got == orig && g.IsOnBranch() == (branch != "")
+	if origErr != nil || (!force && unchanged) {
+		return checkoutErr
+	}
+	if err := g.restoreHead(orig, branch, force); err != nil {
+		return fmt.Errorf("%v\nrestoring HEAD to %s also failed: %v", checkoutErr, orig, err)
+	}
+	return checkoutErr
+}
+
+// restoreHead points HEAD back to branch, or to revision if branch is empty,
+// and brings the index and working tree in line with it.  reset is used
+// rather than checkout so that no checkout hooks run.
+func (g *Git) restoreHead(revision, branch string, hard bool) error {
+	mode := "--keep"
+	if hard {
+		mode = "--hard"
+	}
+	if err := g.run("reset", "-q", mode, revision); err != nil {
+		return err
+	}
+	if branch != "" {
+		return g.run("symbolic-ref", "HEAD", "refs/heads/"+branch)
+	}
+	return nil
+}
+
 // Clone clones the given repository to the given local path.  If reference is
 // not empty it uses the given path as a reference/shared repo.
 func (g *Git) Clone(repo, path string, opts ...CloneOpt) error {
@@ -265,11 +395,20 @@ func (g *Git) Clone(repo, path string, opts ...CloneOpt) error {
 			if typedOpt > 0 {
 				args = append(args, []string{"--depth", strconv.Itoa(int(typedOpt))}...)
 			}
+		case FilterOpt:
+			if typedOpt != "" {
+				args = append(args, "--filter="+string(typedOpt))
+			}
+		case OriginOpt:
+			if typedOpt != "" {
+				args = append(args, "--origin", string(typedOpt))
+			}
 		}
 	}
 	args = append(args, repo)
 	args = append(args, path)
-	return g.run(args...)
+	// Failures are classified by their message, see GitError.Permanent.
+	return g.runWithEnv(cLocale, args...)
 }
 
 // CloneMirror clones the given repository using mirror flag.
@@ -279,30 +418,30 @@ func (g *Git) CloneMirror(repo, path string, depth int) error {
 		args = append(args, []string{"--depth", strconv.Itoa(depth)}...)
 	}
 	args = append(args, []string{repo, path}...)
-	return g.run(args...)
+	return g.runWithEnv(cLocale, args...)
 }
 
 // CloneRecursive clones the given repository recursively to the given local path.
 func (g *Git) CloneRecursive(repo, path string) error {
-	return g.run("clone", "--recursive", repo, path)
+	return g.runWithEnv(cLocale, "clone", "--recursive", repo, path)
 }
 
 // Commit commits all files in staging with an empty message.
-func (g *Git) Commit() error {
-	return g.run("commit", "--allow-empty", "--allow-empty-message", "--no-edit")
+func (g *Git) Commit(opts ...CommitOpt) error {
+	return g.runCommit(opts, "commit", "--allow-empty", "--allow-empty-message", "--no-edit")
 }
 
 // CommitAmend amends the previous commit with the currently staged
 // changes. Empty commits are allowed.
-func (g *Git) CommitAmend() error {
-	return g.run("commit", "--amend", "--allow-empty", "--no-edit")
+func (g *Git) CommitAmend(opts ...CommitOpt) error {
+	return g.runCommit(opts, "commit", "--amend", "--allow-empty", "--no-edit")
 }
 
 // CommitAmendWithMessage amends the previous commit with the
 // currently staged changes, and the given message. Empty commits are
 // allowed.
-func (g *Git) CommitAmendWithMessage(message string) error {
-	return g.run("commit", "--amend", "--allow-empty", "-m", message)
+func (g *Git) CommitAmendWithMessage(message string, opts ...CommitOpt) error {
+	return g.runCommit(opts, "commit", "--amend", "--allow-empty", "-m", message)
 }
 
 // CommitAndEdit commits all files in staging and allows the user to
@@ -332,14 +471,38 @@ func (g *Git) CommitMessages(branch, baseBranch string) (string, error) {
 
 // CommitNoVerify commits all files in staging with the given
 // message and skips all git-hooks.
-func (g *Git) CommitNoVerify(message string) error {
-	return g.run("commit", "--allow-empty", "--allow-empty-message", "--no-verify", "-m", message)
+func (g *Git) CommitNoVerify(message string, opts ...CommitOpt) error {
+	return g.runCommit(opts, "commit", "--allow-empty", "--allow-empty-message", "--no-verify", "-m", message)
 }
 
 // CommitWithMessage commits all files in staging with the given
 // message.
-func (g *Git) CommitWithMessage(message string) error {
-	return g.run("commit", "--allow-empty", "--allow-empty-message", "-m", message)
+func (g *Git) CommitWithMessage(message string, opts ...CommitOpt) error {
+	return g.runCommit(opts, "commit", "--allow-empty", "--allow-empty-message", "-m", message)
+}
+
+// runCommit runs the given commit command, signing the commit if opts ask
+// for it.
+func (g *Git) runCommit(opts []CommitOpt, args ...string) error {
+	for _, opt := range opts {
+		if sign, ok := opt.(SignOpt); ok && bool(sign) {
+			return g.runSigned(append(args, "-S")...)
+		}
+	}
+	return g.run(args...)
+}
+
+// runSigned runs a git command which signs an object.  Signing must not
+// wait for a passphrase prompt that nobody answers, so the command gets no
+// terminal: if the key is not usable without one, git fails and reports
+// the signing error instead.
+func (g *Git) runSigned(args ...string) error {
+	var stdout, stderr bytes.Buffer
+	env := map[string]string{"GPG_TTY": ""}
+	if err := g.runGitWithStdin(nil, &stdout, &stderr, env, args...); err != nil {
+		return Error(stdout.String(), stderr.String(), err, g.rootDir, args...)
+	}
+	return nil
 }
 
 // CommitWithMessage commits all files in staging and allows the user
@@ -350,6 +513,51 @@ func (g *Git) CommitWithMessageAndEdit(message string) error {
 	return g.runInteractive(args...)
 }
 
+// CommitTree creates a commit object with the tree of the given revision,
+// the given parents and message, without updating any ref, and returns its
+// hash.
+func (g *Git) CommitTree(rev, message string, parents ...string) (string, error) {
+	args := []string{"commit-tree", rev + "^{tree}", "-m", message}
+	for _, parent := range parents {
+		args = append(args, "-p", parent)
+	}
+	out, err := g.runOutput(args...)
+	if err != nil {
+		return "", err
+	}
+	if got, want := len(out), 1; got != want {
+		return "", fmt.Errorf("unexpected length of %v: got %v, want %v", out, got, want)
+	}
+	return out[0], nil
+}
+
+// TreeWithPaths returns the hash of a tree with the content of base, except
+// for the files matching pathspecs, which have their content in rev.  Files
+// of base that match pathspecs but are missing in rev are left out.  A
+// temporary index is used, so that no ref, index or working tree changes.
+func (g *Git) TreeWithPaths(base, rev string, pathspecs ...string) (string, error) {
+	dir, err := ioutil.TempDir("", "jiri-index")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+	env := map[string]string{"GIT_INDEX_FILE": filepath.Join(dir, "index")}
+	run := func(args ...string) (string, error) {
+		var stdout, stderr bytes.Buffer
+		if err := g.runGitWithStdin(nil, &stdout, &stderr, env, args...); err != nil {
+			return "", Error(stdout.String(), stderr.String(), err, g.rootDir, args...)
+		}
+		return strings.TrimSpace(stdout.String()), nil
+	}
+	if _, err := run("read-tree", base); err != nil {
+		return "", err
+	}
+	if _, err := run(append([]string{"reset", "-q", rev, "--"}, pathspecs...)...); err != nil {
+		return "", err
+	}
+	return run("write-tree")
+}
+
 // Committers returns a list of committers for the current repository
 // along with the number of their commits.
 func (g *Git) Committers() ([]string, error) {
@@ -366,6 +574,80 @@ func (g *Git) ExtraCommits(rev, base string) ([]string, error) {
 	return g.runOutput("rev-list", base+".."+rev)
 }
 
+// RevListFiltered returns the commits in the given revision range (e.g.
+// "base..rev"), newest first, which match the given filters.  Dates accept
+// any format understood by git, e.g. "2019-01-01" or "2 weeks ago"; author
+// and committer are patterns matched against "name <email>".
+func (g *Git) RevListFiltered(revRange string, opts ...RevListOpt) ([]string, error) {
+	args := []string{"rev-list"}
+	for _, opt := range opts {
+		switch typedOpt := opt.(type) {
+		case SinceOpt:
+			if typedOpt != "" {
+				args = append(args, "--since="+string(typedOpt))
+			}
+		case UntilOpt:
+			if typedOpt != "" {
+				args = append(args, "--until="+string(typedOpt))
+			}
+		case AuthorOpt:
+			if typedOpt != "" {
+				args = append(args, "--author="+string(typedOpt))
+			}
+		case CommitterOpt:
+			if typedOpt != "" {
+				args = append(args, "--committer="+string(typedOpt))
+			}
+		}
+	}
+	args = append(args, revRange, "--")
+	return g.runOutput(args...)
+}
+
+// AheadBehind returns the number of commits on <branch> that are not on
+// <upstream>, and the number of commits on <upstream> that are not on
+// <branch>, using a single git command. If <upstream> is empty, the upstream
+// configured for <branch> is used, and ErrNoUpstream is returned if there is
+// none. <branch> may be "HEAD" for the current branch.
+func (g *Git) AheadBehind(branch, upstream string) (int, int, error) {
+	if upstream == "" {
+		var err error
+		ref := "refs/heads/" + branch
+		if branch == "HEAD" {
+			// A detached HEAD has no upstream.
+			if ref, err = g.GetSymbolicRef(); err != nil {
+				return 0, 0, ErrNoUpstream
+			}
+		}
+		if upstream, err = g.TrackingBranchFromSymbolicRef(ref); err != nil {
+			return 0, 0, err
+		}
+		if upstream == "" {
+			return 0, 0, ErrNoUpstream
+		}
+	}
+	out, err := g.runOutput("rev-list", "--left-right", "--count", branch+"..."+upstream, "--")
+	if err != nil {
+		return 0, 0, err
+	}
+	var counts []string
+	if len(out) == 1 {
+		counts = strings.Fields(out[0])
+	}
+	if len(counts) != 2 {
+		return 0, 0, fmt.Errorf("unexpected output of rev-list --left-right --count: %q", out)
+	}
+	ahead, err := strconv.Atoi(counts[0])
+	if err != nil {
+		return 0, 0, fmt.Errorf("Atoi(%v) failed: %v", counts[0], err)
+	}
+	behind, err := strconv.Atoi(counts[1])
+	if err != nil {
+		return 0, 0, fmt.Errorf("Atoi(%v) failed: %v", counts[1], err)
+	}
+	return ahead, behind, nil
+}
+
 // CountCommits returns the number of commits on <branch> that are not
 // on <base>.
 func (g *Git) CountCommits(branch, base string) (int, error) {
@@ -435,6 +717,45 @@ func (g *Git) LsRemote(args ...string) (string, error) {
 	return out[0], nil
 }
 
+// CheckRemoteAccess checks that the given remote, which may be a remote name
+// or URL, can be read.  Git may not prompt for credentials, so that missing
+// credentials make the check fail rather than wait for input.
+func (g *Git) CheckRemoteAccess(remote string) error {
+	var stdout, stderr bytes.Buffer
+	env := map[string]string{"GIT_TERMINAL_PROMPT": "0"}
+	args := []string{"ls-remote", remote, "HEAD"}
+	if err := g.runGitWithStdin(nil, &stdout, &stderr, env, args...); err != nil {
+		return Error(stdout.String(), stderr.String(), err, g.rootDir, args...)
+	}
+	return nil
+}
+
+// RemoteDefaultBranch returns the name of the branch that the HEAD of the
+// given remote, which may be a remote name or URL, points to.
+func (g *Git) RemoteDefaultBranch(remote string) (string, error) {
+	out, err := g.runOutput("ls-remote", "--symref", remote, "HEAD")
+	if err != nil {
+		return "", err
+	}
+	if branch, ok := parseSymref(out); ok {
+		return branch, nil
+	}
+	return "", fmt.Errorf("git ls-remote --symref %s HEAD: no default branch found in %q", remote, out)
+}
+
+// parseSymref parses the output of "git ls-remote --symref <remote> HEAD",
+// which starts with a "ref: refs/heads/<name>\tHEAD" line when HEAD is a
+// symbolic ref.
+func parseSymref(lines []string) (string, bool) {
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) == 3 && fields[0] == "ref:" && fields[2] == "HEAD" && strings.HasPrefix(fields[1], "refs/heads/") {
+			return strings.TrimPrefix(fields[1], "refs/heads/"), true
+		}
+	}
+	return "", false
+}
+
 // CreateBranchWithUpstream creates a new branch and sets the upstream
 // repository to the given upstream.
 func (g *Git) CreateBranchWithUpstream(branch, upstream string) error {
@@ -617,6 +938,17 @@ func (g *Git) CreateLightweightTag(name string) error {
 	return g.run("tag", name)
 }
 
+// CreateSignedTag creates an annotated tag with the given message, signed
+// with key.  If key is empty, the key given by SigningKeyOpt or else the
+// git configuration is used.
+func (g *Git) CreateSignedTag(name, message, key string) error {
+	args := []string{"tag", "-s", "-m", message, name}
+	if key != "" {
+		args = []string{"tag", "-u", key, "-m", message, name}
+	}
+	return g.runSigned(args...)
+}
+
 // Fetch fetches refs and tags from the given remote.
 func (g *Git) Fetch(remote string, opts ...FetchOpt) error {
 	return g.FetchRefspec(remote, "", opts...)
@@ -627,17 +959,23 @@ func (g *Git) FetchRefspec(remote, refspec string, opts ...FetchOpt) error {
 	tags := false
 	all := false
 	prune := false
+	pruneTags := false
 	updateShallow := false
 	depth := 0
 	fetchTag := ""
+	var refspecs []string
 	for _, opt := range opts {
 		switch typedOpt := opt.(type) {
+		case RefspecsOpt:
+			refspecs = []string(typedOpt)
 		case TagsOpt:
 			tags = bool(typedOpt)
 		case AllOpt:
 			all = bool(typedOpt)
 		case PruneOpt:
 			prune = bool(typedOpt)
+		case PruneTagsOpt:
+			pruneTags = bool(typedOpt)
 		case DepthOpt:
 			depth = int(typedOpt)
 		case UpdateShallowOpt:
@@ -651,6 +989,13 @@ func (g *Git) FetchRefspec(remote, refspec string, opts ...FetchOpt) error {
 	if prune {
 		args = append(args, "-p")
 	}
+	if pruneTags && g.supportsPruneTags() {
+		// --prune-tags only has an effect together with --prune.
+		if !prune {
+			args = append(args, "-p")
+		}
+		args = append(args, "--prune-tags")
+	}
 	if tags {
 		args = append(args, "--tags")
 	}
@@ -672,22 +1017,192 @@ func (g *Git) FetchRefspec(remote, refspec string, opts ...FetchOpt) error {
 	if refspec != "" {
 		args = append(args, refspec)
 	}
+	args = append(args, refspecs...)
 
-	return g.run(args...)
+	// Failures are classified by their message, see GitError.Permanent.
+	return g.runWithEnv(cLocale, args...)
+}
+
+// ValidateRefspec returns an error if refspec is not a valid fetch refspec of
+// the form [+]<src>:<dst>, where <src> and <dst> are full ref names which
+// either both contain a single "*" or both contain none.
+func ValidateRefspec(refspec string) error {
+	parts := strings.Split(strings.TrimPrefix(refspec, "+"), ":")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("invalid refspec %q: want [+]<src>:<dst>", refspec)
+	}
+	for _, ref := range parts {
+		if !strings.HasPrefix(ref, "refs/") {
+			return fmt.Errorf("invalid refspec %q: %q is not a full ref name starting with \"refs/\"", refspec, ref)
+		}
+		if strings.Count(ref, "*") > 1 {
+			return fmt.Errorf("invalid refspec %q: %q contains more than one \"*\"", refspec, ref)
+		}
+		if strings.ContainsAny(ref, " \t~^?[\\") || strings.Contains(ref, "..") || strings.Contains(ref, "//") || strings.HasSuffix(ref, "/") || strings.HasSuffix(ref, ".lock") {
+			return fmt.Errorf("invalid refspec %q: %q is not a valid ref name", refspec, ref)
+		}
+	}
+	if strings.Contains(parts[0], "*") != strings.Contains(parts[1], "*") {
+		return fmt.Errorf("invalid refspec %q: either both or neither of <src> and <dst> must contain \"*\"", refspec)
+	}
+	return nil
+}
+
+// Unshallow fetches the missing history of a shallow repository from the
+// given remote, converting it into a complete repository.
+func (g *Git) Unshallow(remote string) error {
+	return g.run("fetch", "--unshallow", remote)
+}
+
+// supportsPruneTags returns true if git supports "fetch --prune-tags", which
+// was added in git 2.17.
+func (g *Git) supportsPruneTags() bool {
+	major, minor, err := g.Version()
+	if err != nil {
+		return false
+	}
+	return major > 2 || (major == 2 && minor >= 17)
+}
+
+// ErrMaintenanceNotSupported is returned by the background maintenance
+// helpers if git is older than 2.29, which added "git maintenance".
+var ErrMaintenanceNotSupported = errors.New("background maintenance requires git 2.29 or later")
+
+// supportsMaintenance returns true if git supports "git maintenance", which
+// was added in git 2.29.
+func (g *Git) supportsMaintenance() bool {
+	major, minor, err := g.Version()
+	if err != nil {
+		return false
+	}
+	return major > 2 || (major == 2 && minor >= 29)
+}
+
+// MaintenanceRegister registers the repository for git's background
+// maintenance, which runs once the git scheduler is started with "git
+// maintenance start".
+func (g *Git) MaintenanceRegister() error {
+	if !g.supportsMaintenance() {
+		return ErrMaintenanceNotSupported
+	}
+	return g.run("maintenance", "register")
+}
+
+// MaintenanceUnregister removes the repository from git's background
+// maintenance.  Repositories that are not registered are left alone.
+func (g *Git) MaintenanceUnregister() error {
+	if !g.supportsMaintenance() {
+		return ErrMaintenanceNotSupported
+	}
+	var stdout, stderr bytes.Buffer
+	args := []string{"maintenance", "unregister"}
+	// Run in the C locale, so that the message checked below is not
+	// translated.
+	if err := g.runGitWithEnv(&stdout, &stderr, cLocale, args...); err != nil {
+		if strings.Contains(stderr.String(), "is not registered") {
+			return nil
+		}
+		return Error(stdout.String(), stderr.String(), err, g.rootDir, args...)
+	}
+	return nil
+}
+
+// Fsck checks the connectivity and validity of all the objects in the
+// repository with "git fsck --full". The returned error includes git's report
+// of the missing or corrupt objects. Dangling objects are not reported.
+func (g *Git) Fsck() error {
+	return g.run("fsck", "--full", "--no-dangling", "--no-progress")
 }
 
 // FilesWithUncommittedChanges returns the list of files that have
-// uncommitted changes.
+// uncommitted changes: those with unstaged changes, followed by those with
+// staged changes.
 func (g *Git) FilesWithUncommittedChanges() ([]string, error) {
-	out, err := g.runOutput("diff", "--name-only", "--no-ext-diff")
+	staged, unstaged, err := g.DiffIndex()
 	if err != nil {
 		return nil, err
 	}
-	out2, err := g.runOutput("diff", "--cached", "--name-only", "--no-ext-diff")
+	return append(unstaged, staged...), nil
+}
+
+// FileStatus is the status of a changed file, as reported by
+// "git status --porcelain".
+type FileStatus struct {
+	// Index and WorkTree are the states of the file in the index and in
+	// the working tree, such as 'M' for modified, 'A' for added, 'D' for
+	// deleted, 'R' for renamed or ' ' for unchanged. Both are '?' for
+	// untracked files.
+	Index, WorkTree byte
+	// Path is the path of the file relative to the root of the repository.
+	Path string
+	// OrigPath is the path the file was renamed or copied from, if any.
+	OrigPath string
+}
+
+// Status returns the status of the files with staged or unstaged changes,
+// and of the untracked files if untracked is set, with a single
+// "git status" invocation.
+func (g *Git) Status(untracked bool) ([]FileStatus, error) {
+	var stdout, stderr bytes.Buffer
+	args := []string{"status", "--porcelain", "-z"}
+	if untracked {
+		args = append(args, "--untracked-files=all")
+	} else {
+		args = append(args, "--untracked-files=no")
+	}
+	// Like "git diff", status must not take the index lock to refresh
+	// the index, which would make concurrent git commands fail.
+	env := map[string]string{"GIT_OPTIONAL_LOCKS": "0"}
+	if err := g.runGitWithStdin(nil, &stdout, &stderr, env, args...); err != nil {
+		return nil, Error(stdout.String(), stderr.String(), err, g.rootDir, args...)
+	}
+	return parseStatus(stdout.String()), nil
+}
+
+// parseStatus parses the output of "git status --porcelain -z", in which
+// each entry is the two state letters, a space and the path, followed by
+// the original path as a separate entry for renames and copies.
+func parseStatus(out string) []FileStatus {
+	var statuses []FileStatus
+	entries := strings.Split(out, "\x00")
+	for i := 0; i < len(entries); i++ {
+		entry := entries[i]
+		if len(entry) < 4 {
+			continue
+		}
+		status := FileStatus{Index: entry[0], WorkTree: entry[1], Path: entry[3:]}
+		if isRenameOrCopy(status.Index) || isRenameOrCopy(status.WorkTree) {
+			if i++; i < len(entries) {
+				status.OrigPath = entries[i]
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+func isRenameOrCopy(state byte) bool {
+	return state == 'R' || state == 'C'
+}
+
+// DiffIndex returns the files with changes staged in the index and the files
+// with changes in the working tree which are not staged, as "git diff
+// --cached --name-only" and "git diff --name-only" would, with a single
+// "git status" invocation. Untracked files are not included.
+func (g *Git) DiffIndex() (staged, unstaged []string, err error) {
+	statuses, err := g.Status(false)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	for _, status := range statuses {
+		if status.Index != ' ' {
+			staged = append(staged, status.Path)
+		}
+		if status.WorkTree != ' ' {
+			unstaged = append(unstaged, status.Path)
+		}
 	}
-	return append(out, out2...), nil
+	return staged, unstaged, nil
 }
 
 // MergedBranches returns the list of all branches that were already merged.
@@ -696,6 +1211,24 @@ func (g *Git) MergedBranches(ref string) ([]string, error) {
 	return branches, err
 }
 
+// BranchBase returns the revision the given branch was created at, as
+// recorded in its reflog, or "" if its reflog no longer records it.
+func (g *Git) BranchBase(branch string) (string, error) {
+	out, err := g.runOutput("reflog", "show", "--format=%H %gs", "refs/heads/"+branch, "--")
+	if err != nil {
+		return "", err
+	}
+	if len(out) == 0 {
+		return "", nil
+	}
+	// The oldest entry comes last.
+	fields := strings.SplitN(out[len(out)-1], " ", 2)
+	if len(fields) != 2 || !strings.HasPrefix(fields[1], "branch: Created from ") {
+		return "", nil
+	}
+	return fields[0], nil
+}
+
 // GetBranches returns a slice of the local branches of the current
 // repository, followed by the name of the current branch. The
 // behavior can be customized by providing optional arguments
@@ -734,6 +1267,32 @@ func (g *Git) BranchExists(branch string) (bool, error) {
 	return stdout.String() != "", nil
 }
 
+// CommitExists returns true if ref names a commit which exists in the
+// repository.  Refs naming other objects, such as blobs or trees, and refs
+// which cannot be resolved yield false without an error, so that callers can
+// tell missing commits apart from other failures.
+func (g *Git) CommitExists(ref string) (bool, error) {
+	var stdout, stderr bytes.Buffer
+	args := []string{"cat-file", "-e", ref + "^{commit}"}
+	if err := g.runGitWithEnv(&stdout, &stderr, cLocale, args...); err != nil {
+		// git cat-file -e exits with 1 for missing objects and with 128,
+		// complaining about the object name, if the name cannot be
+		// resolved to a commit.  It also exits with 128 for other errors,
+		// so its message is checked, in the C locale so that it is not
+		// translated.
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			if exitErr.ExitCode() == 1 && stderr.Len() == 0 {
+				return false, nil
+			}
+			if exitErr.ExitCode() == 128 && strings.Contains(stderr.String(), "Not a valid object name") {
+				return false, nil
+			}
+		}
+		return false, Error(stdout.String(), stderr.String(), err, g.rootDir, args...)
+	}
+	return true, nil
+}
+
 // ListRemoteBranchesContainingRef returns a slice of the remote branches
 // which contains the given commit
 func (g *Git) ListRemoteBranchesContainingRef(commit string) (map[string]bool, error) {
@@ -862,6 +1421,39 @@ func (g *Git) Log(branch, base, format string) ([][]string, error) {
 	return result, nil
 }
 
+// LogGraph returns the ASCII graph of at most <limit> commits reachable
+// from <rev>, as drawn by "git log --graph --oneline --decorate".  The graph
+// is colored when jiri's color output is enabled.  A <limit> of 0 shows all
+// commits.
+func (g *Git) LogGraph(rev string, limit int) (string, error) {
+	return g.logOneline(rev, limit, "--graph")
+}
+
+// LogOneline is like LogGraph, but lists the commits in order without
+// drawing the graph.
+func (g *Git) LogOneline(rev string, limit int) (string, error) {
+	return g.logOneline(rev, limit)
+}
+
+func (g *Git) logOneline(rev string, limit int, extraArgs ...string) (string, error) {
+	args := append([]string{"log"}, extraArgs...)
+	args = append(args, "--oneline", "--decorate")
+	if g.jirix.Color != nil && g.jirix.Color.Enabled() {
+		args = append(args, "--color=always")
+	} else {
+		args = append(args, "--color=never")
+	}
+	if limit > 0 {
+		args = append(args, fmt.Sprintf("-n%d", limit))
+	}
+	args = append(args, rev, "--")
+	var stdout, stderr bytes.Buffer
+	if err := g.runGit(&stdout, &stderr, args...); err != nil {
+		return "", Error(stdout.String(), stderr.String(), err, g.rootDir, args...)
+	}
+	return stdout.String(), nil
+}
+
 // Merge merges all commits from <branch> to the current branch. If
 // <squash> is set, then all merged commits are squashed into a single
 // commit.
@@ -902,6 +1494,18 @@ func (g *Git) Merge(branch string, opts ...MergeOpt) error {
 	return nil
 }
 
+// MergeBase returns the best common ancestor of the two given refs.
+func (g *Git) MergeBase(ref1, ref2 string) (string, error) {
+	out, err := g.runOutput("merge-base", ref1, ref2)
+	if err != nil {
+		return "", err
+	}
+	if got, want := len(out), 1; got != want {
+		return "", fmt.Errorf("unexpected length of %v: got %v, want %v", out, got, want)
+	}
+	return out[0], nil
+}
+
 // ModifiedFiles returns a slice of filenames that have changed
 // between <baseBranch> and <currentBranch>.
 func (g *Git) ModifiedFiles(baseBranch, currentBranch string) ([]string, error) {
@@ -938,6 +1542,11 @@ func (g *Git) Pull(remote, branch string) error {
 
 // Push pushes the given branch to the given remote.
 func (g *Git) Push(remote, branch string, opts ...PushOpt) error {
+	return g.PushRefspec(remote, branch, opts...)
+}
+
+// PushRefspec pushes the given refspec to the given remote.
+func (g *Git) PushRefspec(remote, refspec string, opts ...PushOpt) error {
 	args := []string{"push"}
 	force := false
 	verify := true
@@ -965,48 +1574,178 @@ func (g *Git) Push(remote, branch string, opts ...PushOpt) error {
 	if followTags {
 		args = append(args, "--follow-tags")
 	}
-	args = append(args, remote, branch)
+	args = append(args, remote, refspec)
 	return g.run(args...)
 }
 
+// PushDeleteRef deletes the given ref (e.g. "refs/tags/v1") from the given
+// remote.
+func (g *Git) PushDeleteRef(remote, ref string, opts ...PushOpt) error {
+	return g.PushRefspec(remote, ":"+ref, opts...)
+}
+
+// PushDeleteBranch deletes the given branch from the given remote.
+func (g *Git) PushDeleteBranch(remote, branch string, opts ...PushOpt) error {
+	return g.PushDeleteRef(remote, "refs/heads/"+branch, opts...)
+}
+
 // Rebase rebases to a particular upstream branch.
 func (g *Git) Rebase(upstream string) error {
 	return g.run("rebase", upstream)
 }
 
-// CherryPickAbort aborts an in-progress cherry-pick operation.
-func (g *Git) CherryPickAbort() error {
-	// First check if cherry-pick is in progress
-	path := ".git/CHERRY_PICK_HEAD"
-	if g.rootDir != "" {
-		path = filepath.Join(g.rootDir, path)
-	}
-	if _, err := os.Stat(path); err != nil {
-		if os.IsNotExist(err) {
-			return nil // Not in progress return
-		}
-		return err
+// RebaseOnto rebases the commits of branch that are not on upstream onto
+// newBase. If branch is empty, the current branch is rebased.
+func (g *Git) RebaseOnto(newBase, upstream, branch string) error {
+	args := []string{"rebase", "--onto", newBase, upstream}
+	if branch != "" {
+		args = append(args, branch)
 	}
-	return g.run("cherry-pick", "--abort")
+	return g.run(args...)
 }
 
-// RebaseAbort aborts an in-progress rebase operation.
-func (g *Git) RebaseAbort() error {
-	// First check if rebase is in progress
-	path := ".git/rebase-apply"
-	if g.rootDir != "" {
-		path = filepath.Join(g.rootDir, path)
+// RebaseInteractiveScripted runs an interactive rebase onto upstream without
+// user interaction. If todo is not nil, it replaces the todo list generated by
+// git, one instruction per line (e.g. "fixup <sha>"); otherwise the generated
+// list is used as is, which is useful together with AutosquashOpt. Commit
+// messages of squashed commits are combined without invoking an editor.
+func (g *Git) RebaseInteractiveScripted(upstream string, todo []string, opts ...RebaseOpt) error {
+	args := []string{"rebase", "-i"}
+	for _, opt := range opts {
+		switch typedOpt := opt.(type) {
+		case AutosquashOpt:
+			if typedOpt {
+				args = append(args, "--autosquash")
+			} else {
+				args = append(args, "--no-autosquash")
+			}
+		}
 	}
-	if _, err := os.Stat(path); err != nil {
-		if os.IsNotExist(err) {
-			return nil // Not in progress return
+	args = append(args, upstream)
+	editor := "true"
+	if todo != nil {
+		f, err := ioutil.TempFile("", "jiri-rebase-todo")
+		if err != nil {
+			return err
 		}
-		return err
+		defer os.Remove(f.Name())
+		_, err = f.WriteString(strings.Join(todo, "\n") + "\n")
+		if err2 := f.Close(); err == nil {
+			err = err2
+		}
+		if err != nil {
+			return err
+		}
+		editor = "cp " + shellQuote(f.Name())
 	}
-	return g.run("rebase", "--abort")
+	return g.runWithEnv(map[string]string{
+		"GIT_SEQUENCE_EDITOR": editor,
+		"GIT_EDITOR":          "true",
+	}, args...)
 }
 
-// Remove removes the given files.
+// RebaseContinue continues a paused rebase, keeping the commit messages
+// unchanged.
+func (g *Git) RebaseContinue() error {
+	return g.runWithEnv(map[string]string{"GIT_EDITOR": "true"}, "rebase", "--continue")
+}
+
+// RebaseSkip skips the current commit of a paused rebase.
+func (g *Git) RebaseSkip() error {
+	return g.run("rebase", "--skip")
+}
+
+// shellQuote quotes s for use as a single word in a shell command, as git
+// runs editors through the shell.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// CherryPickAbort aborts an in-progress cherry-pick operation.
+func (g *Git) CherryPickAbort() error {
+	// First check if cherry-pick is in progress
+	if inProgress, err := g.gitDirPathExists("CHERRY_PICK_HEAD"); err != nil || !inProgress {
+		return err
+	}
+	return g.run("cherry-pick", "--abort")
+}
+
+// MergeAbort aborts an in-progress merge operation.
+func (g *Git) MergeAbort() error {
+	// First check if merge is in progress
+	if inProgress, err := g.gitDirPathExists("MERGE_HEAD"); err != nil || !inProgress {
+		return err
+	}
+	return g.run("merge", "--abort")
+}
+
+// gitDirPathExists returns true if the given path exists in the git
+// directory of the repository, which holds the state of in-progress
+// operations.
+func (g *Git) gitDirPathExists(name string) (bool, error) {
+	gitDir, err := g.GitDir()
+	if err != nil {
+		return false, err
+	}
+	if _, err := os.Stat(filepath.Join(gitDir, name)); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// GetMergeHeadMessage returns the message saved for a paused merge, revert or
+// cherry-pick, or an empty string if there is none.
+func (g *Git) GetMergeHeadMessage() (string, error) {
+	return g.readMessageFile("MERGE_MSG")
+}
+
+// GetCommitEditMessage returns the message of the last commit being edited,
+// or an empty string if there is none.
+func (g *Git) GetCommitEditMessage() (string, error) {
+	return g.readMessageFile("COMMIT_EDITMSG")
+}
+
+// readMessageFile reads a message file from the git directory, dropping
+// comment lines.  A missing file yields an empty message.
+func (g *Git) readMessageFile(name string) (string, error) {
+	gitDir, err := g.GitDir()
+	if err != nil {
+		return "", err
+	}
+	data, err := ioutil.ReadFile(filepath.Join(gitDir, name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	var lines []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if !strings.HasPrefix(line, "#") {
+			lines = append(lines, line)
+		}
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n")), nil
+}
+
+// RebaseAbort aborts an in-progress rebase operation.
+func (g *Git) RebaseAbort() error {
+	// First check if rebase is in progress. Interactive and merge based
+	// rebases keep their state in rebase-merge instead of rebase-apply.
+	for _, dir := range []string{"rebase-apply", "rebase-merge"} {
+		if inProgress, err := g.gitDirPathExists(dir); err != nil {
+			return err
+		} else if inProgress {
+			return g.run("rebase", "--abort")
+		}
+	}
+	return nil // Not in progress return
+}
+
+// Remove removes the given files.
 func (g *Git) Remove(fileNames ...string) error {
 	args := []string{"rm"}
 	args = append(args, fileNames...)
@@ -1030,6 +1769,66 @@ func (g *Git) ConfigGetKey(key string) (string, error) {
 	return out[0], nil
 }
 
+// ConfigListSection returns the config values whose keys start with the
+// given section prefix, keyed by the remainder of the key. If a key has
+// multiple values, the last one is returned.
+func (g *Git) ConfigListSection(prefix string) (map[string]string, error) {
+	var stdout, stderr bytes.Buffer
+	prefix = strings.TrimSuffix(prefix, ".") + "."
+	args := []string{"config", "-z", "--get-regexp", "^" + regexp.QuoteMeta(prefix)}
+	if err := g.runGit(&stdout, &stderr, args...); err != nil {
+		// git config exits with 1 if no key matches.
+		if exitErr, ok := err.(*exec.ExitError); ok && stderr.Len() == 0 && exitErr.ExitCode() == 1 {
+			return map[string]string{}, nil
+		}
+		return nil, Error(stdout.String(), stderr.String(), err, g.rootDir, args...)
+	}
+	values := map[string]string{}
+	for _, entry := range strings.Split(stdout.String(), "\x00") {
+		if entry == "" {
+			continue
+		}
+		// With -z each entry is the key, a newline and the value.
+		kv := strings.SplitN(entry, "\n", 2)
+		value := ""
+		if len(kv) == 2 {
+			value = kv[1]
+		}
+		values[strings.TrimPrefix(kv[0], prefix)] = value
+	}
+	return values, nil
+}
+
+// ConfigSetOwned sets the config key to value and records in the
+// JiriConfigSection that the key is owned by jiri, so that it can later be
+// removed without touching config set by the user.
+func (g *Git) ConfigSetOwned(key, value string) error {
+	if err := g.Config(key, value); err != nil {
+		return err
+	}
+	return g.Config(JiriConfigSection+"."+key, value)
+}
+
+// ConfigUnsetOwned removes all config set through ConfigSetOwned. Keys whose
+// value was changed since jiri set them are left alone.
+func (g *Git) ConfigUnsetOwned() error {
+	owned, err := g.ConfigListSection(JiriConfigSection)
+	if err != nil {
+		return err
+	}
+	for key, value := range owned {
+		if current, err := g.runOutput("config", "--get", key); err == nil && strings.Join(current, "\n") == value {
+			if err := g.run("config", "--unset", key); err != nil {
+				return err
+			}
+		}
+		if err := g.run("config", "--unset-all", JiriConfigSection+"."+key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // RemoteUrl gets the url of the remote with the given name.
 func (g *Git) RemoteUrl(name string) (string, error) {
 	configKey := fmt.Sprintf("remote.%s.url", name)
@@ -1043,9 +1842,19 @@ func (g *Git) RemoteUrl(name string) (string, error) {
 	return out[0], nil
 }
 
-// RemoveUntrackedFiles removes untracked files and directories.
-func (g *Git) RemoveUntrackedFiles() error {
-	return g.run("clean", "-d", "-f")
+// RemoveUntrackedFiles removes untracked files and directories.  Files
+// ignored by git or matching the patterns of an ExcludeOpt are kept.
+func (g *Git) RemoveUntrackedFiles(opts ...CleanOpt) error {
+	args := []string{"clean", "-d", "-f"}
+	for _, opt := range opts {
+		switch typedOpt := opt.(type) {
+		case ExcludeOpt:
+			for _, pattern := range typedOpt {
+				args = append(args, "-e", pattern)
+			}
+		}
+	}
+	return g.run(args...)
 }
 
 // Reset resets the current branch to the target, discarding any
@@ -1073,15 +1882,44 @@ func (g *Git) DeleteRemote(name string) error {
 	return g.run("remote", "rm", name)
 }
 
+// RenameRemote renames the remote oldName to newName, moving its config
+// section, its remote-tracking branches and the upstream of branches tracking
+// it along with it.
+func (g *Git) RenameRemote(oldName, newName string) error {
+	return g.run("remote", "rename", oldName, newName)
+}
+
 // Stash attempts to stash any unsaved changes. It returns true if
 // anything was actually stashed, otherwise false. An error is
 // returned if the stash command fails.
 func (g *Git) Stash() (bool, error) {
+	return g.StashSave("")
+}
+
+// StashSave is like Stash, but records the stash with the given message, if
+// any, and honours the given options.
+func (g *Git) StashSave(message string, opts ...StashOpt) (bool, error) {
+	args := []string{"stash", "push"}
+	for _, opt := range opts {
+		switch typedOpt := opt.(type) {
+		case IncludeUntrackedOpt:
+			if typedOpt {
+				args = append(args, "--include-untracked")
+			}
+		case KeepIndexOpt:
+			if typedOpt {
+				args = append(args, "--keep-index")
+			}
+		}
+	}
+	if message != "" {
+		args = append(args, "-m", message)
+	}
 	oldSize, err := g.StashSize()
 	if err != nil {
 		return false, err
 	}
-	if err := g.run("stash", "save"); err != nil {
+	if err := g.run(args...); err != nil {
 		return false, err
 	}
 	newSize, err := g.StashSize()
@@ -1110,6 +1948,29 @@ func (g *Git) StashPop() error {
 	return g.run("stash", "pop")
 }
 
+// StashCreate creates a stash commit of the uncommitted changes without
+// pushing it onto the stash stack or touching the working tree.  It returns
+// an empty string if there is nothing to stash.
+func (g *Git) StashCreate() (string, error) {
+	out, err := g.runOutput("stash", "create")
+	if err != nil {
+		return "", err
+	}
+	return strings.Join(out, "\n"), nil
+}
+
+// StashStore records a stash commit created by StashCreate on the stash
+// stack with the given message.
+func (g *Git) StashStore(commit, message string) error {
+	return g.run("stash", "store", "-m", message, commit)
+}
+
+// StashApply applies the given stash, which may be a stash commit created by
+// StashCreate, to the current working tree, restoring the index as well.
+func (g *Git) StashApply(stash string) error {
+	return g.run("stash", "apply", "--index", stash)
+}
+
 // TopLevel returns the top level path of the current repository.
 func (g *Git) TopLevel() (string, error) {
 	// TODO(sadovsky): If g.rootDir is set, perhaps simply return that?
@@ -1120,6 +1981,36 @@ func (g *Git) TopLevel() (string, error) {
 	return strings.Join(out, "\n"), nil
 }
 
+// GitDir returns the path of the git directory of the repository, which is
+// not <root>/.git for linked worktrees and submodules.
+func (g *Git) GitDir() (string, error) {
+	return g.revParsePath("--git-dir")
+}
+
+// GitCommonDir returns the path of the git directory shared by all the
+// worktrees of the repository.  It is the same as GitDir except in linked
+// worktrees.
+func (g *Git) GitCommonDir() (string, error) {
+	return g.revParsePath("--git-common-dir")
+}
+
+// revParsePath returns the path printed by "git rev-parse <option>", made
+// absolute if it is relative to the root directory.
+func (g *Git) revParsePath(option string) (string, error) {
+	out, err := g.runOutput("rev-parse", option)
+	if err != nil {
+		return "", err
+	}
+	if got, want := len(out), 1; got != want {
+		return "", fmt.Errorf("unexpected length of %v: got %v, want %v", out, got, want)
+	}
+	path := out[0]
+	if !filepath.IsAbs(path) && g.rootDir != "" {
+		path = filepath.Join(g.rootDir, path)
+	}
+	return path, nil
+}
+
 // TrackedFiles returns the list of files that are tracked.
 func (g *Git) TrackedFiles() ([]string, error) {
 	out, err := g.runOutput("ls-files")
@@ -1148,8 +2039,129 @@ func (g *Git) UntrackedFiles() ([]string, error) {
 	return out, nil
 }
 
+// UpdateSubmodules initializes the submodules of the repository and checks
+// out the commits recorded for them, descending into nested submodules when
+// <recursive> is set.  Submodule URLs are synced from .gitmodules first, so
+// URLs relative to the superproject are resolved against its current origin.
+// DepthOpt limits the history fetched for each submodule.
+func (g *Git) UpdateSubmodules(recursive bool, opts ...SubmoduleOpt) error {
+	syncArgs := []string{"submodule", "sync"}
+	updateArgs := []string{"submodule", "update", "--init"}
+	if recursive {
+		syncArgs = append(syncArgs, "--recursive")
+		updateArgs = append(updateArgs, "--recursive")
+	}
+	for _, opt := range opts {
+		switch typedOpt := opt.(type) {
+		case DepthOpt:
+			if typedOpt > 0 {
+				updateArgs = append(updateArgs, "--depth", strconv.Itoa(int(typedOpt)))
+			}
+		}
+	}
+	if err := g.run(syncArgs...); err != nil {
+		return err
+	}
+	return g.run(updateArgs...)
+}
+
+// Submodule describes a submodule as reported by "git submodule status".
+type Submodule struct {
+	Path string
+	// Revision is the commit checked out in the submodule, or the commit
+	// recorded in the superproject if the submodule is not initialized.
+	Revision string
+	// Initialized is false if the submodule is not checked out.
+	Initialized bool
+	// OutOfDate is true if the commit checked out in the submodule is not
+	// the one recorded in the superproject, or if it has merge conflicts.
+	OutOfDate bool
+}
+
+// Submodules returns the submodules of the repository, recursively.
+func (g *Git) Submodules() ([]Submodule, error) {
+	var stdout, stderr bytes.Buffer
+	args := []string{"submodule", "status", "--recursive"}
+	if err := g.runGit(&stdout, &stderr, args...); err != nil {
+		return nil, Error(stdout.String(), stderr.String(), err, g.rootDir, args...)
+	}
+	// The output is not trimmed, as the first character of each line is the
+	// state of the submodule, which is a space if it is up to date.
+	return parseSubmodules(strings.Split(stdout.String(), "\n")), nil
+}
+
+// parseSubmodules parses the output of "git submodule status", which has
+// one "<state><revision> <path>[ (<describe>)]" line per submodule.  Paths may
+// contain spaces.
+func parseSubmodules(lines []string) []Submodule {
+	var submodules []Submodule
+	for _, line := range lines {
+		if line == "" {
+			continue
+		}
+		state, rest := line[0], line[1:]
+		i := strings.IndexByte(rest, ' ')
+		if i <= 0 || i == len(rest)-1 {
+			continue
+		}
+		revision, path := rest[:i], rest[i+1:]
+		if state != '-' && strings.HasSuffix(path, ")") {
+			// Initialized submodules are followed by the description of
+			// their revision.
+			if j := strings.LastIndex(path, " ("); j >= 0 {
+				path = path[:j]
+			}
+		}
+		submodules = append(submodules, Submodule{
+			Path:        path,
+			Revision:    revision,
+			Initialized: state != '-',
+			OutOfDate:   state == '+' || state == 'U',
+		})
+	}
+	return submodules
+}
+
+// LFSInstall sets up the Git LFS filters and hooks in the repository.
+func (g *Git) LFSInstall() error {
+	return g.runLFS("install", "--local")
+}
+
+// LFSPull fetches the Git LFS objects of the current revision and replaces
+// their pointer files in the working tree.
+func (g *Git) LFSPull() error {
+	return g.runLFS("pull")
+}
+
+// runLFS runs a "git lfs" command, returning ErrLFSNotInstalled if git does
+// not know the command.  It runs in the C locale so that git's message can be
+// recognized.
+func (g *Git) runLFS(lfsArgs ...string) error {
+	var stdout, stderr bytes.Buffer
+	args := append([]string{"lfs"}, lfsArgs...)
+	if err := g.runGitWithEnv(&stdout, &stderr, cLocale, args...); err != nil {
+		if strings.Contains(stderr.String(), "'lfs' is not a git command") {
+			return ErrLFSNotInstalled
+		}
+		return Error(stdout.String(), stderr.String(), err, g.rootDir, args...)
+	}
+	return nil
+}
+
+var (
+	// versionMu guards gitVersion, the version of git, which is cached
+	// once it is read successfully.
+	versionMu  sync.Mutex
+	gitVersion [2]int
+)
+
 // Version returns the major and minor git version.
 func (g *Git) Version() (int, int, error) {
+	versionMu.Lock()
+	defer versionMu.Unlock()
+	if gitVersion[0] != 0 {
+		return gitVersion[0], gitVersion[1], nil
+	}
 	out, err := g.runOutput("version")
 	if err != nil {
 		return 0, 0, err
@@ -1173,9 +2185,432 @@ func (g *Git) Version() (int, int, error) {
 	if err != nil {
 		return 0, 0, fmt.Errorf("failed parsing %q to integer", minor)
 	}
+	gitVersion = [2]int{major, minor}
 	return major, minor, nil
 }
 
+// SignatureStatus describes the outcome of verifying a commit signature.
+type SignatureStatus string
+
+const (
+	// SignatureNone means the commit carries no signature.
+	SignatureNone SignatureStatus = "none"
+	// SignatureGood means the signature is valid.
+	SignatureGood SignatureStatus = "good"
+	// SignatureBad means the signature does not match the commit.
+	SignatureBad SignatureStatus = "bad"
+	// SignatureExpired means the signature or the signing key has expired.
+	SignatureExpired SignatureStatus = "expired"
+	// SignatureRevoked means the signing key has been revoked.
+	SignatureRevoked SignatureStatus = "revoked"
+	// SignatureUnknownKey means the signature could not be checked, usually
+	// because the public key is missing from the keyring.
+	SignatureUnknownKey SignatureStatus = "unknown key"
+)
+
+// Signature holds the result of verifying the signature of a commit.
+type Signature struct {
+	Status SignatureStatus
+	Signer string
+	KeyID  string
+}
+
+// Valid returns true if the signature is present and good.
+func (s Signature) Valid() bool {
+	return s.Status == SignatureGood
+}
+
+// VerifyCommit checks the GPG signature of the commit at ref. A commit without
+// a signature is reported as SignatureNone rather than as an error; an error
+// is only returned if git could not inspect the commit.
+func (g *Git) VerifyCommit(ref string) (Signature, error) {
+	var stdout, stderr bytes.Buffer
+	args := []string{"verify-commit", "--raw", ref}
+	// verify-commit exits non-zero for unsigned and badly signed commits, so
+	// the status lines have to be inspected before the error.
+	err := g.runGit(&stdout, &stderr, args...)
+	if sig, ok := parseSignature(stderr.String()); ok {
+		return sig, nil
+	}
+	if err != nil && strings.TrimSpace(stderr.String()) != "" {
+		return Signature{}, Error(stdout.String(), stderr.String(), err, g.rootDir, args...)
+	}
+	return Signature{Status: SignatureNone}, nil
+}
+
+// parseSignature parses the GPG status lines printed by "git verify-commit
+// --raw". It returns false if the output contains no signature status.
+func parseSignature(output string) (Signature, bool) {
+	var sig Signature
+	found := false
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[0] != "[GNUPG:]" {
+			continue
+		}
+		status := SignatureStatus("")
+		switch fields[1] {
+		case "GOODSIG":
+			status = SignatureGood
+		case "BADSIG":
+			status = SignatureBad
+		case "EXPSIG", "EXPKEYSIG":
+			status = SignatureExpired
+		case "REVKEYSIG":
+			status = SignatureRevoked
+		case "ERRSIG":
+			status = SignatureUnknownKey
+		default:
+			continue
+		}
+		// A bad, expired or revoked signature must not be masked by a good
+		// status line reported for another signature.
+		if found && sig.Status != SignatureGood {
+			continue
+		}
+		found = true
+		sig.Status = status
+		sig.KeyID = fields[2]
+		sig.Signer = ""
+		if status != SignatureUnknownKey {
+			sig.Signer = strings.Join(fields[3:], " ")
+		}
+	}
+	return sig, found
+}
+
+// Worktree describes a working tree attached to a repository.
+type Worktree struct {
+	Path string
+	// Head is the revision checked out in the working tree.
+	Head string
+	// Branch is the branch checked out in the working tree, it is empty if
+	// the working tree has a detached HEAD.
+	Branch string
+}
+
+// AddWorktree creates a new working tree at path with branch checked out.
+// If branch is empty, git creates a branch named after the last component of
+// path.
+func (g *Git) AddWorktree(path, branch string) error {
+	args := []string{"worktree", "add", path}
+	if branch != "" {
+		args = append(args, branch)
+	}
+	return g.run(args...)
+}
+
+// RemoveWorktree removes the working tree at path.  If force is true, the
+// working tree is removed even if it has local modifications.
+func (g *Git) RemoveWorktree(path string, force bool) error {
+	args := []string{"worktree", "remove"}
+	if force {
+		args = append(args, "--force")
+	}
+	args = append(args, path)
+	return g.run(args...)
+}
+
+// ErrWorktreeRepairNotSupported is returned by RepairWorktrees if git is
+// older than 2.30, which added "git worktree repair".
+var ErrWorktreeRepairNotSupported = errors.New("repairing working trees requires git 2.30 or later")
+
+// RepairWorktrees fixes up the links between the repository and its working
+// trees after either of them has been moved.
+func (g *Git) RepairWorktrees() error {
+	major, minor, err := g.Version()
+	if err != nil {
+		return err
+	}
+	if major < 2 || (major == 2 && minor < 30) {
+		return ErrWorktreeRepairNotSupported
+	}
+	return g.run("worktree", "repair")
+}
+
+// ListWorktrees returns the working trees of the repository, starting with
+// the main working tree.
+func (g *Git) ListWorktrees() ([]Worktree, error) {
+	var stdout, stderr bytes.Buffer
+	args := []string{"worktree", "list", "--porcelain"}
+	if err := g.runGit(&stdout, &stderr, args...); err != nil {
+		return nil, Error(stdout.String(), stderr.String(), err, g.rootDir, args...)
+	}
+	return parseWorktrees(stdout.String()), nil
+}
+
+// parseWorktrees parses the output of "git worktree list --porcelain", which
+// has one block of "<attribute> <value>" lines per working tree.
+func parseWorktrees(output string) []Worktree {
+	var worktrees []Worktree
+	for _, line := range strings.Split(output, "\n") {
+		attr, value := line, ""
+		if i := strings.Index(line, " "); i != -1 {
+			attr, value = line[:i], line[i+1:]
+		}
+		switch attr {
+		case "worktree":
+			worktrees = append(worktrees, Worktree{Path: value})
+		case "HEAD":
+			if len(worktrees) != 0 {
+				worktrees[len(worktrees)-1].Head = value
+			}
+		case "branch":
+			if len(worktrees) != 0 {
+				worktrees[len(worktrees)-1].Branch = strings.TrimPrefix(value, "refs/heads/")
+			}
+		}
+	}
+	return worktrees
+}
+
+// ReflogEntry represents an entry of the reflog of a ref.
+type ReflogEntry struct {
+	// Hash is the commit the ref pointed to after the change.
+	Hash string
+	// Selector names the entry, like "HEAD@{2}".
+	Selector string
+	// Subject is the reflog message, like "checkout: moving from a to b".
+	Subject string
+}
+
+// Reflog returns the n most recent entries of the reflog of ref, newest
+// first.  All entries are returned if n is not positive.  An error is
+// returned if ref has no reflog because reflogs are disabled.
+func (g *Git) Reflog(ref string, n int) ([]ReflogEntry, error) {
+	args := []string{"reflog", "show", "--format=%H %gd %gs"}
+	if n > 0 {
+		args = append(args, fmt.Sprintf("-n%d", n))
+	}
+	args = append(args, ref, "--")
+	out, err := g.runOutput(args...)
+	if err != nil {
+		return nil, err
+	}
+	var entries []ReflogEntry
+	for _, line := range out {
+		fields := strings.SplitN(line, " ", 3)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("unexpected reflog line: %q", line)
+		}
+		entry := ReflogEntry{Hash: fields[0], Selector: fields[1]}
+		if len(fields) == 3 {
+			entry.Subject = fields[2]
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) == 0 {
+		if out, err := g.runOutput("config", "--bool", "--get", "core.logAllRefUpdates"); err == nil && len(out) == 1 && out[0] == "false" {
+			return nil, fmt.Errorf("%q has no reflog: reflogs are disabled by core.logAllRefUpdates=false", ref)
+		}
+	}
+	return entries, nil
+}
+
+// ReflogExpire removes the reflog entries of HEAD, or of every ref if all is
+// true, which are older than expire.  Expire is a date understood by git, like
+// "90.days.ago", or "all" to remove every entry.  Unreachable entries are
+// expired alike, so that the objects they keep alive can be pruned by gc.
+func (g *Git) ReflogExpire(expire string, all bool) error {
+	args := []string{"reflog", "expire", "--expire=" + expire, "--expire-unreachable=" + expire}
+	if all {
+		args = append(args, "--all")
+	} else {
+		args = append(args, "HEAD")
+	}
+	return g.run(args...)
+}
+
+// GC runs "git gc", pruning the loose unreachable objects older than prune, a
+// date like "2.weeks.ago" or "now".  Git's gc.pruneExpire setting is used if
+// prune is empty.
+func (g *Git) GC(prune string) error {
+	args := []string{"gc", "--quiet"}
+	if prune != "" {
+		args = append(args, "--prune="+prune)
+	}
+	return g.run(args...)
+}
+
+// BlameLine represents a line of a file annotated by "git blame".
+type BlameLine struct {
+	Commit     string
+	Author     string
+	AuthorMail string
+	// Line is the number of the line in the blamed revision of the file.
+	Line    int
+	Content string
+}
+
+// Blame returns the lines of file annotated with the commit which last
+// changed them.  BlameRevisionOpt blames the file as of a revision instead
+// of the working tree, and LineRangeOpt restricts the lines, using the
+// "<start>,<end>" syntax of "git blame -L".
+func (g *Git) Blame(file string, opts ...BlameOpt) ([]BlameLine, error) {
+	args := []string{"blame", "--line-porcelain"}
+	rev := ""
+	for _, opt := range opts {
+		switch typedOpt := opt.(type) {
+		case BlameRevisionOpt:
+			rev = string(typedOpt)
+		case LineRangeOpt:
+			if typedOpt != "" {
+				args = append(args, "-L", string(typedOpt))
+			}
+		}
+	}
+	if rev != "" {
+		args = append(args, rev)
+	}
+	args = append(args, "--", file)
+	var stdout, stderr bytes.Buffer
+	if err := g.runGit(&stdout, &stderr, args...); err != nil {
+		return nil, Error(stdout.String(), stderr.String(), err, g.rootDir, args...)
+	}
+	return parseBlame(stdout.String())
+}
+
+// parseBlame parses the output of "git blame --line-porcelain", which has a
+// "<commit> <original line> <final line>" header followed by "<key> <value>"
+// lines for each line of the file, and the line itself prefixed with a tab.
+func parseBlame(output string) ([]BlameLine, error) {
+	var lines []BlameLine
+	var current *BlameLine
+	for _, line := range strings.Split(output, "\n") {
+		if strings.HasPrefix(line, "\t") {
+			if current == nil {
+				return nil, fmt.Errorf("unexpected line in blame output: %q", line)
+			}
+			current.Content = line[1:]
+			lines = append(lines, *current)
+			current = nil
+			continue
+		}
+		if line == "" {
+			continue
+		}
+		if current == nil {
+			fields := strings.Fields(line)
+			if len(fields) < 3 {
+				return nil, fmt.Errorf("unexpected header in blame output: %q", line)
+			}
+			n, err := strconv.Atoi(fields[2])
+			if err != nil {
+				return nil, fmt.Errorf("unexpected header in blame output: %q", line)
+			}
+			current = &BlameLine{Commit: fields[0], Line: n}
+			continue
+		}
+		key, value := line, ""
+		if i := strings.Index(line, " "); i != -1 {
+			key, value = line[:i], line[i+1:]
+		}
+		switch key {
+		case "author":
+			current.Author = value
+		case "author-mail":
+			current.AuthorMail = strings.TrimSuffix(strings.TrimPrefix(value, "<"), ">")
+		}
+	}
+	return lines, nil
+}
+
+// DiffHunk is a range of lines of a file which were changed, as numbered in
+// the base revision of a diff.  Count is zero for a hunk which only adds
+// lines, in which case they were added after line Start.
+type DiffHunk struct {
+	File  string
+	Start int
+	Count int
+}
+
+// DiffHunks returns the hunks changed between base and head, with their
+// lines numbered as in base.  Files added by the diff have no lines in base
+// and are not included.
+func (g *Git) DiffHunks(base, head string) ([]DiffHunk, error) {
+	out, err := g.runOutput("diff", "-U0", "--no-color", "--no-renames", "--no-ext-diff", base, head)
+	if err != nil {
+		return nil, err
+	}
+	return parseDiffHunks(out)
+}
+
+var diffHunkRE = regexp.MustCompile(`^@@ -(\d+)(?:,(\d+))? \+\d+(?:,\d+)? @@`)
+
+// parseDiffHunks parses the output of "git diff -U0".
+func parseDiffHunks(lines []string) ([]DiffHunk, error) {
+	var hunks []DiffHunk
+	file := ""
+	for _, line := range lines {
+		switch {
+		case strings.HasPrefix(line, "diff "):
+			file = ""
+		case strings.HasPrefix(line, "--- "):
+			if name := diffPath(strings.TrimPrefix(line, "--- ")); name != "/dev/null" {
+				file = strings.TrimPrefix(name, "a/")
+			}
+		case strings.HasPrefix(line, "@@ "):
+			if file == "" {
+				continue
+			}
+			m := diffHunkRE.FindStringSubmatch(line)
+			if m == nil {
+				return nil, fmt.Errorf("unexpected hunk header in diff output: %q", line)
+			}
+			start, err := strconv.Atoi(m[1])
+			if err != nil {
+				return nil, fmt.Errorf("unexpected hunk header in diff output: %q", line)
+			}
+			count := 1
+			if m[2] != "" {
+				if count, err = strconv.Atoi(m[2]); err != nil {
+					return nil, fmt.Errorf("unexpected hunk header in diff output: %q", line)
+				}
+			}
+			hunks = append(hunks, DiffHunk{File: file, Start: start, Count: count})
+		}
+	}
+	return hunks, nil
+}
+
+// diffPath returns the path named by a "---" or "+++" line of a diff.  Git
+// ends paths containing spaces with a tab, and quotes paths with unusual
+// characters C-style, escaping non-ASCII bytes in octal.
+func diffPath(name string) string {
+	name = strings.TrimSuffix(name, "\t")
+	if strings.HasPrefix(name, "\"") {
+		if unquoted, err := strconv.Unquote(name); err == nil {
+			return unquoted
+		}
+	}
+	return name
+}
+
+// CommitTimes returns the author time of each of the given commits.
+func (g *Git) CommitTimes(commits ...string) (map[string]time.Time, error) {
+	times := make(map[string]time.Time)
+	if len(commits) == 0 {
+		return times, nil
+	}
+	args := append([]string{"show", "-s", "--format=%H %at"}, commits...)
+	out, err := g.runOutput(args...)
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range out {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("unexpected line in git show output: %q", line)
+		}
+		seconds, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected line in git show output: %q", line)
+		}
+		times[fields[0]] = time.Unix(seconds, 0)
+	}
+	return times, nil
+}
+
 func (g *Git) run(args ...string) error {
 	var stdout, stderr bytes.Buffer
 	if err := g.runGit(&stdout, &stderr, args...); err != nil {
@@ -1210,7 +2645,32 @@ func (g *Git) runInteractive(args ...string) error {
 	return nil
 }
 
+// cLocale is the environment which makes git print untranslated messages,
+// for the few callers which need to tell errors apart by their message.
+var cLocale = map[string]string{"LC_ALL": "C"}
+
+// runWithEnv runs git with the given environment variables, which take
+// precedence over the environment of the jiri process.
+func (g *Git) runWithEnv(env map[string]string, args ...string) error {
+	var stdout, stderr bytes.Buffer
+	if err := g.runGitWithEnv(&stdout, &stderr, env, args...); err != nil {
+		return Error(stdout.String(), stderr.String(), err, g.rootDir, args...)
+	}
+	return nil
+}
+
 func (g *Git) runGit(stdout, stderr io.Writer, args ...string) error {
+	return g.runGitWithEnv(stdout, stderr, nil, args...)
+}
+
+func (g *Git) runGitWithEnv(stdout, stderr io.Writer, extraEnv map[string]string, args ...string) error {
+	return g.runGitWithStdin(os.Stdin, stdout, stderr, extraEnv, args...)
+}
+
+func (g *Git) runGitWithStdin(stdin io.Reader, stdout, stderr io.Writer, extraEnv map[string]string, args ...string) error {
+	if g.signingKey != "" {
+		args = append([]string{"-c", fmt.Sprintf("user.signingKey=%s", g.signingKey)}, args...)
+	}
 	if g.userName != "" {
 		args = append([]string{"-c", fmt.Sprintf("user.name=%s", g.userName)}, args...)
 	}
@@ -1219,11 +2679,11 @@ func (g *Git) runGit(stdout, stderr io.Writer, args ...string) error {
 	}
 	command := exec.Command("git", args...)
 	command.Dir = g.rootDir
-	command.Stdin = os.Stdin
+	command.Stdin = stdin
 	command.Stdout = stdout
 	command.Stderr = stderr
 	env := g.jirix.Env()
-	env = envvar.MergeMaps(g.opts, env)
+	env = envvar.MergeMaps(g.opts, env, extraEnv)
 	command.Env = envvar.MapToSlice(env)
 	dir := g.rootDir
 	if dir == "" {
@@ -1263,8 +2723,8 @@ func (g *Git) NewCommitter(edit bool) *Committer {
 		}
 	} else {
 		return &Committer{
-			commit:            g.Commit,
-			commitWithMessage: g.CommitWithMessage,
+			commit:            func() error { return g.Commit() },
+			commitWithMessage: func(message string) error { return g.CommitWithMessage(message) },
 		}
 	}
 }
@@ -0,0 +1,1687 @@
+// Copyright 2019 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gitutil
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dahlia-os/jiri"
+	"github.com/dahlia-os/jiri/cmdline"
+	"github.com/dahlia-os/jiri/color"
+	"github.com/dahlia-os/jiri/log"
+	"github.com/dahlia-os/jiri/tool"
+)
+
+// newTestRepo creates a git repository in a temporary directory and returns a
+// Git instance operating on it along with a cleanup closure.
+func newTestRepo(t testing.TB) (*Git, func()) {
+	ctx := tool.NewContextFromEnv(cmdline.EnvFromOS())
+	color := color.NewColor(color.ColorNever)
+	logger := log.NewLogger(log.InfoLevel, color, log.TextFormat, false, 0, time.Second*100, nil, nil)
+	jirix := &jiri.X{Context: ctx, Color: color, Logger: logger, Attempts: 1}
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("TempDir() failed: %v", err)
+	}
+	cleanup := func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Fatalf("RemoveAll(%q) failed: %v", dir, err)
+		}
+	}
+	g := New(jirix, RootDirOpt(dir), UserNameOpt("John Doe"), UserEmailOpt("john.doe@example.com"))
+	if err := g.Init(dir); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	return g, cleanup
+}
+
+// commitFile writes a file with the given content to the repository and
+// commits it, returning the new revision.
+func commitFile(t testing.TB, g *Git, file, content, message string) string {
+	if err := ioutil.WriteFile(filepath.Join(g.rootDir, file), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Add(file); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.CommitWithMessage(message); err != nil {
+		t.Fatal(err)
+	}
+	rev, err := g.CurrentRevision()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rev
+}
+
+func TestParseSignature(t *testing.T) {
+	tests := []struct {
+		output string
+		found  bool
+		want   Signature
+	}{
+		{"", false, Signature{}},
+		{"error: no signature found\n", false, Signature{}},
+		{
+			"[GNUPG:] NEWSIG\n[GNUPG:] GOODSIG 0123456789ABCDEF John Doe <john.doe@example.com>\n[GNUPG:] VALIDSIG ABCDEF 2017-01-01\n",
+			true,
+			Signature{Status: SignatureGood, Signer: "John Doe <john.doe@example.com>", KeyID: "0123456789ABCDEF"},
+		},
+		{
+			"[GNUPG:] BADSIG 0123456789ABCDEF John Doe <john.doe@example.com>\n",
+			true,
+			Signature{Status: SignatureBad, Signer: "John Doe <john.doe@example.com>", KeyID: "0123456789ABCDEF"},
+		},
+		{
+			"[GNUPG:] ERRSIG 0123456789ABCDEF 1 8 00 1500000000 9\n[GNUPG:] NO_PUBKEY 0123456789ABCDEF\n",
+			true,
+			Signature{Status: SignatureUnknownKey, KeyID: "0123456789ABCDEF"},
+		},
+		{
+			"[GNUPG:] EXPKEYSIG 0123456789ABCDEF John Doe\n",
+			true,
+			Signature{Status: SignatureExpired, Signer: "John Doe", KeyID: "0123456789ABCDEF"},
+		},
+		{
+			"[GNUPG:] BADSIG 1111111111111111 Jane\n[GNUPG:] GOODSIG 0123456789ABCDEF John\n",
+			true,
+			Signature{Status: SignatureBad, Signer: "Jane", KeyID: "1111111111111111"},
+		},
+	}
+	for _, test := range tests {
+		got, found := parseSignature(test.output)
+		if found != test.found {
+			t.Errorf("parseSignature(%q): got found %v, want %v", test.output, found, test.found)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("parseSignature(%q): got %+v, want %+v", test.output, got, test.want)
+		}
+	}
+}
+
+func TestConfigOwned(t *testing.T) {
+	g, cleanup := newTestRepo(t)
+	defer cleanup()
+
+	if err := g.Config("remote.origin.url", "https://example.com/repo"); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.ConfigSetOwned("remote.origin.push", "HEAD:refs/for/master"); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.ConfigSetOwned("core.myValue", "a"); err != nil {
+		t.Fatal(err)
+	}
+	got, err := g.ConfigListSection(JiriConfigSection)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"remote.origin.push": "HEAD:refs/for/master",
+		"core.myvalue":       "a",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("ConfigListSection(%q): got %v, want %v", JiriConfigSection, got, want)
+	}
+	if got, err := g.ConfigListSection("remote.origin"); err != nil {
+		t.Fatal(err)
+	} else if want := map[string]string{"url": "https://example.com/repo", "push": "HEAD:refs/for/master"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("ConfigListSection(%q): got %v, want %v", "remote.origin", got, want)
+	}
+
+	// A value changed by the user must survive ConfigUnsetOwned.
+	if err := g.Config("core.myValue", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.ConfigUnsetOwned(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := g.ConfigListSection(JiriConfigSection); err != nil {
+		t.Fatal(err)
+	} else if len(got) != 0 {
+		t.Fatalf("expected no jiri owned config, got %v", got)
+	}
+	if _, err := g.ConfigGetKey("remote.origin.push"); err == nil {
+		t.Fatalf("expected remote.origin.push to be unset")
+	}
+	if got, err := g.ConfigGetKey("core.myValue"); err != nil || got != "b" {
+		t.Fatalf("ConfigGetKey(core.myValue): got %q, %v, want %q", got, err, "b")
+	}
+	if got, err := g.ConfigGetKey("remote.origin.url"); err != nil || got != "https://example.com/repo" {
+		t.Fatalf("ConfigGetKey(remote.origin.url): got %q, %v", got, err)
+	}
+}
+
+func TestRebaseOnto(t *testing.T) {
+	g, cleanup := newTestRepo(t)
+	defer cleanup()
+
+	base := commitFile(t, g, "a", "a", "base")
+	if err := g.CreateAndCheckoutBranch("topic"); err != nil {
+		t.Fatal(err)
+	}
+	commitFile(t, g, "b", "b", "topic")
+	if err := g.CheckoutBranch(base, DetachOpt(true)); err != nil {
+		t.Fatal(err)
+	}
+	newBase := commitFile(t, g, "c", "c", "new base")
+
+	if err := g.RebaseOnto(newBase, base, "topic"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := g.CurrentBranchName(); err != nil || got != "topic" {
+		t.Fatalf("CurrentBranchName(): got %q, %v, want %q", got, err, "topic")
+	}
+	if got, err := g.CurrentRevisionForRef("topic~1"); err != nil || got != newBase {
+		t.Fatalf("parent of topic: got %q, %v, want %q", got, err, newBase)
+	}
+	if n, err := g.CountCommits("topic", newBase); err != nil || n != 1 {
+		t.Fatalf("CountCommits(topic, %s): got %d, %v, want 1", newBase, n, err)
+	}
+}
+
+func TestRebaseInteractiveScripted(t *testing.T) {
+	g, cleanup := newTestRepo(t)
+	defer cleanup()
+
+	base := commitFile(t, g, "a", "a", "base")
+	commitFile(t, g, "b", "b", "one")
+	commitFile(t, g, "c", "c", "fixup! one")
+	commitFile(t, g, "d", "d", "three")
+
+	// Autosquash with the generated todo list folds the fixup into "one".
+	if err := g.RebaseInteractiveScripted(base, nil, AutosquashOpt(true)); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := g.CountCommits("HEAD", base); err != nil || n != 2 {
+		t.Fatalf("CountCommits(HEAD, base): got %d, %v, want 2", n, err)
+	}
+	if got, err := g.CommitMsg("HEAD~1"); err != nil || got != "one" {
+		t.Fatalf("CommitMsg(HEAD~1): got %q, %v, want %q", got, err, "one")
+	}
+
+	// A scripted todo list can drop and reorder commits.
+	head, err := g.CurrentRevision()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := g.RebaseInteractiveScripted(base, []string{"pick " + head}); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := g.CountCommits("HEAD", base); err != nil || n != 1 {
+		t.Fatalf("CountCommits(HEAD, base): got %d, %v, want 1", n, err)
+	}
+	if got, err := g.CommitMsg("HEAD"); err != nil || got != "three" {
+		t.Fatalf("CommitMsg(HEAD): got %q, %v, want %q", got, err, "three")
+	}
+}
+
+func TestBranchBase(t *testing.T) {
+	g, cleanup := newTestRepo(t)
+	defer cleanup()
+	base := commitFile(t, g, "file", "content", "initial commit")
+	if err := g.CreateAndCheckoutBranch("feature"); err != nil {
+		t.Fatal(err)
+	}
+	commitFile(t, g, "file", "feature", "feature commit")
+	if got, err := g.BranchBase("feature"); err != nil || got != base {
+		t.Errorf("BranchBase(feature): got %q, %v, want %q", got, err, base)
+	}
+	if err := g.run("reflog", "expire", "--expire=now", "--all"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := g.BranchBase("feature"); err != nil || got != "" {
+		t.Errorf("BranchBase(feature) without reflog: got %q, %v, want \"\"", got, err)
+	}
+}
+
+func TestFetchPruneTags(t *testing.T) {
+	remote, cleanupRemote := newTestRepo(t)
+	defer cleanupRemote()
+	commitFile(t, remote, "file", "content", "initial commit")
+	for _, tag := range []string{"v1", "v2"} {
+		if err := remote.CreateLightweightTag(tag); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	local, cleanupLocal := newTestRepo(t)
+	defer cleanupLocal()
+	if err := local.AddRemote("origin", remote.rootDir); err != nil {
+		t.Fatal(err)
+	}
+	tags := func() []string {
+		out, err := local.runOutput("tag", "-l")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+	if err := local.Fetch("origin", TagsOpt(true)); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := tags(), []string{"v1", "v2"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got tags %v, want %v", got, want)
+	}
+
+	if err := remote.run("tag", "-d", "v1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := local.Fetch("origin", PruneOpt(true)); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := tags(), []string{"v1", "v2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got tags %v, want %v without -prune-tags", got, want)
+	}
+	if !local.supportsPruneTags() {
+		t.Skip("git does not support --prune-tags")
+	}
+	if err := local.Fetch("origin", PruneTagsOpt(true)); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := tags(), []string{"v2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got tags %v, want %v", got, want)
+	}
+}
+
+func TestPushDeleteBranch(t *testing.T) {
+	g, cleanup := newTestRepo(t)
+	defer cleanup()
+	commitFile(t, g, "file", "content", "initial commit")
+	if err := g.CreateBranch("feature"); err != nil {
+		t.Fatal(err)
+	}
+	remoteDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(remoteDir)
+	if err := g.Clone(g.rootDir, remoteDir, BareOpt(true)); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.AddRemote("origin", remoteDir); err != nil {
+		t.Fatal(err)
+	}
+	remoteHasBranch := func(branch string) bool {
+		out, err := g.runOutput("ls-remote", "--heads", "origin", branch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(out) != 0
+	}
+	if !remoteHasBranch("feature") {
+		t.Fatalf("remote branch %q does not exist", "feature")
+	}
+	if err := g.PushDeleteBranch("origin", "feature"); err != nil {
+		t.Fatal(err)
+	}
+	if remoteHasBranch("feature") {
+		t.Errorf("remote branch %q still exists", "feature")
+	}
+}
+
+func TestRevListFiltered(t *testing.T) {
+	g, cleanup := newTestRepo(t)
+	defer cleanup()
+	commit := func(name, date, message string) string {
+		env := map[string]string{
+			"GIT_AUTHOR_NAME":     name,
+			"GIT_AUTHOR_EMAIL":    name + "@example.com",
+			"GIT_AUTHOR_DATE":     date,
+			"GIT_COMMITTER_NAME":  "Committer " + name,
+			"GIT_COMMITTER_EMAIL": "committer@example.com",
+			"GIT_COMMITTER_DATE":  date,
+		}
+		if err := g.runWithEnv(env, "commit", "--allow-empty", "-m", message); err != nil {
+			t.Fatal(err)
+		}
+		rev, err := g.CurrentRevision()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rev
+	}
+	first := commit("alice", "2019-01-01T12:00:00Z", "first")
+	second := commit("bob", "2019-02-01T12:00:00Z", "second")
+	third := commit("alice", "2019-03-01T12:00:00Z", "third")
+
+	tests := []struct {
+		opts []RevListOpt
+		want []string
+	}{
+		{nil, []string{third, second, first}},
+		{[]RevListOpt{SinceOpt("2019-01-15")}, []string{third, second}},
+		{[]RevListOpt{UntilOpt("2019-02-15")}, []string{second, first}},
+		{[]RevListOpt{SinceOpt("2019-01-15"), UntilOpt("2019-02-15")}, []string{second}},
+		{[]RevListOpt{AuthorOpt("alice")}, []string{third, first}},
+		{[]RevListOpt{CommitterOpt("Committer bob")}, []string{second}},
+		{[]RevListOpt{AuthorOpt("alice"), SinceOpt("2019-01-15")}, []string{third}},
+	}
+	for _, test := range tests {
+		got, err := g.RevListFiltered("HEAD", test.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("RevListFiltered(%v): got %v, want %v", test.opts, got, test.want)
+		}
+	}
+	if got, err := g.RevListFiltered(first+"..HEAD", AuthorOpt("alice")); err != nil {
+		t.Fatal(err)
+	} else if want := []string{third}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestWorktrees(t *testing.T) {
+	g, cleanup := newTestRepo(t)
+	defer cleanup()
+	rev := commitFile(t, g, "file", "content", "initial commit")
+	if err := g.CreateBranch("feature"); err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "feature")
+	if err := g.AddWorktree(path, "feature"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(path, "file")); err != nil {
+		t.Fatalf("file not checked out in worktree: %v", err)
+	}
+	// Leave a modification in the worktree.
+	if err := ioutil.WriteFile(filepath.Join(path, "file"), []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	worktrees, err := g.ListWorktrees()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(worktrees) != 2 {
+		t.Fatalf("got worktrees %+v, want 2", worktrees)
+	}
+	if got := worktrees[1]; got.Head != rev || got.Branch != "feature" || filepath.Base(got.Path) != "feature" {
+		t.Errorf("got worktree %+v, want head %q on branch %q", got, rev, "feature")
+	}
+	if got := worktrees[0]; got.Head != rev || got.Branch != "master" {
+		t.Errorf("got main worktree %+v, want head %q on branch %q", got, rev, "master")
+	}
+
+	if err := g.RemoveWorktree(path, false); err == nil {
+		t.Fatalf("removing a modified worktree without force should fail")
+	} else if _, ok := err.(GitError); !ok {
+		t.Errorf("got error %T, want GitError", err)
+	}
+	if err := g.RemoveWorktree(path, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("worktree %q still exists", path)
+	}
+	if worktrees, err := g.ListWorktrees(); err != nil {
+		t.Fatal(err)
+	} else if len(worktrees) != 1 {
+		t.Errorf("got worktrees %+v, want 1", worktrees)
+	}
+}
+
+func TestCheckoutRevision(t *testing.T) {
+	g, cleanup := newTestRepo(t)
+	defer cleanup()
+	first := commitFile(t, g, "file", "first", "first commit")
+	second := commitFile(t, g, "file", "second", "second commit")
+	checkHead := func(wantRev string, wantOnBranch bool) {
+		t.Helper()
+		if got, err := g.CurrentRevision(); err != nil {
+			t.Fatal(err)
+		} else if got != wantRev {
+			t.Errorf("got HEAD at %s, want %s", got, wantRev)
+		}
+		if got := g.IsOnBranch(); got != wantOnBranch {
+			t.Errorf("got on branch %v, want %v", got, wantOnBranch)
+		}
+		if changes, err := g.HasUncommittedChanges(); err != nil {
+			t.Fatal(err)
+		} else if changes {
+			t.Errorf("expected no uncommitted changes")
+		}
+	}
+
+	// A bad revision leaves the repo on its original HEAD.
+	if err := g.CheckoutRevision("missing"); err == nil || !strings.Contains(err.Error(), "unknown revision") {
+		t.Fatalf("got error %v, want unknown revision", err)
+	}
+	checkHead(second, true)
+
+	// A checkout that moves HEAD but fails is undone.
+	hook := filepath.Join(g.rootDir, ".git", "hooks", "post-checkout")
+	if err := ioutil.WriteFile(hook, []byte("#!/bin/sh\nexit 1\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.CheckoutRevision(first, ForceOpt(true)); err == nil {
+		t.Fatal("expected the failing post-checkout hook to fail the checkout")
+	}
+	checkHead(second, true)
+	if branch, err := g.CurrentBranchName(); err != nil {
+		t.Fatal(err)
+	} else if branch != "master" {
+		t.Errorf("got branch %q, want master", branch)
+	}
+
+	// A checkout that does not end up at the revision is undone too.
+	script := "#!/bin/sh\n[ -n \"$MOVED\" ] || MOVED=1 git checkout -q --detach HEAD~1\n"
+	if err := ioutil.WriteFile(hook, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	err := g.CheckoutRevision(second + "^0")
+	if _, ok := err.(CheckoutMismatchError); !ok {
+		t.Fatalf("got error %v, want a CheckoutMismatchError", err)
+	}
+	checkHead(second, true)
+
+	if err := os.Remove(hook); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.CheckoutRevision(first); err != nil {
+		t.Fatal(err)
+	}
+	checkHead(first, false)
+}
+
+func TestGitDirInWorktree(t *testing.T) {
+	g, cleanup := newTestRepo(t)
+	defer cleanup()
+	commitFile(t, g, "file", "base", "initial commit")
+	if err := g.CreateBranch("feature"); err != nil {
+		t.Fatal(err)
+	}
+	other := commitFile(t, g, "file", "master", "master change")
+
+	if got, err := g.GitDir(); err != nil {
+		t.Fatal(err)
+	} else if want := filepath.Join(g.rootDir, ".git"); got != want {
+		t.Errorf("got git dir %q, want %q", got, want)
+	}
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "feature")
+	if err := g.AddWorktree(path, "feature"); err != nil {
+		t.Fatal(err)
+	}
+	w := New(g.jirix, RootDirOpt(path), UserNameOpt("John Doe"), UserEmailOpt("john.doe@example.com"))
+	if got, err := w.GitDir(); err != nil {
+		t.Fatal(err)
+	} else if want := filepath.Join(g.rootDir, ".git", "worktrees", "feature"); got != want {
+		t.Errorf("got worktree git dir %q, want %q", got, want)
+	}
+	if got, err := w.GitCommonDir(); err != nil {
+		t.Fatal(err)
+	} else if want := filepath.Join(g.rootDir, ".git"); got != want {
+		t.Errorf("got worktree common dir %q, want %q", got, want)
+	}
+	commitFile(t, w, "file", "feature", "feature change")
+
+	// Leave conflicting operations in progress in the worktree, and check
+	// that they are aborted.
+	abort := []struct {
+		name  string
+		start func() error
+		abort func() error
+	}{
+		{"merge", func() error { return w.Merge(other, ResetOnFailureOpt(false)) }, w.MergeAbort},
+		{"cherry-pick", func() error { return w.CherryPick(other) }, w.CherryPickAbort},
+		{"rebase", func() error { return w.Rebase(other) }, w.RebaseAbort},
+	}
+	for _, test := range abort {
+		if err := test.start(); err == nil {
+			t.Fatalf("%s: expected a conflict", test.name)
+		}
+		if changes, err := w.HasUncommittedChanges(); err != nil {
+			t.Fatal(err)
+		} else if !changes {
+			t.Fatalf("%s: expected the conflict to be left in progress", test.name)
+		}
+		if err := test.abort(); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if changes, err := w.HasUncommittedChanges(); err != nil {
+			t.Fatal(err)
+		} else if changes {
+			t.Errorf("%s: not aborted", test.name)
+		}
+	}
+}
+
+// TestAbortWithGitFile checks that in-progress operations are found in
+// repositories whose .git is a file pointing to the git directory.
+func TestAbortWithGitFile(t *testing.T) {
+	g, cleanup := newTestRepo(t)
+	defer cleanup()
+	gitDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(gitDir)
+	gitDir = filepath.Join(gitDir, "repo.git")
+	if err := g.run("init", "--separate-git-dir", gitDir); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(filepath.Join(g.rootDir, ".git")); err != nil {
+		t.Fatal(err)
+	} else if info.IsDir() {
+		t.Fatalf(".git is a directory, want a file")
+	}
+	if got, err := g.GitDir(); err != nil {
+		t.Fatal(err)
+	} else if got != gitDir {
+		t.Errorf("got git dir %q, want %q", got, gitDir)
+	}
+
+	commitFile(t, g, "file", "base", "initial commit")
+	if err := g.CreateBranch("other"); err != nil {
+		t.Fatal(err)
+	}
+	commitFile(t, g, "file", "master", "master change")
+	if err := g.CheckoutBranch("other"); err != nil {
+		t.Fatal(err)
+	}
+	other := commitFile(t, g, "file", "other", "other change")
+	if err := g.CheckoutBranch("master"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := g.CherryPick(other); err == nil {
+		t.Fatalf("expected a conflict")
+	}
+	if msg, err := g.GetMergeHeadMessage(); err != nil {
+		t.Fatal(err)
+	} else if !strings.HasPrefix(msg, "other change") {
+		t.Errorf("got merge message %q, want it to start with %q", msg, "other change")
+	}
+	if err := g.CherryPickAbort(); err != nil {
+		t.Fatal(err)
+	}
+	if changes, err := g.HasUncommittedChanges(); err != nil {
+		t.Fatal(err)
+	} else if changes {
+		t.Errorf("cherry-pick not aborted")
+	}
+
+	if err := g.Rebase("other"); err == nil {
+		t.Fatalf("expected a conflict")
+	}
+	if err := g.RebaseAbort(); err != nil {
+		t.Fatal(err)
+	}
+	if changes, err := g.HasUncommittedChanges(); err != nil {
+		t.Fatal(err)
+	} else if changes {
+		t.Errorf("rebase not aborted")
+	}
+}
+
+func TestLFSNotInstalled(t *testing.T) {
+	if _, err := exec.LookPath("git-lfs"); err == nil {
+		t.Skip("git-lfs is installed")
+	}
+	g, cleanup := newTestRepo(t)
+	defer cleanup()
+	commitFile(t, g, "file", "content", "initial commit")
+	if err := g.LFSInstall(); err != ErrLFSNotInstalled {
+		t.Errorf("LFSInstall: got error %v, want %v", err, ErrLFSNotInstalled)
+	}
+	if err := g.LFSPull(); err != ErrLFSNotInstalled {
+		t.Errorf("LFSPull: got error %v, want %v", err, ErrLFSNotInstalled)
+	}
+}
+
+func TestReflogExpire(t *testing.T) {
+	g, cleanup := newTestRepo(t)
+	defer cleanup()
+	old := New(g.jirix, RootDirOpt(g.rootDir), UserNameOpt("John Doe"), UserEmailOpt("john.doe@example.com"), CommitterDateOpt("2000-01-01T00:00:00"))
+	commitFile(t, old, "file", "old", "old commit")
+	if err := old.CreateAndCheckoutBranch("feature"); err != nil {
+		t.Fatal(err)
+	}
+	recent := commitFile(t, g, "file", "recent", "recent commit")
+	if entries, err := g.Reflog("HEAD", 0); err != nil || len(entries) != 3 {
+		t.Fatalf("got %d entries, %v, want 3", len(entries), err)
+	}
+
+	// Only the entries older than the cutoff are removed.
+	if err := g.ReflogExpire("90.days.ago", false); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := g.Reflog("HEAD", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ReflogEntry{{Hash: recent, Selector: "HEAD@{0}", Subject: "commit: recent commit"}}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("got %+v, want %+v", entries, want)
+	}
+	if entries, err := g.Reflog("master", 0); err != nil || len(entries) != 1 {
+		t.Errorf("got %d entries for master, %v, want it untouched", len(entries), err)
+	}
+
+	if err := g.ReflogExpire("all", true); err != nil {
+		t.Fatal(err)
+	}
+	for _, ref := range []string{"HEAD", "master", "feature"} {
+		if entries, err := g.Reflog(ref, 0); err != nil || len(entries) != 0 {
+			t.Errorf("got %d entries for %s, %v, want none", len(entries), ref, err)
+		}
+	}
+	if err := g.GC("now"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBlame(t *testing.T) {
+	g, cleanup := newTestRepo(t)
+	defer cleanup()
+	first := commitFile(t, g, "file", "one\ntwo\n", "first")
+	second := commitFile(t, g, "file", "one\n\tTWO\n\nthree\n", "second")
+
+	got, err := g.Blame("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []BlameLine{
+		{first, "John Doe", "john.doe@example.com", 1, "one"},
+		{second, "John Doe", "john.doe@example.com", 2, "\tTWO"},
+		{second, "John Doe", "john.doe@example.com", 3, ""},
+		{second, "John Doe", "john.doe@example.com", 4, "three"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Blame: got %+v, want %+v", got, want)
+	}
+
+	got, err = g.Blame("file", BlameRevisionOpt(first), LineRangeOpt("2,2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []BlameLine{{first, "John Doe", "john.doe@example.com", 2, "two"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Blame(%s, 2,2): got %+v, want %+v", first, got, want)
+	}
+
+	if _, err := g.Blame("missing"); err == nil {
+		t.Errorf("expected an error for a missing file")
+	}
+}
+
+func TestDiffHunks(t *testing.T) {
+	g, cleanup := newTestRepo(t)
+	defer cleanup()
+	base := commitFile(t, g, "file", "one\ntwo\nthree\nfour\n", "base")
+	commitFile(t, g, "file", "one\nTWO\nthree\nfour\nfive\n", "change")
+	commitFile(t, g, "new", "new\n", "add new")
+	commitFile(t, g, "with space", "one\n", "add with space")
+	added := commitFile(t, g, "caf\u00e9", "one\n", "add caf\u00e9")
+	commitFile(t, g, "with space", "ONE\n", "change with space")
+	commitFile(t, g, "caf\u00e9", "ONE\n", "change caf\u00e9")
+
+	got, err := g.DiffHunks(base, added)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []DiffHunk{
+		{File: "file", Start: 2, Count: 1},
+		{File: "file", Start: 4, Count: 0},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("DiffHunks: got %+v, want %+v", got, want)
+	}
+
+	// Paths with spaces are followed by a tab, and non-ASCII paths are
+	// quoted.
+	got, err = g.DiffHunks(added, "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []DiffHunk{
+		{File: "caf\u00e9", Start: 1, Count: 1},
+		{File: "with space", Start: 1, Count: 1},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("DiffHunks: got %+v, want %+v", got, want)
+	}
+
+	times, err := g.CommitTimes(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(times[base]); len(times) != 1 || d < 0 || d > time.Hour {
+		t.Errorf("CommitTimes: got %v, want the time of %s", times, base)
+	}
+}
+
+func TestCommitExists(t *testing.T) {
+	g, cleanup := newTestRepo(t)
+	defer cleanup()
+	rev := commitFile(t, g, "file", "content", "add file")
+	blob, err := g.runOutput("rev-parse", "HEAD:file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]bool{
+		rev:                     true,
+		"HEAD":                  true,
+		blob[0]:                 false,
+		strings.Repeat("0", 40): false,
+		"missing":               false,
+	}
+	for ref, want := range tests {
+		got, err := g.CommitExists(ref)
+		if err != nil {
+			t.Errorf("CommitExists(%q) failed: %v", ref, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("CommitExists(%q): got %v, want %v", ref, got, want)
+		}
+	}
+
+	// Other failures are reported.
+	notRepo, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(notRepo)
+	if _, err := New(g.jirix, RootDirOpt(notRepo)).CommitExists("HEAD"); err == nil {
+		t.Errorf("expected an error outside of a repository")
+	}
+}
+
+func TestCloneFilter(t *testing.T) {
+	g, cleanup := newTestRepo(t)
+	defer cleanup()
+	commitFile(t, g, "file", "content", "add file")
+	if err := g.Config("uploadpack.allowFilter", "true"); err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "clone")
+	if err := g.Clone("file://"+g.rootDir, path, NoCheckoutOpt(true), FilterOpt("blob:none")); err != nil {
+		t.Fatal(err)
+	}
+	got, err := New(g.jirix, RootDirOpt(path)).ConfigGetKey("remote.origin.partialclonefilter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "blob:none" {
+		t.Errorf("got filter %q, want %q", got, "blob:none")
+	}
+}
+
+func TestSignedCommitAndTag(t *testing.T) {
+	g, cleanup := newTestRepo(t)
+	defer cleanup()
+	commitFile(t, g, "file", "content", "initial commit")
+
+	// Without a usable key signing fails rather than waiting for a prompt.
+	user := []gitOpt{RootDirOpt(g.rootDir), UserNameOpt("John Doe"), UserEmailOpt("john.doe@example.com")}
+	unsigned := New(g.jirix, append(user, SigningKeyOpt("missing@example.com"))...)
+	if err := unsigned.CommitWithMessage("signed", SignOpt(true)); err == nil {
+		t.Errorf("expected signing a commit with a missing key to fail")
+	} else if gitErr, ok := err.(GitError); !ok {
+		t.Errorf("got error %T, want GitError", err)
+	} else if !strings.Contains(gitErr.ErrorOutput, "sign") {
+		t.Errorf("got error output %q, want a signing error", gitErr.ErrorOutput)
+	}
+	if err := unsigned.CreateSignedTag("v1", "signed tag", ""); err == nil {
+		t.Errorf("expected signing a tag with a missing key to fail")
+	}
+
+	// SSH keys can sign without an agent or a passphrase.
+	if _, err := exec.LookPath("ssh-keygen"); err != nil {
+		t.Skip("ssh-keygen not found")
+	}
+	key := filepath.Join(g.rootDir, ".git", "signing-key")
+	if out, err := exec.Command("ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-f", key).CombinedOutput(); err != nil {
+		t.Fatalf("ssh-keygen failed: %v\n%s", err, out)
+	}
+	if err := g.Config("gpg.format", "ssh"); err != nil {
+		t.Fatal(err)
+	}
+	signed := New(g.jirix, append(user, SigningKeyOpt(key))...)
+	if err := signed.CommitWithMessage("signed", SignOpt(true)); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := g.runOutput("cat-file", "commit", "HEAD"); err != nil {
+		t.Fatal(err)
+	} else if !strings.Contains(strings.Join(out, "\n"), "gpgsig") {
+		t.Errorf("commit is not signed:\n%s", strings.Join(out, "\n"))
+	}
+	if err := signed.CreateSignedTag("v1", "signed tag", ""); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := g.runOutput("cat-file", "tag", "v1"); err != nil {
+		t.Fatal(err)
+	} else if !strings.Contains(strings.Join(out, "\n"), "BEGIN SSH SIGNATURE") {
+		t.Errorf("tag is not signed:\n%s", strings.Join(out, "\n"))
+	}
+}
+
+func TestParseSymref(t *testing.T) {
+	tests := []struct {
+		lines  []string
+		branch string
+		found  bool
+	}{
+		{nil, "", false},
+		{[]string{"0123456789abcdef0123456789abcdef01234567\tHEAD"}, "", false},
+		{[]string{"ref: refs/heads/main\tHEAD", "0123456789abcdef0123456789abcdef01234567\tHEAD"}, "main", true},
+		{[]string{"ref: refs/heads/release/1.0\tHEAD"}, "release/1.0", true},
+		{[]string{"ref: refs/tags/v1\tHEAD"}, "", false},
+	}
+	for _, test := range tests {
+		branch, found := parseSymref(test.lines)
+		if branch != test.branch || found != test.found {
+			t.Errorf("parseSymref(%q): got (%q, %v), want (%q, %v)", test.lines, branch, found, test.branch, test.found)
+		}
+	}
+}
+
+func TestRemoteDefaultBranch(t *testing.T) {
+	remote, cleanup := newTestRepo(t)
+	defer cleanup()
+	commitFile(t, remote, "file", "content", "initial commit")
+	if err := remote.CreateAndCheckoutBranch("main"); err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.DeleteBranch("master"); err != nil {
+		t.Fatal(err)
+	}
+	g, cleanup2 := newTestRepo(t)
+	defer cleanup2()
+	if err := g.AddRemote("origin", remote.rootDir); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []string{"origin", remote.rootDir} {
+		branch, err := g.RemoteDefaultBranch(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if branch != "main" {
+			t.Errorf("RemoteDefaultBranch(%q): got %q, want %q", r, branch, "main")
+		}
+	}
+	if _, err := g.RemoteDefaultBranch("missing"); err == nil {
+		t.Errorf("expected an error for a missing remote")
+	}
+}
+
+func TestGetMergeHeadMessage(t *testing.T) {
+	g, cleanup := newTestRepo(t)
+	defer cleanup()
+
+	// A fresh repository has neither file.
+	for _, get := range []func() (string, error){g.GetMergeHeadMessage, g.GetCommitEditMessage} {
+		if msg, err := get(); err != nil || msg != "" {
+			t.Errorf("got (%q, %v), want no message", msg, err)
+		}
+	}
+	commitFile(t, g, "file", "base", "initial commit")
+
+	if err := g.CreateAndCheckoutBranch("feature"); err != nil {
+		t.Fatal(err)
+	}
+	commitFile(t, g, "file", "feature", "feature commit")
+	if err := g.CheckoutBranch("master"); err != nil {
+		t.Fatal(err)
+	}
+	commitFile(t, g, "file", "master", "master commit")
+	if err := g.Merge("feature", ResetOnFailureOpt(false)); err == nil {
+		t.Fatal("expected merge conflict")
+	}
+
+	msg, err := g.GetMergeHeadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(msg, "Merge branch 'feature'") || strings.Contains(msg, "#") {
+		t.Errorf("unexpected merge message %q", msg)
+	}
+	msg, err = g.GetCommitEditMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := msg, "master commit"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestStashSave(t *testing.T) {
+	g, cleanup := newTestRepo(t)
+	defer cleanup()
+	commitFile(t, g, "file", "committed", "initial commit")
+
+	if stashed, err := g.StashSave("nothing"); err != nil || stashed {
+		t.Fatalf("got (%v, %v), want nothing stashed", stashed, err)
+	}
+
+	untracked := filepath.Join(g.rootDir, "untracked")
+	if err := ioutil.WriteFile(untracked, []byte("untracked"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Untracked files are left alone by default.
+	if stashed, err := g.StashSave("tracked only"); err != nil || stashed {
+		t.Fatalf("got (%v, %v), want nothing stashed", stashed, err)
+	}
+	stashed, err := g.StashSave("with untracked", IncludeUntrackedOpt(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stashed {
+		t.Fatal("expected untracked file to be stashed")
+	}
+	if _, err := os.Stat(untracked); !os.IsNotExist(err) {
+		t.Fatalf("expected %q to be stashed away, got %v", untracked, err)
+	}
+	out, err := g.runOutput("stash", "list")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 1 || !strings.HasSuffix(out[0], "with untracked") {
+		t.Errorf("unexpected stash list %v", out)
+	}
+	if err := g.StashPop(); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(untracked); err != nil || string(data) != "untracked" {
+		t.Errorf("got (%q, %v), want untracked file restored", data, err)
+	}
+
+	// KeepIndexOpt leaves staged changes in the working tree.
+	path := filepath.Join(g.rootDir, "file")
+	if err := ioutil.WriteFile(path, []byte("staged"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Add("file"); err != nil {
+		t.Fatal(err)
+	}
+	if stashed, err := g.StashSave("", KeepIndexOpt(true)); err != nil || !stashed {
+		t.Fatalf("got (%v, %v), want changes stashed", stashed, err)
+	}
+	if data, err := ioutil.ReadFile(path); err != nil || string(data) != "staged" {
+		t.Errorf("got (%q, %v), want staged change kept", data, err)
+	}
+}
+
+func TestStashCreateStore(t *testing.T) {
+	g, cleanup := newTestRepo(t)
+	defer cleanup()
+	commitFile(t, g, "file", "committed", "initial commit")
+
+	if commit, err := g.StashCreate(); err != nil || commit != "" {
+		t.Fatalf("got (%q, %v), want nothing to stash", commit, err)
+	}
+
+	path := filepath.Join(g.rootDir, "file")
+	if err := ioutil.WriteFile(path, []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	commit, err := g.StashCreate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if commit == "" {
+		t.Fatal("expected a stash commit")
+	}
+	if size, err := g.StashSize(); err != nil || size != 0 {
+		t.Fatalf("got stash size (%d, %v), want 0", size, err)
+	}
+
+	if err := g.run("reset", "--hard"); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.StashApply(commit); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(data), "changed"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	if err := g.StashStore(commit, "saved by test"); err != nil {
+		t.Fatal(err)
+	}
+	out, err := g.runOutput("stash", "list")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 1 || !strings.HasSuffix(out[0], "saved by test") {
+		t.Errorf("unexpected stash list %v", out)
+	}
+}
+
+func TestCommitTree(t *testing.T) {
+	g, cleanup := newTestRepo(t)
+	defer cleanup()
+	base := commitFile(t, g, "file1", "one", "first")
+	commitFile(t, g, "file2", "two", "second")
+	head := commitFile(t, g, "file3", "three", "third")
+
+	commit, err := g.CommitTree(head, "squashed", base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := g.CommitMsg(commit); err != nil || msg != "squashed" {
+		t.Fatalf("got message (%q, %v), want %q", msg, err, "squashed")
+	}
+	if parent, err := g.CurrentRevisionForRef(commit + "^"); err != nil || parent != base {
+		t.Fatalf("got parent (%q, %v), want %q", parent, err, base)
+	}
+	if content, err := g.Show(commit, "file3"); err != nil || content != "three" {
+		t.Fatalf("got file3 (%q, %v), want %q", content, err, "three")
+	}
+	if rev, err := g.CurrentRevision(); err != nil || rev != head {
+		t.Fatalf("HEAD moved to (%q, %v), want %q", rev, err, head)
+	}
+}
+
+func TestLogGraph(t *testing.T) {
+	g, cleanup := newTestRepo(t)
+	defer cleanup()
+	commitFile(t, g, "file1", "one", "first")
+	branch, err := g.CurrentBranchName()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := g.CreateAndCheckoutBranch("feature"); err != nil {
+		t.Fatal(err)
+	}
+	commitFile(t, g, "file2", "two", "second")
+	if err := g.CheckoutBranch(branch); err != nil {
+		t.Fatal(err)
+	}
+	commitFile(t, g, "file3", "three", "third")
+	if err := g.run("merge", "--no-ff", "-m", "merge feature", "feature"); err != nil {
+		t.Fatal(err)
+	}
+
+	graph, err := g.LogGraph("HEAD", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(graph, "|\\") || !strings.Contains(graph, "|/") {
+		t.Errorf("expected merge lines in graph:\n%s", graph)
+	}
+	if got := strings.Count(graph, "* "); got != 4 {
+		t.Errorf("got %d commits, want 4:\n%s", got, graph)
+	}
+	if !strings.Contains(graph, "merge feature") || !strings.Contains(graph, "feature") {
+		t.Errorf("expected subjects and decorations in graph:\n%s", graph)
+	}
+	if strings.Contains(graph, "\x1b[") {
+		t.Errorf("expected no color codes in graph:\n%s", graph)
+	}
+
+	graph, err = g.LogGraph("HEAD", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Count(graph, "* "); got != 2 {
+		t.Errorf("got %d commits with a limit of 2, want 2:\n%s", got, graph)
+	}
+
+	log, err := g.LogOneline("HEAD", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(log, "|") || strings.Contains(log, "* ") {
+		t.Errorf("expected no graph in log:\n%s", log)
+	}
+	if got := strings.Count(log, "\n"); got != 4 {
+		t.Errorf("got %d commits, want 4:\n%s", got, log)
+	}
+}
+
+// allowFileSubmodules lets git clone submodules from local paths, which
+// recent versions of git refuse by default, and returns a function restoring
+// the environment.
+func allowFileSubmodules(t *testing.T) func() {
+	vars := map[string]string{
+		"GIT_CONFIG_COUNT":   "1",
+		"GIT_CONFIG_KEY_0":   "protocol.file.allow",
+		"GIT_CONFIG_VALUE_0": "always",
+	}
+	for key, value := range vars {
+		if err := os.Setenv(key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return func() {
+		for key := range vars {
+			os.Unsetenv(key)
+		}
+	}
+}
+
+func TestUpdateSubmodules(t *testing.T) {
+	defer allowFileSubmodules(t)()
+	sub, cleanupSub := newTestRepo(t)
+	defer cleanupSub()
+	commitFile(t, sub, "file", "submodule file", "submodule commit")
+	commitFile(t, sub, "file", "newer submodule file", "newer submodule commit")
+
+	super, cleanupSuper := newTestRepo(t)
+	defer cleanupSuper()
+	commitFile(t, super, "file", "superproject file", "superproject commit")
+	if err := super.run("submodule", "add", "file://"+sub.rootDir, "sub"); err != nil {
+		t.Fatal(err)
+	}
+	if err := super.CommitWithMessage("add submodule"); err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := super.Clone(super.rootDir, dir); err != nil {
+		t.Fatal(err)
+	}
+	clone := New(super.jirix, RootDirOpt(dir))
+	if _, err := os.Stat(filepath.Join(dir, "sub", "file")); !os.IsNotExist(err) {
+		t.Fatalf("expected submodule not to be checked out yet, got %v", err)
+	}
+	if err := clone.UpdateSubmodules(true, DepthOpt(1)); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "sub", "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(data), "newer submodule file"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	subClone := New(super.jirix, RootDirOpt(filepath.Join(dir, "sub")))
+	if n, err := subClone.CountCommits("HEAD", ""); err != nil || n != 1 {
+		t.Errorf("got (%d, %v) commits in the submodule, want 1", n, err)
+	}
+}
+
+// TestSubmodules tests that the submodules of a real repository are listed
+// with their full revision and path.
+func TestSubmodules(t *testing.T) {
+	defer allowFileSubmodules(t)()
+	sub, cleanupSub := newTestRepo(t)
+	defer cleanupSub()
+	commitFile(t, sub, "file", "submodule file", "submodule commit")
+	revision, err := sub.CurrentRevision()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	super, cleanupSuper := newTestRepo(t)
+	defer cleanupSuper()
+	commitFile(t, super, "file", "superproject file", "superproject commit")
+	if err := super.run("submodule", "add", "file://"+sub.rootDir, "sub dir"); err != nil {
+		t.Fatal(err)
+	}
+	if err := super.CommitWithMessage("add submodule"); err != nil {
+		t.Fatal(err)
+	}
+	got, err := super.Submodules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Submodule{{Path: "sub dir", Revision: revision, Initialized: true}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestParseSubmodules(t *testing.T) {
+	got := parseSubmodules([]string{
+		" 1111111111111111111111111111111111111111 a (heads/master)",
+		"-2222222222222222222222222222222222222222 b",
+		"+3333333333333333333333333333333333333333 c/d (v1.0-1-g3333333)",
+		"U4444444444444444444444444444444444444444 e",
+		" 5555555555555555555555555555555555555555 f g (heads/master)",
+		"-6666666666666666666666666666666666666666 h (i)",
+		"",
+	})
+	want := []Submodule{
+		{Path: "a", Revision: "1111111111111111111111111111111111111111", Initialized: true},
+		{Path: "b", Revision: "2222222222222222222222222222222222222222"},
+		{Path: "c/d", Revision: "3333333333333333333333333333333333333333", Initialized: true, OutOfDate: true},
+		{Path: "e", Revision: "4444444444444444444444444444444444444444", Initialized: true, OutOfDate: true},
+		{Path: "f g", Revision: "5555555555555555555555555555555555555555", Initialized: true},
+		{Path: "h (i)", Revision: "6666666666666666666666666666666666666666"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestGitErrorPermanent(t *testing.T) {
+	tests := []struct {
+		stderr string
+		want   bool
+	}{
+		{"fatal: Authentication failed for 'https://host/repo/'", true},
+		{"remote: Repository not found.", true},
+		{"fatal: unable to access 'https://host/repo/': The requested URL returned error: 403", true},
+		{"fatal: unable to access 'https://host/repo/': Could not resolve host: host", false},
+		{"fatal: unable to access 'https://host/repo/': Operation timed out after 300000 milliseconds", false},
+		{"error: RPC failed; curl 56 GnuTLS recv error (-54): Error in the pull function.", false},
+	}
+	for _, test := range tests {
+		if got := Error("", test.stderr, errors.New("exit status 128"), "", "fetch").Permanent(); got != test.want {
+			t.Errorf("Permanent() for %q: got %v, want %v", test.stderr, got, test.want)
+		}
+	}
+
+	// Errors are recognized whatever the locale of the user.
+	for key, value := range map[string]string{"LANG": "de_DE.UTF-8", "LANGUAGE": "de", "LC_ALL": "de_DE.UTF-8"} {
+		if old, ok := os.LookupEnv(key); ok {
+			defer os.Setenv(key, old)
+		} else {
+			defer os.Unsetenv(key)
+		}
+		os.Setenv(key, value)
+	}
+	g, cleanup := newTestRepo(t)
+	defer cleanup()
+	err := g.Fetch(filepath.Join(g.rootDir, "missing"))
+	if err == nil {
+		t.Fatal("expected fetch from a missing repository to fail")
+	}
+	if ge, ok := err.(GitError); !ok || !ge.Permanent() {
+		t.Errorf("expected a permanent GitError, got %#v", err)
+	}
+}
+
+func TestTreeWithPaths(t *testing.T) {
+	g, cleanup := newTestRepo(t)
+	defer cleanup()
+	if err := os.Mkdir(filepath.Join(g.rootDir, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	commitFile(t, g, "file", "base", "base")
+	base := commitFile(t, g, "dir/old", "old", "add dir/old")
+	if err := g.Remove("dir/old"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(g.rootDir, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	commitFile(t, g, "dir/new", "new", "replace dir/old")
+	head := commitFile(t, g, "file", "head", "change file")
+
+	tree, err := g.TreeWithPaths(base, head, "dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := g.runOutput("ls-tree", "-r", "--name-only", tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"dir/new", "file"}; !reflect.DeepEqual(out, want) {
+		t.Errorf("got files %q, want %q", out, want)
+	}
+	if out, err := g.runOutput("show", tree+":file"); err != nil || !reflect.DeepEqual(out, []string{"base"}) {
+		t.Errorf("got file content %q, %v, want the content of base", out, err)
+	}
+	if changes, err := g.HasUncommittedChanges(); err != nil || changes {
+		t.Errorf("got uncommitted changes %v, %v, want none", changes, err)
+	}
+}
+
+func TestFsck(t *testing.T) {
+	g, cleanup := newTestRepo(t)
+	defer cleanup()
+	commitFile(t, g, "file", "content", "initial commit")
+	if err := g.Fsck(); err != nil {
+		t.Fatalf("Fsck() failed on a healthy repository: %v", err)
+	}
+
+	out, err := g.runOutput("rev-parse", "HEAD:file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob := out[0]
+	if err := os.Remove(filepath.Join(g.rootDir, ".git", "objects", blob[:2], blob[2:])); err != nil {
+		t.Fatal(err)
+	}
+	err = g.Fsck()
+	if err == nil {
+		t.Fatal("Fsck() succeeded on a repository with a missing object")
+	}
+	if !strings.Contains(err.Error(), blob) {
+		t.Errorf("got error %q, want it to report the missing object %s", err, blob)
+	}
+}
+
+func TestRenameRemote(t *testing.T) {
+	g, cleanup := newTestRepo(t)
+	defer cleanup()
+	commitFile(t, g, "file", "content", "initial commit")
+	remoteDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(remoteDir)
+	if err := g.Clone(g.rootDir, remoteDir, BareOpt(true)); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.AddOrReplaceRemote("old", remoteDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Fetch("old"); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.RenameRemote("old", "new"); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := g.runOutput("for-each-ref", "--format=%(refname)", "refs/remotes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"refs/remotes/new/master"}; !reflect.DeepEqual(out, want) {
+		t.Errorf("got remote refs %q, want %q", out, want)
+	}
+	if url, err := g.RemoteUrl("new"); err != nil || url != remoteDir {
+		t.Errorf("got url %q, %v for remote new, want %q", url, err, remoteDir)
+	}
+	if err := g.run("config", "remote.old.url"); err == nil {
+		t.Errorf("config of remote old still exists")
+	}
+}
+
+func TestReflog(t *testing.T) {
+	g, cleanup := newTestRepo(t)
+	defer cleanup()
+	first := commitFile(t, g, "file", "first", "first commit")
+	if err := g.CreateAndCheckoutBranch("feature"); err != nil {
+		t.Fatal(err)
+	}
+	second := commitFile(t, g, "file", "second", "second commit")
+
+	entries, err := g.Reflog("HEAD", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ReflogEntry{
+		{Hash: second, Selector: "HEAD@{0}", Subject: "commit: second commit"},
+		{Hash: first, Selector: "HEAD@{1}", Subject: "checkout: moving from master to feature"},
+	}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("got %+v, want %+v", entries, want)
+	}
+	if entries, err := g.Reflog("HEAD", 0); err != nil || len(entries) != 3 {
+		t.Errorf("got %d entries, %v, want 3", len(entries), err)
+	}
+
+	// Without reflogs, an informative error is returned.
+	g, cleanup = newTestRepo(t)
+	defer cleanup()
+	if err := g.Config("core.logAllRefUpdates", "false"); err != nil {
+		t.Fatal(err)
+	}
+	commitFile(t, g, "file", "content", "initial commit")
+	if _, err := g.Reflog("HEAD", 0); err == nil || !strings.Contains(err.Error(), "reflogs are disabled") {
+		t.Errorf("expected a disabled reflog error, got %v", err)
+	}
+}
+
+func TestAheadBehind(t *testing.T) {
+	g, cleanup := newTestRepo(t)
+	defer cleanup()
+	commitFile(t, g, "file", "base", "base commit")
+	if err := g.CreateBranchWithUpstream("feature", "master"); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.SetUpstream("feature", "master"); err != nil {
+		t.Fatal(err)
+	}
+	commitFile(t, g, "file", "master 1", "master commit 1")
+	commitFile(t, g, "file", "master 2", "master commit 2")
+	if err := g.CheckoutBranch("feature"); err != nil {
+		t.Fatal(err)
+	}
+	commitFile(t, g, "feature", "feature", "feature commit")
+
+	for _, test := range []struct {
+		branch, upstream      string
+		wantAhead, wantBehind int
+	}{
+		{"feature", "", 1, 2},
+		{"HEAD", "", 1, 2},
+		{"feature", "master", 1, 2},
+		{"master", "feature", 2, 1},
+	} {
+		ahead, behind, err := g.AheadBehind(test.branch, test.upstream)
+		if err != nil {
+			t.Errorf("AheadBehind(%q, %q) failed: %v", test.branch, test.upstream, err)
+			continue
+		}
+		if ahead != test.wantAhead || behind != test.wantBehind {
+			t.Errorf("AheadBehind(%q, %q): got %d, %d, want %d, %d", test.branch, test.upstream, ahead, behind, test.wantAhead, test.wantBehind)
+		}
+	}
+
+	if _, _, err := g.AheadBehind("master", ""); err != ErrNoUpstream {
+		t.Errorf("got %v for a branch without upstream, want ErrNoUpstream", err)
+	}
+	if err := g.CheckoutBranch("master", DetachOpt(true)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := g.AheadBehind("HEAD", ""); err != ErrNoUpstream {
+		t.Errorf("got %v for a detached HEAD, want ErrNoUpstream", err)
+	}
+}
+
+func TestFetchRefspecs(t *testing.T) {
+	remote, cleanup := newTestRepo(t)
+	defer cleanup()
+	commitFile(t, remote, "file", "content", "initial commit")
+	change := commitFile(t, remote, "change", "change", "a change")
+	if err := remote.run("update-ref", "refs/changes/34/1234/1", change); err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.run("reset", "--hard", "HEAD~1"); err != nil {
+		t.Fatal(err)
+	}
+
+	g, cleanup2 := newTestRepo(t)
+	defer cleanup2()
+	if err := g.AddOrReplaceRemote("origin", remote.rootDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Fetch("origin", RefspecsOpt{"+refs/heads/*:refs/remotes/origin/*", "+refs/changes/*:refs/changes/*"}); err != nil {
+		t.Fatal(err)
+	}
+	out, err := g.runOutput("for-each-ref", "--format=%(refname) %(objectname)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"refs/changes/34/1234/1 " + change}
+	master, err := remote.CurrentRevision()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = append(want, "refs/remotes/origin/master "+master)
+	if !reflect.DeepEqual(out, want) {
+		t.Errorf("got refs %q, want %q", out, want)
+	}
+}
+
+func TestValidateRefspec(t *testing.T) {
+	for _, refspec := range []string{
+		"+refs/changes/*:refs/changes/*",
+		"refs/heads/main:refs/remotes/origin/main",
+		"+refs/ci/builds/*:refs/remotes/ci/*",
+	} {
+		if err := ValidateRefspec(refspec); err != nil {
+			t.Errorf("ValidateRefspec(%q) failed: %v", refspec, err)
+		}
+	}
+	for _, refspec := range []string{
+		"",
+		"refs/changes/*",
+		"+refs/changes/*:",
+		":refs/changes/*",
+		"changes/*:refs/changes/*",
+		"refs/changes/*:refs/changes/x",
+		"refs/*/changes/*:refs/*/changes/*",
+		"refs/a b:refs/a",
+		"refs/a..b:refs/a",
+		"refs/a:refs/b:refs/c",
+	} {
+		if err := ValidateRefspec(refspec); err == nil {
+			t.Errorf("ValidateRefspec(%q) succeeded, want an error", refspec)
+		}
+	}
+}
+
+// setupUncommittedChanges commits files and leaves each of them with a
+// different kind of uncommitted change.
+func setupUncommittedChanges(t testing.TB, g *Git) {
+	for _, file := range []string{"modified", "staged", "both", "deleted", "renamed"} {
+		commitFile(t, g, file, file, "add "+file)
+	}
+	write := func(file, content string) {
+		if err := ioutil.WriteFile(filepath.Join(g.rootDir, file), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("modified", "change")
+	write("staged", "change")
+	write("both", "change")
+	write("added", "added")
+	write("untracked", "untracked")
+	if err := g.Add("staged"); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Add("both"); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Add("added"); err != nil {
+		t.Fatal(err)
+	}
+	write("both", "another change")
+	if err := os.Remove(filepath.Join(g.rootDir, "deleted")); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.run("mv", "renamed", "new-name"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// diffTwice returns the files with uncommitted changes as the two diffs
+// that FilesWithUncommittedChanges used to run do.
+func diffTwice(g *Git) ([]string, error) {
+	out, err := g.runOutput("diff", "--name-only", "--no-ext-diff")
+	if err != nil {
+		return nil, err
+	}
+	out2, err := g.runOutput("diff", "--cached", "--name-only", "--no-ext-diff")
+	if err != nil {
+		return nil, err
+	}
+	return append(out, out2...), nil
+}
+
+func TestDiffIndex(t *testing.T) {
+	g, cleanup := newTestRepo(t)
+	defer cleanup()
+	if files, err := g.FilesWithUncommittedChanges(); err != nil || len(files) != 0 {
+		t.Errorf("got %v, %v in an empty repository, want no files", files, err)
+	}
+	setupUncommittedChanges(t, g)
+
+	staged, unstaged, err := g.DiffIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"added", "both", "new-name", "staged"}; !reflect.DeepEqual(staged, want) {
+		t.Errorf("got staged files %v, want %v", staged, want)
+	}
+	if want := []string{"both", "deleted", "modified"}; !reflect.DeepEqual(unstaged, want) {
+		t.Errorf("got unstaged files %v, want %v", unstaged, want)
+	}
+
+	want, err := diffTwice(g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := g.FilesWithUncommittedChanges(); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v as listed by git diff", got, want)
+	}
+
+	statuses, err := g.Status(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantStatuses := map[string]FileStatus{
+		"new-name":  {Index: 'R', WorkTree: ' ', Path: "new-name", OrigPath: "renamed"},
+		"untracked": {Index: '?', WorkTree: '?', Path: "untracked"},
+	}
+	for _, status := range statuses {
+		if want, ok := wantStatuses[status.Path]; ok {
+			if status != want {
+				t.Errorf("got status %+v, want %+v", status, want)
+			}
+			delete(wantStatuses, status.Path)
+		}
+	}
+	if len(wantStatuses) != 0 {
+		t.Errorf("files missing from status: %v", wantStatuses)
+	}
+}
+
+func BenchmarkFilesWithUncommittedChanges(b *testing.B) {
+	g, cleanup := newTestRepo(b)
+	defer cleanup()
+	setupUncommittedChanges(b, g)
+	b.Run("status", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := g.FilesWithUncommittedChanges(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("diff-twice", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := diffTwice(g); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
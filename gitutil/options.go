@@ -8,6 +8,10 @@ type CheckoutOpt interface {
 	checkoutOpt()
 }
 
+type CleanOpt interface {
+	cleanOpt()
+}
+
 type CloneOpt interface {
 	cloneOpt()
 }
@@ -27,9 +31,24 @@ type MergeOpt interface {
 type PushOpt interface {
 	pushOpt()
 }
+type RebaseOpt interface {
+	rebaseOpt()
+}
 type ResetOpt interface {
 	resetOpt()
 }
+type RevListOpt interface {
+	revListOpt()
+}
+type BlameOpt interface {
+	blameOpt()
+}
+type StashOpt interface {
+	stashOpt()
+}
+type SubmoduleOpt interface {
+	submoduleOpt()
+}
 
 type FollowTagsOpt bool
 
@@ -41,6 +60,12 @@ func (ForceOpt) checkoutOpt()     {}
 func (ForceOpt) deleteBranchOpt() {}
 func (ForceOpt) pushOpt()         {}
 
+// ExcludeOpt lists patterns of untracked files to keep, in addition to the
+// standard ignore rules.
+type ExcludeOpt []string
+
+func (ExcludeOpt) cleanOpt() {}
+
 type DetachOpt bool
 
 func (DetachOpt) checkoutOpt() {}
@@ -49,6 +74,11 @@ type MessageOpt string
 
 func (MessageOpt) commitOpt() {}
 
+// SignOpt signs the commit with the signing key.
+type SignOpt bool
+
+func (SignOpt) commitOpt() {}
+
 type ModeOpt string
 
 func (ModeOpt) resetOpt() {}
@@ -57,6 +87,10 @@ type ResetOnFailureOpt bool
 
 func (ResetOnFailureOpt) mergeOpt() {}
 
+type AutosquashOpt bool
+
+func (AutosquashOpt) rebaseOpt() {}
+
 type SquashOpt bool
 
 func (SquashOpt) mergeOpt() {}
@@ -85,14 +119,25 @@ type PruneOpt bool
 
 func (PruneOpt) fetchOpt() {}
 
+type PruneTagsOpt bool
+
+func (PruneTagsOpt) fetchOpt() {}
+
 type DepthOpt int
 
-func (DepthOpt) fetchOpt() {}
+func (DepthOpt) fetchOpt()     {}
+func (DepthOpt) submoduleOpt() {}
 
 type UpdateShallowOpt bool
 
 func (UpdateShallowOpt) fetchOpt() {}
 
+// RefspecsOpt lists refspecs to fetch. As with git fetch, the refspecs
+// configured for the remote are not used when refspecs are given.
+type RefspecsOpt []string
+
+func (RefspecsOpt) fetchOpt() {}
+
 type VerifyOpt bool
 
 func (VerifyOpt) pushOpt() {}
@@ -114,3 +159,47 @@ func (DepthOpt) cloneOpt() {}
 type BareOpt bool
 
 func (BareOpt) cloneOpt() {}
+
+// FilterOpt is a partial clone filter spec, e.g. "blob:none".
+type FilterOpt string
+
+func (FilterOpt) cloneOpt() {}
+
+// OriginOpt names the remote created by a clone, instead of "origin".
+type OriginOpt string
+
+func (OriginOpt) cloneOpt() {}
+
+type SinceOpt string
+
+func (SinceOpt) revListOpt() {}
+
+type UntilOpt string
+
+func (UntilOpt) revListOpt() {}
+
+type AuthorOpt string
+
+func (AuthorOpt) revListOpt() {}
+
+type CommitterOpt string
+
+func (CommitterOpt) revListOpt() {}
+
+type BlameRevisionOpt string
+
+func (BlameRevisionOpt) blameOpt() {}
+
+type LineRangeOpt string
+
+func (LineRangeOpt) blameOpt() {}
+
+// IncludeUntrackedOpt stashes untracked files as well.
+type IncludeUntrackedOpt bool
+
+func (IncludeUntrackedOpt) stashOpt() {}
+
+// KeepIndexOpt leaves changes already added to the index in place.
+type KeepIndexOpt bool
+
+func (KeepIndexOpt) stashOpt() {}
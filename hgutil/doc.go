@@ -0,0 +1,7 @@
+// Copyright 2020 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package hgutil provides Go wrappers for the Mercurial commands jiri needs to
+// sync projects using the "hg" protocol.
+package hgutil
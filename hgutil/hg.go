@@ -0,0 +1,219 @@
+// Copyright 2020 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package hgutil
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/dahlia-os/jiri"
+	"github.com/dahlia-os/jiri/envvar"
+)
+
+// ErrNotInstalled is returned by the Mercurial wrappers if hg is not
+// installed.
+var ErrNotInstalled = errors.New("hg is not installed; install Mercurial from https://www.mercurial-scm.org and run the command again")
+
+type HgError struct {
+	Root        string
+	Args        []string
+	Output      string
+	ErrorOutput string
+	err         error
+}
+
+func Error(output, errorOutput string, err error, root string, args ...string) HgError {
+	return HgError{
+		Root:        root,
+		Args:        args,
+		Output:      output,
+		ErrorOutput: errorOutput,
+		err:         err,
+	}
+}
+
+func (he HgError) Error() string {
+	result := "'hg "
+	result += strings.Join(he.Args, " ")
+	result += "' failed:\n"
+	result += "stdout:\n"
+	result += he.Output + "\n"
+	result += "stderr:\n"
+	result += he.ErrorOutput
+	result += "\ncommand fail error: " + he.err.Error()
+	return result
+}
+
+type Hg struct {
+	jirix   *jiri.X
+	rootDir string
+	user    string
+}
+
+type hgOpt interface {
+	hgOpt()
+}
+type RootDirOpt string
+
+// UserOpt sets the author of commits, e.g. "John Doe <john.doe@example.com>".
+type UserOpt string
+
+func (RootDirOpt) hgOpt() {}
+func (UserOpt) hgOpt()    {}
+
+// New is the Hg factory.
+func New(jirix *jiri.X, opts ...hgOpt) *Hg {
+	h := &Hg{jirix: jirix}
+	for _, opt := range opts {
+		switch typedOpt := opt.(type) {
+		case RootDirOpt:
+			h.rootDir = string(typedOpt)
+		case UserOpt:
+			h.user = string(typedOpt)
+		}
+	}
+	return h
+}
+
+// Init initializes a new repository at path.
+func (h *Hg) Init(path string) error {
+	return h.run("init", path)
+}
+
+// Add adds a file to be tracked.
+func (h *Hg) Add(file string) error {
+	return h.run("add", file)
+}
+
+// CommitWithMessage commits all the changes with the given message.
+func (h *Hg) CommitWithMessage(message string) error {
+	args := []string{"commit", "-m", message}
+	if h.user != "" {
+		args = append(args, "--user", h.user)
+	}
+	return h.run(args...)
+}
+
+// Clone clones the repository at remote into path, without checking out any
+// revision.
+func (h *Hg) Clone(remote, path string) error {
+	return h.run("clone", "--noupdate", remote, path)
+}
+
+// Pull pulls the new revisions of the repository at remote, without changing
+// the revision checked out.
+func (h *Hg) Pull(remote string) error {
+	return h.run("pull", remote)
+}
+
+type UpdateOpt interface {
+	updateOpt()
+}
+
+// CleanOpt discards the uncommitted changes when updating.
+type CleanOpt bool
+
+func (CleanOpt) updateOpt() {}
+
+// Update checks out revision.  It fails if there are uncommitted changes,
+// unless they are discarded with CleanOpt.
+func (h *Hg) Update(revision string, opts ...UpdateOpt) error {
+	args := []string{"update", "--check"}
+	for _, opt := range opts {
+		switch typedOpt := opt.(type) {
+		case CleanOpt:
+			if typedOpt {
+				args = []string{"update", "--clean"}
+			}
+		}
+	}
+	return h.run(append(args, "--rev", revision)...)
+}
+
+// CurrentRevision returns the revision of the working directory parent.
+func (h *Hg) CurrentRevision() (string, error) {
+	return h.Revision(".")
+}
+
+// Revision returns the full hash of revision, which can be a hash, a tag,
+// a bookmark or a branch, for which the tipmost head of the branch is
+// returned.
+func (h *Hg) Revision(revision string) (string, error) {
+	out, err := h.runOutput("log", "--rev", revision, "--limit", "1", "--template", "{node}")
+	if err != nil {
+		return "", err
+	}
+	if got, want := len(out), 1; got != want {
+		return "", fmt.Errorf("unknown revision %q", revision)
+	}
+	return out[0], nil
+}
+
+// FilesWithUncommittedChanges returns the list of files that have
+// uncommitted changes.
+func (h *Hg) FilesWithUncommittedChanges() ([]string, error) {
+	return h.runOutput("status", "--modified", "--added", "--removed", "--deleted", "--no-status")
+}
+
+// HasUntrackedFiles returns whether the working directory contains files
+// which are neither tracked nor ignored.
+func (h *Hg) HasUntrackedFiles() (bool, error) {
+	out, err := h.runOutput("status", "--unknown", "--no-status")
+	if err != nil {
+		return false, err
+	}
+	return len(out) != 0, nil
+}
+
+func (h *Hg) run(args ...string) error {
+	var stdout, stderr bytes.Buffer
+	if err := h.runHg(&stdout, &stderr, args...); err != nil {
+		return h.error(stdout.String(), stderr.String(), err, args...)
+	}
+	return nil
+}
+
+func (h *Hg) runOutput(args ...string) ([]string, error) {
+	var stdout, stderr bytes.Buffer
+	if err := h.runHg(&stdout, &stderr, args...); err != nil {
+		return nil, h.error(stdout.String(), stderr.String(), err, args...)
+	}
+	output := strings.TrimSpace(stdout.String())
+	if len(output) == 0 {
+		return nil, nil
+	}
+	return strings.Split(output, "\n"), nil
+}
+
+func (h *Hg) error(output, errorOutput string, err error, args ...string) error {
+	if errors.Is(err, exec.ErrNotFound) {
+		return ErrNotInstalled
+	}
+	return Error(output, errorOutput, err, h.rootDir, args...)
+}
+
+func (h *Hg) runHg(stdout, stderr io.Writer, args ...string) error {
+	command := exec.Command("hg", args...)
+	command.Dir = h.rootDir
+	command.Stdout = stdout
+	command.Stderr = stderr
+	// HGPLAIN disables the user configuration which changes the output of
+	// commands, such as aliases and localization, so that it can be parsed.
+	env := envvar.MergeMaps(h.jirix.Env(), map[string]string{"HGPLAIN": "1"})
+	command.Env = envvar.MapToSlice(env)
+	dir := h.rootDir
+	if dir == "" {
+		if cwd, err := os.Getwd(); err == nil {
+			dir = cwd
+		}
+	}
+	h.jirix.Logger.Tracef("Run: hg %s (%s)", strings.Join(args, " "), dir)
+	return command.Run()
+}
@@ -0,0 +1,168 @@
+// Copyright 2020 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package hgutil
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dahlia-os/jiri"
+	"github.com/dahlia-os/jiri/cmdline"
+	"github.com/dahlia-os/jiri/color"
+	"github.com/dahlia-os/jiri/log"
+	"github.com/dahlia-os/jiri/tool"
+)
+
+func newTestX() *jiri.X {
+	ctx := tool.NewContextFromEnv(cmdline.EnvFromOS())
+	color := color.NewColor(color.ColorNever)
+	logger := log.NewLogger(log.InfoLevel, color, log.TextFormat, false, 0, time.Second*100, nil, nil)
+	return &jiri.X{Context: ctx, Color: color, Logger: logger, Attempts: 1}
+}
+
+// newTestRepo creates a Mercurial repository in a temporary directory and
+// returns an Hg instance operating on it along with a cleanup closure.
+func newTestRepo(t *testing.T) (*Hg, func()) {
+	if _, err := exec.LookPath("hg"); err != nil {
+		t.Skip("hg not found")
+	}
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("TempDir() failed: %v", err)
+	}
+	cleanup := func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Fatalf("RemoveAll(%q) failed: %v", dir, err)
+		}
+	}
+	h := New(newTestX(), RootDirOpt(dir), UserOpt("John Doe <john.doe@example.com>"))
+	if err := h.Init(dir); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	return h, cleanup
+}
+
+// commitFile writes a file with the given content to the repository and
+// commits it, returning the new revision.
+func commitFile(t *testing.T, h *Hg, file, content string) string {
+	path := filepath.Join(h.rootDir, file)
+	_, statErr := os.Stat(path)
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if os.IsNotExist(statErr) {
+		if err := h.Add(file); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := h.CommitWithMessage("change " + file); err != nil {
+		t.Fatal(err)
+	}
+	rev, err := h.CurrentRevision()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rev
+}
+
+func TestCloneAndUpdate(t *testing.T) {
+	remote, cleanup := newTestRepo(t)
+	defer cleanup()
+	first := commitFile(t, remote, "file", "first")
+	second := commitFile(t, remote, "file", "second")
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "clone")
+	if err := New(newTestX()).Clone(remote.rootDir, path); err != nil {
+		t.Fatal(err)
+	}
+	h := New(newTestX(), RootDirOpt(path))
+	if _, err := os.Stat(filepath.Join(path, "file")); !os.IsNotExist(err) {
+		t.Errorf("expected no revision to be checked out, got %v", err)
+	}
+	if got, err := h.Revision("default"); err != nil || got != second {
+		t.Errorf("got revision %q, %v for the default branch, want %q", got, err, second)
+	}
+	if _, err := h.Revision("missing"); err == nil {
+		t.Errorf("expected an error for an unknown revision")
+	}
+
+	if err := h.Update(first); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := h.CurrentRevision(); err != nil || got != first {
+		t.Errorf("got current revision %q, %v, want %q", got, err, first)
+	}
+
+	third := commitFile(t, remote, "file", "third")
+	if err := h.Pull(remote.rootDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Update(third); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(path, "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(data), "third"; got != want {
+		t.Errorf("got file %q, want %q", got, want)
+	}
+}
+
+func TestUncommittedChanges(t *testing.T) {
+	h, cleanup := newTestRepo(t)
+	defer cleanup()
+	first := commitFile(t, h, "file", "first")
+	commitFile(t, h, "file", "second")
+
+	if files, err := h.FilesWithUncommittedChanges(); err != nil || len(files) != 0 {
+		t.Errorf("got uncommitted changes %v, %v, want none", files, err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(h.rootDir, "file"), []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(h.rootDir, "untracked"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if files, err := h.FilesWithUncommittedChanges(); err != nil || !reflect.DeepEqual(files, []string{"file"}) {
+		t.Errorf("got uncommitted changes %v, %v, want [file]", files, err)
+	}
+	if untracked, err := h.HasUntrackedFiles(); err != nil || !untracked {
+		t.Errorf("got untracked files %v, %v, want true", untracked, err)
+	}
+
+	if err := h.Update(first); err == nil {
+		t.Errorf("expected update to fail with uncommitted changes")
+	}
+	if err := h.Update(first, CleanOpt(true)); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := h.CurrentRevision(); err != nil || got != first {
+		t.Errorf("got current revision %q, %v, want %q", got, err, first)
+	}
+	if files, err := h.FilesWithUncommittedChanges(); err != nil || len(files) != 0 {
+		t.Errorf("got uncommitted changes %v, %v, want none", files, err)
+	}
+}
+
+func TestNotInstalled(t *testing.T) {
+	if _, err := exec.LookPath("hg"); err == nil {
+		t.Skip("hg is installed")
+	}
+	if _, err := New(newTestX()).CurrentRevision(); err != ErrNotInstalled {
+		t.Errorf("got error %v, want %v", err, ErrNotInstalled)
+	}
+}
@@ -23,7 +23,7 @@ import (
 func NewX(t *testing.T) (*jiri.X, func()) {
 	ctx := tool.NewContextFromEnv(cmdline.EnvFromOS())
 	color := color.NewColor(color.ColorNever)
-	logger := log.NewLogger(log.InfoLevel, color, false, 0, time.Second*100, nil, nil)
+	logger := log.NewLogger(log.InfoLevel, color, log.TextFormat, false, 0, time.Second*100, nil, nil)
 	root, err := ioutil.TempDir("", "")
 	if err != nil {
 		t.Fatalf("TempDir() failed: %v", err)
@@ -36,5 +36,5 @@ func NewX(t *testing.T) (*jiri.X, func()) {
 			t.Fatalf("RemoveAll(%q) failed: %v", root, err)
 		}
 	}
-	return &jiri.X{Context: ctx, Root: root, Jobs: jiri.DefaultJobs, Color: color, Logger: logger, Attempts: 1}, cleanup
+	return &jiri.X{Context: ctx, Root: root, Jobs: jiri.DefaultJobs, FetchJobs: jiri.DefaultFetchJobs, FetchJobsPerHost: jiri.DefaultFetchJobsPerHost, Color: color, Logger: logger, Attempts: 1}, cleanup
 }
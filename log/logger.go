@@ -6,10 +6,13 @@ package log
 
 import (
 	"container/list"
+	"encoding/json"
 	"fmt"
 	"io"
 	glog "log"
 	"os"
+	"regexp"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -48,14 +51,31 @@ type Logger struct {
 	goLogger             *glog.Logger
 	goErrorLogger        *glog.Logger
 	color                color.Color
+	format               Format
 	progressLines        int
 	progressWindowSize   uint
 	enableProgress       uint32
 	progressUpdateNeeded bool
 	timeLogThreshold     time.Duration
 	tasks                *list.List
+	bar                  *ProgressBar
 }
 
+// ProgressBar is a line of progress output counting the items of a job which
+// are done, followed by the names of those in progress. It is shown above the
+// task messages while progress is enabled, and does nothing otherwise. Its
+// methods are safe for concurrent use.
+type ProgressBar struct {
+	l      *Logger
+	title  string
+	total  int
+	done   int
+	active []string
+}
+
+// progressBarWidth is the number of characters in the bar of a ProgressBar.
+const progressBarWidth = 20
+
 type LogLevel int
 
 const (
@@ -67,7 +87,47 @@ const (
 	TraceLevel
 )
 
-func NewLogger(loggerLevel LogLevel, color color.Color, enableProgress bool, progressWindowSize uint, timeLogThreshold time.Duration, outWriter, errWriter io.Writer) *Logger {
+func (l LogLevel) String() string {
+	switch l {
+	case ErrorLevel:
+		return "error"
+	case WarningLevel:
+		return "warning"
+	case InfoLevel:
+		return "info"
+	case DebugLevel:
+		return "debug"
+	case TraceLevel:
+		return "trace"
+	}
+	return fmt.Sprintf("LogLevel(%d)", int(l))
+}
+
+// Format is the format of the lines written by a Logger.
+type Format int
+
+const (
+	// TextFormat writes messages as they are, prefixed with their level
+	// in color.
+	TextFormat Format = iota
+	// JSONFormat writes each message as a JSON object on its own line,
+	// with the fields "level", "time", "msg" and, for messages about a
+	// project, "project". Progress is not shown.
+	JSONFormat
+)
+
+// jsonRecord is a message written in JSONFormat.
+type jsonRecord struct {
+	Level   string `json:"level"`
+	Time    string `json:"time"`
+	Msg     string `json:"msg"`
+	Project string `json:"project,omitempty"`
+}
+
+// ansiEscape matches the escape sequences with which messages are colored.
+var ansiEscape = regexp.MustCompile("\x1b\\[[0-9;?]*[A-Za-z]")
+
+func NewLogger(loggerLevel LogLevel, color color.Color, format Format, enableProgress bool, progressWindowSize uint, timeLogThreshold time.Duration, outWriter, errWriter io.Writer) *Logger {
 	if outWriter == nil {
 		outWriter = os.Stdout
 	}
@@ -80,7 +140,7 @@ func NewLogger(loggerLevel LogLevel, color color.Color, enableProgress bool, pro
 		enableProgress = false
 	}
 	if enableProgress {
-		enableProgress = isatty.IsTerminal()
+		enableProgress = isatty.IsTerminal() && format == TextFormat
 	}
 	l := &Logger{
 		LoggerLevel:          loggerLevel,
@@ -88,6 +148,7 @@ func NewLogger(loggerLevel LogLevel, color color.Color, enableProgress bool, pro
 		goLogger:             glog.New(outWriter, "", 0),
 		goErrorLogger:        glog.New(errWriter, "", 0),
 		color:                color,
+		format:               format,
 		progressLines:        0,
 		enableProgress:       0,
 		progressWindowSize:   progressWindowSize,
@@ -141,6 +202,72 @@ func (l *Logger) AddTaskMsg(format string, a ...interface{}) Task {
 	}
 }
 
+// StartProgressBar shows a progress bar for a job with total items, replacing
+// the current progress bar if any. Finish must be called once the job is done.
+func (l *Logger) StartProgressBar(title string, total int) *ProgressBar {
+	b := &ProgressBar{l: l, title: title, total: total}
+	if !l.IsProgressEnabled() {
+		return b
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.bar = b
+	l.progressUpdateNeeded = true
+	return b
+}
+
+// Start marks the item name as in progress.
+func (b *ProgressBar) Start(name string) {
+	b.update(func() {
+		b.active = append(b.active, name)
+	})
+}
+
+// Done marks the item name as done.
+func (b *ProgressBar) Done(name string) {
+	b.update(func() {
+		for i, n := range b.active {
+			if n == name {
+				b.active = append(b.active[:i], b.active[i+1:]...)
+				break
+			}
+		}
+		b.done++
+	})
+}
+
+// Finish removes the progress bar.
+func (b *ProgressBar) Finish() {
+	b.update(func() {
+		if b.l.bar == b {
+			b.l.bar = nil
+		}
+	})
+}
+
+func (b *ProgressBar) update(f func()) {
+	if !b.l.IsProgressEnabled() {
+		return
+	}
+	b.l.lock.Lock()
+	defer b.l.lock.Unlock()
+	f()
+	b.l.progressUpdateNeeded = true
+}
+
+// This is thread unsafe
+func (b *ProgressBar) String() string {
+	filled := progressBarWidth
+	if b.total > 0 && b.done < b.total {
+		filled = progressBarWidth * b.done / b.total
+	}
+	s := fmt.Sprintf("%s [%s%s] %d/%d", b.title, strings.Repeat("=", filled), strings.Repeat(" ", progressBarWidth-filled), b.done, b.total)
+	if len(b.active) > 0 {
+		s += ": " + strings.Join(b.active, ", ")
+	}
+	return s
+}
+
 func (t *Task) Done() {
 	t.taskData.progress = 100
 	if !t.l.IsProgressEnabled() {
@@ -158,6 +285,9 @@ func (l *Logger) repaintProgressMsgs() {
 		return
 	}
 	l.clearProgress()
+	if l.bar != nil {
+		l.printProgressMsg(l.bar.String())
+	}
 	e := l.tasks.Front()
 	for i := 0; i < int(l.progressWindowSize); i++ {
 		if e == nil {
@@ -198,59 +328,80 @@ func (l *Logger) clearProgress() {
 	l.progressLines = 0
 }
 
-func (l *Logger) log(prefix, format string, a ...interface{}) {
+func (l *Logger) log(level LogLevel, project, prefix, format string, a ...interface{}) {
+	if l.LoggerLevel < level {
+		return
+	}
+	msg := fmt.Sprintf(format, a...)
+	logger := l.goLogger
+	if level == ErrorLevel {
+		logger = l.goErrorLogger
+	}
 	l.lock.Lock()
 	defer l.lock.Unlock()
+	if l.format == JSONFormat {
+		logger.Print(jsonLine(level, project, msg))
+		return
+	}
 	l.clearProgress()
-	l.goLogger.Printf("%s%s", prefix, fmt.Sprintf(format, a...))
+	logger.Printf("%s%s", prefix, msg)
+}
+
+// jsonLine returns msg as a JSONFormat record, without its colors and
+// trailing newlines.
+func jsonLine(level LogLevel, project, msg string) string {
+	data, err := json.Marshal(jsonRecord{
+		Level:   level.String(),
+		Time:    time.Now().Format(time.RFC3339Nano),
+		Msg:     strings.TrimRight(ansiEscape.ReplaceAllString(msg, ""), "\n"),
+		Project: project,
+	})
+	if err != nil {
+		// Marshalling strings does not fail.
+		panic(err)
+	}
+	return string(data)
 }
 
 func (l *Logger) Logf(loglevel LogLevel, format string, a ...interface{}) {
+	l.ProjectLogf(loglevel, "", format, a...)
+}
+
+// ProjectLogf logs a message about project at loglevel. The project is only
+// recorded in JSONFormat, so the message should mention it as well.
+func (l *Logger) ProjectLogf(loglevel LogLevel, project, format string, a ...interface{}) {
 	switch loglevel {
 	case InfoLevel:
-		l.Infof(format, a...)
+		l.log(loglevel, project, "", format, a...)
 	case DebugLevel:
-		l.Debugf(format, a...)
+		l.log(loglevel, project, l.color.Cyan("DEBUG: "), format, a...)
 	case TraceLevel:
-		l.Tracef(format, a...)
+		l.log(loglevel, project, l.color.Blue("TRACE: "), format, a...)
 	case WarningLevel:
-		l.Warningf(format, a...)
+		l.log(loglevel, project, l.color.Yellow("WARN: "), format, a...)
 	case ErrorLevel:
-		l.Errorf(format, a...)
+		l.log(loglevel, project, l.color.Red("ERROR: "), format, a...)
 	default:
 		panic(fmt.Sprintf("Undefined loglevel: %v, log message: %s", loglevel, fmt.Sprintf(format, a...)))
 	}
 }
 
 func (l *Logger) Infof(format string, a ...interface{}) {
-	if l.LoggerLevel >= InfoLevel {
-		l.log("", format, a...)
-	}
+	l.ProjectLogf(InfoLevel, "", format, a...)
 }
 
 func (l *Logger) Debugf(format string, a ...interface{}) {
-	if l.LoggerLevel >= DebugLevel {
-		l.log(l.color.Cyan("DEBUG: "), format, a...)
-	}
+	l.ProjectLogf(DebugLevel, "", format, a...)
 }
 
 func (l *Logger) Tracef(format string, a ...interface{}) {
-	if l.LoggerLevel >= TraceLevel {
-		l.log(l.color.Blue("TRACE: "), format, a...)
-	}
+	l.ProjectLogf(TraceLevel, "", format, a...)
 }
 
 func (l *Logger) Warningf(format string, a ...interface{}) {
-	if l.LoggerLevel >= WarningLevel {
-		l.log(l.color.Yellow("WARN: "), format, a...)
-	}
+	l.ProjectLogf(WarningLevel, "", format, a...)
 }
 
 func (l *Logger) Errorf(format string, a ...interface{}) {
-	if l.LoggerLevel >= ErrorLevel {
-		l.lock.Lock()
-		defer l.lock.Unlock()
-		l.clearProgress()
-		l.goErrorLogger.Printf("%s%s", l.color.Red("ERROR: "), fmt.Sprintf(format, a...))
-	}
+	l.ProjectLogf(ErrorLevel, "", format, a...)
 }
@@ -0,0 +1,103 @@
+// Copyright 2019 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/dahlia-os/jiri/color"
+)
+
+func TestProgressBar(t *testing.T) {
+	logger := NewLogger(InfoLevel, color.NewColor(color.ColorNever), TextFormat, false, 5, 0, nil, nil)
+
+	// The bar does nothing while progress is disabled.
+	b := logger.StartProgressBar("Fetching", 4)
+	b.Start("a")
+	if logger.bar != nil || len(b.active) != 0 {
+		t.Errorf("progress bar updated while progress is disabled")
+	}
+
+	// Enable progress without starting the goroutine painting it.
+	atomic.StoreUint32(&logger.enableProgress, 1)
+	b = logger.StartProgressBar("Fetching", 4)
+	b.Start("a")
+	b.Start("b")
+	b.Start("c")
+	b.Done("b")
+	if got, want := b.String(), "Fetching [=====               ] 1/4: a, c"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	b = logger.StartProgressBar("Cloning", 50)
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			b.Start(name)
+			b.Done(name)
+		}(fmt.Sprintf("p%d", i))
+	}
+	wg.Wait()
+	if got, want := b.String(), "Cloning ["+strings.Repeat("=", progressBarWidth)+"] 50/50"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	b.Finish()
+	if logger.bar != nil {
+		t.Errorf("progress bar not removed by Finish")
+	}
+}
+
+func TestJSONFormat(t *testing.T) {
+	var out, errOut bytes.Buffer
+	logger := NewLogger(DebugLevel, color.NewColor(color.ColorAlways), JSONFormat, true, 5, 0, &out, &errOut)
+	if logger.IsProgressEnabled() {
+		t.Errorf("progress enabled in JSON format")
+	}
+	logger.Infof("updating %s\n\n", logger.color.Green("projects"))
+	logger.ProjectLogf(WarningLevel, "a", "project %s is dirty", "a")
+	logger.Tracef("not logged")
+	logger.Errorf("failed")
+
+	type record struct {
+		Level   string `json:"level"`
+		Time    string `json:"time"`
+		Msg     string `json:"msg"`
+		Project string `json:"project"`
+	}
+	parse := func(s string) []record {
+		var records []record
+		for _, line := range strings.Split(strings.TrimSuffix(s, "\n"), "\n") {
+			var r record
+			if err := json.Unmarshal([]byte(line), &r); err != nil {
+				t.Fatalf("line %q is not valid JSON: %s", line, err)
+			}
+			if r.Time == "" {
+				t.Errorf("line %q has no time", line)
+			}
+			r.Time = ""
+			records = append(records, r)
+		}
+		return records
+	}
+	want := []record{
+		{Level: "info", Msg: "updating projects"},
+		{Level: "warning", Msg: "project a is dirty", Project: "a"},
+	}
+	if got := parse(out.String()); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	want = []record{{Level: "error", Msg: "failed"}}
+	if got := parse(errOut.String()); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
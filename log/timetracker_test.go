@@ -22,7 +22,7 @@ const timeThreshold = 100 * time.Millisecond
 // It creates logger using |loglevel| and |threshold| params.
 func runTimeTracker(loglevel LogLevel, threshold, sleeptime time.Duration, operations []string) *bytes.Buffer {
 	buf := bytes.NewBufferString("")
-	logger := NewLogger(loglevel, color.NewColor(color.ColorNever), false, 0, threshold, buf, nil)
+	logger := NewLogger(loglevel, color.NewColor(color.ColorNever), TextFormat, false, 0, threshold, buf, nil)
 	var tts []*TimeTracker
 	for _, op := range operations {
 		tts = append(tts, logger.TrackTime(op))
@@ -0,0 +1,83 @@
+// Copyright 2019 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package project implements the jiri project model: manifests, the projects,
+// hooks and packages they declare, and the operations that bring a jiri root
+// in sync with them.
+//
+// Tools embedding jiri can enumerate the projects of a jiri root without
+// going through the command layer using ResolveProjects, and look projects up
+// with FindProjectByName and FindProjectByPath.  These functions are a stable
+// API; the rest of the package is tailored to the jiri commands and may
+// change between releases.
+package project
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/dahlia-os/jiri"
+)
+
+// ResolveProjects loads the given manifest file, resolving its local and
+// remote imports and applying local overrides, and returns the projects it
+// declares sorted by path.  If manifestFile is empty, the .jiri_manifest file
+// of the jiri root is used.  Remote imports are resolved using the manifests
+// checked out in the jiri root, so no network access is needed as long as
+// "jiri update" has been run.
+//
+// Like LoadManifestFile, ResolveProjects cannot be run multiple times in
+// parallel on the same jiri root.
+func ResolveProjects(jirix *jiri.X, manifestFile string) ([]Project, error) {
+	if manifestFile == "" {
+		manifestFile = jirix.JiriManifestFile()
+	}
+	localProjects, err := LocalProjects(jirix, FastScan)
+	if err != nil {
+		return nil, err
+	}
+	projects, _, _, err := LoadManifestFile(jirix, manifestFile, localProjects, false)
+	if err != nil {
+		return nil, err
+	}
+	result := projects.toSlice()
+	sort.Sort(ProjectsByPath(result))
+	return result, nil
+}
+
+// FindProjectByName returns the project with the given name.  The boolean is
+// false if there is no such project.  If several projects share the name, the
+// first one is returned.
+func FindProjectByName(projects []Project, name string) (Project, bool) {
+	for _, p := range projects {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return Project{}, false
+}
+
+// FindProjectByPath returns the project whose checkout contains path, which
+// is either the path of the project or a file or directory inside it.  When
+// projects are nested, the innermost one is returned.  Relative paths are
+// relative to the current directory.  The boolean is false if path is not in
+// any project.
+func FindProjectByPath(projects []Project, path string) (Project, bool) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return Project{}, false
+	}
+	var found Project
+	ok := false
+	for _, p := range projects {
+		if p.Path != path && !strings.HasPrefix(path, p.Path+string(filepath.Separator)) {
+			continue
+		}
+		if !ok || len(p.Path) > len(found.Path) {
+			found, ok = p, true
+		}
+	}
+	return found, ok
+}
@@ -0,0 +1,36 @@
+// Copyright 2019 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package project_test
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/dahlia-os/jiri"
+	"github.com/dahlia-os/jiri/cmdline"
+	"github.com/dahlia-os/jiri/project"
+)
+
+func ExampleResolveProjects() {
+	// The jiri root is found from the JIRI_ROOT environment variable or the
+	// current directory, as for the jiri commands.
+	jirix, err := jiri.NewX(cmdline.EnvFromOS())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	defer jirix.RunCleanup()
+	projects, err := project.ResolveProjects(jirix, "")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	for _, p := range projects {
+		fmt.Printf("%s %s\n", p.Name, p.Path)
+	}
+	if p, ok := project.FindProjectByPath(projects, "."); ok {
+		fmt.Printf("current project: %s\n", p.Name)
+	}
+}
@@ -4,5 +4,22 @@
 
 package project
 
+import "github.com/dahlia-os/jiri"
+
 // InternalWriteMetadata exports writeMetadata for tests.
 var InternalWriteMetadata = writeMetadata
+
+// InternalRemoteHost exports remoteHost for tests.
+var InternalRemoteHost = remoteHost
+
+// InternalHostLimiter returns the acquire function of a new hostLimiter for
+// tests.
+func InternalHostLimiter(jirix *jiri.X) func(remote string) func() {
+	return newHostLimiter(jirix).acquire
+}
+
+// InternalExpandVars exports expandVars for tests.
+var InternalExpandVars = expandVars
+
+// InternalGenerateEnsureFile exports generateEnsureFile for tests.
+var InternalGenerateEnsureFile = generateEnsureFile
@@ -10,6 +10,7 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"reflect"
 	"strings"
 
 	"github.com/dahlia-os/jiri"
@@ -40,6 +41,32 @@ type loader struct {
 	manifests      map[string]bool
 	lockfiles      map[string]bool
 	parentFile     string
+	// skipMissingImports makes remote imports which are not among
+	// localProjects be skipped with a warning instead of being cloned.
+	skipMissingImports bool
+	// localManifestsUsed records the projects of jirix.LocalManifests whose
+	// local manifests were loaded.
+	localManifestsUsed map[string]bool
+	// removes are the projects to remove once the root manifest is loaded.
+	removes []Remove
+	// Imports records every manifest loaded, in load order.
+	Imports []ManifestImport
+}
+
+// ManifestImport describes a manifest file loaded while resolving the imports
+// of the root manifest.
+type ManifestImport struct {
+	// Depth is the import depth, the root manifest has depth 0.
+	Depth int `json:"depth"`
+	// Type is one of "root", "local" or "remote".
+	Type string `json:"type"`
+	// File is the manifest file path.  For remote imports loaded from git
+	// it is relative to the manifest repository.
+	File string `json:"file"`
+	// Remote and Revision are set for remote imports.  Revision is empty if
+	// the import was read from the local checkout.
+	Remote   string `json:"remote,omitempty"`
+	Revision string `json:"revision,omitempty"`
 }
 
 func (ld *loader) cleanup() {
@@ -75,6 +102,30 @@ func newManifestLoader(localProjects Projects, update bool, file string) *loader
 		manifests:      make(map[string]bool),
 		lockfiles:      make(map[string]bool),
 		parentFile:     file,
+
+		localManifestsUsed: make(map[string]bool),
+	}
+}
+
+// isLocalManifest returns true if the manifest of the imported project is
+// read from its local checkout because it is listed in jirix.LocalManifests.
+func (ld *loader) isLocalManifest(jirix *jiri.X, project Project) bool {
+	for _, name := range jirix.LocalManifests {
+		if name == project.Name {
+			ld.localManifestsUsed[name] = true
+			return true
+		}
+	}
+	return false
+}
+
+// warnUnusedLocalManifests warns about the projects of jirix.LocalManifests
+// which hold no imported manifest.
+func (ld *loader) warnUnusedLocalManifests(jirix *jiri.X) {
+	for _, name := range jirix.LocalManifests {
+		if !ld.localManifestsUsed[name] {
+			jirix.Logger.Warningf("Project %q does not hold an imported manifest, its local manifest is not used\n\n", name)
+		}
 	}
 }
 
@@ -113,12 +164,12 @@ func (ld *loader) loadNoCycles(jirix *jiri.X, root, repoPath, file, ref, cycleKe
 		f = filepath.Join(repoPath, file)
 	}
 	info := cycleInfo{f, cycleKey}
-	for _, c := range ld.cycleStack {
+	for i, c := range ld.cycleStack {
 		switch {
 		case f == c.file:
-			return fmt.Errorf("import cycle detected in local manifest files: %q", append(ld.cycleStack, info))
+			return fmt.Errorf("import cycle detected in local manifest files: %s", formatCycle(jirix, append(ld.cycleStack[i:], info), false))
 		case cycleKey == c.key && cycleKey != "":
-			return fmt.Errorf("import cycle detected in remote manifest imports: %q", append(ld.cycleStack, info))
+			return fmt.Errorf("import cycle detected in remote manifest imports: %s", formatCycle(jirix, append(ld.cycleStack[i:], info), true))
 		}
 	}
 	ld.cycleStack = append(ld.cycleStack, info)
@@ -129,6 +180,21 @@ func (ld *loader) loadNoCycles(jirix *jiri.X, root, repoPath, file, ref, cycleKe
 	return nil
 }
 
+// formatCycle returns the import path of a cycle, e.g. "A -> B -> A".  Remote
+// imports are named by their key if useKey is set, all other imports by the
+// manifest file.
+func formatCycle(jirix *jiri.X, cycle []cycleInfo, useKey bool) string {
+	var names []string
+	for _, c := range cycle {
+		if useKey && c.key != "" {
+			names = append(names, c.key)
+		} else {
+			names = append(names, shortFileName(jirix.Root, "", c.file, ""))
+		}
+	}
+	return strings.Join(names, " -> ")
+}
+
 // shortFileName returns the relative path if file is relative to root,
 // otherwise returns the file name unchanged.
 func shortFileName(root, repoPath, file, ref string) string {
@@ -147,10 +213,72 @@ func (ld *loader) Load(jirix *jiri.X, root, repoPath, file, ref, cycleKey, paren
 	return ld.loadNoCycles(jirix, root, repoPath, file, ref, cycleKey, parentImport, localManifest)
 }
 
+// applyLocalOverrides layers the overrides in the .jiri_manifest.local file,
+// if present, on top of the loaded projects.  Overrides match projects by
+// name, and each attribute set in an override replaces the one of the
+// matching project.
+func (ld *loader) applyLocalOverrides(jirix *jiri.X) error {
+	file := jirix.JiriLocalManifestFile()
+	if _, err := os.Stat(file); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmtError(err)
+	}
+	m, err := ManifestFromFile(jirix, file)
+	if err != nil {
+		return err
+	}
+	if err := m.expandVars(jirix.Env()); err != nil {
+		return fmt.Errorf("Error reading from manifest file %s:error(%s)", file, err)
+	}
+	for _, override := range m.Overrides {
+		// Only attributes explicitly set in the local manifest are applied.
+		if err := override.unfillDefaults(); err != nil {
+			return err
+		}
+		override.absolutizePaths(jirix.Root)
+		var keys []ProjectKey
+		for key, p := range ld.Projects {
+			if p.Name == override.Name {
+				keys = append(keys, key)
+			}
+		}
+		if len(keys) == 0 {
+			return fmt.Errorf("failed to override %q found in %q. Original project not found in manifest", override.Name, jiri.JiriLocalManifestFile)
+		}
+		if len(keys) > 1 {
+			return fmt.Errorf("failed to override %q found in %q. Multiple projects with this name found in manifest", override.Name, jiri.JiriLocalManifestFile)
+		}
+		key := keys[0]
+		if _, ok := ld.importProjects[key]; ok {
+			return fmt.Errorf("cannot override project %q because the project contains an imported manifest", key)
+		}
+		project := ld.Projects[key]
+		project.update(&override)
+		if err := project.validate(); err != nil {
+			return err
+		}
+		if override.Remote != "" {
+			project.Remote = override.Remote
+		}
+		jirix.Logger.Infof("Project %q overridden by %s\n", project.Name, jiri.JiriLocalManifestFile)
+		delete(ld.Projects, key)
+		ld.Projects[project.Key()] = project
+	}
+	return nil
+}
+
 func (ld *loader) cloneManifestRepo(jirix *jiri.X, remote *Import, cacheDirPath string, localManifest bool) error {
 	if !ld.update || localManifest {
 		jirix.Logger.Warningf("import %q not found locally, getting from server. Please check your manifest file (default: .jiri_manifest).\nMake sure that the 'name' attributes on the 'import' and 'project' tags match and that there is a corresponding 'project' tag for every 'import' tag.\n\n", remote.Name)
 	}
+	if jirix.Offline {
+		return fmt.Errorf("import %q not found locally and cannot be cloned in offline mode, run without -offline", remote.Name)
+	}
+	if jirix.DryRun {
+		return fmt.Errorf("import %q not found locally and cannot be cloned in a dry run, run without -dry-run", remote.Name)
+	}
 	jirix.Logger.Debugf("clone manifest project %q", remote.Name)
 	// The remote manifest project doesn't exist locally.  Clone it into a
 	// temp directory, and add it to ld.localProjects.
@@ -311,6 +439,14 @@ func (ld *loader) load(jirix *jiri.X, root, repoPath, file, ref, parentImport st
 	if err != nil {
 		return err
 	}
+	// Only the root manifest and its local imports can reference variables,
+	// as manifests imported from remotes must not be able to read the
+	// environment, e.g. to send credentials to a host of their choosing.
+	if parentImport == "" {
+		if err := m.expandVars(jirix.Env()); err != nil {
+			return fmt.Errorf("Error reading from manifest file %s %s:%s:error(%s)", repoPath, ref, file, err)
+		}
+	}
 
 	// Process remote imports.
 	for _, remote := range m.Imports {
@@ -324,6 +460,10 @@ func (ld *loader) load(jirix *jiri.X, root, repoPath, file, ref, parentImport st
 		}
 
 		if !ok {
+			if ld.skipMissingImports {
+				jirix.Logger.Warningf("import %q not found locally, skipping it and the manifests it imports\n\n", remote.Name)
+				continue
+			}
 			if err := ld.cloneManifestRepo(jirix, &remote, cacheDirPath, localManifest); err != nil {
 				return err
 			}
@@ -348,6 +488,12 @@ func (ld *loader) load(jirix *jiri.X, root, repoPath, file, ref, parentImport st
 	// Process local imports.
 	for _, local := range m.LocalImports {
 		nextFile := filepath.Join(filepath.Dir(file), local.File)
+		ld.Imports = append(ld.Imports, ManifestImport{
+			Depth:    len(ld.cycleStack),
+			Type:     "local",
+			File:     shortFileName(jirix.Root, "", nextFile, ""),
+			Revision: ld.resolveRef(jirix, repoPath, ref),
+		})
 		if err := ld.Load(jirix, root, repoPath, nextFile, ref, "", parentImport, localManifest); err != nil {
 			return err
 		}
@@ -389,7 +535,7 @@ func (ld *loader) load(jirix *jiri.X, root, repoPath, file, ref, parentImport st
 			}
 		}
 
-		if dup, ok := ld.Projects[key]; ok && dup != project {
+		if dup, ok := ld.Projects[key]; ok && !reflect.DeepEqual(dup, project) {
 			// TODO(toddw): Tell the user the other conflicting file.
 			return fmt.Errorf("duplicate project %q found in %q", key, shortFileName(jirix.Root, repoPath, file, ref))
 		}
@@ -415,12 +561,21 @@ func (ld *loader) load(jirix *jiri.X, root, repoPath, file, ref, parentImport st
 
 			project := ld.Projects[key]
 			project.update(&override)
+			if err := project.validate(); err != nil {
+				return err
+			}
 			ld.Projects[key] = project
 		}
 	} else if len(m.Overrides) != 0 {
 		return fmt.Errorf("manifest %q contains overrides but was imported by %q. Overrides are allowed only in the root manifest.", shortFileName(jirix.Root, repoPath, file, ref), parentImport)
 	}
 
+	if parentImport == "" {
+		ld.removes = append(ld.removes, m.Removes...)
+	} else if len(m.Removes) != 0 {
+		return fmt.Errorf("manifest %q contains removes but was imported by %q. Removes are allowed only in the root manifest.", shortFileName(jirix.Root, repoPath, file, ref), parentImport)
+	}
+
 	for _, hook := range m.Hooks {
 		if hook.ActionPath == "" {
 			return fmt.Errorf("invalid hook %q for project %q. Please make sure you are importing project %q and this hook is in the manifest which directly/indirectly imports that project.", hook.Name, hook.ProjectName, hook.ProjectName)
@@ -429,15 +584,62 @@ func (ld *loader) load(jirix *jiri.X, root, repoPath, file, ref, parentImport st
 		ld.Hooks[key] = hook
 	}
 
+	if parentImport == "" {
+		// All imports have been loaded, hooks inherit the environment of the
+		// project they run in.
+		envs := map[string][]EnvVar{}
+		for _, project := range ld.Projects {
+			envs[project.Path], _ = project.envVars()
+		}
+		for key, hook := range ld.Hooks {
+			hook.Env = envs[hook.ActionPath]
+			ld.Hooks[key] = hook
+		}
+	}
+
 	for _, pkg := range m.Packages {
 		key := pkg.Key()
 		ld.Packages[key] = pkg
 	}
+
+	// Apply removes once the root manifest, and so every import, is loaded.
+	if len(ld.cycleStack) == 1 {
+		return ld.applyRemoves(jirix)
+	}
+	return nil
+}
+
+// applyRemoves drops the projects named by the <remove> elements of the root
+// manifest, along with their hooks.  Removes which match no project are
+// reported but not an error.
+func (ld *loader) applyRemoves(jirix *jiri.X) error {
+	for _, remove := range ld.removes {
+		found := false
+		for key, p := range ld.Projects {
+			if p.Name != remove.Name {
+				continue
+			}
+			if _, ok := ld.importProjects[key]; ok {
+				return fmt.Errorf("cannot remove project %q because the project contains an imported manifest", key)
+			}
+			for hookKey, hook := range ld.Hooks {
+				if hook.ActionPath == p.Path {
+					delete(ld.Hooks, hookKey)
+				}
+			}
+			delete(ld.Projects, key)
+			found = true
+		}
+		if !found {
+			jirix.Logger.Warningf("Project %q to remove not found in manifest\n\n", remove.Name)
+		}
+	}
+	ld.removes = nil
 	return nil
 }
 
 func (ld *loader) loadImport(jirix *jiri.X, root, file, cycleKey, cacheDirPath, parentImport string, project Project, localManifest bool) (e error) {
-	lm := localManifest
+	lm := localManifest || ld.isLocalManifest(jirix, project)
 	ref := ""
 
 	if v, ok := ld.importCacheMap[strings.Trim(project.Remote, "/")]; ok {
@@ -458,11 +660,12 @@ func (ld *loader) loadImport(jirix *jiri.X, root, file, cycleKey, cacheDirPath,
 		// We don't need to fetch or find ref for local manifest changes
 		if !lm {
 			// We only fetch on updates.
-			if ld.update {
+			if ld.update && !jirix.Offline {
 				// Fetch only if project not pinned or revision not available in
 				// local git as we anyways update all the projects later.
-				fetch := true
-				if project.Revision != "" && project.Revision != "HEAD" {
+				// A dry run uses what was fetched last.
+				fetch := !jirix.DryRun
+				if fetch && project.Revision != "" && project.Revision != "HEAD" {
 					if _, err := gitutil.New(jirix, gitutil.RootDirOpt(project.Path)).Show(project.Revision, ""); err == nil {
 						fetch = false
 					}
@@ -498,9 +701,33 @@ func (ld *loader) loadImport(jirix *jiri.X, root, file, cycleKey, cacheDirPath,
 			parentImport:  parentImport,
 		}
 	}
+	imp := ManifestImport{
+		Depth:  len(ld.cycleStack),
+		Type:   "remote",
+		File:   file,
+		Remote: project.Remote,
+	}
+	if lm {
+		imp.File = shortFileName(jirix.Root, "", filepath.Join(project.Path, file), "")
+	} else {
+		imp.Revision = ld.resolveRef(jirix, project.Path, ref)
+	}
+	ld.Imports = append(ld.Imports, imp)
 	if lm {
 		// load from local checked out file
 		return ld.Load(jirix, root, "", filepath.Join(project.Path, file), "", cycleKey, parentImport, false)
 	}
 	return ld.Load(jirix, root, project.Path, file, ref, cycleKey, parentImport, false)
 }
+
+// resolveRef returns the revision ref points to in the repository at
+// repoPath, or ref itself if it cannot be resolved.
+func (ld *loader) resolveRef(jirix *jiri.X, repoPath, ref string) string {
+	if repoPath == "" || ref == "" {
+		return ref
+	}
+	if rev, err := gitutil.New(jirix, gitutil.RootDirOpt(repoPath)).CurrentRevisionForRef(ref); err == nil {
+		return rev
+	}
+	return ref
+}
@@ -38,6 +38,7 @@ type Manifest struct {
 	Imports      []Import      `xml:"imports>import"`
 	LocalImports []LocalImport `xml:"imports>localimport"`
 	Projects     []Project     `xml:"projects>project"`
+	Removes      []Remove      `xml:"projects>remove"`
 	Overrides    []Project     `xml:"overrides>project"`
 	Hooks        []Hook        `xml:"hooks>hook"`
 	Packages     []Package     `xml:"packages>package"`
@@ -90,12 +91,15 @@ var (
 	endElemBytes        = []byte("/>\n")
 	endImportBytes      = []byte("></import>\n")
 	endLocalImportBytes = []byte("></localimport>\n")
+	endRemoveBytes      = []byte("></remove>\n")
 	endProjectBytes     = []byte("></project>\n")
 	endHookBytes        = []byte("></hook>\n")
 	endPackageBytes     = []byte("></package>\n")
+	endEnvBytes         = []byte("></env>\n")
 
 	endImportSoloBytes  = []byte("></import>")
 	endProjectSoloBytes = []byte("></project>")
+	endEnvSoloBytes     = []byte("></env>")
 	endElemSoloBytes    = []byte("/>")
 
 	errGitHookNotRequired = errors.New("git hooks are not required")
@@ -111,6 +115,7 @@ func (m *Manifest) deepCopy() *Manifest {
 	x.Imports = append([]Import(nil), m.Imports...)
 	x.LocalImports = append([]LocalImport(nil), m.LocalImports...)
 	x.Projects = append([]Project(nil), m.Projects...)
+	x.Removes = append([]Remove(nil), m.Removes...)
 	x.Overrides = append([]Project(nil), m.Overrides...)
 	x.Hooks = append([]Hook(nil), m.Hooks...)
 	x.Packages = append([]Package(nil), m.Packages...)
@@ -137,9 +142,11 @@ func (m *Manifest) ToBytes() ([]byte, error) {
 	data = bytes.Replace(data, emptyPackagesBytes, newlineBytes, -1)
 	data = bytes.Replace(data, endImportBytes, endElemBytes, -1)
 	data = bytes.Replace(data, endLocalImportBytes, endElemBytes, -1)
+	data = bytes.Replace(data, endRemoveBytes, endElemBytes, -1)
 	data = bytes.Replace(data, endProjectBytes, endElemBytes, -1)
 	data = bytes.Replace(data, endHookBytes, endElemBytes, -1)
 	data = bytes.Replace(data, endPackageBytes, endElemBytes, -1)
+	data = bytes.Replace(data, endEnvBytes, endElemBytes, -1)
 	if !bytes.HasSuffix(data, newlineBytes) {
 		data = append(data, '\n')
 	}
@@ -220,6 +227,23 @@ func (m *Manifest) unfillDefaults() error {
 	return nil
 }
 
+// expandVars expands ${VAR} references in the attributes of the projects and
+// overrides of the manifest with the values in env.  Manifests are only
+// expanded when loaded, so that writing them back keeps the references.
+func (m *Manifest) expandVars(env map[string]string) error {
+	for index := range m.Projects {
+		if err := m.Projects[index].expandVars(env); err != nil {
+			return err
+		}
+	}
+	for index := range m.Overrides {
+		if err := m.Overrides[index].expandVars(env); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Import represents a remote manifest import.
 type Import struct {
 	// Manifest file to use from the remote manifest project.
@@ -295,7 +319,7 @@ func (i *Import) projectKeyFileName() string {
 	return fmt.Sprintf("%s_%x", i.Name, hash.Sum64())
 }
 
-// cycleKey returns a key based on the remote and manifest, used for
+// cycleKey returns a key based on the remote, manifest and revision, used for
 // cycle-detection.  It's only valid for new-style remote imports; it's empty
 // for the old-style local imports.
 func (i *Import) cycleKey() string {
@@ -307,7 +331,11 @@ func (i *Import) cycleKey() string {
 	//   remote:   https://foo.com/a/b    remote:   https://foo.com/a
 	//   manifest: c                      manifest: b/c
 	// In both cases, the key would be https://foo.com/a/b/c.
-	return i.Remote + " + " + i.Manifest
+	key := i.Remote + " + " + i.Manifest
+	if i.Revision != "" && i.Revision != "HEAD" {
+		key += "@" + i.Revision
+	}
+	return key
 }
 
 // LocalImport represents a local manifest import.
@@ -317,6 +345,14 @@ type LocalImport struct {
 	XMLName struct{} `xml:"localimport"`
 }
 
+// Remove drops a project contributed by an imported manifest.  It is only
+// allowed in the root manifest and is applied once all imports are loaded.
+type Remove struct {
+	// Name of the project to remove.
+	Name    string   `xml:"name,attr,omitempty"`
+	XMLName struct{} `xml:"remove"`
+}
+
 func (i *LocalImport) validate() error {
 	if i.File == "" {
 		return fmt.Errorf("bad localimport: must specify file: %+v", *i)
@@ -369,7 +405,7 @@ func (lc *LocalConfig) ToFile(jirix *jiri.X, filename string) error {
 }
 
 func WriteLocalConfig(jirix *jiri.X, project Project, lc LocalConfig) error {
-	configFile := filepath.Join(project.Path, jiri.ProjectMetaDir, jiri.ProjectConfigFile)
+	configFile := filepath.Join(metadataDir(project.Path), jiri.ProjectConfigFile)
 	return lc.ToFile(jirix, configFile)
 }
 
@@ -378,8 +414,13 @@ type Hook struct {
 	Name        string   `xml:"name,attr"`
 	Action      string   `xml:"action,attr"`
 	ProjectName string   `xml:"project,attr"`
+	RunAfter    string   `xml:"runafter,attr,omitempty"`
+	Args        string   `xml:"args,attr,omitempty"`
+	ArgList     []string `xml:"arg,omitempty"`
+	Cwd         string   `xml:"cwd,attr,omitempty"`
 	XMLName     struct{} `xml:"hook"`
 	ActionPath  string   `xml:"-"`
+	Env         []EnvVar `xml:"-"`
 }
 
 // HookKey is a unique string for a project.
@@ -397,6 +438,23 @@ func MakeHookKey(name, projectName string) HookKey {
 	return HookKey(name + KeySeparator + projectName)
 }
 
+// runAfter returns the names of the hooks listed in the runafter attribute.
+func (h Hook) runAfter() []string {
+	var names []string
+	for _, name := range strings.Split(h.RunAfter, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// arguments returns the arguments of the hook action: the space separated
+// args attribute followed by the <arg> children.
+func (h Hook) arguments() []string {
+	return append(strings.Fields(h.Args), h.ArgList...)
+}
+
 func (h *Hook) validate() error {
 	if strings.Contains(h.Name, KeySeparator) {
 		return fmt.Errorf("bad hook: name cannot contain %q: %+v", KeySeparator, *h)
@@ -404,9 +462,41 @@ func (h *Hook) validate() error {
 	if strings.Contains(h.ProjectName, KeySeparator) {
 		return fmt.Errorf("bad hook: project cannot contain %q: %+v", KeySeparator, *h)
 	}
+	if h.Cwd != "" {
+		if filepath.IsAbs(h.Cwd) || isOutsideDir(filepath.Clean(h.Cwd)) {
+			return fmt.Errorf("bad hook: cwd must be a directory inside the project: %+v", *h)
+		}
+	}
 	return nil
 }
 
+// isOutsideDir returns true if the cleaned relative path rel leaves the
+// directory it is relative to.
+func isOutsideDir(rel string) bool {
+	return rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// hookDir returns the directory hook runs in, which is its project directory
+// or the cwd directory inside it.  Symlinks are resolved so that cwd can not
+// leave the project through them.
+func hookDir(hook Hook) (string, error) {
+	if hook.Cwd == "" {
+		return hook.ActionPath, nil
+	}
+	root, err := filepath.EvalSymlinks(hook.ActionPath)
+	if err != nil {
+		return "", fmtError(err)
+	}
+	dir, err := filepath.EvalSymlinks(filepath.Join(hook.ActionPath, hook.Cwd))
+	if err != nil {
+		return "", fmtError(err)
+	}
+	if rel, err := filepath.Rel(root, dir); err != nil || isOutsideDir(rel) {
+		return "", fmt.Errorf("cwd %q of hook(%s) for project %q is outside of the project", hook.Cwd, hook.Name, hook.ProjectName)
+	}
+	return dir, nil
+}
+
 // HooksByName implements the Sort interface. It sorts Hooks by the Name
 // and ProjectName field.
 type HooksByName []Hook
@@ -564,7 +654,9 @@ func (ld *loader) enforceLocks(jirix *jiri.X) error {
 	enforceProjLocks := func(jirix *jiri.X) (err error) {
 		for _, v := range ld.Projects {
 			if projectLock, ok := ld.ProjectLocks[ProjectLockKey(v.Key())]; ok {
-				if v.Revision == "" {
+				// "HEAD", which imports default to, tracks the remote
+				// branch just like an empty revision.
+				if v.Revision == "" || v.Revision == "HEAD" {
 					v.Revision = projectLock.Revision
 					ld.Projects[v.Key()] = v
 				} else if v.Revision != projectLock.Revision {
@@ -580,7 +672,12 @@ func (ld *loader) enforceLocks(jirix *jiri.X) error {
 	if err := enforceProjLocks(jirix); err != nil {
 		return err
 	}
+	return ld.enforcePackageLocks(jirix)
+}
 
+// enforcePackageLocks fills in the instance IDs of loaded packages using the
+// package locks read from lockfiles.
+func (ld *loader) enforcePackageLocks(jirix *jiri.X) error {
 	usedPkgLocks := make(map[PackageLockKey]bool)
 	for k := range ld.PackageLocks {
 		usedPkgLocks[k] = false
@@ -632,6 +729,11 @@ func LoadManifestFile(jirix *jiri.X, file string, localProjects Projects, localM
 		return nil, nil, nil, err
 	}
 	jirix.AddCleanupFunc(ld.cleanup)
+	if file == jirix.JiriManifestFile() {
+		if err := ld.applyLocalOverrides(jirix); err != nil {
+			return nil, nil, nil, err
+		}
+	}
 	if jirix.LockfileEnabled {
 		if err := ld.enforceLocks(jirix); err != nil {
 			return nil, nil, nil, err
@@ -640,8 +742,33 @@ func LoadManifestFile(jirix *jiri.X, file string, localProjects Projects, localM
 	return ld.Projects, ld.Hooks, ld.Packages, nil
 }
 
+// loadPackageInstances loads the packages in the .jiri_manifest file with
+// instance IDs filled in from lockfiles, regardless of whether lockfiles are
+// enabled.  Project locks are not enforced.
+func loadPackageInstances(jirix *jiri.X, localProjects Projects, localManifest bool) (Packages, error) {
+	if jirix.LockfileName == "" {
+		return nil, nil
+	}
+	enableLockfile := jirix.LockfileEnabled
+	jirix.LockfileEnabled = true
+	defer func() {
+		jirix.LockfileEnabled = enableLockfile
+	}()
+	file := jirix.JiriManifestFile()
+	ld := newManifestLoader(localProjects, false, file)
+	if err := ld.Load(jirix, "", "", file, "", "", "", localManifest); err != nil {
+		return nil, err
+	}
+	jirix.AddCleanupFunc(ld.cleanup)
+	if err := ld.enforcePackageLocks(jirix); err != nil {
+		return nil, err
+	}
+	return ld.Packages, nil
+}
+
 // LoadUpdatedManifest loads an updated manifest starting with the .jiri_manifest file for localProjects. It will use
-// local manifest files instead of manifest files in remote repositories if localManifest is set to true.
+// local manifest files instead of manifest files in remote repositories if localManifest is set to true, or only for
+// the imported manifest projects named by jirix.LocalManifests otherwise.
 func LoadUpdatedManifest(jirix *jiri.X, localProjects Projects, localManifest bool) (Projects, Hooks, Packages, error) {
 	jirix.TimerPush("load updated manifest")
 	defer jirix.TimerPop()
@@ -649,7 +776,13 @@ func LoadUpdatedManifest(jirix *jiri.X, localProjects Projects, localManifest bo
 	if err := ld.Load(jirix, "", "", jirix.JiriManifestFile(), "", "", "", localManifest); err != nil {
 		return nil, nil, nil, err
 	}
+	if !localManifest {
+		ld.warnUnusedLocalManifests(jirix)
+	}
 	jirix.AddCleanupFunc(ld.cleanup)
+	if err := ld.applyLocalOverrides(jirix); err != nil {
+		return nil, nil, nil, err
+	}
 	if jirix.LockfileEnabled {
 		if err := ld.enforceLocks(jirix); err != nil {
 			return nil, nil, nil, err
@@ -658,6 +791,38 @@ func LoadUpdatedManifest(jirix *jiri.X, localProjects Projects, localManifest bo
 	return ld.Projects, ld.Hooks, ld.Packages, nil
 }
 
+// LoadManifestImports loads the manifest starting with the .jiri_manifest
+// file and returns the manifests loaded while resolving its imports, in the
+// order they were loaded.  Local projects are used to resolve remote imports.
+func LoadManifestImports(jirix *jiri.X, localProjects Projects, localManifest bool) ([]ManifestImport, error) {
+	file := jirix.JiriManifestFile()
+	ld := newManifestLoader(localProjects, false, file)
+	ld.Imports = append(ld.Imports, ManifestImport{Type: "root", File: file})
+	if err := ld.Load(jirix, "", "", file, "", "", "", localManifest); err != nil {
+		return nil, err
+	}
+	jirix.AddCleanupFunc(ld.cleanup)
+	return ld.Imports, nil
+}
+
+// LoadManifestImportProjects returns the projects holding the manifest
+// repositories imported, directly or transitively, by the .jiri_manifest
+// file.  Only repositories among localProjects are returned: the others are
+// skipped with a warning, along with the manifests they import.
+func LoadManifestImportProjects(jirix *jiri.X, localProjects Projects) (Projects, error) {
+	file := jirix.JiriManifestFile()
+	ld := newManifestLoader(localProjects, false, file)
+	ld.skipMissingImports = true
+	if err := ld.Load(jirix, "", "", file, "", "", "", false); err != nil {
+		return nil, err
+	}
+	projects := make(Projects)
+	for key := range ld.importProjects {
+		projects[key] = localProjects[key]
+	}
+	return projects, nil
+}
+
 // resovlePackageLocks resolves instance ids using versions described in given
 // pkgs using cipd.
 func resolvePackageLocks(jirix *jiri.X, pkgs Packages) (PackageLocks, error) {
@@ -725,7 +890,9 @@ func FetchPackages(jirix *jiri.X, pkgs Packages, fetchTimeout uint) error {
 		defer os.Remove(versionFilePath)
 	}
 
-	if err := cipd.Ensure(jirix, ensureFilePath, jirix.Root, fetchTimeout); err != nil {
+	err = cipd.Ensure(jirix, ensureFilePath, jirix.Root, fetchTimeout)
+	recordPackages(jirix, pkgs, pkgsWAccess, err)
+	if err != nil {
 		return err
 	}
 
@@ -752,6 +919,29 @@ func FetchPackages(jirix *jiri.X, pkgs Packages, fetchTimeout uint) error {
 	return nil
 }
 
+// recordPackages records in jirix.UpdateResult that the packages in pkgsWA
+// were fetched, or failed to be fetched if err is not nil, and that the other
+// packages in pkgs were skipped for lack of access.
+func recordPackages(jirix *jiri.X, pkgs, pkgsWA Packages, err error) {
+	if jirix.UpdateResult == nil {
+		return
+	}
+	for key, pkg := range pkgs {
+		status := jiri.ResultOK
+		if _, ok := pkgsWA[key]; !ok {
+			status = jiri.ResultSkipped
+		} else if err != nil {
+			status = jiri.ResultFailed
+		}
+		jirix.UpdateResult.AddPackage(jiri.PackageResult{
+			Name:    pkg.Name,
+			Version: pkg.Version,
+			Path:    pkg.Path,
+			Status:  status,
+		})
+	}
+}
+
 // WritePackageFlags write flag files into project directory using in "flag"
 // attribute from pkgs.
 func WritePackageFlags(jirix *jiri.X, pkgs, pkgsWA Packages) error {
@@ -856,8 +1046,16 @@ func generateEnsureFile(jirix *jiri.X, pkgs Packages, ignoreCryptoCheck bool) (s
 			}
 		}
 
-		for _, plat := range allPlats {
-			ensureFileBuf.WriteString(fmt.Sprintf("$VerifiedPlatform %s\n", plat))
+		// The ensure file only depends on the manifest, not on the
+		// host or on map iteration order, so that the packages resolve
+		// to the same lockfile everywhere.
+		var platNames []string
+		for name := range allPlats {
+			platNames = append(platNames, name)
+		}
+		sort.Strings(platNames)
+		for _, name := range platNames {
+			ensureFileBuf.WriteString(fmt.Sprintf("$VerifiedPlatform %s\n", allPlats[name]))
 		}
 		versionFileName := ensureFilePath[:len(ensureFilePath)-len(".ensure")] + ".version"
 		ensureFileBuf.WriteString("$ResolvedVersions " + versionFileName + "\n")
@@ -865,8 +1063,13 @@ func generateEnsureFile(jirix *jiri.X, pkgs Packages, ignoreCryptoCheck bool) (s
 	ensureFileBuf.WriteString("$ParanoidMode CheckPresence\n")
 	ensureFileBuf.WriteString("\n")
 
-	for _, pkg := range pkgs {
-
+	var keys []string
+	for key := range pkgs {
+		keys = append(keys, string(key))
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		pkg := pkgs[PackageKey(key)]
 		cipdDecl, err := pkg.cipdDecl(jirix.UsingSnapshot)
 		if err != nil {
 			return "", err
@@ -948,13 +1151,102 @@ func generateVersionFile(jirix *jiri.X, ensureFile string, pkgs Packages) (strin
 	return versionFileName, ioutil.WriteFile(versionFileName, versionFileBuf.Bytes(), 0655)
 }
 
-// RunHooks runs all given hooks.
+// OfflineEnv is the environment variable set for hooks when jiri runs in
+// offline mode.
+const OfflineEnv = "JIRI_OFFLINE"
+
+// hookDependencies returns the keys of the hooks that each hook runs after, as
+// given by its runafter attribute.  It fails if a hook runs after an unknown
+// hook, or if hooks run after each other in a cycle.
+func hookDependencies(hooks Hooks) (map[HookKey][]HookKey, error) {
+	byName := make(map[string][]HookKey)
+	var keys []string
+	for key, hook := range hooks {
+		byName[hook.Name] = append(byName[hook.Name], key)
+		keys = append(keys, string(key))
+	}
+	sort.Strings(keys)
+	deps := make(map[HookKey][]HookKey)
+	for _, key := range keys {
+		hook := hooks[HookKey(key)]
+		for _, name := range hook.runAfter() {
+			depKeys, ok := byName[name]
+			if !ok {
+				return nil, fmt.Errorf("hook(%s) for project %q runs after unknown hook %q", hook.Name, hook.ProjectName, name)
+			}
+			deps[hook.Key()] = append(deps[hook.Key()], depKeys...)
+		}
+	}
+
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := make(map[HookKey]int)
+	var stack []HookKey
+	var visit func(key HookKey) error
+	visit = func(key HookKey) error {
+		switch state[key] {
+		case visiting:
+			var cycle []string
+			for i := len(stack) - 1; i >= 0; i-- {
+				cycle = append([]string{hooks[stack[i]].Name}, cycle...)
+				if stack[i] == key {
+					break
+				}
+			}
+			cycle = append(cycle, hooks[key].Name)
+			return fmt.Errorf("hooks have cyclic runafter dependencies: %s", strings.Join(cycle, " -> "))
+		case visited:
+			return nil
+		}
+		state[key] = visiting
+		stack = append(stack, key)
+		for _, dep := range deps[key] {
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[key] = visited
+		return nil
+	}
+	for _, key := range keys {
+		if err := visit(HookKey(key)); err != nil {
+			return nil, err
+		}
+	}
+	return deps, nil
+}
+
+// hookLogFile returns the path of the file the output of hook is logged to
+// when jirix.LogHooks is set.
+func hookLogFile(jirix *jiri.X, hook Hook) string {
+	return filepath.Join(jirix.HookLogsDir(), hook.ProjectName, hook.Name+".log")
+}
+
+// RunHooks runs all given hooks.  A hook runs only once all the hooks listed
+// in its runafter attribute have completed successfully, and at most
+// jirix.Jobs hooks run at the same time.  If jirix.LogHooks is set, the
+// output of each hook is also written to its log file, after the logs of
+// the previous run are removed.
 func RunHooks(jirix *jiri.X, hooks Hooks, runHookTimeout uint) error {
 	jirix.TimerPush("run hooks")
 	defer jirix.TimerPop()
+	deps, err := hookDependencies(hooks)
+	if err != nil {
+		return err
+	}
+	if jirix.LogHooks {
+		if err := os.RemoveAll(jirix.HookLogsDir()); err != nil {
+			return fmtError(err)
+		}
+	}
 	type result struct {
+		key     HookKey
 		outFile *os.File
 		errFile *os.File
+		logFile string
 		err     error
 	}
 	ch := make(chan result)
@@ -963,53 +1255,131 @@ func RunHooks(jirix *jiri.X, hooks Hooks, runHookTimeout uint) error {
 		return fmt.Errorf("not able to create tmp dir: %v", err)
 	}
 	defer os.RemoveAll(tmpDir)
-	for _, hook := range hooks {
-		go func(hook Hook) {
-			logStr := fmt.Sprintf("running hook(%s) for project %q", hook.Name, hook.ProjectName)
-			jirix.Logger.Debugf(logStr)
-			task := jirix.Logger.AddTaskMsg(logStr)
-			defer task.Done()
-			outFile, err := ioutil.TempFile(tmpDir, hook.Name+"-out")
-			if err != nil {
-				ch <- result{nil, nil, fmtError(err)}
+	runHook := func(hook Hook) {
+		logStr := fmt.Sprintf("running hook(%s) for project %q", hook.Name, hook.ProjectName)
+		jirix.Logger.Debugf(logStr)
+		task := jirix.Logger.AddTaskMsg(logStr)
+		defer task.Done()
+		start := time.Now()
+		send := func(r result) {
+			jirix.UpdateResult.AddHook(hook.Name, hook.ProjectName, time.Since(start), r.err)
+			ch <- r
+		}
+		outFile, err := ioutil.TempFile(tmpDir, hook.Name+"-out")
+		if err != nil {
+			send(result{hook.Key(), nil, nil, "", fmtError(err)})
+			return
+		}
+		errFile, err := ioutil.TempFile(tmpDir, hook.Name+"-err")
+		if err != nil {
+			send(result{hook.Key(), nil, nil, "", fmtError(err)})
+			return
+		}
+
+		var stdout, stderr io.Writer = outFile, errFile
+		logFile := ""
+		if jirix.LogHooks {
+			logFile = hookLogFile(jirix, hook)
+			if err := os.MkdirAll(filepath.Dir(logFile), 0755); err != nil {
+				send(result{hook.Key(), nil, nil, "", fmtError(err)})
 				return
 			}
-			errFile, err := ioutil.TempFile(tmpDir, hook.Name+"-err")
+			logOut, err := os.Create(logFile)
 			if err != nil {
-				ch <- result{nil, nil, fmtError(err)}
+				send(result{hook.Key(), nil, nil, "", fmtError(err)})
 				return
 			}
+			defer logOut.Close()
+			stdout = io.MultiWriter(outFile, logOut)
+			stderr = io.MultiWriter(errFile, logOut)
+		}
 
-			fmt.Fprintf(outFile, "output for hook(%v) for project %q\n", hook.Name, hook.ProjectName)
-			fmt.Fprintf(errFile, "Error for hook(%v) for project %q\n", hook.Name, hook.ProjectName)
-			cmdLine := filepath.Join(hook.ActionPath, hook.Action)
-			err = retry.Function(jirix, func() error {
-				ctx, cancel := context.WithTimeout(context.Background(), time.Duration(runHookTimeout)*time.Minute)
-				defer cancel()
-				command := exec.CommandContext(ctx, cmdLine)
-				command.Dir = hook.ActionPath
-				command.Stdin = os.Stdin
-				command.Stdout = outFile
-				command.Stderr = errFile
-				env := jirix.Env()
-				command.Env = envvar.MapToSlice(env)
-				jirix.Logger.Tracef("Run: %q", cmdLine)
-				err = command.Run()
-				if ctx.Err() == context.DeadlineExceeded {
-					err = ctx.Err()
-				}
-				return err
-			}, fmt.Sprintf("running hook(%s) for project %s", hook.Name, hook.ProjectName),
-				retry.AttemptsOpt(jirix.Attempts))
-			ch <- result{outFile, errFile, err}
-		}(hook)
+		fmt.Fprintf(outFile, "output for hook(%v) for project %q\n", hook.Name, hook.ProjectName)
+		fmt.Fprintf(errFile, "Error for hook(%v) for project %q\n", hook.Name, hook.ProjectName)
+		cmdLine := filepath.Join(hook.ActionPath, hook.Action)
+		dir, err := hookDir(hook)
+		if err != nil {
+			send(result{hook.Key(), outFile, errFile, logFile, err})
+			return
+		}
+		args := hook.arguments()
+		err = retry.Function(jirix, func() error {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Duration(runHookTimeout)*time.Minute)
+			defer cancel()
+			command := exec.CommandContext(ctx, cmdLine, args...)
+			command.Dir = dir
+			command.Stdin = os.Stdin
+			command.Stdout = stdout
+			command.Stderr = stderr
+			env := mergeEnv(jirix.Env(), hook.Env)
+			if jirix.Offline {
+				// Let hooks know that they should not access the network.
+				env[OfflineEnv] = "1"
+			}
+			command.Env = envvar.MapToSlice(env)
+			jirix.Logger.Tracef("Run: %q %q in %s", cmdLine, args, dir)
+			err = command.Run()
+			if ctx.Err() == context.DeadlineExceeded {
+				err = ctx.Err()
+			}
+			return err
+		}, fmt.Sprintf("running hook(%s) for project %s", hook.Name, hook.ProjectName),
+			retry.AttemptsOpt(jirix.Attempts))
+		send(result{hook.Key(), outFile, errFile, logFile, err})
+	}
 
+	// pending counts the hooks each hook still waits for, or is -1 once the
+	// hook is skipped because one of them failed.
+	pending := make(map[HookKey]int)
+	dependents := make(map[HookKey][]HookKey)
+	var ready []HookKey
+	for _, hook := range hooks {
+		pending[hook.Key()] = len(deps[hook.Key()])
+		for _, dep := range deps[hook.Key()] {
+			dependents[dep] = append(dependents[dep], hook.Key())
+		}
+		if len(deps[hook.Key()]) == 0 {
+			ready = append(ready, hook.Key())
+		}
 	}
+	jobs := int(jirix.Jobs)
+	if jobs < 1 {
+		jobs = 1
+	}
+	running := 0
+	var skipped []result
+	var failedLogs []string
 
 	err = nil
 	timeout := false
 	for range hooks {
-		out := <-ch
+		for len(ready) > 0 && running < jobs {
+			go runHook(hooks[ready[0]])
+			ready = ready[1:]
+			running++
+		}
+		var out result
+		if len(skipped) > 0 {
+			out, skipped = skipped[0], skipped[1:]
+		} else {
+			out = <-ch
+			running--
+		}
+		for _, key := range dependents[out.key] {
+			if out.err != nil {
+				if pending[key] >= 0 {
+					pending[key] = -1
+					hook := hooks[key]
+					skipErr := fmt.Errorf("hook(%s) for project %q not run as hook(%s) for project %q failed", hook.Name, hook.ProjectName, hooks[out.key].Name, hooks[out.key].ProjectName)
+					jirix.UpdateResult.AddSkippedHook(hook.Name, hook.ProjectName, skipErr)
+					skipped = append(skipped, result{key: key, err: skipErr})
+				}
+			} else if pending[key] > 0 {
+				if pending[key]--; pending[key] == 0 {
+					ready = append(ready, key)
+				}
+			}
+		}
 		defer func() {
 			if out.outFile != nil {
 				out.outFile.Close()
@@ -1018,6 +1388,9 @@ func RunHooks(jirix *jiri.X, hooks Hooks, runHookTimeout uint) error {
 				out.errFile.Close()
 			}
 		}()
+		if out.err != nil && out.logFile != "" {
+			failedLogs = append(failedLogs, out.logFile)
+		}
 		if out.err == context.DeadlineExceeded {
 			timeout = true
 			out.outFile.Sync()
@@ -1052,6 +1425,9 @@ func RunHooks(jirix *jiri.X, hooks Hooks, runHookTimeout uint) error {
 	if timeout {
 		err = fmt.Errorf("%s Use %s flag to set timeout.", err, jirix.Color.Yellow("-hook-timeout"))
 	}
+	if err != nil && len(failedLogs) > 0 {
+		err = fmt.Errorf("%s See the logs of the failed hooks:\n  %s", err, strings.Join(failedLogs, "\n  "))
+	}
 	return err
 }
 
@@ -1128,6 +1504,9 @@ func applyGitHooks(jirix *jiri.X, ops []operation) error {
 	defer jirix.TimerPop()
 	commitMsgFetcher := commitMsgFetcher{}
 	for _, op := range ops {
+		if !op.Project().usesGit() {
+			continue
+		}
 		if op.Kind() != "delete" && !op.Project().LocalConfig.Ignore && !op.Project().LocalConfig.NoUpdate {
 			if op.Project().GerritHost != "" {
 				hookPath := filepath.Join(op.Project().Path, ".git", "hooks", "commit-msg")
@@ -7,17 +7,20 @@ package project
 import (
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
 	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/dahlia-os/jiri"
 	"github.com/dahlia-os/jiri/gitutil"
 	"github.com/dahlia-os/jiri/log"
 	"github.com/dahlia-os/jiri/osutil"
+	"github.com/dahlia-os/jiri/retry"
 )
 
 // fsUpdates is used to track filesystem updates made by operations.
@@ -56,6 +59,8 @@ type operation interface {
 	String() string
 	// Test checks whether the operation would fail.
 	Test(jirix *jiri.X, updates *fsUpdates) error
+	// localProject returns the project at its current location.
+	localProject() Project
 }
 
 // commonOperation represents a project operation.
@@ -76,6 +81,12 @@ func (op commonOperation) Project() Project {
 	return op.project
 }
 
+func (op commonOperation) localProject() Project {
+	project := op.project
+	project.Path = op.source
+	return project
+}
+
 // createOperation represents the creation of a project.
 type createOperation struct {
 	commonOperation
@@ -85,68 +96,177 @@ func (op createOperation) Kind() string {
 	return "create"
 }
 
-func (op createOperation) checkoutProject(jirix *jiri.X, cache string) error {
+// cloneTempPrefix returns the prefix of the temporary directories used to
+// clone a new project before it is moved to dir. The leading dot keeps local
+// project scans from descending into them.
+func cloneTempPrefix(dir string) string {
+	return "." + filepath.Base(dir) + ".jiri-tmp-"
+}
+
+// removeStaleCloneDirs removes temporary clone directories for dir left behind
+// by an interrupted update.
+func removeStaleCloneDirs(jirix *jiri.X, dir string) {
+	matches, err := filepath.Glob(filepath.Join(filepath.Dir(dir), cloneTempPrefix(dir)+"*"))
+	if err != nil {
+		return
+	}
+	for _, m := range matches {
+		jirix.Logger.Debugf("Removing stale clone directory %q", m)
+		if err := os.RemoveAll(m); err != nil {
+			jirix.Logger.Warningf("Not able to remove stale clone directory %q: %s", m, err)
+		}
+	}
+}
+
+func (op createOperation) checkoutProject(jirix *jiri.X, cache string) (e error) {
 	var err error
 	remote := rewriteRemote(jirix, op.project.Remote)
+	// project is the copy of op.project that gets checked out. New projects are
+	// cloned into a temporary sibling of the destination and only renamed into
+	// place once they are fully set up, so that an interrupted update never
+	// leaves a partial clone at the destination.
+	project := op.project
 	// Hack to make fuchsia.git happen
 	if op.destination == jirix.Root {
 		scm := gitutil.New(jirix, gitutil.RootDirOpt(op.project.Path))
 		if err = scm.Init(op.destination); err != nil {
 			return err
 		}
-		if err = scm.AddOrReplaceRemote("origin", remote); err != nil {
+		if err = scm.AddOrReplaceRemote(op.project.GitRemoteName(), remote); err != nil {
 			return err
 		}
 		// We must specify a refspec here in order for patch to be able to set
 		// upstream to 'origin/master'.
-		if err = scm.FetchRefspec(remote, "+refs/heads/*:refs/remotes/origin/*"); err != nil {
+		if err = scm.FetchRefspec(remote, "+refs/heads/*:refs/"+op.project.RemoteRef("*")); err != nil {
 			return err
 		}
 	} else {
+		tmpDir, err := ioutil.TempDir(filepath.Dir(op.destination), cloneTempPrefix(op.destination))
+		if err != nil {
+			return fmtError(err)
+		}
+		defer func() {
+			if e != nil {
+				if err := os.RemoveAll(tmpDir); err != nil {
+					jirix.Logger.Warningf("Not able to remove %q after create failed: %s", tmpDir, err)
+				}
+			}
+		}()
+		project.Path = tmpDir
+		origin := gitutil.OriginOpt(op.project.GitRemoteName())
 		// Shallow clones can not be used as as local git reference
-		if op.project.HistoryDepth > 0 && cache != "" {
-			err = clone(jirix, cache, op.destination, gitutil.NoCheckoutOpt(true), gitutil.DepthOpt(op.project.HistoryDepth))
+		if op.project.Partial {
+			// Partial clones fetch missing objects from their origin on
+			// demand, so they are created from the remote directly.
+			err = clone(jirix, remote, tmpDir, gitutil.NoCheckoutOpt(true), gitutil.FilterOpt(partialCloneFilter), origin)
+		} else if depth := op.project.cloneDepth(); depth > 0 && cache != "" {
+			err = clone(jirix, cache, tmpDir, gitutil.NoCheckoutOpt(true), gitutil.DepthOpt(depth), origin)
 		} else {
-			err = clone(jirix, remote, op.destination, gitutil.ReferenceOpt(cache),
-				gitutil.NoCheckoutOpt(true), gitutil.DepthOpt(op.project.HistoryDepth))
+			err = clone(jirix, remote, tmpDir, gitutil.ReferenceOpt(cache),
+				gitutil.NoCheckoutOpt(true), gitutil.DepthOpt(depth), origin)
+		}
+		if err != nil {
+			return err
 		}
-	}
-	if err != nil {
-		return err
 	}
 
-	if err := os.Chmod(op.destination, os.FileMode(0755)); err != nil {
+	if err := os.Chmod(project.Path, os.FileMode(0755)); err != nil {
 		return fmtError(err)
 	}
 
-	if err := checkoutHeadRevision(jirix, op.project, false); err != nil {
+	// The revision may only be reachable from the extra refspecs, so they are
+	// fetched before it is checked out.
+	if refspecs, _ := op.project.fetchRefspecs(); len(refspecs) > 0 {
+		if err := fetch(jirix, project.Path, remote, gitutil.RefspecsOpt(refspecs)); err != nil {
+			return err
+		}
+	}
+
+	if err := checkoutHeadRevision(jirix, project, false); err != nil {
 		return err
 	}
 
-	if err := writeMetadata(jirix, op.project, op.project.Path); err != nil {
+	if err := writeUpdatedMetadata(jirix, op.project, project.Path); err != nil {
 		return err
 	}
-	scm := gitutil.New(jirix, gitutil.RootDirOpt(op.project.Path))
+	scm := gitutil.New(jirix, gitutil.RootDirOpt(project.Path))
 
 	// Reset remote to point to correct location so that shared cache does not cause problem.
-	if err := scm.SetRemoteUrl("origin", remote); err != nil {
+	if err := scm.SetRemoteUrl(op.project.GitRemoteName(), remote); err != nil {
+		return err
+	}
+
+	// Submodule URLs relative to the project are resolved against the
+	// remote, so this must happen once it points to the project remote.
+	if err := updateSubmodules(jirix, project, ""); err != nil {
+		return err
+	}
+	if err := pullLFS(jirix, project, ""); err != nil {
 		return err
 	}
 
 	// Delete inital branch(es)
 	if branches, _, err := scm.GetBranches(); err != nil {
-		jirix.Logger.Warningf("not able to get branches for newly created project %s(%s)\n\n", op.project.Name, op.project.Path)
+		jirix.Logger.ProjectLogf(log.WarningLevel, op.project.Name, "not able to get branches for newly created project %s(%s)\n\n", op.project.Name, op.project.Path)
 	} else {
-		scm := gitutil.New(jirix, gitutil.RootDirOpt(op.project.Path))
 		for _, b := range branches {
 			if err := scm.DeleteBranch(b); err != nil {
-				jirix.Logger.Warningf("not able to delete branch %s for project %s(%s)\n\n", b, op.project.Name, op.project.Path)
+				jirix.Logger.ProjectLogf(log.WarningLevel, op.project.Name, "not able to delete branch %s for project %s(%s)\n\n", b, op.project.Name, op.project.Path)
 			}
 		}
 	}
+
+	if project.Path != op.destination {
+		if err := osutil.Rename(project.Path, op.destination); err != nil {
+			return fmtError(err)
+		}
+	}
 	return nil
 }
 
+// checkoutSCMProject clones a project which does not use git and checks it out
+// at its revision. There is no cache for such projects, so cache is ignored.
+func (op createOperation) checkoutSCMProject(jirix *jiri.X, cache string) (e error) {
+	if jirix.Offline {
+		return fmt.Errorf("cannot clone %s in offline mode, run without -offline", op.project.Remote)
+	}
+	tmpDir, err := ioutil.TempDir(filepath.Dir(op.destination), cloneTempPrefix(op.destination))
+	if err != nil {
+		return fmtError(err)
+	}
+	defer func() {
+		if e != nil {
+			if err := os.RemoveAll(tmpDir); err != nil {
+				jirix.Logger.Warningf("Not able to remove %q after create failed: %s", tmpDir, err)
+			}
+		}
+	}()
+	project := op.project
+	project.Path = tmpDir
+	scm := newSCM(jirix, project)
+	remote := rewriteRemote(jirix, op.project.Remote)
+	msg := fmt.Sprintf("Cloning %s", remote)
+	t := jirix.Logger.TrackTime(msg)
+	defer t.Done()
+	if err := retry.Function(jirix, func() error {
+		// Start over from an empty directory, which may be left behind
+		// with part of the clone by a previous attempt.
+		if err := os.RemoveAll(tmpDir); err != nil {
+			return fmtError(err)
+		}
+		return scm.Clone(remote, tmpDir)
+	}, msg, retry.AttemptsOpt(jirix.Attempts)); err != nil {
+		return err
+	}
+	if err := checkoutSCMRevision(jirix, project, false); err != nil {
+		return err
+	}
+	if err := writeUpdatedMetadata(jirix, op.project, tmpDir); err != nil {
+		return err
+	}
+	return fmtError(osutil.Rename(tmpDir, op.destination))
+}
+
 func (op createOperation) Run(jirix *jiri.X) (e error) {
 	path, perm := filepath.Dir(op.destination), os.FileMode(0755)
 
@@ -171,6 +291,7 @@ func (op createOperation) Run(jirix *jiri.X) (e error) {
 		if err := os.MkdirAll(path, perm); err != nil {
 			return fmtError(err)
 		}
+		removeStaleCloneDirs(jirix, op.destination)
 	}
 
 	cache, err := op.project.CacheDirPath(jirix)
@@ -181,7 +302,11 @@ func (op createOperation) Run(jirix *jiri.X) (e error) {
 		cache = ""
 	}
 
-	if err := op.checkoutProject(jirix, cache); err != nil {
+	checkout := op.checkoutProject
+	if !op.project.usesGit() {
+		checkout = op.checkoutSCMProject
+	}
+	if err := checkout(jirix, cache); err != nil {
 		if op.destination != jirix.Root {
 			if err := os.RemoveAll(op.destination); err != nil {
 				jirix.Logger.Warningf("Not able to remove %q after create failed: %s", op.destination, err)
@@ -211,35 +336,38 @@ func (op deleteOperation) Kind() string {
 
 func (op deleteOperation) Run(jirix *jiri.X) error {
 	if op.project.LocalConfig.Ignore {
-		jirix.Logger.Warningf("Project %s(%s) won't be deleted due to it's local-config\n\n", op.project.Name, op.source)
+		jirix.Logger.ProjectLogf(log.WarningLevel, op.project.Name, "Project %s(%s) won't be deleted due to it's local-config\n\n", op.project.Name, op.source)
 		return nil
 	}
 	// Never delete projects with non-master branches, uncommitted
 	// work, or untracked content.
-	scm := gitutil.New(jirix, gitutil.RootDirOpt(op.project.Path))
-	branches, _, err := scm.GetBranches()
-	if err != nil {
-		return fmt.Errorf("Cannot get branches for project %q: %s", op.Project().Name, err)
-	}
-	uncommitted, err := scm.HasUncommittedChanges()
+	scm := newSCM(jirix, op.project)
+	files, err := scm.FilesWithUncommittedChanges()
 	if err != nil {
 		return fmt.Errorf("Cannot get uncommited changes for project %q: %s", op.Project().Name, err)
 	}
+	uncommitted := len(files) != 0
 	untracked, err := scm.HasUntrackedFiles()
 	if err != nil {
 		return fmt.Errorf("Cannot get untracked changes for project %q: %s", op.Project().Name, err)
 	}
 	extraBranches := false
-	for _, branch := range branches {
-		if !strings.Contains(branch, "HEAD detached") {
-			extraBranches = true
-			break
+	if op.project.usesGit() {
+		branches, _, err := gitutil.New(jirix, gitutil.RootDirOpt(op.project.Path)).GetBranches()
+		if err != nil {
+			return fmt.Errorf("Cannot get branches for project %q: %s", op.Project().Name, err)
+		}
+		for _, branch := range branches {
+			if !strings.Contains(branch, "HEAD detached") {
+				extraBranches = true
+				break
+			}
 		}
 	}
 
 	if extraBranches || uncommitted || untracked {
 		rmCommand := jirix.Color.Yellow("rm -rf %q", op.source)
-		unManageCommand := jirix.Color.Yellow("rm -rf %q", filepath.Join(op.source, jiri.ProjectMetaDir))
+		unManageCommand := jirix.Color.Yellow("rm -rf %q", metadataDir(op.source))
 		msg := ""
 		if extraBranches {
 			msg = fmt.Sprintf("Project %q won't be deleted as it contains branches", op.project.Name)
@@ -314,6 +442,7 @@ type moveOperation struct {
 	rebaseUntracked bool
 	rebaseAll       bool
 	snapshot        bool
+	report          *updateReport
 }
 
 func (op moveOperation) Kind() string {
@@ -322,7 +451,7 @@ func (op moveOperation) Kind() string {
 
 func (op moveOperation) Run(jirix *jiri.X) error {
 	if op.project.LocalConfig.Ignore {
-		jirix.Logger.Warningf("Project %s(%s) won't be moved or updated  due to it's local-config\n\n", op.project.Name, op.source)
+		jirix.Logger.ProjectLogf(log.WarningLevel, op.project.Name, "Project %s(%s) won't be moved or updated  due to it's local-config\n\n", op.project.Name, op.source)
 		return nil
 	}
 	// If it was nested project it might have been moved with its parent project
@@ -335,10 +464,16 @@ func (op moveOperation) Run(jirix *jiri.X) error {
 			return fmtError(err)
 		}
 	}
-	if err := syncProjectMaster(jirix, op.project, op.state, op.rebaseTracked, op.rebaseUntracked, op.rebaseAll, op.snapshot); err != nil {
+	if err := syncProjectMaster(jirix, op.project, op.state, op.rebaseTracked, op.rebaseUntracked, op.rebaseAll, op.snapshot, op.report); err != nil {
 		return err
 	}
-	return writeMetadata(jirix, op.project, op.project.Path)
+	if err := updateSubmodules(jirix, op.project, op.state.CurrentBranch.Revision); err != nil {
+		return err
+	}
+	if err := pullLFS(jirix, op.project, op.state.CurrentBranch.Revision); err != nil {
+		return err
+	}
+	return writeUpdatedMetadata(jirix, op.project, op.project.Path)
 }
 
 func (op moveOperation) String() string {
@@ -370,6 +505,7 @@ type changeRemoteOperation struct {
 	rebaseUntracked bool
 	rebaseAll       bool
 	snapshot        bool
+	report          *updateReport
 }
 
 func (op changeRemoteOperation) Kind() string {
@@ -378,9 +514,20 @@ func (op changeRemoteOperation) Kind() string {
 
 func (op changeRemoteOperation) Run(jirix *jiri.X) error {
 	if op.project.LocalConfig.Ignore || op.project.LocalConfig.NoUpdate {
-		jirix.Logger.Warningf("Project %s(%s) won't be updated due to it's local-config. It has a changed remote\n\n", op.project.Name, op.project.Path)
+		jirix.Logger.ProjectLogf(log.WarningLevel, op.project.Name, "Project %s(%s) won't be updated due to it's local-config. It has a changed remote\n\n", op.project.Name, op.project.Path)
 		return nil
 	}
+	if !op.project.usesGit() {
+		// The new remote is fetched from directly, there is no remote to
+		// change.
+		if err := fetchAll(jirix, op.project); err != nil {
+			return err
+		}
+		if err := syncProjectMaster(jirix, op.project, op.state, op.rebaseTracked, op.rebaseUntracked, op.rebaseAll, op.snapshot, op.report); err != nil {
+			return err
+		}
+		return writeUpdatedMetadata(jirix, op.project, op.project.Path)
+	}
 	git := gitutil.New(jirix, gitutil.RootDirOpt(op.project.Path))
 	tempRemote := "new-remote-origin"
 	if err := git.AddRemote(tempRemote, op.project.Remote); err != nil {
@@ -415,7 +562,7 @@ func (op changeRemoteOperation) Run(jirix *jiri.X) error {
 	}
 
 	// Everything ok, change the remote url
-	if err := git.SetRemoteUrl("origin", op.project.Remote); err != nil {
+	if err := setRemote(jirix, op.project, op.project.Remote); err != nil {
 		return err
 	}
 
@@ -423,11 +570,17 @@ func (op changeRemoteOperation) Run(jirix *jiri.X) error {
 		return err
 	}
 
-	if err := syncProjectMaster(jirix, op.project, op.state, op.rebaseTracked, op.rebaseUntracked, op.rebaseAll, op.snapshot); err != nil {
+	if err := syncProjectMaster(jirix, op.project, op.state, op.rebaseTracked, op.rebaseUntracked, op.rebaseAll, op.snapshot, op.report); err != nil {
+		return err
+	}
+	if err := updateSubmodules(jirix, op.project, op.state.CurrentBranch.Revision); err != nil {
+		return err
+	}
+	if err := pullLFS(jirix, op.project, op.state.CurrentBranch.Revision); err != nil {
 		return err
 	}
 
-	return writeMetadata(jirix, op.project, op.project.Path)
+	return writeUpdatedMetadata(jirix, op.project, op.project.Path)
 }
 
 func (op changeRemoteOperation) String() string {
@@ -445,6 +598,7 @@ type updateOperation struct {
 	rebaseUntracked bool
 	rebaseAll       bool
 	snapshot        bool
+	report          *updateReport
 }
 
 func (op updateOperation) Kind() string {
@@ -452,10 +606,16 @@ func (op updateOperation) Kind() string {
 }
 
 func (op updateOperation) Run(jirix *jiri.X) error {
-	if err := syncProjectMaster(jirix, op.project, op.state, op.rebaseTracked, op.rebaseUntracked, op.rebaseAll, op.snapshot); err != nil {
+	if err := syncProjectMaster(jirix, op.project, op.state, op.rebaseTracked, op.rebaseUntracked, op.rebaseAll, op.snapshot, op.report); err != nil {
+		return err
+	}
+	if err := updateSubmodules(jirix, op.project, op.state.CurrentBranch.Revision); err != nil {
 		return err
 	}
-	return writeMetadata(jirix, op.project, op.project.Path)
+	if err := pullLFS(jirix, op.project, op.state.CurrentBranch.Revision); err != nil {
+		return err
+	}
+	return writeUpdatedMetadata(jirix, op.project, op.project.Path)
 }
 
 func (op updateOperation) String() string {
@@ -477,7 +637,13 @@ func (op nullOperation) Kind() string {
 }
 
 func (op nullOperation) Run(jirix *jiri.X) error {
-	return writeMetadata(jirix, op.project, op.project.Path)
+	if err := updateSubmodules(jirix, op.project, op.state.CurrentBranch.Revision); err != nil {
+		return err
+	}
+	if err := pullLFS(jirix, op.project, op.state.CurrentBranch.Revision); err != nil {
+		return err
+	}
+	return writeUpdatedMetadata(jirix, op.project, op.project.Path)
 }
 
 func (op nullOperation) String() string {
@@ -544,7 +710,7 @@ func (ops operations) Swap(i, j int) {
 // system and manifest file respectively) and outputs a collection of
 // operations that describe the actions needed to update the target
 // projects.
-func computeOperations(localProjects, remoteProjects Projects, states map[ProjectKey]*ProjectState, gc, rebaseTracked, rebaseUntracked, rebaseAll, snapshot bool) operations {
+func computeOperations(localProjects, remoteProjects Projects, states map[ProjectKey]*ProjectState, gc, rebaseTracked, rebaseUntracked, rebaseAll, snapshot bool, report *updateReport) operations {
 	result := operations{}
 	allProjects := map[ProjectKey]bool{}
 	for _, p := range localProjects {
@@ -570,13 +736,13 @@ func computeOperations(localProjects, remoteProjects Projects, states map[Projec
 		if s, ok := states[key]; ok {
 			state = s
 		}
-		result = append(result, computeOp(local, remote, state, gc, rebaseTracked, rebaseUntracked, rebaseAll, snapshot))
+		result = append(result, computeOp(local, remote, state, gc, rebaseTracked, rebaseUntracked, rebaseAll, snapshot, report))
 	}
 	sort.Sort(result)
 	return result
 }
 
-func computeOp(local, remote *Project, state *ProjectState, gc, rebaseTracked, rebaseUntracked, rebaseAll, snapshot bool) operation {
+func computeOp(local, remote *Project, state *ProjectState, gc, rebaseTracked, rebaseUntracked, rebaseAll, snapshot bool, report *updateReport) operation {
 	switch {
 	case local == nil && remote != nil:
 		return createOperation{commonOperation{
@@ -619,7 +785,7 @@ func computeOp(local, remote *Project, state *ProjectState, gc, rebaseTracked, r
 				project:     *remote,
 				source:      local.Path,
 				state:       *state,
-			}, rebaseTracked, rebaseUntracked, rebaseAll, snapshot}
+			}, rebaseTracked, rebaseUntracked, rebaseAll, snapshot, report}
 		case local.Path != remote.Path:
 			// moveOperation also does an update, so we don't need to check the
 			// revision here.
@@ -628,28 +794,28 @@ func computeOp(local, remote *Project, state *ProjectState, gc, rebaseTracked, r
 				project:     *remote,
 				source:      local.Path,
 				state:       *state,
-			}, rebaseTracked, rebaseUntracked, rebaseAll, snapshot}
+			}, rebaseTracked, rebaseUntracked, rebaseAll, snapshot, report}
 		case snapshot && local.Revision != remote.Revision:
 			return updateOperation{commonOperation{
 				destination: remote.Path,
 				project:     *remote,
 				source:      local.Path,
 				state:       *state,
-			}, rebaseTracked, rebaseUntracked, rebaseAll, snapshot}
+			}, rebaseTracked, rebaseUntracked, rebaseAll, snapshot, report}
 		case localBranchesNeedUpdating || (state.CurrentBranch.Name == "" && local.Revision != remote.Revision):
 			return updateOperation{commonOperation{
 				destination: remote.Path,
 				project:     *remote,
 				source:      local.Path,
 				state:       *state,
-			}, rebaseTracked, rebaseUntracked, rebaseAll, snapshot}
+			}, rebaseTracked, rebaseUntracked, rebaseAll, snapshot, report}
 		case state.CurrentBranch.Tracking == nil && local.Revision != remote.Revision:
 			return updateOperation{commonOperation{
 				destination: remote.Path,
 				project:     *remote,
 				source:      local.Path,
 				state:       *state,
-			}, rebaseTracked, rebaseUntracked, rebaseAll, snapshot}
+			}, rebaseTracked, rebaseUntracked, rebaseAll, snapshot, report}
 		default:
 			return nullOperation{commonOperation{
 				destination: remote.Path,
@@ -708,38 +874,41 @@ func runCreateOperations(jirix *jiri.X, ops []createOperation) MultiError {
 		node.ops = append(node.ops, op)
 	}
 
-	workQueue := make(chan *workTree, count)
 	errs := make(chan error, count)
+	fetchLimit := make(chan struct{}, jirix.FetchJobs)
+	hosts := newHostLimiter(jirix)
+	bar := jirix.Logger.StartProgressBar("Creating projects", count)
+	defer bar.Finish()
 	var wg sync.WaitGroup
-	processTree := func(tree *workTree) {
+	run := func(op operation) error {
+		// Wait for the host first, so that projects on other hosts can use
+		// the remaining fetch slots meanwhile.
+		defer hosts.acquire(rewriteRemote(jirix, op.Project().Remote))()
+		fetchLimit <- struct{}{}
+		defer func() { <-fetchLimit }()
+		bar.Start(op.Project().Name)
+		defer bar.Done(op.Project().Name)
+		return runOperation(jirix, op)
+	}
+	var processTree func(tree *workTree)
+	processTree = func(tree *workTree) {
 		defer wg.Done()
 		for _, op := range tree.ops {
 			logMsg := fmt.Sprintf("Creating project %q", op.Project().Name)
-			task := jirix.Logger.AddTaskMsg(logMsg)
 			jirix.Logger.Debugf("%v", op)
-			if err := op.Run(jirix); err != nil {
-				task.Done()
+			if err := run(op); err != nil {
 				errs <- fmt.Errorf("%s: %s", logMsg, err)
 				return
 			}
-			task.Done()
 		}
 		for _, v := range tree.after {
 			wg.Add(1)
-			workQueue <- v
+			go processTree(v)
 		}
 	}
 	wg.Add(1)
-	workQueue <- head
-	for i := uint(0); i < jirix.Jobs; i++ {
-		go func() {
-			for tree := range workQueue {
-				processTree(tree)
-			}
-		}()
-	}
+	go processTree(head)
 	wg.Wait()
-	close(workQueue)
 	close(errs)
 
 	var multiErr MultiError
@@ -749,6 +918,35 @@ func runCreateOperations(jirix *jiri.X, ops []createOperation) MultiError {
 	return multiErr
 }
 
+// runOperation runs op, recording its outcome in jirix.UpdateResult if it
+// changes the project or fails.
+func runOperation(jirix *jiri.X, op operation) error {
+	if jirix.UpdateResult == nil {
+		return op.Run(jirix)
+	}
+	path, err := filepath.Rel(jirix.Root, op.Project().Path)
+	if err != nil {
+		path = op.Project().Path
+	}
+	result := jiri.ProjectResult{
+		Name:   op.Project().Name,
+		Path:   path,
+		Action: op.Kind(),
+	}
+	if op.Kind() != "create" {
+		result.OldRevision, _ = newSCM(jirix, op.localProject()).CurrentRevision()
+	}
+	start := time.Now()
+	err = op.Run(jirix)
+	if err == nil && op.Kind() != "delete" {
+		result.NewRevision, _ = newSCM(jirix, op.Project()).CurrentRevision()
+	}
+	if op.Kind() != "null" || err != nil {
+		jirix.UpdateResult.AddProject(result, time.Since(start), err)
+	}
+	return err
+}
+
 type PathTrie struct {
 	current  string
 	children map[string]*PathTrie
@@ -828,7 +1026,7 @@ func runDeleteOperations(jirix *jiri.X, ops []deleteOperation, gc bool) error {
 		logMsg := fmt.Sprintf("Deleting project %q", op.Project().Name)
 		task := jirix.Logger.AddTaskMsg(logMsg)
 		jirix.Logger.Debugf("%s", op)
-		if err := op.Run(jirix); err != nil {
+		if err := runOperation(jirix, op); err != nil {
 			task.Done()
 			return fmt.Errorf("%s: %s", logMsg, err)
 		}
@@ -856,7 +1054,7 @@ func runMoveOperations(jirix *jiri.X, ops []moveOperation) error {
 		logMsg := fmt.Sprintf("Moving and updating project %q", op.Project().Name)
 		task := jirix.Logger.AddTaskMsg(logMsg)
 		jirix.Logger.Debugf("%s", op)
-		if err := op.Run(jirix); err != nil {
+		if err := runOperation(jirix, op); err != nil {
 			task.Done()
 			return fmt.Errorf("%s: %s", logMsg, err)
 		}
@@ -866,15 +1064,17 @@ func runMoveOperations(jirix *jiri.X, ops []moveOperation) error {
 }
 
 func runCommonOperations(jirix *jiri.X, ops operations, loglevel log.LogLevel) error {
+	bar := jirix.Logger.StartProgressBar("Updating projects", len(ops))
+	defer bar.Finish()
 	for _, op := range ops {
 		logMsg := fmt.Sprintf("Updating project %q", op.Project().Name)
-		task := jirix.Logger.AddTaskMsg(logMsg)
+		bar.Start(op.Project().Name)
 		jirix.Logger.Logf(loglevel, "%s", op)
-		if err := op.Run(jirix); err != nil {
-			task.Done()
+		err := runOperation(jirix, op)
+		bar.Done(op.Project().Name)
+		if err != nil {
 			return fmt.Errorf("%s: %s", logMsg, err)
 		}
-		task.Done()
 	}
 	return nil
 }
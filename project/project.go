@@ -25,8 +25,11 @@ import (
 	"time"
 
 	"github.com/dahlia-os/jiri"
+	"github.com/dahlia-os/jiri/cipd"
+	"github.com/dahlia-os/jiri/envvar"
 	"github.com/dahlia-os/jiri/gitutil"
 	"github.com/dahlia-os/jiri/log"
+	"github.com/dahlia-os/jiri/osutil"
 	"github.com/dahlia-os/jiri/retry"
 )
 
@@ -37,6 +40,13 @@ var (
 	DefaultPackageTimeout = uint(20) // DefaultPackageTimeout is the time in minutes to wait for cipd fetching packages.
 )
 
+// partialCloneFilter is the object filter used to clone partial projects.
+const partialCloneFilter = "blob:none"
+
+// jiriIgnoreFile is the name of the file at the root of a project listing
+// patterns of untracked files which "jiri project -clean" must keep.
+const jiriIgnoreFile = ".jiri-ignore"
+
 const (
 	JiriProject     = "release.go.jiri"
 	JiriName        = "jiri"
@@ -56,8 +66,14 @@ type Project struct {
 	Path string `xml:"path,attr,omitempty"`
 	// Remote is the project remote.
 	Remote string `xml:"remote,attr,omitempty"`
+	// Protocol is the version control system of the project, either "git",
+	// the default, or "hg" for Mercurial.
+	Protocol string `xml:"protocol,attr,omitempty"`
 	// RemoteBranch is the name of the remote branch to track.
 	RemoteBranch string `xml:"remotebranch,attr,omitempty"`
+	// RemoteName is the name of the git remote pointing to Remote in the
+	// local repository. If not set, "origin" is used as the default.
+	RemoteName string `xml:"remotename,attr,omitempty"`
 	// Revision is the revision the project should be advanced to during "jiri
 	// update".  If Revision is set, RemoteBranch will be ignored.  If Revision
 	// is not set, "HEAD" is used as the default.
@@ -66,11 +82,49 @@ type Project struct {
 	// commands. It is used to limit downloading large histories for large
 	// projects.
 	HistoryDepth int `xml:"historydepth,attr,omitempty"`
+	// CloneDepth, if set, replaces HistoryDepth when the project is first
+	// cloned.
+	CloneDepth int `xml:"clonedepth,attr,omitempty"`
+	// FetchDepth, if set, replaces HistoryDepth when an existing project is
+	// fetched.
+	FetchDepth int `xml:"fetchdepth,attr,omitempty"`
+	// FetchRefspec is a comma separated list of refspecs fetched from the
+	// remote in addition to its branches whenever the project is cloned or
+	// fetched, such as "+refs/changes/*:refs/changes/*".
+	FetchRefspec string `xml:"fetchrefspec,attr,omitempty"`
+	// Partial makes jiri create the project as a partial clone, fetching
+	// file contents lazily as they are needed. It cannot be combined with
+	// HistoryDepth.
+	Partial bool `xml:"partial,attr,omitempty"`
 	// GerritHost is the gerrit host where project CLs will be sent.
 	GerritHost string `xml:"gerrithost,attr,omitempty"`
 	// GitHooks is a directory containing git hooks that will be installed for
 	// this project.
 	GitHooks string `xml:"githooks,attr,omitempty"`
+	// VerifyCommit requires the commit the project is advanced to during "jiri
+	// update" to carry a valid GPG signature.
+	VerifyCommit bool `xml:"verifycommit,attr,omitempty"`
+	// Env is a comma separated list of KEY=VALUE pairs that are added to the
+	// environment of hooks and "jiri runp" commands run for this project.
+	// Values cannot contain commas, EnvVars can be used for those.
+	Env string `xml:"env,attr,omitempty"`
+	// EnvVars are environment variables added to the environment of hooks
+	// and "jiri runp" commands run for this project, after those in Env.
+	EnvVars []EnvVar `xml:"env"`
+	// GitSubmodules makes "jiri update" initialize and update the git
+	// submodules of the project, recursively, once it is checked out.
+	GitSubmodules bool `xml:"gitsubmodules,attr,omitempty"`
+	// LFS makes "jiri update" set up Git LFS in the project and pull its LFS
+	// objects once it is checked out.
+	LFS bool `xml:"lfs,attr,omitempty"`
+	// SkipBulk excludes the project from commands run across all projects,
+	// such as "jiri runp", "jiri status" and "jiri project -clean", unless
+	// it is named explicitly or -all is passed. It is still updated.
+	SkipBulk bool `xml:"skipbulk,attr,omitempty"`
+	// LastUpdate is the time at which "jiri update" last updated the
+	// project, in RFC 3339 format. It is only recorded in the project
+	// metadata, and is empty in metadata written by older versions of jiri.
+	LastUpdate string `xml:"lastupdate,attr,omitempty"`
 
 	XMLName struct{} `xml:"project"`
 
@@ -82,6 +136,34 @@ type Project struct {
 	LocalConfig LocalConfig `xml:"-"`
 }
 
+// LastUpdateTime returns the time at which the project was last updated, or
+// the zero time if it is not recorded.
+func (p Project) LastUpdateTime() time.Time {
+	t, err := time.Parse(time.RFC3339, p.LastUpdate)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// DefaultRemoteName is the name of the git remote of projects that do not set
+// the remotename attribute.
+const DefaultRemoteName = "origin"
+
+// GitRemoteName returns the name of the git remote of the project.
+func (p Project) GitRemoteName() string {
+	if p.RemoteName == "" {
+		return DefaultRemoteName
+	}
+	return p.RemoteName
+}
+
+// RemoteRef returns the remote-tracking ref of the given branch of the
+// project, such as "remotes/origin/master".
+func (p Project) RemoteRef(branch string) string {
+	return "remotes/" + p.GitRemoteName() + "/" + branch
+}
+
 // ProjectsByPath implements the Sort interface. It sorts Projects by
 // the Path field.
 type ProjectsByPath []Project
@@ -150,7 +232,10 @@ func (p Project) ToFile(jirix *jiri.X, filename string) error {
 		return fmt.Errorf("project xml.Marshal failed: %v", err)
 	}
 	// Same logic as Manifest.ToBytes, to make the output more compact.
-	data = bytes.Replace(data, endProjectSoloBytes, endElemSoloBytes, -1)
+	data = bytes.Replace(data, endEnvSoloBytes, endElemSoloBytes, -1)
+	if len(p.EnvVars) == 0 {
+		data = bytes.Replace(data, endProjectSoloBytes, endElemSoloBytes, -1)
+	}
 	if !bytes.HasSuffix(data, newlineBytes) {
 		data = append(data, '\n')
 	}
@@ -167,6 +252,53 @@ func (p *Project) absolutizePaths(basepath string) {
 	}
 }
 
+// expandVars expands ${VAR} references in the remote, path, revision, remote
+// branch and gerrit host of the project with the values in env.
+func (p *Project) expandVars(env map[string]string) error {
+	for _, attr := range []*string{&p.Remote, &p.Path, &p.Revision, &p.RemoteBranch, &p.GerritHost} {
+		value, err := expandVars(*attr, env)
+		if err != nil {
+			return fmt.Errorf("project %q: %s", p.Name, err)
+		}
+		*attr = value
+	}
+	return nil
+}
+
+// expandVars replaces ${VAR} references in s with the value of VAR in env,
+// where "$$" stands for a literal "$".  Referencing a variable which is not
+// in env is an error.
+func expandVars(s string, env map[string]string) (string, error) {
+	if !strings.Contains(s, "$") {
+		return s, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] != '$':
+			b.WriteByte(s[i])
+		case strings.HasPrefix(s[i:], "$$"):
+			b.WriteByte('$')
+			i++
+		case strings.HasPrefix(s[i:], "${"):
+			end := strings.IndexByte(s[i:], '}')
+			if end < 0 {
+				return "", fmt.Errorf("unterminated variable reference in %q", s)
+			}
+			name := s[i+2 : i+end]
+			value, ok := env[name]
+			if !ok {
+				return "", fmt.Errorf("undefined variable %q in %q", name, s)
+			}
+			b.WriteString(value)
+			i += end
+		default:
+			b.WriteByte('$')
+		}
+	}
+	return b.String(), nil
+}
+
 // relativizePaths makes all absolute paths relative to basepath.
 func (p *Project) relativizePaths(basepath string) error {
 	if filepath.IsAbs(p.Path) {
@@ -196,7 +328,7 @@ func (p Project) Key() ProjectKey {
 
 func (p *Project) fillDefaults() error {
 	if p.RemoteBranch == "" {
-		p.RemoteBranch = "master"
+		p.RemoteBranch = p.defaultBranch()
 	}
 	if p.Revision == "" {
 		p.Revision = "HEAD"
@@ -205,7 +337,7 @@ func (p *Project) fillDefaults() error {
 }
 
 func (p *Project) unfillDefaults() error {
-	if p.RemoteBranch == "master" {
+	if p.RemoteBranch == p.defaultBranch() {
 		p.RemoteBranch = ""
 	}
 	if p.Revision == "HEAD" {
@@ -218,28 +350,239 @@ func (p *Project) validate() error {
 	if strings.Contains(p.Name, KeySeparator) {
 		return fmt.Errorf("bad project: name cannot contain %q: %+v", KeySeparator, *p)
 	}
+	if _, err := p.envVars(); err != nil {
+		return fmt.Errorf("bad project %q: %v", p.Name, err)
+	}
+	if _, err := p.fetchRefspecs(); err != nil {
+		return fmt.Errorf("bad project %q: %v", p.Name, err)
+	}
+	if p.Partial && (p.HistoryDepth > 0 || p.CloneDepth > 0 || p.FetchDepth > 0) {
+		return fmt.Errorf("bad project %q: partial and historydepth, clonedepth or fetchdepth cannot both be set", p.Name)
+	}
+	switch p.Protocol {
+	case "", gitProtocol:
+	case hgProtocol:
+		if attrs := p.gitAttributes(); len(attrs) != 0 {
+			return fmt.Errorf("bad project %q: %s not supported with the %q protocol", p.Name, strings.Join(attrs, ", "), p.Protocol)
+		}
+	default:
+		return fmt.Errorf("bad project %q: protocol %q is not supported, only %q and %q are", p.Name, p.Protocol, gitProtocol, hgProtocol)
+	}
+	if strings.ContainsAny(p.RemoteName, "/ \t") {
+		return fmt.Errorf("bad project %q: remotename %q is not a valid remote name", p.Name, p.RemoteName)
+	}
 	return nil
 }
 
+// defaultBranch returns the branch tracked by the project if it has no
+// RemoteBranch.
+func (p *Project) defaultBranch() string {
+	if p.Protocol == hgProtocol {
+		return "default"
+	}
+	return "master"
+}
+
+// gitAttributes returns the attributes set for the project which are only
+// supported by git projects.
+func (p *Project) gitAttributes() []string {
+	var attrs []string
+	for _, attr := range []struct {
+		name string
+		set  bool
+	}{
+		{"historydepth", p.HistoryDepth != 0},
+		{"partial", p.Partial},
+		{"gerrithost", p.GerritHost != ""},
+		{"githooks", p.GitHooks != ""},
+		{"verifycommit", p.VerifyCommit},
+		{"gitsubmodules", p.GitSubmodules},
+		{"clonedepth", p.CloneDepth != 0},
+		{"fetchdepth", p.FetchDepth != 0},
+		{"fetchrefspec", p.FetchRefspec != ""},
+		{"lfs", p.LFS},
+		{"remotename", p.RemoteName != ""},
+	} {
+		if attr.set {
+			attrs = append(attrs, attr.name)
+		}
+	}
+	return attrs
+}
+
+// cloneDepth returns the history depth used when the project is first cloned.
+func (p *Project) cloneDepth() int {
+	if p.CloneDepth > 0 {
+		return p.CloneDepth
+	}
+	return p.HistoryDepth
+}
+
+// fetchDepth returns the history depth used when the project is fetched after
+// it has been cloned.
+func (p *Project) fetchDepth() int {
+	if p.FetchDepth > 0 {
+		return p.FetchDepth
+	}
+	return p.HistoryDepth
+}
+
+// fetchRefspecs returns the refspecs listed by FetchRefspec.
+func (p *Project) fetchRefspecs() ([]string, error) {
+	if p.FetchRefspec == "" {
+		return nil, nil
+	}
+	var refspecs []string
+	for _, refspec := range strings.Split(p.FetchRefspec, ",") {
+		refspec = strings.TrimSpace(refspec)
+		if err := gitutil.ValidateRefspec(refspec); err != nil {
+			return nil, err
+		}
+		refspecs = append(refspecs, refspec)
+	}
+	return refspecs, nil
+}
+
+// Merge policies of environment variables.
+const (
+	envReplace = "replace"
+	envPrepend = "prepend"
+	envAppend  = "append"
+)
+
+// EnvVar is an environment variable declared by a project.
+type EnvVar struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+	// Merge is the policy used to merge Value with the value the variable
+	// already has: "replace", the default, overrides it, while "prepend" and
+	// "append" add Value to it as an element of a list of paths, like PATH.
+	Merge   string   `xml:"merge,attr,omitempty"`
+	XMLName struct{} `xml:"env"`
+}
+
+func (v EnvVar) validate() error {
+	if v.Name == "" || strings.Contains(v.Name, "=") {
+		return fmt.Errorf("invalid env name %q", v.Name)
+	}
+	switch v.Merge {
+	case "", envReplace, envPrepend, envAppend:
+	default:
+		return fmt.Errorf("invalid merge policy %q for env %q, expected %q, %q or %q", v.Merge, v.Name, envReplace, envPrepend, envAppend)
+	}
+	return nil
+}
+
+// parseEnv parses a comma separated list of KEY=VALUE pairs.
+func parseEnv(env string) ([]EnvVar, error) {
+	if env == "" {
+		return nil, nil
+	}
+	var vars []EnvVar
+	for _, kv := range strings.Split(env, ",") {
+		key, value := envvar.SplitKeyValue(strings.TrimSpace(kv))
+		if key == "" || !strings.Contains(kv, "=") {
+			return nil, fmt.Errorf("invalid env entry %q, expected KEY=VALUE", kv)
+		}
+		vars = append(vars, EnvVar{Name: key, Value: value})
+	}
+	return vars, nil
+}
+
+// envVars returns the variables of Env followed by EnvVars, in the order in
+// which they are merged into the environment.
+func (p *Project) envVars() ([]EnvVar, error) {
+	vars, err := parseEnv(p.Env)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range p.EnvVars {
+		if err := v.validate(); err != nil {
+			return nil, err
+		}
+	}
+	return append(vars, p.EnvVars...), nil
+}
+
+// Environment returns the environment in base with the project's variables
+// merged into it according to their merge policies.
+func (p *Project) Environment(base map[string]string) map[string]string {
+	// The variables are validated when the manifest is loaded.
+	vars, _ := p.envVars()
+	return mergeEnv(base, vars)
+}
+
+func mergeEnv(base map[string]string, vars []EnvVar) map[string]string {
+	env := envvar.CopyMap(base)
+	separator := string(os.PathListSeparator)
+	for _, v := range vars {
+		switch v.Merge {
+		case envPrepend:
+			env[v.Name] = envvar.PrependUniqueToken(env[v.Name], separator, v.Value)
+		case envAppend:
+			env[v.Name] = envvar.AppendUniqueToken(env[v.Name], separator, v.Value)
+		default:
+			env[v.Name] = v.Value
+		}
+	}
+	return env
+}
+
 func (p *Project) update(other *Project) {
 	if other.Path != "" {
 		p.Path = other.Path
 	}
+	if other.Protocol != "" {
+		p.Protocol = other.Protocol
+	}
 	if other.RemoteBranch != "" {
 		p.RemoteBranch = other.RemoteBranch
 	}
+	if other.RemoteName != "" {
+		p.RemoteName = other.RemoteName
+	}
 	if other.Revision != "" {
 		p.Revision = other.Revision
 	}
 	if other.HistoryDepth != 0 {
 		p.HistoryDepth = other.HistoryDepth
 	}
+	if other.FetchRefspec != "" {
+		p.FetchRefspec = other.FetchRefspec
+	}
+	if other.CloneDepth != 0 {
+		p.CloneDepth = other.CloneDepth
+	}
+	if other.FetchDepth != 0 {
+		p.FetchDepth = other.FetchDepth
+	}
+	if other.Partial {
+		p.Partial = other.Partial
+	}
 	if other.GerritHost != "" {
 		p.GerritHost = other.GerritHost
 	}
 	if other.GitHooks != "" {
 		p.GitHooks = other.GitHooks
 	}
+	if other.VerifyCommit {
+		p.VerifyCommit = other.VerifyCommit
+	}
+	if other.GitSubmodules {
+		p.GitSubmodules = other.GitSubmodules
+	}
+	if other.LFS {
+		p.LFS = other.LFS
+	}
+	if other.SkipBulk {
+		p.SkipBulk = other.SkipBulk
+	}
+	if other.Env != "" {
+		p.Env = other.Env
+	}
+	if len(other.EnvVars) > 0 {
+		p.EnvVars = other.EnvVars
+	}
 }
 
 // ProjectLock describes locked version information for a jiri managed project.
@@ -397,12 +740,12 @@ func (p *Project) CacheDirPath(jirix *jiri.X) (string, error) {
 func (p *Project) writeJiriRevisionFiles(jirix *jiri.X) error {
 	scm := gitutil.New(jirix, gitutil.RootDirOpt(p.Path))
 	file := filepath.Join(p.Path, ".git", "JIRI_HEAD")
-	head := "refs/remotes/origin/master"
+	head := "refs/" + p.RemoteRef("master")
 	var err error
 	if p.Revision != "" && p.Revision != "HEAD" {
 		head = p.Revision
 	} else if p.RemoteBranch != "" {
-		head = "refs/remotes/origin/" + p.RemoteBranch
+		head = "refs/" + p.RemoteRef(p.RemoteBranch)
 	}
 	head, err = scm.CurrentRevisionForRef(head)
 	if err != nil {
@@ -420,34 +763,40 @@ func (p *Project) writeJiriRevisionFiles(jirix *jiri.X) error {
 }
 
 func (p *Project) setupDefaultPushTarget(jirix *jiri.X) error {
+	scm := gitutil.New(jirix, gitutil.RootDirOpt(p.Path))
 	if p.GerritHost == "" {
-		// Skip projects w/o gerrit host
-		return nil
+		// Projects w/o gerrit host have no default, remove the one set while
+		// the project had a gerrit host, unless the user changed it since.
+		return scm.ConfigUnsetOwned()
 	}
-	scm := gitutil.New(jirix, gitutil.RootDirOpt(p.Path))
-	if err := scm.Config("--get", "remote.origin.push"); err == nil {
+	key := "remote." + p.GitRemoteName() + ".push"
+	if err := scm.Config("--get", key); err == nil {
 		// Default already set, skip
 		return nil
 	}
-	if err := scm.Config("remote.origin.push", "HEAD:refs/for/master"); err != nil {
-		return fmt.Errorf("not able to set remote.origin.push for project %s(%s) due to error: %v", p.Name, p.Path, err)
+	if err := scm.ConfigSetOwned(key, "HEAD:refs/for/master"); err != nil {
+		return fmt.Errorf("not able to set %s for project %s(%s) due to error: %v", key, p.Name, p.Path, err)
 	}
-	jirix.Logger.Debugf("set remote.origin.push to \"HEAD:refs/for/master\" for project %s(%s)", p.Name, p.Path)
+	jirix.Logger.Debugf("set %s to \"HEAD:refs/for/master\" for project %s(%s)", key, p.Name, p.Path)
 	return nil
 }
 
 func (p *Project) IsOnJiriHead(jirix *jiri.X) (bool, error) {
-	scm := gitutil.New(jirix, gitutil.RootDirOpt(p.Path))
-	jiriHead := "refs/remotes/origin/master"
+	scm := newSCM(jirix, *p)
+	ref, branch := p.Revision, p.RemoteBranch
+	if branch == "" {
+		branch = p.defaultBranch()
+	}
+	var jiriHead string
 	var err error
-	if p.Revision != "" && p.Revision != "HEAD" {
-		jiriHead = p.Revision
-	} else if p.RemoteBranch != "" {
-		jiriHead = "refs/remotes/origin/" + p.RemoteBranch
+	if ref != "" && ref != "HEAD" {
+		jiriHead, err = scm.ResolveRevision(ref)
+	} else {
+		ref = branch
+		jiriHead, err = scm.BranchRevision(branch)
 	}
-	jiriHead, err = scm.CurrentRevisionForRef(jiriHead)
 	if err != nil {
-		return false, fmt.Errorf("Cannot find revision for ref %q for project %s(%s): %s", jiriHead, p.Name, p.Path, err)
+		return false, fmt.Errorf("Cannot find revision for ref %q for project %s(%s): %s", ref, p.Name, p.Path, err)
 	}
 	head, err := scm.CurrentRevision()
 	if err != nil {
@@ -537,6 +886,9 @@ func CreateSnapshot(jirix *jiri.X, file string, hooks Hooks, pkgs Packages, loca
 	}
 
 	for _, project := range localProjects {
+		// The update time is local state, which does not belong in
+		// manifests.
+		project.LastUpdate = ""
 		manifest.Projects = append(manifest.Projects, project)
 	}
 
@@ -557,6 +909,19 @@ func CreateSnapshot(jirix *jiri.X, file string, hooks Hooks, pkgs Packages, loca
 		manifest.Hooks = append(manifest.Hooks, hook)
 	}
 
+	// Record resolved instance IDs for packages that do not have them yet,
+	// so that checking out the snapshot pins the same package instances.
+	for _, pack := range pkgs {
+		if len(pack.Instances) == 0 {
+			lockedPkgs, err := loadPackageInstances(jirix, localProjects, localManifest)
+			if err != nil {
+				return err
+			}
+			pkgs = mergePackageInstances(pkgs, lockedPkgs)
+			break
+		}
+	}
+
 	for _, pack := range pkgs {
 		manifest.Packages = append(manifest.Packages, pack)
 	}
@@ -564,6 +929,19 @@ func CreateSnapshot(jirix *jiri.X, file string, hooks Hooks, pkgs Packages, loca
 	return manifest.ToFile(jirix, file)
 }
 
+// mergePackageInstances returns a copy of pkgs where packages without
+// instances take the instances of the matching package in lockedPkgs.
+func mergePackageInstances(pkgs, lockedPkgs Packages) Packages {
+	ret := make(Packages)
+	for k, v := range pkgs {
+		if locked, ok := lockedPkgs[k]; ok && len(v.Instances) == 0 {
+			v.Instances = locked.Instances
+		}
+		ret[k] = v
+	}
+	return ret
+}
+
 // CheckoutSnapshot updates project state to the state specified in the given
 // snapshot file.  Note that the snapshot file must not contain remote imports.
 func CheckoutSnapshot(jirix *jiri.X, snapshot string, gc, runHooks, fetchPkgs bool, runHookTimeout, fetchTimeout uint) error {
@@ -584,6 +962,9 @@ func CheckoutSnapshot(jirix *jiri.X, snapshot string, gc, runHooks, fetchPkgs bo
 	if err := updateProjects(jirix, localProjects, remoteProjects, hooks, pkgs, gc, runHookTimeout, fetchTimeout, false /*rebaseTracked*/, false /*rebaseUntracked*/, false /*rebaseAll*/, true /*snapshot*/, runHooks, fetchPkgs); err != nil {
 		return err
 	}
+	if jirix.DryRun {
+		return nil
+	}
 	return WriteUpdateHistorySnapshot(jirix, snapshot, hooks, pkgs, false)
 }
 
@@ -659,8 +1040,7 @@ func setProjectRevisions(jirix *jiri.X, projects Projects) (Projects, error) {
 	jirix.TimerPush("set revisions")
 	defer jirix.TimerPop()
 	for name, project := range projects {
-		scm := gitutil.New(jirix, gitutil.RootDirOpt(project.Path))
-		revision, err := scm.CurrentRevision()
+		revision, err := newSCM(jirix, project).CurrentRevision()
 		if err != nil {
 			return nil, fmt.Errorf("Can't get revision for project %q: %v", project.Name, err)
 		}
@@ -715,7 +1095,7 @@ func LocalProjects(jirix *jiri.X, scanMode ScanMode) (Projects, error) {
 		}
 		if projectsExist {
 			for key, p := range snapshotProjects {
-				localConfigFile := filepath.Join(p.Path, jiri.ProjectMetaDir, jiri.ProjectConfigFile)
+				localConfigFile := filepath.Join(metadataDir(p.Path), jiri.ProjectConfigFile)
 				if p.LocalConfig, err = LocalConfigFromFile(jirix, localConfigFile); err != nil {
 					return nil, fmt.Errorf("Error while reading config for project %s(%s): %s", p.Name, p.Path, err)
 				}
@@ -810,7 +1190,7 @@ func loadManifestFiles(jirix *jiri.X, manifestFiles []string, localManifest bool
 	addProject := func(projects Projects) error {
 		for _, project := range projects {
 			if existingProject, ok := allProjects[project.Key()]; ok {
-				if existingProject != project {
+				if !reflect.DeepEqual(existingProject, project) {
 					return fmt.Errorf("project: %v conflicts with project: %v", existingProject, project)
 				}
 				continue
@@ -875,38 +1255,115 @@ func writeLockFile(jirix *jiri.X, lockfilePath string, projectLocks ProjectLocks
 	return nil
 }
 
+// ResolveLocks resolves the revisions of the projects and the instance ids of
+// the packages in the manifests in manifestFiles slice, as they would be
+// written to a jiri lockfile by GenerateJiriLockFile.
+func ResolveLocks(jirix *jiri.X, manifestFiles []string, enableProjectLocks, enablePkgLocks, localManifest bool) (projectLocks ProjectLocks, pkgLocks PackageLocks, err error) {
+	projects, pkgs, err := loadManifestFiles(jirix, manifestFiles, localManifest)
+	if err != nil {
+		return nil, nil, err
+	}
+	if enableProjectLocks {
+		projectLocks, err = resolveProjectLocks(jirix, projects)
+		if err != nil {
+			return
+		}
+	}
+	if enablePkgLocks {
+		pkgLocks, err = resolvePackageLocks(jirix, pkgs)
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
 // GenerateJiriLockFile generates jiri lockfile to lockFilePath using
 // manifests in manifestFiles slice.
 func GenerateJiriLockFile(jirix *jiri.X, manifestFiles []string, lockFilePath string, enableProjectLocks, enablePkgLocks, localManifest bool) error {
 	jirix.Logger.Debugf("Generate jiri lockfile for manifests %v to %q", manifestFiles, lockFilePath)
 
-	resolveLocks := func(jirix *jiri.X, manifestFiles []string, localManifest bool) (projectLocks ProjectLocks, pkgLocks PackageLocks, err error) {
-		projects, pkgs, err := loadManifestFiles(jirix, manifestFiles, localManifest)
+	projectLocks, pkgLocks, err := ResolveLocks(jirix, manifestFiles, enableProjectLocks, enablePkgLocks, localManifest)
+	if err != nil {
+		return err
+	}
+
+	return writeLockFile(jirix, lockFilePath, projectLocks, pkgLocks)
+}
+
+// InstalledPackageLocks returns locks pinning the packages in the
+// .jiri_manifest file to the instances installed in the jiri root, rather
+// than resolving their versions again.  Only packages for the host platform
+// are installed, so only those are pinned.  Packages which are not installed
+// result in an error.
+func InstalledPackageLocks(jirix *jiri.X, localManifest bool) (PackageLocks, error) {
+	localProjects, err := LocalProjects(jirix, FastScan)
+	if err != nil {
+		return nil, err
+	}
+	_, _, pkgs, err := LoadManifestFile(jirix, jirix.JiriManifestFile(), localProjects, localManifest)
+	if err != nil {
+		return nil, err
+	}
+	installed, err := cipd.Installed(jirix.Root)
+	if err != nil {
+		return nil, err
+	}
+	return installedPackageLocks(pkgs, installed)
+}
+
+// WritePackageLockFile writes a lockfile to lockFilePath which pins only the
+// given packages.
+func WritePackageLockFile(jirix *jiri.X, lockFilePath string, pkgLocks PackageLocks) error {
+	return writeLockFile(jirix, lockFilePath, nil, pkgLocks)
+}
+
+// installedPackageLocks returns the package locks of pkgs for the host
+// platform from the installed instances.
+func installedPackageLocks(pkgs Packages, installed []cipd.PackageInstance) (PackageLocks, error) {
+	instanceIDs := make(map[string]string)
+	for _, instance := range installed {
+		instanceIDs[instance.PackageName] = instance.InstanceID
+	}
+	pkgLocks := make(PackageLocks)
+	var missing []string
+	for _, pkg := range pkgs {
+		plats, err := pkg.GetPlatforms()
 		if err != nil {
-			return nil, nil, err
+			return nil, err
 		}
-		if enableProjectLocks {
-			projectLocks, err = resolveProjectLocks(jirix, projects)
-			if err != nil {
-				return
-			}
+		if cipd.MustExpand(pkg.Name) && !hasPlatform(plats, cipd.CipdPlatform) {
+			continue
 		}
-		if enablePkgLocks {
-			pkgLocks, err = resolvePackageLocks(jirix, pkgs)
-			if err != nil {
-				return
+		names, err := cipd.Expand(pkg.Name, []cipd.Platform{cipd.CipdPlatform})
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			id, ok := instanceIDs[name]
+			if !ok {
+				missing = append(missing, name)
+				continue
 			}
+			pkgLock := PackageLock{PackageName: name, InstanceID: id}
+			pkgLocks[pkgLock.Key()] = pkgLock
 		}
-
-		return
 	}
-
-	projectLocks, pkgLocks, err := resolveLocks(jirix, manifestFiles, localManifest)
-	if err != nil {
-		return err
+	if len(missing) != 0 {
+		sort.Strings(missing)
+		return nil, fmt.Errorf("packages are not installed, run \"jiri fetch-packages\" first: %s", strings.Join(missing, ", "))
 	}
+	return pkgLocks, nil
+}
 
-	return writeLockFile(jirix, lockFilePath, projectLocks, pkgLocks)
+func hasPlatform(plats []cipd.Platform, plat cipd.Platform) bool {
+	for _, p := range plats {
+		if p == plat {
+			return true
+		}
+	}
+	return false
 }
 
 // UpdateUniverse updates all local projects and tools to match the remote
@@ -999,11 +1456,140 @@ func WriteUpdateHistorySnapshot(jirix *jiri.X, snapshotPath string, hooks Hooks,
 	return fmtError(os.Symlink(snapshotFile, latestLink))
 }
 
+// RenameProject moves the local project at oldPath to newPath, together with
+// any projects nested inside it, and updates their metadata and the links to
+// their git working trees. Unless force is true, it refuses to move a project
+// with uncommitted changes or untracked files, or to replace an existing
+// directory at newPath. Even with force, only an empty directory is replaced.
+func RenameProject(jirix *jiri.X, localProjects Projects, oldPath, newPath string, force bool) error {
+	oldPath, newPath = filepath.Clean(oldPath), filepath.Clean(newPath)
+	var moved *Project
+	for _, p := range localProjects {
+		if p.Path == oldPath {
+			p := p
+			moved = &p
+			break
+		}
+	}
+	if moved == nil {
+		return fmt.Errorf("no project found at %q", oldPath)
+	}
+	if rel, err := filepath.Rel(jirix.Root, newPath); err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return fmt.Errorf("cannot move project %q to %q as it is not inside %q", moved.Name, newPath, jirix.Root)
+	}
+	if strings.HasPrefix(newPath+string(filepath.Separator), oldPath+string(filepath.Separator)) {
+		return fmt.Errorf("cannot move project %q into itself", moved.Name)
+	}
+	if fi, err := os.Stat(newPath); err == nil {
+		if !force {
+			return fmt.Errorf("cannot move project %q to %q as the destination already exists, use -force to replace an empty directory", moved.Name, newPath)
+		}
+		if !fi.IsDir() {
+			return fmt.Errorf("cannot move project %q to %q as the destination is not a directory", moved.Name, newPath)
+		}
+		if err := os.Remove(newPath); err != nil {
+			return fmtError(err)
+		}
+	} else if !os.IsNotExist(err) {
+		return fmtError(err)
+	}
+	prefix := oldPath + string(filepath.Separator)
+	if !force {
+		// Projects nested in the moved one move along with it.
+		for _, p := range localProjects {
+			if p.Path != oldPath && !strings.HasPrefix(p.Path, prefix) {
+				continue
+			}
+			scm := newSCM(jirix, p)
+			if files, err := scm.FilesWithUncommittedChanges(); err != nil {
+				return err
+			} else if len(files) != 0 {
+				return fmt.Errorf("project %q has uncommitted changes, commit them or use -force", p.Name)
+			}
+			if untracked, err := scm.HasUntrackedFiles(); err != nil {
+				return err
+			} else if untracked {
+				return fmt.Errorf("project %q has untracked files, remove them or use -force", p.Name)
+			}
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(newPath), os.FileMode(0755)); err != nil {
+		return fmtError(err)
+	}
+	if err := osutil.Rename(oldPath, newPath); err != nil {
+		return fmtError(err)
+	}
+	for _, p := range localProjects {
+		if p.Path != oldPath && !strings.HasPrefix(p.Path, prefix) {
+			continue
+		}
+		p.Path = newPath + strings.TrimPrefix(p.Path, oldPath)
+		if err := writeMetadata(jirix, p, p.Path); err != nil {
+			return err
+		}
+		// The linked working trees of the project still point to its old
+		// location.
+		if _, err := os.Stat(filepath.Join(p.Path, ".git", "worktrees")); err == nil {
+			if err := gitutil.New(jirix, gitutil.RootDirOpt(p.Path)).RepairWorktrees(); err != nil {
+				jirix.Logger.Warningf("Not able to repair the working trees of project %q: %s\nRun '%s' once git is updated.\n\n", p.Name, err, jirix.Color.Yellow("git -C %q worktree repair", p.Path))
+			}
+		}
+		jirix.Logger.Infof("Moved project %q to %q\n", p.Name, p.Path)
+	}
+	return nil
+}
+
+// RecloneProject replaces the git directory of the project at p.Path, for
+// instance after it was found to be corrupt, with a fresh clone of p's remote
+// checked out at p's revision, where p is usually the project as given in the
+// manifest. The working tree is left in place, including any projects nested
+// inside it, so files that differ from the new checkout show up as local
+// changes.
+func RecloneProject(jirix *jiri.X, p Project) error {
+	tmpDir, err := ioutil.TempDir(filepath.Dir(p.Path), cloneTempPrefix(p.Path))
+	if err != nil {
+		return fmtError(err)
+	}
+	// The old git directory is only kept if it cannot be moved back.
+	keepTmpDir := false
+	defer func() {
+		if keepTmpDir {
+			return
+		}
+		if err := os.RemoveAll(tmpDir); err != nil {
+			jirix.Logger.Warningf("Not able to remove %q: %s", tmpDir, err)
+		}
+	}()
+	cloneDir := filepath.Join(tmpDir, "clone")
+	op := createOperation{commonOperation{project: p, destination: cloneDir}}
+	if err := op.Run(jirix); err != nil {
+		return err
+	}
+	gitDir := filepath.Join(p.Path, ".git")
+	oldGitDir := filepath.Join(tmpDir, "old.git")
+	if err := osutil.Rename(gitDir, oldGitDir); err != nil {
+		return fmtError(err)
+	}
+	if err := osutil.Rename(filepath.Join(cloneDir, ".git"), gitDir); err != nil {
+		if restoreErr := osutil.Rename(oldGitDir, gitDir); restoreErr != nil {
+			keepTmpDir = true
+			return fmt.Errorf("not able to move the new git directory into place: %s, and not able to restore the old one from %q: %s", err, oldGitDir, restoreErr)
+		}
+		return fmtError(err)
+	}
+	jirix.Logger.Infof("Re-cloned project %q in %q\n", p.Name, p.Path)
+	return nil
+}
+
 // CleanupProjects restores the given jiri projects back to their detached
 // heads, resets to the specified revision if there is one, and gets rid of
 // all the local changes. If "cleanupBranches" is true, it will also delete all
-// the non-master branches.
-func CleanupProjects(jirix *jiri.X, localProjects Projects, cleanupBranches bool) (e error) {
+// the non-master branches. Branches matching "keep", if not nil, are not
+// deleted, and if "mergedOnly" is true only branches merged into the revision
+// the project is reset to are deleted. In both cases the branch that was
+// checked out and the project's remote branch are kept as well.
+func CleanupProjects(jirix *jiri.X, localProjects Projects, cleanupBranches bool, keep *regexp.Regexp, mergedOnly bool) (e error) {
 	remoteProjects, _, _, err := LoadManifest(jirix)
 	if err != nil {
 		return err
@@ -1028,7 +1614,7 @@ func CleanupProjects(jirix *jiri.X, localProjects Projects, cleanupBranches bool
 				jirix.IncrementFailures()
 				return
 			}
-			if err := resetLocalProject(jirix, local, remote, cleanupBranches); err != nil {
+			if err := resetLocalProject(jirix, local, remote, cleanupBranches, keep, mergedOnly); err != nil {
 				errs <- fmt.Errorf("Erorr cleaning project %q: %v", local.Name, err)
 			}
 		}(local)
@@ -1046,10 +1632,43 @@ func CleanupProjects(jirix *jiri.X, localProjects Projects, cleanupBranches bool
 	return nil
 }
 
+// readJiriIgnore returns the patterns of untracked files to keep listed in
+// the .jiri-ignore file of the project at path, one per line, along with the
+// file itself.  Blank lines and lines starting with "#" are skipped.
+func readJiriIgnore(path string) ([]string, error) {
+	bytes, err := ioutil.ReadFile(filepath.Join(path, jiriIgnoreFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmtError(err)
+	}
+	patterns := []string{"/" + jiriIgnoreFile}
+	for _, line := range strings.Split(string(bytes), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+	return patterns, nil
+}
+
 // resetLocalProject checks out the detached_head, cleans up untracked files
 // and uncommitted changes, and optionally deletes all the branches except master.
-func resetLocalProject(jirix *jiri.X, local, remote Project, cleanupBranches bool) error {
+func resetLocalProject(jirix *jiri.X, local, remote Project, cleanupBranches bool, keep *regexp.Regexp, mergedOnly bool) error {
+	if !local.usesGit() {
+		return fmt.Errorf("cannot clean up project %s(%s): only git projects can be cleaned up, not %q ones", local.Name, local.Path, local.Protocol)
+	}
 	scm := gitutil.New(jirix, gitutil.RootDirOpt(local.Path))
+	selective := keep != nil || mergedOnly
+	currentBranch := ""
+	if cleanupBranches && selective && scm.IsOnBranch() {
+		var err error
+		if currentBranch, err = scm.CurrentBranchName(); err != nil {
+			return err
+		}
+	}
 	headRev, err := GetHeadRevision(jirix, remote)
 	if err != nil {
 		return err
@@ -1064,7 +1683,11 @@ func resetLocalProject(jirix *jiri.X, local, remote Project, cleanupBranches boo
 		}
 	}
 	// Cleanup changes.
-	if err := scm.RemoveUntrackedFiles(); err != nil {
+	keepPatterns, err := readJiriIgnore(local.Path)
+	if err != nil {
+		return err
+	}
+	if err := scm.RemoveUntrackedFiles(gitutil.ExcludeOpt(keepPatterns)); err != nil {
 		return err
 	}
 	if !cleanupBranches {
@@ -1076,7 +1699,30 @@ func resetLocalProject(jirix *jiri.X, local, remote Project, cleanupBranches boo
 	if err != nil {
 		return fmt.Errorf("Cannot get branches for project %q: %v", local.Name, err)
 	}
+	var merged map[string]bool
+	if mergedOnly {
+		mergedBranches, err := scm.MergedBranches(headRev)
+		if err != nil {
+			return fmt.Errorf("Cannot get merged branches for project %q: %v", local.Name, err)
+		}
+		merged = make(map[string]bool)
+		for _, branch := range mergedBranches {
+			merged[branch] = true
+		}
+	}
+	defaultBranch := remote.RemoteBranch
+	if defaultBranch == "" {
+		defaultBranch = "master"
+	}
 	for _, branch := range branches {
+		if selective {
+			if branch == currentBranch || branch == defaultBranch ||
+				(keep != nil && keep.MatchString(branch)) ||
+				(mergedOnly && !merged[branch]) {
+				jirix.Logger.Debugf("Keeping branch %q of project %q", branch, local.Name)
+				continue
+			}
+		}
 		if err := scm.DeleteBranch(branch, gitutil.ForceOpt(true)); err != nil {
 			return err
 		}
@@ -1084,12 +1730,26 @@ func resetLocalProject(jirix *jiri.X, local, remote Project, cleanupBranches boo
 	return nil
 }
 
+// metadataDir returns the metadata directory of the project at path, which is
+// kept in the ".hg" directory of Mercurial projects.
+func metadataDir(path string) string {
+	if isPathDir(filepath.Join(path, ".hg")) {
+		return filepath.Join(path, jiri.HgProjectMetaDir)
+	}
+	return filepath.Join(path, jiri.ProjectMetaDir)
+}
+
 // IsLocalProject returns true if there is a project at the given path.
 func IsLocalProject(jirix *jiri.X, path string) (bool, error) {
 	// Existence of a metadata directory is how we know we've found a
 	// Jiri-maintained project.
-	metadataDir := filepath.Join(path, jiri.ProjectMetaDir)
-	if _, err := os.Stat(metadataDir); err != nil {
+	metaDir := metadataDir(path)
+	if _, err := os.Stat(metaDir); err != nil {
+		// Submodules and linked working trees have a ".git" file, which
+		// cannot hold the metadata directory.
+		if info, err := os.Stat(filepath.Join(path, ".git")); err == nil && !info.IsDir() {
+			return false, nil
+		}
 		if os.IsNotExist(err) {
 			// Check for old meta directory
 			oldMetadataDir := filepath.Join(path, jiri.OldProjectMetaDir)
@@ -1101,7 +1761,7 @@ func IsLocalProject(jirix *jiri.X, path string) (bool, error) {
 				return false, fmtError(err)
 			}
 			// Old metadir found, move it
-			if err := os.Rename(oldMetadataDir, metadataDir); err != nil {
+			if err := os.Rename(oldMetadataDir, metaDir); err != nil {
 				return false, fmtError(err)
 			}
 			return true, nil
@@ -1117,12 +1777,12 @@ func IsLocalProject(jirix *jiri.X, path string) (bool, error) {
 // ProjectAtPath returns a Project struct corresponding to the project at the
 // path in the filesystem.
 func ProjectAtPath(jirix *jiri.X, path string) (Project, error) {
-	metadataFile := filepath.Join(path, jiri.ProjectMetaDir, jiri.ProjectMetaFile)
+	metadataFile := filepath.Join(metadataDir(path), jiri.ProjectMetaFile)
 	project, err := ProjectFromFile(jirix, metadataFile)
 	if err != nil {
 		return Project{}, err
 	}
-	localConfigFile := filepath.Join(path, jiri.ProjectMetaDir, jiri.ProjectConfigFile)
+	localConfigFile := filepath.Join(metadataDir(path), jiri.ProjectConfigFile)
 	if project.LocalConfig, err = LocalConfigFromFile(jirix, localConfigFile); err != nil {
 		return *project, fmt.Errorf("Error while reading config for project %s(%s): %s", project.Name, path, err)
 	}
@@ -1221,17 +1881,49 @@ func fetchAll(jirix *jiri.X, project Project) error {
 	if project.Remote == "" {
 		return fmt.Errorf("project %q does not have a remote", project.Name)
 	}
-	scm := gitutil.New(jirix, gitutil.RootDirOpt(project.Path))
 	remote := rewriteRemote(jirix, project.Remote)
-	if err := scm.SetRemoteUrl("origin", remote); err != nil {
+	if !project.usesGit() {
+		// Other version control systems fetch from the remote url itself.
+		return retry.Function(jirix, func() error {
+			return newSCM(jirix, project).Fetch(remote)
+		}, fmt.Sprintf("Fetching for %s", project.Path), retry.AttemptsOpt(jirix.Attempts))
+	}
+	if err := setRemote(jirix, project, remote); err != nil {
 		return err
 	}
-	if project.HistoryDepth > 0 {
-		return fetch(jirix, project.Path, "origin", gitutil.PruneOpt(true),
-			gitutil.DepthOpt(project.HistoryDepth), gitutil.UpdateShallowOpt(true))
-	} else {
-		return fetch(jirix, project.Path, "origin", gitutil.PruneOpt(true))
+	opts := []gitutil.FetchOpt{gitutil.PruneOpt(true), gitutil.PruneTagsOpt(jirix.PruneTags)}
+	if depth := project.fetchDepth(); depth > 0 {
+		opts = append(opts, gitutil.DepthOpt(depth), gitutil.UpdateShallowOpt(true))
+	}
+	// The manifest is validated when it is loaded.
+	if refspecs, _ := project.fetchRefspecs(); len(refspecs) > 0 {
+		// The branches have to be listed too, as the refspecs configured
+		// for the remote are not used once refspecs are given.
+		refspecs = append([]string{"+refs/heads/*:refs/" + project.RemoteRef("*")}, refspecs...)
+		opts = append(opts, gitutil.RefspecsOpt(refspecs))
 	}
+	return fetch(jirix, project.Path, project.GitRemoteName(), opts...)
+}
+
+// setRemote points the git remote of project to url.  A project whose
+// remotename changed still has its remote under the previous name, which is
+// renamed first.
+func setRemote(jirix *jiri.X, project Project, url string) error {
+	scm := gitutil.New(jirix, gitutil.RootDirOpt(project.Path))
+	name := project.GitRemoteName()
+	if _, err := scm.RemoteUrl(name); err != nil {
+		previous := DefaultRemoteName
+		if local, err := ProjectFromFile(jirix, filepath.Join(project.Path, jiri.ProjectMetaDir, jiri.ProjectMetaFile)); err == nil {
+			previous = local.GitRemoteName()
+		}
+		if _, err := scm.RemoteUrl(previous); err != nil || previous == name {
+			return scm.AddOrReplaceRemote(name, url)
+		}
+		if err := scm.RenameRemote(previous, name); err != nil {
+			return err
+		}
+	}
+	return scm.SetRemoteUrl(name, url)
 }
 
 func GetHeadRevision(jirix *jiri.X, project Project) (string, error) {
@@ -1242,7 +1934,74 @@ func GetHeadRevision(jirix *jiri.X, project Project) (string, error) {
 	if project.Revision != "HEAD" {
 		return project.Revision, nil
 	}
-	return "remotes/origin/" + project.RemoteBranch, nil
+	if !project.usesGit() {
+		// Mercurial resolves branch names to their tipmost head.
+		return project.RemoteBranch, nil
+	}
+	return project.RemoteRef(project.RemoteBranch), nil
+}
+
+// updateSubmodules checks out the git submodules of project at the commits
+// recorded in its current revision, if the project asks for it. Unless its
+// revision is no longer previous, this is only done for submodules which are
+// not initialized, e.g. as gitsubmodules was just set or the last update
+// failed. Nothing is done offline, as submodules may have to be fetched.
+// Submodules are fetched with the history depth of the project.
+func updateSubmodules(jirix *jiri.X, project Project, previous string) error {
+	if !project.GitSubmodules || project.LocalConfig.Ignore || project.LocalConfig.NoUpdate || jirix.Offline {
+		return nil
+	}
+	scm := gitutil.New(jirix, gitutil.RootDirOpt(project.Path))
+	if previous != "" {
+		if head, err := scm.CurrentRevision(); err == nil && head == previous && submodulesInitialized(scm) {
+			return nil
+		}
+	}
+	if err := scm.UpdateSubmodules(true, gitutil.DepthOpt(project.HistoryDepth)); err != nil {
+		return fmt.Errorf("not able to update submodules of project %s(%s): %v", project.Name, project.Path, err)
+	}
+	return nil
+}
+
+// submodulesInitialized returns true if all the submodules of the repository
+// are initialized.
+func submodulesInitialized(scm *gitutil.Git) bool {
+	submodules, err := scm.Submodules()
+	if err != nil {
+		return false
+	}
+	for _, s := range submodules {
+		if !s.Initialized {
+			return false
+		}
+	}
+	return true
+}
+
+// pullLFS sets up Git LFS in project and replaces the LFS pointer files of
+// its current revision with their content, if the project asks for it. Unless
+// its revision is no longer previous, this is only done if Git LFS is not set
+// up in the project, e.g. as lfs was just set or the last update failed.
+// Nothing is done offline, as LFS objects are fetched from the LFS server.
+func pullLFS(jirix *jiri.X, project Project, previous string) error {
+	if !project.LFS || project.LocalConfig.Ignore || project.LocalConfig.NoUpdate || jirix.Offline {
+		return nil
+	}
+	scm := gitutil.New(jirix, gitutil.RootDirOpt(project.Path))
+	if previous != "" {
+		if head, err := scm.CurrentRevision(); err == nil && head == previous {
+			if filter, err := scm.ConfigGetKey("filter.lfs.process"); err == nil && filter != "" {
+				return nil
+			}
+		}
+	}
+	if err := scm.LFSInstall(); err != nil {
+		return fmt.Errorf("not able to set up Git LFS in project %s(%s): %v", project.Name, project.Path, err)
+	}
+	if err := scm.LFSPull(); err != nil {
+		return fmt.Errorf("not able to pull Git LFS objects of project %s(%s): %v", project.Name, project.Path, err)
+	}
+	return nil
 }
 
 func checkoutHeadRevision(jirix *jiri.X, project Project, forceCheckout bool) error {
@@ -1251,23 +2010,118 @@ func checkoutHeadRevision(jirix *jiri.X, project Project, forceCheckout bool) er
 		return err
 	}
 	git := gitutil.New(jirix, gitutil.RootDirOpt(project.Path))
-	err = git.CheckoutBranch(revision, gitutil.DetachOpt(true), gitutil.ForceOpt(forceCheckout))
+	checkout := func() error {
+		if err := verifyRevision(jirix, project, revision); err != nil {
+			return err
+		}
+		err := git.CheckoutRevision(revision, gitutil.ForceOpt(forceCheckout))
+		if e, ok := err.(gitutil.CheckoutMismatchError); ok {
+			return checkoutMismatchError{project.Name, revision, e.Want, e.Got}
+		}
+		return err
+	}
+	err = checkout()
 	if err == nil {
 		return nil
 	}
+	switch err.(type) {
+	case signatureError, checkoutMismatchError:
+		return err
+	}
+	if jirix.Offline {
+		return fmt.Errorf("revision %q of project %q is not available locally, run without -offline to fetch it: %v", revision, project.Name, err)
+	}
 	if project.Revision != "" && project.Revision != "HEAD" {
 		//might be a tag
-		if err2 := fetch(jirix, project.Path, "origin", gitutil.FetchTagOpt(project.Revision)); err2 != nil {
+		if err2 := fetch(jirix, project.Path, project.GitRemoteName(), gitutil.FetchTagOpt(project.Revision)); err2 != nil {
 			// error while fetching tag, return original err and debug log this err
 			jirix.Logger.Debugf("Error while fetching tag for project %s (%s): %s\n\n", project.Name, project.Path, err2)
 			return err
 		} else {
-			return git.CheckoutBranch(revision, gitutil.DetachOpt(true), gitutil.ForceOpt(forceCheckout))
+			return checkout()
 		}
 	}
 	return err
 }
 
+// checkoutSCMRevision checks out the revision of a project which does not use
+// git, discarding its uncommitted changes if force is set.
+func checkoutSCMRevision(jirix *jiri.X, project Project, force bool) error {
+	revision, err := GetHeadRevision(jirix, project)
+	if err != nil {
+		return err
+	}
+	return newSCM(jirix, project).Checkout(revision, force)
+}
+
+// syncSCMProject advances a project which does not use git to its revision.
+// Such projects have no local branches to rebase, and their uncommitted changes
+// are never stashed: the project is left alone unless jirix.ForceUpdate is set.
+func syncSCMProject(jirix *jiri.X, project Project, report *updateReport) error {
+	files, err := newSCM(jirix, project).FilesWithUncommittedChanges()
+	if err != nil {
+		return fmt.Errorf("Cannot get uncommited changes for project %q: %s", project.Name, err)
+	}
+	if len(files) != 0 && !jirix.ForceUpdate {
+		// Reported by reportDirtyProjects once all the projects are updated.
+		report.addDirty(project, files)
+		return nil
+	}
+	if err := checkoutSCMRevision(jirix, project, jirix.ForceUpdate); err != nil {
+		jirix.Logger.Errorf("For project %q, not able to checkout latest, error: %s\n\n", project.Name, err)
+		jirix.IncrementFailures()
+	}
+	return nil
+}
+
+// checkoutMismatchError is returned when HEAD does not point to the expected
+// revision after a checkout reported success.  HEAD is restored to where it
+// was before the checkout.
+type checkoutMismatchError struct {
+	project  string
+	revision string
+	want     string
+	got      string
+}
+
+func (e checkoutMismatchError) Error() string {
+	if e.revision == e.want {
+		return fmt.Sprintf("project %q: HEAD is at %s after checking out %s", e.project, e.got, e.want)
+	}
+	return fmt.Sprintf("project %q: HEAD is at %s after checking out %s (%s)", e.project, e.got, e.revision, e.want)
+}
+
+// signatureError is returned when a project requires signed commits and the
+// revision it should be advanced to is not validly signed.
+type signatureError struct {
+	project  string
+	revision string
+	sig      gitutil.Signature
+}
+
+func (e signatureError) Error() string {
+	if e.sig.Status == gitutil.SignatureNone {
+		return fmt.Sprintf("project %q requires signed commits but %s is not signed", e.project, e.revision)
+	}
+	return fmt.Sprintf("project %q requires signed commits but %s has a %s signature (key %s)", e.project, e.revision, e.sig.Status, e.sig.KeyID)
+}
+
+// verifyRevision checks the signature of revision if the project sets the
+// verifycommit attribute.
+func verifyRevision(jirix *jiri.X, project Project, revision string) error {
+	if !project.VerifyCommit {
+		return nil
+	}
+	sig, err := gitutil.New(jirix, gitutil.RootDirOpt(project.Path)).VerifyCommit(revision)
+	if err != nil {
+		return err
+	}
+	if !sig.Valid() {
+		return signatureError{project.Name, revision, sig}
+	}
+	return nil
+}
+
 func tryRebase(jirix *jiri.X, project Project, branch string) (bool, error) {
 	scm := gitutil.New(jirix, gitutil.RootDirOpt(project.Path))
 	if err := scm.Rebase(branch); err != nil {
@@ -1277,9 +2131,80 @@ func tryRebase(jirix *jiri.X, project Project, branch string) (bool, error) {
 	return true, nil
 }
 
+// rebaseConflict records a local branch which could not be rebased during
+// an update.
+type rebaseConflict struct {
+	Project Project
+	Branch  string
+	Onto    string
+}
+
+// dirtyProject is a project which was not checked out because of its
+// uncommitted changes.
+type dirtyProject struct {
+	Project Project
+	Files   []string
+}
+
+// updateReport collects the rebase conflicts and the dirty projects of all
+// the projects being updated so that they can be summarized once the update
+// is done.
+type updateReport struct {
+	mu        sync.Mutex
+	conflicts []rebaseConflict
+	dirty     []dirtyProject
+}
+
+func (r *updateReport) addConflict(project Project, branch, onto string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.conflicts = append(r.conflicts, rebaseConflict{project, branch, onto})
+}
+
+func (r *updateReport) addDirty(project Project, files []string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.dirty = append(r.dirty, dirtyProject{project, files})
+}
+
+// reportRebaseConflicts lists the local branches which were left as they
+// were because rebasing them failed.
+func reportRebaseConflicts(jirix *jiri.X, c *updateReport) {
+	if len(c.conflicts) == 0 {
+		return
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		cwd = jirix.Root
+	}
+	sort.Slice(c.conflicts, func(i, j int) bool {
+		if c.conflicts[i].Project.Path != c.conflicts[j].Project.Path {
+			return c.conflicts[i].Project.Path < c.conflicts[j].Project.Path
+		}
+		return c.conflicts[i].Branch < c.conflicts[j].Branch
+	})
+	msg := "Local branches not rebased due to conflicts:"
+	for _, conflict := range c.conflicts {
+		relativePath, err := filepath.Rel(cwd, conflict.Project.Path)
+		if err != nil {
+			// Just use the full path if an error occurred.
+			relativePath = conflict.Project.Path
+		}
+		msg = fmt.Sprintf("%s\n%s (%s): %q onto %q", msg, conflict.Project.Name, relativePath, conflict.Branch, conflict.Onto)
+	}
+	msg += "\nThese branches were left unchanged, please rebase them manually.\n\n"
+	jirix.Logger.Errorf("%s", msg)
+}
+
 // syncProjectMaster checks out latest detached head if project is on one
 // else it rebases current branch onto its tracking branch
-func syncProjectMaster(jirix *jiri.X, project Project, state ProjectState, rebaseTracked, rebaseUntracked, rebaseAll, snapshot bool) error {
+func syncProjectMaster(jirix *jiri.X, project Project, state ProjectState, rebaseTracked, rebaseUntracked, rebaseAll, snapshot bool, report *updateReport) error {
 	cwd, err := os.Getwd()
 	if err != nil {
 		return fmtError(err)
@@ -1293,21 +2218,36 @@ func syncProjectMaster(jirix *jiri.X, project Project, state ProjectState, rebas
 		jirix.Logger.Warningf("Project %s(%s) won't be updated due to it's local-config\n\n", project.Name, relativePath)
 		return nil
 	}
+	if !project.usesGit() {
+		return syncSCMProject(jirix, project, report)
+	}
 
 	scm := gitutil.New(jirix, gitutil.RootDirOpt(project.Path))
 
-	if uncommitted, err := scm.HasUncommittedChanges(); err != nil {
+	if files, err := scm.FilesWithUncommittedChanges(); err != nil {
 		return fmt.Errorf("Cannot get uncommited changes for project %q: %s", project.Name, err)
-	} else if uncommitted {
-		msg := fmt.Sprintf("Project %s(%s) contains uncommited changes.", project.Name, relativePath)
-		msg += fmt.Sprintf("\nCommit or discard the changes and try again.\n\n")
-		jirix.Logger.Errorf(msg)
-		jirix.IncrementFailures()
+	} else if uncommitted := len(files) != 0; uncommitted && jirix.Autostash {
+		if _, err := scm.StashSave("jiri update autostash", gitutil.IncludeUntrackedOpt(true)); err != nil {
+			return err
+		}
+		// Registered first so that it runs after the original branch or
+		// detached head is restored below.
+		defer func() {
+			if err := scm.StashPop(); err != nil {
+				msg := fmt.Sprintf("For project %s(%s), not able to restore your stashed changes, error: %s", project.Name, relativePath, err)
+				msg += fmt.Sprintf("\nPlease restore them manually using: '%s'\n\n", jirix.Color.Yellow("git -C %q stash pop", relativePath))
+				jirix.Logger.Errorf("%s", msg)
+				jirix.IncrementFailures()
+			}
+		}()
+	} else if uncommitted && !jirix.ForceUpdate {
+		// Reported by reportDirtyProjects once all the projects are updated.
+		report.addDirty(project, files)
 		return nil
 	}
 
 	if state.CurrentBranch.Name == "" || snapshot { // detached head
-		if err := checkoutHeadRevision(jirix, project, false); err != nil {
+		if err := checkoutHeadRevision(jirix, project, jirix.ForceUpdate); err != nil {
 			revision, err2 := GetHeadRevision(jirix, project)
 			if err2 != nil {
 				return err2
@@ -1428,6 +2368,7 @@ func syncProjectMaster(jirix *jiri.X, project Project, state ProjectState, rebas
 				msg += "\nPlease do it manually\n\n"
 				jirix.Logger.Errorf(msg)
 				jirix.IncrementFailures()
+				report.addConflict(project, branch.Name, tracking.Name)
 				continue
 			}
 		} else {
@@ -1458,6 +2399,7 @@ func syncProjectMaster(jirix *jiri.X, project Project, state ProjectState, rebas
 					msg += "\nPlease do it manually\n\n"
 					jirix.Logger.Errorf(msg)
 					jirix.IncrementFailures()
+					report.addConflict(project, branch.Name, "JIRI_HEAD")
 					continue
 				}
 			} else if !rebaseUntrackedMessage {
@@ -1494,12 +2436,13 @@ func setRemoteHeadRevisions(jirix *jiri.X, remoteProjects Projects, localProject
 			for key := range keys {
 				local := localProjects[key]
 				remote := remoteProjects[key]
-				scm := gitutil.New(jirix, gitutil.RootDirOpt(local.Path))
-				b := "master"
+				b := remote.defaultBranch()
 				if remote.RemoteBranch != "" {
 					b = remote.RemoteBranch
 				}
-				rev, err := scm.CurrentRevisionForRef("remotes/origin/" + b)
+				checkout := remote
+				checkout.Path = local.Path
+				rev, err := newSCM(jirix, checkout).BranchRevision(b)
 				if err != nil {
 					errs <- err
 					return
@@ -1594,23 +2537,32 @@ func updateCache(jirix *jiri.X, remoteProjects Projects) error {
 	errs := make(chan error, len(remoteProjects))
 	var wg sync.WaitGroup
 	processingPath := make(map[string]bool)
-	fetchLimit := make(chan struct{}, jirix.Jobs)
+	fetchLimit := make(chan struct{}, jirix.FetchJobs)
+	hosts := newHostLimiter(jirix)
 	for _, project := range remoteProjects {
+		if project.Partial || !project.usesGit() {
+			// Partial projects are cloned from their remote directly, and
+			// the cache only holds git repositories.
+			continue
+		}
 		if cacheDirPath, err := project.CacheDirPath(jirix); err == nil {
 			if processingPath[cacheDirPath] {
 				continue
 			}
 			processingPath[cacheDirPath] = true
-			wg.Add(1)
-			fetchLimit <- struct{}{}
 			if err := project.fillDefaults(); err != nil {
 				errs <- err
 				continue
 			}
+			wg.Add(1)
 			go func(dir, remote string, depth int, branch string) {
-				defer func() { <-fetchLimit }()
 				defer wg.Done()
 				remote = rewriteRemote(jirix, remote)
+				// Wait for the host first, so that projects on other hosts
+				// can use the remaining fetch slots meanwhile.
+				defer hosts.acquire(remote)()
+				fetchLimit <- struct{}{}
+				defer func() { <-fetchLimit }()
 				if err := updateOrCreateCache(jirix, dir, remote, branch, depth); err != nil {
 					errs <- err
 					return
@@ -1637,9 +2589,9 @@ func updateCache(jirix *jiri.X, remoteProjects Projects) error {
 func fetchLocalProjects(jirix *jiri.X, localProjects, remoteProjects Projects) error {
 	jirix.TimerPush("fetch local projects")
 	defer jirix.TimerPop()
-	fetchLimit := make(chan struct{}, jirix.Jobs)
-	errs := make(chan error, len(localProjects))
-	var wg sync.WaitGroup
+	fetchLimit := make(chan struct{}, jirix.FetchJobs)
+	hosts := newHostLimiter(jirix)
+	var toFetch []Project
 	for key, project := range localProjects {
 		if r, ok := remoteProjects[key]; ok {
 			if project.LocalConfig.Ignore || project.LocalConfig.NoUpdate {
@@ -1650,21 +2602,32 @@ func fetchLocalProjects(jirix *jiri.X, localProjects, remoteProjects Projects) e
 			if r.Remote != project.Remote {
 				continue
 			}
-			wg.Add(1)
-			fetchLimit <- struct{}{}
 			project.HistoryDepth = r.HistoryDepth
-			go func(project Project) {
-				defer func() { <-fetchLimit }()
-				defer wg.Done()
-				task := jirix.Logger.AddTaskMsg("Fetching remotes for project %q", project.Name)
-				defer task.Done()
-				if err := fetchAll(jirix, project); err != nil {
-					errs <- fmt.Errorf("fetch failed for %v: %v", project.Name, err)
-					return
-				}
-			}(project)
+			project.FetchDepth = r.FetchDepth
+			project.FetchRefspec = r.FetchRefspec
+			project.RemoteName = r.RemoteName
+			toFetch = append(toFetch, project)
 		}
 	}
+	bar := jirix.Logger.StartProgressBar("Fetching projects", len(toFetch))
+	defer bar.Finish()
+	errs := make(chan error, len(toFetch))
+	var wg sync.WaitGroup
+	for _, project := range toFetch {
+		wg.Add(1)
+		go func(project Project) {
+			defer wg.Done()
+			defer hosts.acquire(rewriteRemote(jirix, project.Remote))()
+			fetchLimit <- struct{}{}
+			defer func() { <-fetchLimit }()
+			bar.Start(project.Name)
+			defer bar.Done(project.Name)
+			if err := fetchAll(jirix, project); err != nil {
+				errs <- fmt.Errorf("fetch failed for %v: %v", project.Name, err)
+				return
+			}
+		}(project)
+	}
 	wg.Wait()
 	close(errs)
 
@@ -1678,15 +2641,88 @@ func fetchLocalProjects(jirix *jiri.X, localProjects, remoteProjects Projects) e
 	return nil
 }
 
+// precheckRemotes checks that the remote of one project per remote host can
+// be read before projects are fetched, so that missing credentials or a host
+// which cannot be reached fail the update once, upfront, rather than slowly
+// for every project of the host.  Remotes on the local filesystem are not
+// checked.
+func precheckRemotes(jirix *jiri.X, remoteProjects Projects) error {
+	jirix.TimerPush("precheck remotes")
+	defer jirix.TimerPop()
+	var keys ProjectKeys
+	for key := range remoteProjects {
+		keys = append(keys, key)
+	}
+	sort.Sort(keys)
+	remotes := make(map[string]string)
+	var hosts []string
+	for _, key := range keys {
+		if !remoteProjects[key].usesGit() {
+			// Access is checked with git.
+			continue
+		}
+		remote := rewriteRemote(jirix, remoteProjects[key].Remote)
+		host := remoteHost(remote)
+		if host == "" {
+			continue
+		}
+		if _, ok := remotes[host]; !ok {
+			remotes[host] = remote
+			hosts = append(hosts, host)
+		}
+	}
+	errs := make([]error, len(hosts))
+	var wg sync.WaitGroup
+	for i, host := range hosts {
+		wg.Add(1)
+		go func(i int, remote string) {
+			defer wg.Done()
+			errs[i] = retry.Function(jirix, func() error {
+				return gitutil.New(jirix, gitutil.RootDirOpt(jirix.Root)).CheckRemoteAccess(remote)
+			}, fmt.Sprintf("Checking access to %s", remote), retry.AttemptsOpt(jirix.Attempts))
+		}(i, remotes[host])
+	}
+	wg.Wait()
+	var failed []string
+	for i, err := range errs {
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", hosts[i], err))
+		}
+	}
+	if len(failed) != 0 {
+		return fmt.Errorf("cannot read from %d of %d remote hosts:\n%s\nCheck that your credentials for these hosts are set up, for instance in ~/.gitcookies, ~/.netrc or as an ssh key, and that the hosts can be reached, then run the update again. Pass -skip-precheck to update anyway.", len(failed), len(hosts), strings.Join(failed, "\n"))
+	}
+	return nil
+}
+
 func updateProjects(jirix *jiri.X, localProjects, remoteProjects Projects, hooks Hooks, pkgs Packages, gc bool, runHookTimeout, fetchTimeout uint, rebaseTracked, rebaseUntracked, rebaseAll, snapshot, shouldRunHooks, shouldFetchPkgs bool) error {
 	jirix.TimerPush("update projects")
 	defer jirix.TimerPop()
 
-	if err := updateCache(jirix, remoteProjects); err != nil {
+	if err := checkProtocols(localProjects, remoteProjects); err != nil {
 		return err
 	}
-	if err := fetchLocalProjects(jirix, localProjects, remoteProjects); err != nil {
-		return err
+	if jirix.Offline {
+		jirix.Logger.Infof("Offline mode, projects are not fetched")
+	} else if jirix.DryRun {
+		jirix.Logger.Infof("Dry run, projects are not fetched")
+	} else {
+		if !jirix.SkipPrecheck {
+			if err := precheckRemotes(jirix, remoteProjects); err != nil {
+				return err
+			}
+		}
+		if err := updateCache(jirix, remoteProjects); err != nil {
+			return err
+		}
+		if err := fetchLocalProjects(jirix, localProjects, remoteProjects); err != nil {
+			return err
+		}
+		if jirix.Unshallow {
+			if err := unshallowProjects(jirix, localProjects, remoteProjects); err != nil {
+				return err
+			}
+		}
 	}
 	states, err := GetProjectStates(jirix, localProjects, false)
 	if err != nil {
@@ -1696,7 +2732,8 @@ func updateProjects(jirix *jiri.X, localProjects, remoteProjects Projects, hooks
 		return err
 	}
 
-	ops := computeOperations(localProjects, remoteProjects, states, gc, rebaseTracked, rebaseUntracked, rebaseAll, snapshot)
+	report := &updateReport{}
+	ops := computeOperations(localProjects, remoteProjects, states, gc, rebaseTracked, rebaseUntracked, rebaseAll, snapshot, report)
 	moveOperations := []moveOperation{}
 	changeRemoteOperations := operations{}
 	deleteOperations := []deleteOperation{}
@@ -1723,6 +2760,37 @@ func updateProjects(jirix *jiri.X, localProjects, remoteProjects Projects, hooks
 			nullOperations = append(nullOperations, o)
 		}
 	}
+	if jirix.Offline {
+		if err := checkOffline(jirix, localProjects, remoteProjects, createOperations, changeRemoteOperations); err != nil {
+			return err
+		}
+	}
+	if jirix.DryRun {
+		var changes operations
+		for _, op := range deleteOperations {
+			changes = append(changes, op)
+		}
+		changes = append(changes, changeRemoteOperations...)
+		for _, op := range moveOperations {
+			changes = append(changes, op)
+		}
+		changes = append(changes, updateOperations...)
+		for _, op := range createOperations {
+			changes = append(changes, op)
+		}
+		var dirtyProjects []dirtyProject
+		if !jirix.Autostash && !jirix.ForceUpdate {
+			var checkouts operations
+			checkouts = append(checkouts, changeRemoteOperations...)
+			for _, op := range moveOperations {
+				checkouts = append(checkouts, op)
+			}
+			checkouts = append(checkouts, updateOperations...)
+			dirtyProjects = findDirtyProjects(jirix, checkouts)
+		}
+		reportUpdatePlan(jirix, changes, nullOperations, dirtyProjects, gc)
+		return nil
+	}
 	if err := runDeleteOperations(jirix, deleteOperations, gc); err != nil {
 		return err
 	}
@@ -1743,7 +2811,8 @@ func updateProjects(jirix *jiri.X, localProjects, remoteProjects Projects, hooks
 	}
 	jirix.TimerPush("jiri revision files")
 	for _, project := range remoteProjects {
-		if !(project.LocalConfig.Ignore || project.LocalConfig.NoUpdate) {
+		// JIRI_HEAD and push targets are git refs and configuration.
+		if project.usesGit() && !(project.LocalConfig.Ignore || project.LocalConfig.NoUpdate) {
 			project.writeJiriRevisionFiles(jirix)
 			if err := project.setupDefaultPushTarget(jirix); err != nil {
 				jirix.Logger.Debugf("set up default push target failed due to error: %v", err)
@@ -1776,8 +2845,12 @@ func updateProjects(jirix *jiri.X, localProjects, remoteProjects Projects, hooks
 		}
 		jirix.Logger.Warningf("%s\n\n", msg)
 	}
+	reportDirtyProjects(jirix, report.dirty)
+	reportRebaseConflicts(jirix, report)
 
-	if shouldFetchPkgs && len(pkgs) > 0 {
+	if shouldFetchPkgs && len(pkgs) > 0 && jirix.Offline {
+		jirix.Logger.Warningf("Offline mode, packages are not fetched\n\n")
+	} else if shouldFetchPkgs && len(pkgs) > 0 {
 		if err := FetchPackages(jirix, pkgs, fetchTimeout); err != nil {
 			return err
 		}
@@ -1796,6 +2869,80 @@ func updateProjects(jirix *jiri.X, localProjects, remoteProjects Projects, hooks
 	return nil
 }
 
+// isShallow returns true if the repository of the project is a shallow clone.
+// The shallow file lives in the common git directory, which is not .git in
+// submodules and linked working trees.
+func isShallow(jirix *jiri.X, project Project) (bool, error) {
+	gitDir, err := gitutil.New(jirix, gitutil.RootDirOpt(project.Path)).GitCommonDir()
+	if err != nil {
+		return false, err
+	}
+	if _, err := os.Stat(filepath.Join(gitDir, "shallow")); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, fmtError(err)
+	}
+	return true, nil
+}
+
+// unshallowProjects fetches the full history of local projects which are
+// shallow clones but no longer have a history, clone or fetch depth in the
+// manifest.
+// Complete repositories are skipped.
+func unshallowProjects(jirix *jiri.X, localProjects, remoteProjects Projects) error {
+	jirix.TimerPush("unshallow projects")
+	defer jirix.TimerPop()
+	for key, local := range localProjects {
+		remote, ok := remoteProjects[key]
+		if !ok || remote.HistoryDepth > 0 || remote.CloneDepth > 0 || remote.FetchDepth > 0 || !local.usesGit() || local.LocalConfig.Ignore || local.LocalConfig.NoUpdate {
+			continue
+		}
+		if shallow, err := isShallow(jirix, local); err != nil {
+			return err
+		} else if !shallow {
+			continue
+		}
+		jirix.Logger.Infof("Fetching full history of shallow project %s(%s)", local.Name, local.Path)
+		msg := fmt.Sprintf("Unshallowing %s", local.Path)
+		if err := retry.Function(jirix, func() error {
+			return gitutil.New(jirix, gitutil.RootDirOpt(local.Path)).Unshallow(remote.GitRemoteName())
+		}, msg, retry.AttemptsOpt(jirix.Attempts)); err != nil {
+			return fmt.Errorf("Unshallow failed for project %s(%s): %v", local.Name, local.Path, err)
+		}
+	}
+	return nil
+}
+
+// checkOffline returns an error if updating to remoteProjects needs network
+// access, which is not available in offline mode.
+func checkOffline(jirix *jiri.X, localProjects, remoteProjects Projects, createOperations []createOperation, changeRemoteOperations operations) error {
+	var missing []string
+	for _, op := range createOperations {
+		missing = append(missing, fmt.Sprintf("%s (not cloned)", op.project.Name))
+	}
+	for _, op := range changeRemoteOperations {
+		missing = append(missing, fmt.Sprintf("%s (remote changed)", op.Project().Name))
+	}
+	for key, remote := range remoteProjects {
+		local, ok := localProjects[key]
+		if !ok || local.LocalConfig.Ignore || local.LocalConfig.NoUpdate {
+			continue
+		}
+		if remote.Revision == "" || remote.Revision == "HEAD" {
+			continue
+		}
+		if _, err := newSCM(jirix, local).ResolveRevision(remote.Revision); err != nil {
+			missing = append(missing, fmt.Sprintf("%s (revision %s not found)", remote.Name, remote.Revision))
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	sort.Strings(missing)
+	return fmt.Errorf("projects need to be fetched from their remotes, run without -offline:\n%s", strings.Join(missing, "\n"))
+}
+
 type ProjectStatus struct {
 	Project      Project
 	HasChanges   bool
@@ -1821,12 +2968,12 @@ func getProjectStatus(jirix *jiri.X, ps Projects) ([]ProjectStatus, MultiError)
 				if project.LocalConfig.Ignore || project.LocalConfig.NoUpdate {
 					continue
 				}
-				scm := gitutil.New(jirix, gitutil.RootDirOpt(project.Path))
-				uncommitted, err := scm.HasUncommittedChanges()
+				files, err := newSCM(jirix, project).FilesWithUncommittedChanges()
 				if err != nil {
 					errs <- fmt.Errorf("Cannot get uncommited changes for project %q: %s", project.Name, err)
 					continue
 				}
+				uncommitted := len(files) != 0
 
 				isOnJiriHead, err := project.IsOnJiriHead(jirix)
 				if err != nil {
@@ -1854,13 +3001,126 @@ func getProjectStatus(jirix *jiri.X, ps Projects) ([]ProjectStatus, MultiError)
 	return psa, multiErr
 }
 
+// findDirtyProjects returns the projects of ops which have uncommitted
+// changes, and so would not be checked out by the update. It is only used to
+// preview the update: the projects whose changes cannot be read are left out
+// with a warning.
+func findDirtyProjects(jirix *jiri.X, ops operations) []dirtyProject {
+	workQueue := make(chan Project, len(ops))
+	for _, op := range ops {
+		workQueue <- op.localProject()
+	}
+	close(workQueue)
+	dirty := make(chan dirtyProject, len(ops))
+	var wg sync.WaitGroup
+	for i := uint(0); i < jirix.Jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for project := range workQueue {
+				if project.LocalConfig.Ignore || project.LocalConfig.NoUpdate {
+					continue
+				}
+				files, err := newSCM(jirix, project).FilesWithUncommittedChanges()
+				if err != nil {
+					jirix.Logger.Warningf("Cannot get uncommited changes for project %q: %s\n\n", project.Name, err)
+					continue
+				}
+				if len(files) != 0 {
+					dirty <- dirtyProject{project, files}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(dirty)
+
+	var projects []dirtyProject
+	for d := range dirty {
+		projects = append(projects, d)
+	}
+	sort.Slice(projects, func(i, j int) bool {
+		return projects[i].Project.Path < projects[j].Project.Path
+	})
+	return projects
+}
+
+// reportUpdatePlan reports what updating the projects would do, listing the
+// operations that change projects separately from the projects which are
+// already up-to-date.
+func reportUpdatePlan(jirix *jiri.X, changes, unchanged operations, dirty []dirtyProject, gc bool) {
+	msg := "Dry run, no changes were made."
+	if len(changes) == 0 {
+		msg += "\nNo projects would change."
+	} else {
+		msg += "\nProjects that would change:"
+		for _, op := range changes {
+			if _, ok := op.(deleteOperation); ok && !gc {
+				msg = fmt.Sprintf("%s\n  %s (only with -gc, otherwise left in place)", msg, op)
+				continue
+			}
+			msg = fmt.Sprintf("%s\n  %s", msg, op)
+		}
+	}
+	if len(dirty) != 0 {
+		msg += "\nProjects that would not be updated as they contain uncommited changes:"
+		for _, d := range dirty {
+			msg = fmt.Sprintf("%s\n  %s (%s)", msg, d.Project.Name, d.Project.Path)
+		}
+	}
+	if len(unchanged) != 0 {
+		msg += "\nProjects already up-to-date:"
+		for _, op := range unchanged {
+			msg = fmt.Sprintf("%s\n  %s (%s)", msg, op.Project().Name, op.Project().Path)
+		}
+	}
+	jirix.Logger.Infof("%s\n\n", msg)
+}
+
+// reportDirtyProjects reports the projects which were not updated because of
+// their uncommitted changes.
+func reportDirtyProjects(jirix *jiri.X, projects []dirtyProject) {
+	if len(projects) == 0 {
+		return
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		cwd = jirix.Root
+	}
+	sort.Slice(projects, func(i, j int) bool {
+		return projects[i].Project.Path < projects[j].Project.Path
+	})
+	msg := "Projects not updated as they contain uncommited changes:"
+	for _, d := range projects {
+		relativePath, err := filepath.Rel(cwd, d.Project.Path)
+		if err != nil {
+			// Just use the full path if an error occurred.
+			relativePath = d.Project.Path
+		}
+		msg = fmt.Sprintf("%s\n%s (%s):", msg, d.Project.Name, relativePath)
+		for _, file := range d.Files {
+			msg = fmt.Sprintf("%s\n  %s", msg, file)
+		}
+		jirix.IncrementFailures()
+	}
+	msg += "\nCommit or discard the changes and try again, or run with -autostash or -force.\n\n"
+	jirix.Logger.Errorf("%s", msg)
+}
+
+// writeUpdatedMetadata stores the given project metadata in the directory
+// identified by the given path, recording that the project was just updated.
+func writeUpdatedMetadata(jirix *jiri.X, project Project, dir string) error {
+	project.LastUpdate = time.Now().UTC().Format(time.RFC3339)
+	return writeMetadata(jirix, project, dir)
+}
+
 // writeMetadata stores the given project metadata in the directory
 // identified by the given path.
 func writeMetadata(jirix *jiri.X, project Project, dir string) (e error) {
-	metadataDir := filepath.Join(dir, jiri.ProjectMetaDir)
-	if err := os.MkdirAll(metadataDir, os.FileMode(0755)); err != nil {
+	metaDir := metadataDir(dir)
+	if err := os.MkdirAll(metaDir, os.FileMode(0755)); err != nil {
 		return fmtError(err)
 	}
-	metadataFile := filepath.Join(metadataDir, jiri.ProjectMetaFile)
+	metadataFile := filepath.Join(metaDir, jiri.ProjectMetaFile)
 	return project.ToFile(jirix, metadataFile)
 }
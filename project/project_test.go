@@ -11,16 +11,21 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"reflect"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/dahlia-os/jiri"
 	"github.com/dahlia-os/jiri/cipd"
 	"github.com/dahlia-os/jiri/gitutil"
+	"github.com/dahlia-os/jiri/hgutil"
 	"github.com/dahlia-os/jiri/jiritest"
 	"github.com/dahlia-os/jiri/project"
 )
@@ -821,6 +826,87 @@ func TestRecursiveImportWhenOriginalManifestIsImportedAgain(t *testing.T) {
 	}
 }
 
+// TestLocalManifestProjects tests that only the imports of the manifest
+// projects in jirix.LocalManifests are read from their local checkouts.
+func TestLocalManifestProjects(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	defer func() { fake.X.LocalManifests = nil }()
+
+	// Import a second manifest project.
+	otherManifest := "othermanifest"
+	if err := fake.CreateRemoteProject(otherManifest); err != nil {
+		t.Fatal(err)
+	}
+	other := &project.Manifest{
+		Projects: []project.Project{{
+			Name:   otherManifest,
+			Path:   otherManifest,
+			Remote: fake.Projects[otherManifest],
+		}},
+	}
+	if err := other.ToFile(fake.X, filepath.Join(fake.Projects[otherManifest], "manifest")); err != nil {
+		t.Fatal(err)
+	}
+	commitFile(t, fake.X, fake.Projects[otherManifest], "manifest", "1")
+	jiriManifest, err := fake.ReadJiriManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	jiriManifest.Imports = append(jiriManifest.Imports, project.Import{
+		Name:     otherManifest,
+		Remote:   fake.Projects[otherManifest],
+		Manifest: "manifest",
+	})
+	if err := fake.WriteJiriManifest(jiriManifest); err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+
+	// Locally pin the first project in the manifest project, and locally
+	// add a project in the other manifest project.
+	pinned, err := gitutil.New(fake.X, gitutil.RootDirOpt(localProjects[0].Path)).CurrentRevision()
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := fake.ReadRemoteManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range manifest.Projects {
+		if manifest.Projects[i].Name == localProjects[0].Name {
+			manifest.Projects[i].Revision = pinned
+		}
+	}
+	if err := manifest.ToFile(fake.X, filepath.Join(fake.X.Root, jiritest.ManifestProjectPath, jiritest.ManifestFileName)); err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.CreateRemoteProject("extra"); err != nil {
+		t.Fatal(err)
+	}
+	writeReadme(t, fake.X, fake.Projects["extra"], "initial readme")
+	other.Projects = append(other.Projects, project.Project{Name: "extra", Path: "extra", Remote: fake.Projects["extra"]})
+	if err := other.ToFile(fake.X, filepath.Join(fake.X.Root, otherManifest, "manifest")); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, fake.X, fake.Projects[localProjects[0].Name], "file1", "file1")
+
+	fake.X.LocalManifests = []string{jiritest.ManifestProjectName}
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := gitutil.New(fake.X, gitutil.RootDirOpt(localProjects[0].Path)).CurrentRevision(); err != nil {
+		t.Fatal(err)
+	} else if got != pinned {
+		t.Errorf("project %q is at %q, want the locally pinned %q", localProjects[0].Name, got, pinned)
+	}
+	if _, err := os.Stat(filepath.Join(fake.X.Root, "extra")); !os.IsNotExist(err) {
+		t.Errorf("project added by the local manifest of %q was created: %v", otherManifest, err)
+	}
+}
+
 func TestProjectUpdateWhenIgnore(t *testing.T) {
 	localProjects, fake, cleanup := setupUniverse(t)
 	defer cleanup()
@@ -986,48 +1072,933 @@ func TestHookLoadError(t *testing.T) {
 	}
 }
 
-// TestUpdateUniverseWithRevision checks that UpdateUniverse will pull remote
-// projects at the specified revision.
-func TestUpdateUniverseWithRevision(t *testing.T) {
-	localProjects, fake, cleanup := setupUniverse(t)
+// TestHookProjectEnv tests that hooks run with the environment declared by
+// their project, and that project variables override jiri's environment.
+func TestHookProjectEnv(t *testing.T) {
+	p, fake, cleanup := setupUniverse(t)
 	defer cleanup()
+	script := "#!/bin/sh\necho \"$FOO $BAR\" > env.out\n"
+	path := filepath.Join(fake.Projects[p[0].Name], "action.sh")
+	if err := ioutil.WriteFile(path, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	commitFile(t, fake.X, fake.Projects[p[0].Name], path, "add action.sh")
 
-	// Set project 1's revision in the manifest to the current revision.
-	g := gitutil.New(fake.X, gitutil.RootDirOpt(fake.Projects[localProjects[1].Name]))
-	rev, err := g.CurrentRevision()
+	m, err := fake.ReadRemoteManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range m.Projects {
+		if m.Projects[i].Name == p[0].Name {
+			m.Projects[i].Env = "FOO=project"
+		}
+	}
+	m.Hooks = append(m.Hooks, project.Hook{Name: "hook1",
+		Action:      "action.sh",
+		ProjectName: p[0].Name})
+	if err := fake.WriteRemoteManifest(m); err != nil {
+		t.Fatal(err)
+	}
+
+	env := fake.X.Env()
+	env["FOO"] = "global"
+	env["BAR"] = "global"
+	defer delete(env, "FOO")
+	defer delete(env, "BAR")
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(p[0].Path, "env.out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.TrimSpace(string(data)), "project global"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// TestHookArgsAndCwd tests that hooks run with their arguments in their cwd
+// directory.
+func TestHookArgsAndCwd(t *testing.T) {
+	p, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	remote := fake.Projects[p[0].Name]
+	script := "#!/bin/sh\nfor arg in \"$@\"; do echo \"$arg\"; done > args.out\n"
+	if err := os.MkdirAll(filepath.Join(remote, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{"action.sh", "sub/.keep"} {
+		if err := ioutil.WriteFile(filepath.Join(remote, file), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+		commitFile(t, fake.X, remote, file, "add "+file)
+	}
+	if err := fake.AddHook(project.Hook{Name: "hook1",
+		Action:      "action.sh",
+		ProjectName: p[0].Name,
+		Args:        "a  b",
+		ArgList:     []string{"c d"},
+		Cwd:         "sub"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(p[0].Path, "sub", "args.out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(data), "a\nb\nc d\n"; got != want {
+		t.Errorf("got arguments %q, want %q", got, want)
+	}
+}
+
+// TestHookArgsFromXML tests that hook arguments are read from the args
+// attribute and the <arg> children.
+func TestHookArgsFromXML(t *testing.T) {
+	data := `<manifest><hooks><hook name="h" project="p" action="a.sh" args="a b" cwd="sub"><arg>c d</arg><arg>e</arg></hook></hooks></manifest>`
+	m, err := project.ManifestFromBytes([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := project.Hook{Name: "h", ProjectName: "p", Action: "a.sh", Args: "a b", ArgList: []string{"c d", "e"}, Cwd: "sub"}
+	if len(m.Hooks) != 1 || !reflect.DeepEqual(m.Hooks[0], want) {
+		t.Errorf("got hooks %+v, want %+v", m.Hooks, want)
+	}
+}
+
+// TestHookCwdInvalid tests that hooks can not run outside of their project.
+func TestHookCwdInvalid(t *testing.T) {
+	p, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	if err := fake.AddHook(project.Hook{Name: "hook1",
+		Action:      "action.sh",
+		ProjectName: p[0].Name,
+		Cwd:         "../" + filepath.Base(p[0].Path)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.UpdateUniverse(false); err == nil || !strings.Contains(err.Error(), "cwd must be a directory inside the project") {
+		t.Errorf("expected an error for a cwd outside of the project, got %v", err)
+	}
+}
+
+// TestProjectEnvInvalid tests that malformed project env is rejected.
+func TestProjectEnvInvalid(t *testing.T) {
+	for _, env := range []string{"FOO=bar,BAZ", "=bar", "FOO=bar,"} {
+		data := `<manifest><projects><project name="a" path="a" remote="r" env="` + env + `"/></projects></manifest>`
+		_, err := project.ManifestFromBytes([]byte(data))
+		if err == nil || !strings.Contains(err.Error(), "invalid env entry") {
+			t.Errorf("env %q: expected invalid env error, got %v", env, err)
+		}
+	}
+}
+
+// TestProjectEnvVars tests that <env> children are parsed, may contain
+// commas and are validated.
+func TestProjectEnvVars(t *testing.T) {
+	data := `<manifest><projects><project name="a" path="a" remote="r">
+<env name="FOO" value="a,b=c"/>
+<env name="PATH" value="/bin" merge="append"/>
+</project></projects></manifest>`
+	m, err := project.ManifestFromBytes([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := m.Projects[0].Environment(map[string]string{"FOO": "x", "PATH": "/usr/bin:/bin"})
+	if got, want := env["FOO"], "a,b=c"; got != want {
+		t.Errorf("FOO: got %q, want %q", got, want)
+	}
+	if got, want := env["PATH"], "/usr/bin:/bin"; got != want {
+		t.Errorf("PATH: got %q, want %q", got, want)
+	}
+	out, err := m.ToBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `<env name="FOO" value="a,b=c"/>`; !strings.Contains(string(out), want) {
+		t.Errorf("manifest %s does not contain %s", out, want)
+	}
+
+	for _, env := range []string{`name=""`, `name="FOO" merge="bad"`} {
+		data := `<manifest><projects><project name="a" path="a" remote="r"><env ` + env + ` value="v"/></project></projects></manifest>`
+		if _, err := project.ManifestFromBytes([]byte(data)); err == nil || !strings.Contains(err.Error(), "invalid") {
+			t.Errorf("env %s: expected invalid env error, got %v", env, err)
+		}
+	}
+}
+
+// TestProjectPartialWithDepth tests that a project can not be both a partial
+// and a shallow clone.
+func TestProjectPartialWithDepth(t *testing.T) {
+	data := `<manifest><projects><project name="a" path="a" remote="r" partial="true" historydepth="1"/></projects></manifest>`
+	_, err := project.ManifestFromBytes([]byte(data))
+	if err == nil || !strings.Contains(err.Error(), "cannot both be set") {
+		t.Errorf("expected partial and historydepth error, got %v", err)
+	}
+}
+
+func TestProjectProtocol(t *testing.T) {
+	data := `<manifest><projects><project name="a" path="a" remote="r" protocol="git"/></projects></manifest>`
+	if _, err := project.ManifestFromBytes([]byte(data)); err != nil {
+		t.Errorf("unexpected error for git protocol: %v", err)
+	}
+	data = `<manifest><projects><project name="a" path="a" remote="r" protocol="hg"/></projects></manifest>`
+	m, err := project.ManifestFromBytes([]byte(data))
 	if err != nil {
+		t.Errorf("unexpected error for hg protocol: %v", err)
+	} else if got, want := m.Projects[0].RemoteBranch, "default"; got != want {
+		t.Errorf("got remote branch %q for hg project, want %q", got, want)
+	}
+	data = `<manifest><projects><project name="a" path="a" remote="r" protocol="hg" historydepth="1" githooks="hooks"/></projects></manifest>`
+	_, err = project.ManifestFromBytes([]byte(data))
+	if err == nil || !strings.Contains(err.Error(), `historydepth, githooks not supported with the "hg" protocol`) {
+		t.Errorf("expected git attributes error, got %v", err)
+	}
+	data = `<manifest><projects><project name="a" path="a" remote="r" protocol="svn"/></projects></manifest>`
+	_, err = project.ManifestFromBytes([]byte(data))
+	if err == nil || !strings.Contains(err.Error(), `protocol "svn" is not supported`) {
+		t.Errorf("expected unsupported protocol error, got %v", err)
+	}
+}
+
+// TestUpdateUniversePrecheck checks that an update fails before fetching
+// anything if a remote host cannot be read.
+func TestUpdateUniversePrecheck(t *testing.T) {
+	_, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	if err := fake.CreateRemoteProject("new"); err != nil {
+		t.Fatal(err)
+	}
+	newProject := project.Project{
+		Name:   "new",
+		Path:   filepath.Join(fake.X.Root, "new"),
+		Remote: fake.Projects["new"],
+	}
+	if err := fake.AddProject(newProject); err != nil {
+		t.Fatal(err)
+	}
+	// Nothing listens on port 1.
+	if err := fake.AddProject(project.Project{
+		Name:   "unreachable",
+		Path:   filepath.Join(fake.X.Root, "unreachable"),
+		Remote: "http://127.0.0.1:1/unreachable",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	err := fake.UpdateUniverse(false)
+	if err == nil || !strings.Contains(err.Error(), "cannot read from 1 of 1 remote hosts") || !strings.Contains(err.Error(), "127.0.0.1") {
+		t.Fatalf("expected the precheck to fail for 127.0.0.1, got %v", err)
+	}
+	if err := dirExists(newProject.Path); err == nil {
+		t.Errorf("expected project %q not to be created", newProject.Name)
+	}
+
+	// The precheck can be skipped, the update then fails for the
+	// unreachable project only.
+	fake.X.SkipPrecheck = true
+	defer func() { fake.X.SkipPrecheck = false }()
+	if err := fake.UpdateUniverse(false); err == nil || strings.Contains(err.Error(), "remote hosts") {
+		t.Fatalf("expected the update to fail without precheck, got %v", err)
+	}
+	if err := dirExists(newProject.Path); err != nil {
+		t.Errorf("expected project %q to be created: %v", newProject.Name, err)
+	}
+}
+
+// TestUpdateUniverseLFS checks that projects with lfs set have Git LFS set
+// up, and that a missing git-lfs is reported.
+func TestUpdateUniverseLFS(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	if err := fake.UpdateUniverse(false); err != nil {
 		t.Fatal(err)
 	}
+	p := localProjects[1]
 	m, err := fake.ReadRemoteManifest()
 	if err != nil {
 		t.Fatal(err)
 	}
-	projects := []project.Project{}
-	for _, p := range m.Projects {
-		if p.Name == localProjects[1].Name {
-			p.Revision = rev
+	for i := range m.Projects {
+		if m.Projects[i].Name == p.Name {
+			m.Projects[i].LFS = true
 		}
-		projects = append(projects, p)
 	}
-	m.Projects = projects
 	if err := fake.WriteRemoteManifest(m); err != nil {
 		t.Fatal(err)
 	}
-	// Update README in all projects.
-	for _, remoteProjectDir := range fake.Projects {
-		writeReadme(t, fake.X, remoteProjectDir, "new revision")
+	err = fake.UpdateUniverse(false)
+	if _, lookErr := exec.LookPath("git-lfs"); lookErr != nil {
+		if err == nil || !strings.Contains(err.Error(), gitutil.ErrLFSNotInstalled.Error()) {
+			t.Fatalf("expected an error about git-lfs not being installed, got %v", err)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	filter, err := gitutil.New(fake.X, gitutil.RootDirOpt(p.Path)).ConfigGetKey("filter.lfs.process")
+	if err != nil || filter == "" {
+		t.Errorf("expected Git LFS to be set up in project %q: %q, %v", p.Name, filter, err)
+	}
+}
+
+// TestUpdateUniverseProtocolChange checks that projects are not converted
+// from one version control system to another.
+func TestUpdateUniverseProtocolChange(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	p := localProjects[1]
+	m, err := fake.ReadRemoteManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range m.Projects {
+		if m.Projects[i].Name == p.Name {
+			m.Projects[i].Protocol = "hg"
+			m.Projects[i].RemoteBranch = ""
+		}
+	}
+	if err := fake.WriteRemoteManifest(m); err != nil {
+		t.Fatal(err)
+	}
+	err = fake.UpdateUniverse(false)
+	if err == nil || !strings.Contains(err.Error(), `uses the "git" protocol but the manifest asks for "hg"`) {
+		t.Errorf("expected a protocol change error, got %v", err)
+	}
+}
+
+// TestUpdateUniverseHg checks that projects using the hg protocol are cloned
+// and advanced to their revision with Mercurial.
+func TestUpdateUniverseHg(t *testing.T) {
+	_, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	remoteDir, err := ioutil.TempDir("", "hg")
+	if err != nil {
+		t.Fatalf("TempDir() failed: %v", err)
+	}
+	defer os.RemoveAll(remoteDir)
+	p := project.Project{
+		Name:     "hgproject",
+		Path:     filepath.Join(fake.X.Root, "hgproject"),
+		Remote:   remoteDir,
+		Protocol: "hg",
+	}
+	if err := fake.AddProject(project.Project{Name: p.Name, Path: "hgproject", Remote: p.Remote, Protocol: p.Protocol}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := exec.LookPath("hg"); err != nil {
+		err := fake.UpdateUniverse(false)
+		if err == nil || !strings.Contains(err.Error(), hgutil.ErrNotInstalled.Error()) {
+			t.Fatalf("expected an error about hg not being installed, got %v", err)
+		}
+		return
+	}
+
+	remote := hgutil.New(fake.X, hgutil.RootDirOpt(remoteDir), hgutil.UserOpt("John Doe <john.doe@example.com>"))
+	if err := remote.Init(remoteDir); err != nil {
+		t.Fatal(err)
+	}
+	commit := func(content string) string {
+		readme := filepath.Join(remoteDir, "README")
+		_, statErr := os.Stat(readme)
+		if err := ioutil.WriteFile(readme, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if os.IsNotExist(statErr) {
+			if err := remote.Add("README"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := remote.CommitWithMessage(content); err != nil {
+			t.Fatal(err)
+		}
+		rev, err := remote.CurrentRevision()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rev
+	}
+	checkRevision := func(want, content string) {
+		t.Helper()
+		if got, err := hgutil.New(fake.X, hgutil.RootDirOpt(p.Path)).CurrentRevision(); err != nil || got != want {
+			t.Errorf("got revision %q, %v, want %q", got, err, want)
+		}
+		checkReadme(t, fake.X, p, content)
+	}
+
+	first := commit("initial readme")
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	checkRevision(first, "initial readme")
+	if local, err := project.ProjectAtPath(fake.X, p.Path); err != nil || local.Protocol != "hg" {
+		t.Errorf("got project metadata %+v, %v, want an hg project", local, err)
+	}
+
+	second := commit("new readme")
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	checkRevision(second, "new readme")
+
+	// Projects with uncommitted changes are left alone.
+	commit("newer readme")
+	writeUncommitedFile(t, fake.X, p.Path, "README", "local change")
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := hgutil.New(fake.X, hgutil.RootDirOpt(p.Path)).CurrentRevision(); err != nil || got != second {
+		t.Errorf("got revision %q, %v, want %q", got, err, second)
+	}
+}
+
+// TestUpdateUniversePushTarget checks that the default push target of
+// projects with a gerrit host is removed once they no longer have one.
+func TestUpdateUniversePushTarget(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	p := localProjects[1]
+	setGerritHost := func(host string) {
+		t.Helper()
+		m, err := fake.ReadRemoteManifest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range m.Projects {
+			if m.Projects[i].Name == p.Name {
+				m.Projects[i].GerritHost = host
+			}
+		}
+		if err := fake.WriteRemoteManifest(m); err != nil {
+			t.Fatal(err)
+		}
+		if err := fake.UpdateUniverse(false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	scm := gitutil.New(fake.X, gitutil.RootDirOpt(p.Path))
+
+	setGerritHost("https://gerrit.example.com")
+	if got, err := scm.ConfigGetKey("remote.origin.push"); err != nil || got != "HEAD:refs/for/master" {
+		t.Errorf("got push target %q, %v, want %q", got, err, "HEAD:refs/for/master")
+	}
+	setGerritHost("")
+	if got, err := scm.ConfigGetKey("remote.origin.push"); err == nil {
+		t.Errorf("got push target %q, want none", got)
+	}
+}
+
+// TestUpdateUniverseSubmodules checks that the submodules of projects with
+// gitsubmodules set are checked out, resolving relative submodule URLs
+// against the project remote.
+func TestUpdateUniverseSubmodules(t *testing.T) {
+	// Recent versions of git refuse to clone submodules from local paths.
+	for key, value := range map[string]string{
+		"GIT_CONFIG_COUNT":   "1",
+		"GIT_CONFIG_KEY_0":   "protocol.file.allow",
+		"GIT_CONFIG_VALUE_0": "always",
+	} {
+		os.Setenv(key, value)
+		defer os.Unsetenv(key)
+	}
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+
+	super, sub := localProjects[1], localProjects[2]
+	superRemote, subRemote := fake.Projects[super.Name], fake.Projects[sub.Name]
+	url, err := filepath.Rel(superRemote, subRemote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subRev, err := gitutil.New(fake.X, gitutil.RootDirOpt(subRemote)).CurrentRevision()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("git", "update-index", "--add", "--cacheinfo", "160000,"+subRev+",sub")
+	cmd.Dir = superRemote
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	writeFile(t, fake.X, superRemote, ".gitmodules", fmt.Sprintf("[submodule \"sub\"]\n\tpath = sub\n\turl = %s\n", url))
+
+	// Submodules are ignored by default.
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	if err := fileExists(filepath.Join(super.Path, "sub", "README")); err == nil {
+		t.Fatalf("expected submodule not to be checked out")
+	}
+
+	m, err := fake.ReadRemoteManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range m.Projects {
+		if m.Projects[i].Name == super.Name {
+			m.Projects[i].GitSubmodules = true
+		}
+	}
+	if err := fake.WriteRemoteManifest(m); err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	subProject := project.Project{Path: filepath.Join(super.Path, "sub")}
+	checkReadme(t, fake.X, subProject, "initial readme")
+
+	// Checked out submodules are left alone while the project is
+	// up-to-date.
+	writeReadme(t, fake.X, subProject.Path, "local change")
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	checkReadme(t, fake.X, subProject, "local change")
+}
+
+// TestUpdateUniversePartial checks that partial projects are cloned from
+// their remote rather than referencing the cache.
+func TestUpdateUniversePartial(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	cacheDir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatalf("TempDir() failed: %v", err)
+	}
+	defer os.RemoveAll(cacheDir)
+	fake.X.Cache = cacheDir
+
+	m, err := fake.ReadRemoteManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range m.Projects {
+		if m.Projects[i].Name == localProjects[1].Name {
+			m.Projects[i].Partial = true
+		}
+	}
+	if err := fake.WriteRemoteManifest(m); err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	p := localProjects[1]
+	if err := fileExists(p.Path + "/.git/objects/info/alternates"); err == nil {
+		t.Errorf("expected %v to not exist, but found", p.Path+"/.git/objects/info/alternates")
+	}
+	cacheDirPath, err := p.CacheDirPath(fake.X)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fileExists(cacheDirPath); err == nil {
+		t.Errorf("expected no cache at %v for a partial project", cacheDirPath)
+	}
+	checkReadme(t, fake.X, p, "initial readme")
+}
+
+// TestRenameProject checks that a project can be moved to a new path along
+// with its metadata and working trees.
+func TestRenameProject(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	p := localProjects[1]
+	newPath := filepath.Join(fake.X.Root, "renamed", "project")
+	scm := gitutil.New(fake.X, gitutil.RootDirOpt(p.Path))
+	worktreeDir, err := ioutil.TempDir("", "worktree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(worktreeDir)
+	worktree := filepath.Join(worktreeDir, "worktree")
+	if err := scm.AddWorktree(worktree, ""); err != nil {
+		t.Fatal(err)
+	}
+	scanned, err := project.LocalProjects(fake.X, project.FullScan)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Local changes and existing destinations are refused without force.
+	if err := ioutil.WriteFile(filepath.Join(p.Path, "untracked"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := project.RenameProject(fake.X, scanned, p.Path, newPath, false); err == nil || !strings.Contains(err.Error(), "untracked files") {
+		t.Fatalf("expected untracked files error, got %v", err)
+	}
+	if err := os.Remove(filepath.Join(p.Path, "untracked")); err != nil {
+		t.Fatal(err)
+	}
+	// Projects nested in the moved one are checked as well.
+	nested := scanned[localProjects[2].Key()]
+	nested.Path = filepath.Join(p.Path, "nested")
+	if err := os.Rename(localProjects[2].Path, nested.Path); err != nil {
+		t.Fatal(err)
+	}
+	writeUncommitedFile(t, fake.X, p.Path, ".git/info/exclude", "nested\n")
+	scanned[nested.Key()] = nested
+	writeUncommitedFile(t, fake.X, nested.Path, "README", "local change")
+	if err := project.RenameProject(fake.X, scanned, p.Path, newPath, false); err == nil || !strings.Contains(err.Error(), fmt.Sprintf("project %q has uncommitted changes", nested.Name)) {
+		t.Fatalf("expected uncommitted changes error for the nested project, got %v", err)
+	}
+	if err := gitutil.New(fake.X, gitutil.RootDirOpt(nested.Path)).Reset("HEAD"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(newPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := project.RenameProject(fake.X, scanned, p.Path, newPath, false); err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Fatalf("expected destination exists error, got %v", err)
+	}
+
+	if err := project.RenameProject(fake.X, scanned, p.Path, newPath, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(p.Path); !os.IsNotExist(err) {
+		t.Errorf("expected %q to be gone, got %v", p.Path, err)
+	}
+	scanned, err = project.LocalProjects(fake.X, project.FullScan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := scanned[p.Key()]; !ok || got.Path != newPath {
+		t.Errorf("got project %+v, want path %q", got, newPath)
+	}
+	worktrees, err := gitutil.New(fake.X, gitutil.RootDirOpt(worktree)).ListWorktrees()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(worktrees) != 2 || worktrees[0].Path != newPath {
+		t.Errorf("got worktrees %+v, want main working tree at %q", worktrees, newPath)
+	}
+}
+
+// TestCleanupProjectsKeepBranches checks that CleanupProjects can preserve
+// branches while deleting the others.
+func TestCleanupProjectsKeepBranches(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	p := localProjects[1]
+	scm := gitutil.New(fake.X, gitutil.RootDirOpt(p.Path))
+	for _, branch := range []string{"wip/keep", "merged", "unmerged", "current"} {
+		if err := scm.CreateBranchFromRef(branch, "HEAD"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, branch := range []string{"unmerged", "current"} {
+		if err := scm.CheckoutBranch(branch); err != nil {
+			t.Fatal(err)
+		}
+		writeReadme(t, fake.X, p.Path, "commit on "+branch)
+	}
+	projects := project.Projects{p.Key(): p}
+	branches := func() []string {
+		branches, _, err := scm.GetBranches()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return branches
+	}
+
+	// Only merged branches are deleted, and kept branches survive.
+	if err := project.CleanupProjects(fake.X, projects, true, regexp.MustCompile("^wip/"), true); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := branches(), []string{"current", "unmerged", "wip/keep"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got branches %v, want %v", got, want)
+	}
+
+	// The kept branches still survive when deleting unmerged branches.
+	if err := scm.CheckoutBranch("current"); err != nil {
+		t.Fatal(err)
+	}
+	if err := project.CleanupProjects(fake.X, projects, true, regexp.MustCompile("^wip/"), false); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := branches(), []string{"current", "wip/keep"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got branches %v, want %v", got, want)
+	}
+}
+
+// TestCleanupProjectsJiriIgnore checks that CleanupProjects keeps untracked
+// files listed in .jiri-ignore.
+func TestCleanupProjectsJiriIgnore(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	p := localProjects[1]
+	if err := os.MkdirAll(filepath.Join(p.Path, "out"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		".jiri-ignore": "# Local artifacts\n\nout/\n*.notes\n",
+		"out/obj.o":    "obj",
+		"todo.notes":   "notes",
+		"junk":         "junk",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(p.Path, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := project.CleanupProjects(fake.X, project.Projects{p.Key(): p}, false, nil, false); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{".jiri-ignore", "out/obj.o", "todo.notes"} {
+		if err := fileExists(filepath.Join(p.Path, name)); err != nil {
+			t.Errorf("expected %q to be kept: %v", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(p.Path, "junk")); !os.IsNotExist(err) {
+		t.Errorf("expected junk to be removed, got %v", err)
+	}
+}
+
+// TestUpdateUniverseWithRevision checks that UpdateUniverse will pull remote
+// projects at the specified revision.
+func TestUpdateUniverseWithRevision(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+
+	// Set project 1's revision in the manifest to the current revision.
+	g := gitutil.New(fake.X, gitutil.RootDirOpt(fake.Projects[localProjects[1].Name]))
+	rev, err := g.CurrentRevision()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := fake.ReadRemoteManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	projects := []project.Project{}
+	for _, p := range m.Projects {
+		if p.Name == localProjects[1].Name {
+			p.Revision = rev
+		}
+		projects = append(projects, p)
+	}
+	m.Projects = projects
+	if err := fake.WriteRemoteManifest(m); err != nil {
+		t.Fatal(err)
+	}
+	// Update README in all projects.
+	for _, remoteProjectDir := range fake.Projects {
+		writeReadme(t, fake.X, remoteProjectDir, "new revision")
+	}
+	// Check that calling UpdateUniverse() updates all projects except for
+	// project 1.
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	for i, p := range localProjects {
+		if i == 1 {
+			checkReadme(t, fake.X, p, "initial readme")
+		} else {
+			checkReadme(t, fake.X, p, "new revision")
+		}
+	}
+}
+
+// TestUpdateUniverseVerifyCommit checks that UpdateUniverse refuses to check
+// out an unsigned revision of a project requiring signed commits.
+func TestUpdateUniverseVerifyCommit(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+
+	m, err := fake.ReadRemoteManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	projects := []project.Project{}
+	for _, p := range m.Projects {
+		if p.Name == localProjects[1].Name {
+			p.VerifyCommit = true
+		}
+		projects = append(projects, p)
+	}
+	m.Projects = projects
+	if err := fake.WriteRemoteManifest(m); err != nil {
+		t.Fatal(err)
+	}
+	err = fake.UpdateUniverse(false)
+	if err == nil {
+		t.Fatal("expected UpdateUniverse to fail for an unsigned commit")
+	}
+	if !strings.Contains(err.Error(), "is not signed") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	checkReadme(t, fake.X, localProjects[0], "initial readme")
+}
+
+// TestUpdateUniverseDirtyProject checks that projects with uncommitted
+// changes are not updated unless they are stashed away.
+func TestUpdateUniverseDirtyProject(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	p := localProjects[1]
+	writeFile(t, fake.X, fake.Projects[p.Name], "new", "new")
+	writeUncommitedFile(t, fake.X, p.Path, "README", "local change")
+
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	if got := fake.X.Failures(); got == 0 {
+		t.Errorf("expected update to report the dirty project")
+	}
+	checkReadme(t, fake.X, p, "local change")
+	if err := fileExists(filepath.Join(p.Path, "new")); err == nil {
+		t.Errorf("expected dirty project %q not to be updated", p.Name)
+	}
+
+	failures := fake.X.Failures()
+	fake.X.Autostash = true
+	defer func() { fake.X.Autostash = false }()
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	if got := fake.X.Failures(); got != failures {
+		t.Errorf("got %d failures, want %d", got, failures)
+	}
+	checkReadme(t, fake.X, p, "local change")
+	if err := fileExists(filepath.Join(p.Path, "new")); err != nil {
+		t.Errorf("expected project %q to be updated: %v", p.Name, err)
+	}
+}
+
+// TestUpdateUniverseMovedDirtyProject checks that a project with uncommitted
+// changes is still moved, only its checkout being skipped.
+func TestUpdateUniverseMovedDirtyProject(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	p := localProjects[1]
+	writeFile(t, fake.X, fake.Projects[p.Name], "new", "new")
+	writeUncommitedFile(t, fake.X, p.Path, "README", "local change")
+
+	m, err := fake.ReadRemoteManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldProjectPath := p.Path
+	p.Path = filepath.Join(fake.X.Root, "new-project-path")
+	for i := range m.Projects {
+		if m.Projects[i].Name == p.Name {
+			m.Projects[i].Path = p.Path
+		}
+	}
+	if err := fake.WriteRemoteManifest(m); err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	if got := fake.X.Failures(); got == 0 {
+		t.Errorf("expected update to report the dirty project")
+	}
+	if err := dirExists(oldProjectPath); err == nil {
+		t.Errorf("expected project %q to be moved from %q", p.Name, oldProjectPath)
+	}
+	checkReadme(t, fake.X, p, "local change")
+	if err := fileExists(filepath.Join(p.Path, "new")); err == nil {
+		t.Errorf("expected dirty project %q not to be checked out", p.Name)
+	}
+	if _, err := project.ProjectAtPath(fake.X, p.Path); err != nil {
+		t.Errorf("expected metadata of project %q to be written: %v", p.Name, err)
+	}
+}
+
+// TestUpdateUniverseCheckoutMismatch checks that a project whose HEAD does not
+// end up at the expected revision is reported as a failure.
+func TestUpdateUniverseCheckoutMismatch(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	writeReadme(t, fake.X, fake.Projects[localProjects[1].Name], "new revision")
+
+	// A post-checkout hook that moves HEAD back simulates a checkout that
+	// silently went wrong.
+	hook := filepath.Join(localProjects[1].Path, ".git", "hooks", "post-checkout")
+	script := "#!/bin/sh\n[ -n \"$MISMATCH\" ] || MISMATCH=1 git checkout -q --detach HEAD~1\n"
+	if err := ioutil.WriteFile(hook, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	if got := fake.X.Failures(); got == 0 {
+		t.Errorf("expected update to report a failure")
+	}
+	checkReadme(t, fake.X, localProjects[1], "initial readme")
+	checkReadme(t, fake.X, localProjects[2], "initial readme")
+}
+
+// TestUpdateUniverseCloneInterrupted checks that leftovers of an interrupted
+// clone are cleaned up and that a failed clone leaves nothing behind.
+func TestUpdateUniverseCloneInterrupted(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+
+	// Simulate a clone of project 1 that was interrupted half-way.
+	p := localProjects[1]
+	parent := filepath.Dir(p.Path)
+	staleDir := filepath.Join(parent, "."+filepath.Base(p.Path)+".jiri-tmp-1234")
+	if err := os.MkdirAll(filepath.Join(staleDir, ".git"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeUncommitedFile(t, fake.X, staleDir, "partial", "partial")
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range localProjects {
+		checkReadme(t, fake.X, p, "initial readme")
+	}
+	if _, err := os.Stat(staleDir); !os.IsNotExist(err) {
+		t.Fatalf("expected stale clone directory %q to be removed", staleDir)
+	}
+
+	// Add a project whose clone fails.
+	broken := project.Project{
+		Name:   "broken",
+		Path:   filepath.Join(fake.X.Root, "broken"),
+		Remote: filepath.Join(fake.X.Root, "does-not-exist"),
+	}
+	if err := fake.AddProject(broken); err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.UpdateUniverse(false); err == nil {
+		t.Fatal("expected UpdateUniverse to fail")
+	}
+	if _, err := os.Stat(broken.Path); !os.IsNotExist(err) {
+		t.Fatalf("expected %q not to exist after a failed clone", broken.Path)
 	}
-	// Check that calling UpdateUniverse() updates all projects except for
-	// project 1.
-	if err := fake.UpdateUniverse(false); err != nil {
+	matches, err := filepath.Glob(filepath.Join(fake.X.Root, ".broken.jiri-tmp-*"))
+	if err != nil {
 		t.Fatal(err)
 	}
-	for i, p := range localProjects {
-		if i == 1 {
-			checkReadme(t, fake.X, p, "initial readme")
-		} else {
-			checkReadme(t, fake.X, p, "new revision")
-		}
+	if len(matches) != 0 {
+		t.Fatalf("expected no temporary clone directories, got %v", matches)
 	}
 }
 
@@ -1539,6 +2510,58 @@ func TestUpdateUniverseRemoteBranch(t *testing.T) {
 	checkReadme(t, fake.X, localProjects[1], "non-master commit")
 }
 
+// TestUpdateUniverseRemoteName checks that projects are cloned and updated
+// using the git remote named by their remotename attribute, and that the
+// remote is renamed when the attribute changes.
+func TestUpdateUniverseRemoteName(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	setRemoteName := func(name string, remoteName string) {
+		m, err := fake.ReadRemoteManifest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range m.Projects {
+			if m.Projects[i].Name == name {
+				m.Projects[i].RemoteName = remoteName
+			}
+		}
+		if err := fake.WriteRemoteManifest(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkRemote := func(p project.Project) {
+		t.Helper()
+		git := gitutil.New(fake.X, gitutil.RootDirOpt(p.Path))
+		if url, err := git.RemoteUrl("upstream"); err != nil || url != fake.Projects[p.Name] {
+			t.Errorf("project %q: got remote upstream %q, %v, want %q", p.Name, url, err, fake.Projects[p.Name])
+		}
+		if _, err := git.RemoteUrl("origin"); err == nil {
+			t.Errorf("project %q still has an origin remote", p.Name)
+		}
+		if _, err := git.CurrentRevisionForRef("remotes/upstream/master"); err != nil {
+			t.Errorf("project %q: %v", p.Name, err)
+		}
+	}
+
+	setRemoteName(localProjects[1].Name, "upstream")
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	checkRemote(localProjects[1])
+
+	setRemoteName(localProjects[2].Name, "upstream")
+	writeReadme(t, fake.X, fake.Projects[localProjects[1].Name], "new commit")
+	writeReadme(t, fake.X, fake.Projects[localProjects[2].Name], "new commit")
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	checkRemote(localProjects[1])
+	checkRemote(localProjects[2])
+	checkReadme(t, fake.X, localProjects[1], "new commit")
+	checkReadme(t, fake.X, localProjects[2], "new commit")
+}
+
 // TestUpdateWhenRemoteChangesRebased checks that UpdateUniverse can pull from a
 // non-master remote branch if the local changes were rebased somewhere else(gerrit)
 // before being pushed to remote
@@ -1874,6 +2897,356 @@ func testLocalBranchesAreUpdated(t *testing.T, shouldLocalBeOnABranch, rebaseAll
 	}
 }
 
+// TestCreateSnapshotPackageInstances tests that snapshots record package
+// instance IDs from lockfiles even when lockfiles are not enabled.
+func TestCreateSnapshotPackageInstances(t *testing.T) {
+	_, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	fake.X.LockfileName = "jiri.lock"
+
+	m, err := fake.ReadJiriManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkg := project.Package{Name: "test/pkg", Version: "version:1", Path: "pkgs/test"}
+	m.Packages = append(m.Packages, pkg)
+	if err := fake.WriteJiriManifest(m); err != nil {
+		t.Fatal(err)
+	}
+	pkgLocks := project.PackageLocks{}
+	pkgLock := project.PackageLock{PackageName: "test/pkg", InstanceID: "test-instance-id"}
+	pkgLocks[pkgLock.Key()] = pkgLock
+	data, err := project.MarshalLockEntries(nil, pkgLocks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(fake.X.Root, fake.X.LockfileName), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshotFile := filepath.Join(fake.X.Root, "snapshot")
+	if err := project.CreateSnapshot(fake.X, snapshotFile, nil, nil, false); err != nil {
+		t.Fatal(err)
+	}
+	want := []project.PackageInstance{{Name: "test/pkg", ID: "test-instance-id"}}
+	snapshot, err := project.ManifestFromFile(fake.X, snapshotFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshot.Packages) != 1 || !reflect.DeepEqual(snapshot.Packages[0].Instances, want) {
+		t.Fatalf("snapshot packages %+v do not record instances %+v", snapshot.Packages, want)
+	}
+
+	_, _, pkgs, err := project.LoadSnapshotFile(fake.X, snapshotFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := pkgs[pkg.Key()].Instances; !reflect.DeepEqual(got, want) {
+		t.Fatalf("restored package instances are %+v, want %+v", got, want)
+	}
+}
+
+// TestLocalManifestOverrides tests that projects in .jiri_manifest.local
+// override the revision and remote of matching projects.
+func TestLocalManifestOverrides(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	gitRemote := gitutil.New(fake.X, gitutil.RootDirOpt(fake.Projects[localProjects[1].Name]))
+	oldRev, err := gitRemote.CurrentRevision()
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeReadme(t, fake.X, fake.Projects[localProjects[1].Name], "new readme")
+
+	forkRemote := fake.Projects[localProjects[2].Name]
+	local := project.Manifest{
+		Overrides: []project.Project{
+			{Name: localProjects[0].Name, Remote: forkRemote},
+			{Name: localProjects[1].Name, Revision: oldRev},
+		},
+	}
+	if err := local.ToFile(fake.X, fake.X.JiriLocalManifestFile()); err != nil {
+		t.Fatal(err)
+	}
+
+	scanned, err := project.LocalProjects(fake.X, project.FastScan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	projects, _, _, err := project.LoadManifestFile(fake.X, fake.X.JiriManifestFile(), scanned, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := 0
+	for _, p := range projects {
+		switch p.Name {
+		case localProjects[0].Name:
+			found++
+			if p.Remote != forkRemote {
+				t.Errorf("project %q has remote %q, want %q", p.Name, p.Remote, forkRemote)
+			}
+			if p.Path != localProjects[0].Path {
+				t.Errorf("project %q has path %q, want %q", p.Name, p.Path, localProjects[0].Path)
+			}
+		case localProjects[1].Name:
+			found++
+			if p.Revision != oldRev {
+				t.Errorf("project %q has revision %q, want %q", p.Name, p.Revision, oldRev)
+			}
+		}
+	}
+	if found != 2 {
+		t.Fatalf("overridden projects not found in %+v", projects)
+	}
+
+	// Undo the remote override and check the revision override is honored
+	// by update.
+	local.Overrides = local.Overrides[1:]
+	if err := local.ToFile(fake.X, fake.X.JiriLocalManifestFile()); err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	gitLocal := gitutil.New(fake.X, gitutil.RootDirOpt(localProjects[1].Path))
+	if rev, err := gitLocal.CurrentRevision(); err != nil {
+		t.Fatal(err)
+	} else if rev != oldRev {
+		t.Fatalf("project %q is at %q, want %q", localProjects[1].Name, rev, oldRev)
+	}
+	checkReadme(t, fake.X, localProjects[1], "initial readme")
+}
+
+// TestManifestRemoves tests that <remove> tags in the root manifest drop
+// projects contributed by imported manifests.
+func TestManifestRemoves(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	m, err := project.ManifestFromFile(fake.X, fake.X.JiriManifestFile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Removes = []project.Remove{{Name: localProjects[1].Name}, {Name: "no-such-project"}}
+	if err := m.ToFile(fake.X, fake.X.JiriManifestFile()); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(fake.X.JiriManifestFile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := fmt.Sprintf("<remove name=%q/>", localProjects[1].Name); !strings.Contains(string(data), want) {
+		t.Errorf("manifest %s does not contain %s", data, want)
+	}
+
+	scanned, err := project.LocalProjects(fake.X, project.FastScan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	projects, _, _, err := project.LoadManifestFile(fake.X, fake.X.JiriManifestFile(), scanned, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range localProjects {
+		_, found := projects[p.Key()]
+		if want := p.Name != localProjects[1].Name; found != want {
+			t.Errorf("project %q: got found %v, want %v", p.Name, found, want)
+		}
+	}
+}
+
+// TestUpdateUniverseOffline tests that an offline update does not fetch and
+// fails only if a required revision is not present locally.
+func TestUpdateUniverseOffline(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	gitRemote := gitutil.New(fake.X, gitutil.RootDirOpt(fake.Projects[localProjects[1].Name]))
+	oldRev, err := gitRemote.CurrentRevision()
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeReadme(t, fake.X, fake.Projects[localProjects[1].Name], "new readme")
+	newRev, err := gitRemote.CurrentRevision()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Make every remote unreachable, any fetch would fail the update.
+	for _, remote := range fake.Projects {
+		if err := os.Rename(remote, remote+".offline"); err != nil {
+			t.Fatal(err)
+		}
+		defer os.Rename(remote+".offline", remote)
+	}
+
+	fake.X.Offline = true
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatalf("offline update failed: %v", err)
+	}
+	gitLocal := gitutil.New(fake.X, gitutil.RootDirOpt(localProjects[1].Path))
+	if rev, err := gitLocal.CurrentRevision(); err != nil {
+		t.Fatal(err)
+	} else if rev != oldRev {
+		t.Fatalf("project %q is at %q, want %q", localProjects[1].Name, rev, oldRev)
+	}
+
+	// A revision which was never fetched cannot be checked out offline.
+	local := project.Manifest{
+		Overrides: []project.Project{{Name: localProjects[1].Name, Revision: newRev}},
+	}
+	if err := local.ToFile(fake.X, fake.X.JiriLocalManifestFile()); err != nil {
+		t.Fatal(err)
+	}
+	err = fake.UpdateUniverse(false)
+	if err == nil || !strings.Contains(err.Error(), "-offline") {
+		t.Fatalf("offline update to a missing revision returned %v, want an error suggesting an online update", err)
+	}
+}
+
+// TestUpdateUniversePruneTags checks that local tags are only deleted by
+// updates which prune tags.
+func TestUpdateUniversePruneTags(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	p := localProjects[1]
+	git := gitutil.New(fake.X, gitutil.RootDirOpt(p.Path))
+	if err := git.CreateLightweightTag("local-tag"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := git.CommitExists("refs/tags/local-tag"); err != nil || !exists {
+		t.Fatalf("expected tag to be kept without pruning, got %v, %v", exists, err)
+	}
+
+	fake.X.PruneTags = true
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := git.CommitExists("refs/tags/local-tag"); err != nil || exists {
+		t.Fatalf("expected tag to be pruned, got %v, %v", exists, err)
+	}
+}
+
+// TestUpdateUniverseLockHEAD checks that lockfiles pin projects whose
+// revision is "HEAD" in the manifest, like projects without a revision.
+func TestUpdateUniverseLockHEAD(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	p := localProjects[1]
+	lockedRev, err := gitutil.New(fake.X, gitutil.RootDirOpt(fake.Projects[p.Name])).CurrentRevision()
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeReadme(t, fake.X, fake.Projects[p.Name], "new readme")
+
+	m, err := fake.ReadRemoteManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range m.Projects {
+		if m.Projects[i].Name == p.Name {
+			m.Projects[i].Revision = "HEAD"
+		}
+	}
+	if err := fake.WriteRemoteManifest(m); err != nil {
+		t.Fatal(err)
+	}
+	lock := project.ProjectLock{Remote: fake.Projects[p.Name], Name: p.Name, Revision: lockedRev}
+	data, err := project.MarshalLockEntries(project.ProjectLocks{lock.Key(): lock}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.X.LockfileName = "jiri.lock"
+	fake.X.LockfileEnabled = true
+	if err := ioutil.WriteFile(filepath.Join(fake.X.Root, fake.X.LockfileName), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	checkReadme(t, fake.X, p, "initial readme")
+}
+
+// TestUpdateUniverseUnshallow tests that shallow projects which no longer
+// specify a history depth are converted to full clones.
+func TestUpdateUniverseUnshallow(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	// Add history to the shallow project.
+	shallowProject := localProjects[2]
+	writeReadme(t, fake.X, fake.Projects[shallowProject.Name], "second readme")
+	// git ignores the depth of clones from local paths.
+	setManifestProject := func(update func(p *project.Project)) {
+		m, err := fake.ReadRemoteManifest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, p := range m.Projects {
+			if p.Name == shallowProject.Name {
+				update(&m.Projects[i])
+			}
+		}
+		if err := fake.WriteRemoteManifest(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	setManifestProject(func(p *project.Project) {
+		p.Remote = "file://" + p.Remote
+	})
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	shallowFile := filepath.Join(shallowProject.Path, ".git", "shallow")
+	if err := fileExists(shallowFile); err != nil {
+		t.Fatalf("project %q should be shallow: %v", shallowProject.Name, err)
+	}
+
+	// Keep the project shallow while the manifest specifies a depth.
+	fake.X.Unshallow = true
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	if err := fileExists(shallowFile); err != nil {
+		t.Fatalf("project %q should still be shallow: %v", shallowProject.Name, err)
+	}
+
+	setManifestProject(func(p *project.Project) {
+		p.HistoryDepth = 0
+	})
+	// Running twice checks that complete repositories are skipped.
+	for i := 0; i < 2; i++ {
+		if err := fake.UpdateUniverse(false); err != nil {
+			t.Fatal(err)
+		}
+		if err := fileExists(shallowFile); err == nil {
+			t.Fatalf("project %q should not be shallow", shallowProject.Name)
+		}
+	}
+	count, err := gitutil.New(fake.X, gitutil.RootDirOpt(shallowProject.Path)).CountCommits("HEAD", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count < 2 {
+		t.Errorf("project %q has %d commits, want the full history", shallowProject.Name, count)
+	}
+}
+
 // TestLocalBranchesAreUpdatedWhenOnHead test that all the local branches are
 // updated on jiri update when local repo is on detached head
 func TestLocalBranchesAreUpdatedWhenOnHead(t *testing.T) {
@@ -1898,6 +3271,66 @@ func TestLocalBranchesNotUpdatedWhenOnBranch(t *testing.T) {
 	testLocalBranchesAreUpdated(t, true, false)
 }
 
+// TestUpdateUniverseRebaseConflict tests that a local branch which can't be
+// rebased is left unchanged, other branches are still rebased, and the
+// project is left on its original branch.
+func TestUpdateUniverseRebaseConflict(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	p := localProjects[1]
+	gitLocal := gitutil.New(fake.X, gitutil.RootDirOpt(p.Path))
+	if err := gitLocal.Config("user.email", "john.doe@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := gitLocal.Config("user.name", "John Doe"); err != nil {
+		t.Fatal(err)
+	}
+	if err := gitLocal.CreateBranchWithUpstream("clean", "origin/master"); err != nil {
+		t.Fatal(err)
+	}
+	if err := gitLocal.CheckoutBranch("clean"); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, fake.X, p.Path, "new", "new")
+	if err := gitLocal.CreateBranchWithUpstream("conflict", "origin/master"); err != nil {
+		t.Fatal(err)
+	}
+	if err := gitLocal.CheckoutBranch("conflict"); err != nil {
+		t.Fatal(err)
+	}
+	writeReadme(t, fake.X, p.Path, "local change")
+	conflictRev, err := gitLocal.CurrentRevision()
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeReadme(t, fake.X, fake.Projects[p.Name], "remote change")
+
+	if err := project.UpdateUniverse(fake.X, false, false, false, false, true /*rebaseAll*/, false /*run-hooks*/, false /*run-packages*/, project.DefaultHookTimeout, project.DefaultPackageTimeout); err != nil {
+		t.Fatal(err)
+	}
+	if got := fake.X.Failures(); got != 1 {
+		t.Errorf("got %d failures, want 1", got)
+	}
+	if branch, err := gitLocal.CurrentBranchName(); err != nil || branch != "conflict" {
+		t.Fatalf("got current branch (%q, %v), want %q", branch, err, "conflict")
+	}
+	if rev, err := gitLocal.CurrentRevision(); err != nil || rev != conflictRev {
+		t.Errorf("conflicting branch moved to (%q, %v), want %q", rev, err, conflictRev)
+	}
+	if changes, err := gitLocal.HasUncommittedChanges(); err != nil || changes {
+		t.Errorf("got uncommitted changes (%v, %v), want none", changes, err)
+	}
+	if n, err := gitLocal.CountCommits("origin/master", "clean"); err != nil || n != 0 {
+		t.Errorf("branch clean is missing (%d, %v) commits of origin/master, want 0", n, err)
+	}
+	if n, err := gitLocal.CountCommits("clean", "origin/master"); err != nil || n != 1 {
+		t.Errorf("got (%d, %v) local commits on branch clean, want 1", n, err)
+	}
+}
+
 func TestFileImportCycle(t *testing.T) {
 	jirix, cleanup := jiritest.NewX(t)
 	defer cleanup()
@@ -1930,7 +3363,7 @@ func TestFileImportCycle(t *testing.T) {
 
 	// The update should complain about the cycle.
 	err := project.UpdateUniverse(jirix, false, false, false, false, false, true /*run-hooks*/, true /*run-packages*/, project.DefaultHookTimeout, project.DefaultPackageTimeout)
-	if got, want := fmt.Sprint(err), "import cycle detected in local manifest files"; !strings.Contains(got, want) {
+	if got, want := fmt.Sprint(err), "import cycle detected in local manifest files: A -> B -> A"; !strings.Contains(got, want) {
 		t.Errorf("got error %v, want substr %v", got, want)
 	}
 }
@@ -1981,7 +3414,8 @@ func TestRemoteImportCycle(t *testing.T) {
 
 	// The update should complain about the cycle.
 	err := project.UpdateUniverse(fake.X, false, false, false, false, false, true /*run-hooks*/, true /*run-packages*/, project.DefaultHookTimeout, project.DefaultPackageTimeout)
-	if got, want := fmt.Sprint(err), "import cycle detected in remote manifest imports"; !strings.Contains(got, want) {
+	want := fmt.Sprintf("import cycle detected in remote manifest imports: %[1]s + A -> %[2]s + B -> %[1]s + A", remote1, remote2)
+	if got := fmt.Sprint(err); !strings.Contains(got, want) {
 		t.Errorf("got error %v, want substr %v", got, want)
 	}
 }
@@ -2338,3 +3772,591 @@ func TestWritePackageFlags(t *testing.T) {
 		}
 	}
 }
+
+func TestRemoteHost(t *testing.T) {
+	tests := map[string]string{
+		"https://fuchsia.googlesource.com/jiri": "fuchsia.googlesource.com",
+		"sso://fuchsia/jiri":                    "fuchsia",
+		"ssh://user@example.com:29418/jiri":     "example.com",
+		"git@github.com:dahlia-os/jiri.git":     "github.com",
+		"/path/to/jiri":                         "",
+		"file:///path/to/jiri":                  "",
+		"../jiri":                               "",
+	}
+	for remote, want := range tests {
+		if got := project.InternalRemoteHost(remote); got != want {
+			t.Errorf("remoteHost(%q): got %q, want %q", remote, got, want)
+		}
+	}
+}
+
+// TestHostLimiter checks that operations against the same host are limited
+// to FetchJobsPerHost, while other hosts are not held up.
+func TestHostLimiter(t *testing.T) {
+	fake, cleanup := jiritest.NewFakeJiriRoot(t)
+	defer cleanup()
+	fake.X.FetchJobsPerHost = 2
+	acquire := project.InternalHostLimiter(fake.X)
+
+	var mu sync.Mutex
+	running := make(map[string]int)
+	maxRunning := make(map[string]int)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		for _, host := range []string{"a.example.com", "b.example.com"} {
+			wg.Add(1)
+			go func(host string) {
+				defer wg.Done()
+				release := acquire("https://" + host + "/project")
+				defer release()
+				mu.Lock()
+				running[host]++
+				if running[host] > maxRunning[host] {
+					maxRunning[host] = running[host]
+				}
+				mu.Unlock()
+				time.Sleep(10 * time.Millisecond)
+				mu.Lock()
+				running[host]--
+				mu.Unlock()
+			}(host)
+		}
+	}
+	wg.Wait()
+	for _, host := range []string{"a.example.com", "b.example.com"} {
+		if got := maxRunning[host]; got != 2 {
+			t.Errorf("%s: got at most %d simultaneous operations, want 2", host, got)
+		}
+	}
+
+	// Both hosts are at their limit; another host must not be blocked.
+	releaseA := acquire("https://a.example.com/x")
+	defer releaseA()
+	done := make(chan struct{})
+	go func() {
+		acquire("https://c.example.com/x")()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Errorf("operation against c.example.com was blocked")
+	}
+}
+
+func TestResolveProjects(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+
+	projects, err := project.ResolveProjects(fake.X, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sort.IsSorted(project.ProjectsByPath(projects)) {
+		t.Errorf("projects are not sorted by path: %v", projects)
+	}
+	for _, lp := range localProjects {
+		p, ok := project.FindProjectByName(projects, lp.Name)
+		if !ok {
+			t.Fatalf("project %q not found", lp.Name)
+		}
+		if p.Path != lp.Path {
+			t.Errorf("project %q: got path %q, want %q", lp.Name, p.Path, lp.Path)
+		}
+		if p, ok := project.FindProjectByPath(projects, lp.Path); !ok || p.Name != lp.Name {
+			t.Errorf("FindProjectByPath(%q): got %q, %v, want %q", lp.Path, p.Name, ok, lp.Name)
+		}
+	}
+
+	// Project 4 is nested in project 3, which is nested in project 2.
+	file := filepath.Join(localProjects[4].Path, "README")
+	if p, ok := project.FindProjectByPath(projects, file); !ok || p.Name != localProjects[4].Name {
+		t.Errorf("FindProjectByPath(%q): got %q, %v, want %q", file, p.Name, ok, localProjects[4].Name)
+	}
+	if p, ok := project.FindProjectByPath(projects, localProjects[2].Path+"-other"); ok {
+		t.Errorf("FindProjectByPath found %q for a path outside of all projects", p.Name)
+	}
+	if _, ok := project.FindProjectByName(projects, "missing"); ok {
+		t.Errorf("FindProjectByName found a missing project")
+	}
+}
+
+// TestRunHooksRunAfter tests that hooks run after the hooks listed in their
+// runafter attribute, and not at all if one of those fails.
+func TestRunHooksRunAfter(t *testing.T) {
+	fake, cleanup := jiritest.NewFakeJiriRoot(t)
+	defer cleanup()
+	dir := fake.X.Root
+	scripts := map[string]string{
+		"gen.sh":  "#!/bin/sh\nsleep 0.2\necho generated > gen.out\n",
+		"use.sh":  "#!/bin/sh\ncp gen.out use.out\n",
+		"fail.sh": "#!/bin/sh\nexit 1\n",
+		"skip.sh": "#!/bin/sh\necho ran > skip.out\n",
+	}
+	for name, script := range scripts {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hooks := project.Hooks{}
+	for _, h := range []project.Hook{
+		{Name: "use", Action: "use.sh", RunAfter: "gen"},
+		{Name: "gen", Action: "gen.sh"},
+		{Name: "fail", Action: "fail.sh"},
+		{Name: "skip", Action: "skip.sh", RunAfter: "use, fail"},
+	} {
+		h.ProjectName = "p"
+		h.ActionPath = dir
+		hooks[h.Key()] = h
+	}
+	if err := project.RunHooks(fake.X, hooks, project.DefaultHookTimeout); err == nil {
+		t.Fatal("expected the failing hook to fail RunHooks")
+	}
+	if err := fileExists(filepath.Join(dir, "use.out")); err != nil {
+		t.Errorf("hook use did not run after hook gen: %s", err)
+	}
+	if err := fileExists(filepath.Join(dir, "skip.out")); err == nil {
+		t.Errorf("hook skip ran even though hook fail failed")
+	}
+}
+
+func TestRunHooksRunAfterErrors(t *testing.T) {
+	fake, cleanup := jiritest.NewFakeJiriRoot(t)
+	defer cleanup()
+	tests := []struct {
+		hooks []project.Hook
+		want  string
+	}{
+		{
+			[]project.Hook{{Name: "a", RunAfter: "missing"}},
+			`runs after unknown hook "missing"`,
+		},
+		{
+			[]project.Hook{{Name: "a", RunAfter: "b"}, {Name: "b", RunAfter: "c"}, {Name: "c", RunAfter: "b"}},
+			"cyclic runafter dependencies: b -> c -> b",
+		},
+	}
+	for _, test := range tests {
+		hooks := project.Hooks{}
+		for _, h := range test.hooks {
+			h.ProjectName = "p"
+			h.Action = "action.sh"
+			h.ActionPath = fake.X.Root
+			hooks[h.Key()] = h
+		}
+		err := project.RunHooks(fake.X, hooks, project.DefaultHookTimeout)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("got error %v, want it to contain %q", err, test.want)
+		}
+	}
+}
+
+// TestRunHooksLogHooks tests that the output of each hook is written to its
+// log file, that the log files of failed hooks are named in the error, and
+// that old logs are removed.
+func TestRunHooksLogHooks(t *testing.T) {
+	fake, cleanup := jiritest.NewFakeJiriRoot(t)
+	defer cleanup()
+	fake.X.LogHooks = true
+	dir := fake.X.Root
+	scripts := map[string]string{
+		"ok.sh":   "#!/bin/sh\necho ok output\n",
+		"fail.sh": "#!/bin/sh\necho fail output\necho fail error >&2\nexit 1\n",
+	}
+	for name, script := range scripts {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stale := filepath.Join(fake.X.HookLogsDir(), "old", "hook.log")
+	if err := os.MkdirAll(filepath.Dir(stale), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(stale, []byte("stale"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	hooks := project.Hooks{}
+	for _, h := range []project.Hook{
+		{Name: "ok", Action: "ok.sh", ProjectName: "p1"},
+		{Name: "fail", Action: "fail.sh", ProjectName: "p2"},
+	} {
+		h.ActionPath = dir
+		hooks[h.Key()] = h
+	}
+	err := project.RunHooks(fake.X, hooks, project.DefaultHookTimeout)
+	failLog := filepath.Join(fake.X.HookLogsDir(), "p2", "fail.log")
+	if err == nil || !strings.Contains(err.Error(), failLog) {
+		t.Fatalf("got error %v, want it to name %s", err, failLog)
+	}
+	okLog := filepath.Join(fake.X.HookLogsDir(), "p1", "ok.log")
+	if strings.Contains(err.Error(), okLog) {
+		t.Errorf("error %v names the log of a successful hook", err)
+	}
+	for file, want := range map[string][]string{
+		okLog:   {"ok output"},
+		failLog: {"fail output", "fail error"},
+	} {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, w := range want {
+			if !strings.Contains(string(data), w) {
+				t.Errorf("%s: got %q, want it to contain %q", file, data, w)
+			}
+		}
+	}
+	if err := fileExists(stale); err == nil {
+		t.Errorf("log %s of a previous run was not removed", stale)
+	}
+}
+
+func TestExpandVars(t *testing.T) {
+	env := map[string]string{"HOST": "example.com", "EMPTY": ""}
+	tests := []struct {
+		in, want, err string
+	}{
+		{"https://example.com/repo", "https://example.com/repo", ""},
+		{"https://${HOST}/repo", "https://example.com/repo", ""},
+		{"${HOST}${EMPTY}/${HOST}", "example.com/example.com", ""},
+		{"cost$$5", "cost$5", ""},
+		{"$${HOST}", "${HOST}", ""},
+		{"a$b", "a$b", ""},
+		{"${MISSING}/repo", "", `undefined variable "MISSING"`},
+		{"${HOST", "", "unterminated variable reference"},
+	}
+	for _, test := range tests {
+		got, err := project.InternalExpandVars(test.in, env)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("expandVars(%q): got error %v, want %q", test.in, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("expandVars(%q): %s", test.in, err)
+		} else if got != test.want {
+			t.Errorf("expandVars(%q): got %q, want %q", test.in, got, test.want)
+		}
+	}
+}
+
+// TestUpdateUniverseExpandVars tests that environment variables referenced by
+// project attributes are expanded when loading the root manifest, and only
+// then.
+func TestUpdateUniverseExpandVars(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	if err := fake.CreateRemoteProject("expanded"); err != nil {
+		t.Fatal(err)
+	}
+	writeReadme(t, fake.X, fake.Projects["expanded"], "initial readme")
+	remoteDir, remoteName := filepath.Split(fake.Projects["expanded"])
+	jiriManifest, err := fake.ReadJiriManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	jiriManifest.Projects = append(jiriManifest.Projects, project.Project{
+		Name:   "expanded",
+		Remote: "${JIRI_TEST_REMOTES}/" + remoteName,
+		Path:   "${JIRI_TEST_PATH}",
+	})
+	if err := fake.WriteJiriManifest(jiriManifest); err != nil {
+		t.Fatal(err)
+	}
+
+	err = fake.UpdateUniverse(false)
+	if err == nil || !strings.Contains(err.Error(), `undefined variable "JIRI_TEST_REMOTES"`) {
+		t.Fatalf("expected an undefined variable error, got %v", err)
+	}
+
+	env := fake.X.Env()
+	env["JIRI_TEST_REMOTES"] = filepath.Clean(remoteDir)
+	env["JIRI_TEST_PATH"] = "expanded"
+	defer delete(env, "JIRI_TEST_REMOTES")
+	defer delete(env, "JIRI_TEST_PATH")
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	checkReadme(t, fake.X, project.Project{Path: filepath.Join(fake.X.Root, "expanded")}, "initial readme")
+
+	// Variables are left alone in imported manifests.
+	m, err := fake.ReadRemoteManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote := "${JIRI_TEST_REMOTES}/" + filepath.Base(fake.Projects[localProjects[1].Name])
+	for i, p := range m.Projects {
+		if p.Name == localProjects[1].Name {
+			m.Projects[i].Remote = remote
+		}
+	}
+	if err := fake.WriteRemoteManifest(m); err != nil {
+		t.Fatal(err)
+	}
+	locals, err := project.LocalProjects(fake.X, project.FullScan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remoteProjects, _, _, err := project.LoadUpdatedManifest(fake.X, locals, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := remoteProjects.FindUnique(localProjects[1].Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Remote != remote {
+		t.Errorf("got remote %q for imported project, want %q", p.Remote, remote)
+	}
+}
+
+// TestUpdateUniverseDryRun tests that a dry run neither fetches nor changes
+// any project.
+func TestUpdateUniverseDryRun(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+
+	// Update a project and add a new one, and fetch the manifest and the
+	// updated project so that the dry run sees the changes.
+	writeReadme(t, fake.X, fake.Projects[localProjects[1].Name], "new readme")
+	if err := fake.CreateRemoteProject("new-project"); err != nil {
+		t.Fatal(err)
+	}
+	writeReadme(t, fake.X, fake.Projects["new-project"], "initial readme")
+	newProject := project.Project{
+		Name:   "new-project",
+		Path:   filepath.Join(fake.X.Root, "new-project"),
+		Remote: fake.Projects["new-project"],
+	}
+	if err := fake.AddProject(newProject); err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{localProjects[1].Path, filepath.Join(fake.X.Root, jiritest.ManifestProjectPath)} {
+		if err := gitutil.New(fake.X, gitutil.RootDirOpt(dir)).Fetch("origin"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A remote change which was not fetched is not reported.
+	writeReadme(t, fake.X, fake.Projects[localProjects[2].Name], "unfetched readme")
+
+	fake.X.DryRun = true
+	if err := fake.UpdateUniverse(true); err != nil {
+		t.Fatal(err)
+	}
+	checkReadme(t, fake.X, localProjects[1], "initial readme")
+	if err := dirExists(newProject.Path); err == nil {
+		t.Errorf("dry run created project %q", newProject.Name)
+	}
+	remoteRev, err := gitutil.New(fake.X, gitutil.RootDirOpt(localProjects[2].Path)).CurrentRevisionForRef("origin/master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if localRev, err := gitutil.New(fake.X, gitutil.RootDirOpt(localProjects[2].Path)).CurrentRevision(); err != nil || localRev != remoteRev {
+		t.Errorf("dry run fetched project %q: got origin/master %q, want %q", localProjects[2].Name, remoteRev, localRev)
+	}
+
+	fake.X.DryRun = false
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	checkReadme(t, fake.X, localProjects[1], "new readme")
+	checkReadme(t, fake.X, newProject, "initial readme")
+}
+
+// TestUpdateUniverseCloneAndFetchDepth tests that clonedepth only applies to
+// the first clone of a project and fetchdepth only to later fetches.
+func TestUpdateUniverseCloneAndFetchDepth(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	cloneShallow, fetchShallow := localProjects[0], localProjects[1]
+	m, err := fake.ReadRemoteManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, p := range m.Projects {
+		switch p.Name {
+		case cloneShallow.Name:
+			m.Projects[i].CloneDepth = 1
+		case fetchShallow.Name:
+			m.Projects[i].FetchDepth = 1
+		default:
+			continue
+		}
+		// git ignores the depth of clones from local paths.
+		m.Projects[i].Remote = "file://" + p.Remote
+	}
+	if err := fake.WriteRemoteManifest(m); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []project.Project{cloneShallow, fetchShallow} {
+		writeReadme(t, fake.X, fake.Projects[p.Name], "second readme")
+	}
+	check := func(p project.Project, shallow bool, commits int) {
+		t.Helper()
+		if err := fileExists(filepath.Join(p.Path, ".git", "shallow")); (err == nil) != shallow {
+			t.Errorf("project %q: got shallow %v, want %v", p.Name, err == nil, shallow)
+		}
+		count, err := gitutil.New(fake.X, gitutil.RootDirOpt(p.Path)).CountCommits("HEAD", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != commits {
+			t.Errorf("project %q has %d commits, want %d", p.Name, count, commits)
+		}
+	}
+
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	remoteCommits, err := gitutil.New(fake.X, gitutil.RootDirOpt(fake.Projects[fetchShallow.Name])).CountCommits("HEAD", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(cloneShallow, true, 1)
+	check(fetchShallow, false, remoteCommits)
+
+	for _, p := range []project.Project{cloneShallow, fetchShallow} {
+		writeReadme(t, fake.X, fake.Projects[p.Name], "third readme")
+	}
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	// New history accumulates on top of the shallow clone.
+	check(cloneShallow, true, 2)
+	check(fetchShallow, true, 1)
+	checkReadme(t, fake.X, cloneShallow, "third readme")
+	checkReadme(t, fake.X, fetchShallow, "third readme")
+}
+
+// TestUpdateUniverseFetchRefspec tests that the refspecs listed by
+// fetchrefspec are fetched when a project is created and updated.
+func TestUpdateUniverseFetchRefspec(t *testing.T) {
+	localProjects, fake, cleanup := setupUniverse(t)
+	defer cleanup()
+	p := localProjects[1]
+	remote := gitutil.New(fake.X, gitutil.UserNameOpt("John Doe"), gitutil.UserEmailOpt("john.doe@example.com"), gitutil.RootDirOpt(fake.Projects[p.Name]))
+	// Creates a commit only reachable from the given change ref.
+	createChange := func(ref, content string) string {
+		writeReadme(t, fake.X, fake.Projects[p.Name], content)
+		rev, err := remote.CurrentRevision()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cmd := exec.Command("git", "update-ref", ref, rev)
+		cmd.Dir = fake.Projects[p.Name]
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("%v: %s", err, out)
+		}
+		if err := remote.Reset("HEAD~1"); err != nil {
+			t.Fatal(err)
+		}
+		return rev
+	}
+	setManifestProject := func(update func(p *project.Project)) {
+		m, err := fake.ReadRemoteManifest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range m.Projects {
+			if m.Projects[i].Name == p.Name {
+				update(&m.Projects[i])
+			}
+		}
+		if err := fake.WriteRemoteManifest(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data := `<manifest><projects><project name="a" path="a" remote="r" fetchrefspec="refs/changes/*"/></projects></manifest>`
+	if _, err := project.ManifestFromBytes([]byte(data)); err == nil || !strings.Contains(err.Error(), "invalid refspec") {
+		t.Errorf("expected an invalid refspec error, got %v", err)
+	}
+
+	// The project is created at a revision only reachable from a change.
+	change1 := createChange("refs/changes/01/1/1", "change 1")
+	setManifestProject(func(mp *project.Project) {
+		mp.FetchRefspec = "+refs/changes/*:refs/changes/*"
+		mp.Revision = change1
+	})
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	checkReadme(t, fake.X, p, "change 1")
+
+	// New changes are fetched on update.
+	change2 := createChange("refs/changes/02/2/1", "change 2")
+	setManifestProject(func(mp *project.Project) {
+		mp.Revision = change2
+	})
+	if err := fake.UpdateUniverse(false); err != nil {
+		t.Fatal(err)
+	}
+	checkReadme(t, fake.X, p, "change 2")
+	local := gitutil.New(fake.X, gitutil.RootDirOpt(p.Path))
+	for ref, want := range map[string]string{"refs/changes/01/1/1": change1, "refs/changes/02/2/1": change2} {
+		if got, err := local.CurrentRevisionForRef(ref); err != nil || got != want {
+			t.Errorf("got %q, %v for %s, want %q", got, err, ref, want)
+		}
+	}
+}
+
+func TestGenerateEnsureFileHostIndependent(t *testing.T) {
+	jirix, cleanup := jiritest.NewX(t)
+	defer cleanup()
+
+	pkgs := make(project.Packages)
+	for _, pkg := range []project.Package{
+		{Name: "gn/gn/${platform}", Version: "version", Platforms: "mac-arm64,linux-arm64,linux-amd64"},
+		{Name: "tools/${os}/${arch}/clang", Version: "version", Path: "prebuilt/clang"},
+		{Name: "vpython/${platform}", Version: "version"},
+		{Name: "data/images", Version: "version"},
+	} {
+		pkgs[pkg.Key()] = pkg
+	}
+	// ensure returns the content of the ensure file generated on the host
+	// plat, without the lines which depend on the host or the file name.
+	ensure := func(plat cipd.Platform) string {
+		defer func(host cipd.Platform) { cipd.CipdPlatform = host }(cipd.CipdPlatform)
+		cipd.CipdPlatform = plat
+		path, err := project.InternalGenerateEnsureFile(jirix, pkgs, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(path)
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var lines []string
+		for _, line := range strings.Split(string(data), "\n") {
+			if !strings.HasPrefix(line, "@Subdir ") && !strings.HasPrefix(line, "$ResolvedVersions ") {
+				lines = append(lines, line)
+			}
+		}
+		return strings.Join(lines, "\n")
+	}
+
+	want := ensure(cipd.Platform{OS: "linux", Arch: "amd64"})
+	for _, plat := range []cipd.Platform{{OS: "mac", Arch: "amd64"}, {OS: "linux", Arch: "arm64"}, {OS: "linux", Arch: "amd64"}} {
+		if got := ensure(plat); got != want {
+			t.Errorf("ensure file on %s:\n%s\nwant:\n%s", plat, got, want)
+		}
+	}
+	for _, line := range []string{
+		"$VerifiedPlatform linux-amd64\n$VerifiedPlatform linux-arm64\n$VerifiedPlatform mac-amd64\n$VerifiedPlatform mac-arm64\n",
+		"gn/gn/${platform=mac-arm64,linux-arm64,linux-amd64} version\n",
+		"tools/${os=linux,mac}/${arch=amd64}/clang version\n",
+	} {
+		if !strings.Contains(want, line) {
+			t.Errorf("ensure file does not contain %q:\n%s", line, want)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright 2020 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package project
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/dahlia-os/jiri"
+	"github.com/dahlia-os/jiri/gitutil"
+	"github.com/dahlia-os/jiri/hgutil"
+)
+
+// Protocols of the version control systems projects can use.
+const (
+	gitProtocol = "git"
+	hgProtocol  = "hg"
+)
+
+// scm is the version control system of a project, selected by its protocol.
+// It covers what "jiri update" needs to check out a project at a revision.
+// Everything else, such as local branches, rebases, submodules, Git LFS and
+// git hooks, is only supported for git projects.
+type scm interface {
+	// Clone clones remote into dir without checking out any revision.
+	Clone(remote, dir string) error
+	// Fetch fetches the new revisions of remote.
+	Fetch(remote string) error
+	// Checkout checks out revision. Uncommitted changes make it fail,
+	// unless force is set and they are discarded.
+	Checkout(revision string, force bool) error
+	// CurrentRevision returns the revision checked out.
+	CurrentRevision() (string, error)
+	// BranchRevision returns the revision of the remote branch, as of the
+	// last fetch.
+	BranchRevision(branch string) (string, error)
+	// ResolveRevision returns the full hash of revision, which must have been
+	// fetched.
+	ResolveRevision(revision string) (string, error)
+	// FilesWithUncommittedChanges returns the files with uncommitted changes.
+	FilesWithUncommittedChanges() ([]string, error)
+	// HasUntrackedFiles returns whether there are untracked files.
+	HasUntrackedFiles() (bool, error)
+}
+
+// newSCM returns the version control system of the project.
+func newSCM(jirix *jiri.X, project Project) scm {
+	if project.Protocol == hgProtocol {
+		return hgSCM{hgutil.New(jirix, hgutil.RootDirOpt(project.Path))}
+	}
+	return gitSCM{gitutil.New(jirix, gitutil.RootDirOpt(project.Path)), project}
+}
+
+// protocol returns the protocol of the project, which defaults to git.
+func (p Project) protocol() string {
+	if p.Protocol == "" {
+		return gitProtocol
+	}
+	return p.Protocol
+}
+
+// usesGit returns whether the project uses git.
+func (p Project) usesGit() bool {
+	return p.protocol() == gitProtocol
+}
+
+// checkProtocols returns an error if a local project does not use the
+// protocol the manifest asks for, as jiri cannot convert a project from one
+// version control system to another.
+func checkProtocols(localProjects, remoteProjects Projects) error {
+	var keys ProjectKeys
+	for key := range localProjects {
+		keys = append(keys, key)
+	}
+	sort.Sort(keys)
+	for _, key := range keys {
+		local := localProjects[key]
+		if remote, ok := remoteProjects[key]; ok && local.protocol() != remote.protocol() {
+			return fmt.Errorf("project %s(%s) uses the %q protocol but the manifest asks for %q, move it out of the root and run the update again", local.Name, local.Path, local.protocol(), remote.protocol())
+		}
+	}
+	return nil
+}
+
+type gitSCM struct {
+	git     *gitutil.Git
+	project Project
+}
+
+func (s gitSCM) Clone(remote, dir string) error {
+	return s.git.Clone(remote, dir, gitutil.NoCheckoutOpt(true), gitutil.OriginOpt(s.project.GitRemoteName()))
+}
+
+func (s gitSCM) Fetch(remote string) error {
+	return s.git.Fetch(remote, gitutil.PruneOpt(true))
+}
+
+func (s gitSCM) Checkout(revision string, force bool) error {
+	return s.git.CheckoutBranch(revision, gitutil.DetachOpt(true), gitutil.ForceOpt(force))
+}
+
+func (s gitSCM) CurrentRevision() (string, error) {
+	return s.git.CurrentRevision()
+}
+
+func (s gitSCM) BranchRevision(branch string) (string, error) {
+	return s.git.CurrentRevisionForRef(s.project.RemoteRef(branch))
+}
+
+func (s gitSCM) ResolveRevision(revision string) (string, error) {
+	return s.git.CurrentRevisionForRef(revision)
+}
+
+func (s gitSCM) FilesWithUncommittedChanges() ([]string, error) {
+	return s.git.FilesWithUncommittedChanges()
+}
+
+func (s gitSCM) HasUntrackedFiles() (bool, error) {
+	return s.git.HasUntrackedFiles()
+}
+
+type hgSCM struct {
+	hg *hgutil.Hg
+}
+
+func (s hgSCM) Clone(remote, dir string) error {
+	return s.hg.Clone(remote, dir)
+}
+
+func (s hgSCM) Fetch(remote string) error {
+	return s.hg.Pull(remote)
+}
+
+func (s hgSCM) Checkout(revision string, force bool) error {
+	return s.hg.Update(revision, hgutil.CleanOpt(force))
+}
+
+func (s hgSCM) CurrentRevision() (string, error) {
+	return s.hg.CurrentRevision()
+}
+
+// BranchRevision returns the tipmost head of the named branch, as Mercurial
+// pulls the branches of remotes into the repository itself.
+func (s hgSCM) BranchRevision(branch string) (string, error) {
+	return s.hg.Revision(branch)
+}
+
+func (s hgSCM) ResolveRevision(revision string) (string, error) {
+	return s.hg.Revision(revision)
+}
+
+func (s hgSCM) FilesWithUncommittedChanges() ([]string, error) {
+	return s.hg.FilesWithUncommittedChanges()
+}
+
+func (s hgSCM) HasUntrackedFiles() (bool, error) {
+	return s.hg.HasUntrackedFiles()
+}
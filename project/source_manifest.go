@@ -118,6 +118,9 @@ func NewSourceManifest(jirix *jiri.X, projects Projects) (*SourceManifest, Multi
 	}
 	var mux sync.Mutex
 	processProject := func(proj Project) error {
+		if !proj.usesGit() {
+			return fmt.Errorf("project %q uses the %q protocol, source manifests only describe git checkouts", proj.Name, proj.Protocol)
+		}
 		gc := &SourceManifest_GitCheckout{
 			RepoUrl: rewriteRemote(jirix, proj.Remote),
 		}
@@ -134,15 +137,16 @@ func NewSourceManifest(jirix *jiri.X, projects Projects) (*SourceManifest, Multi
 		if err != nil {
 			return err
 		}
-		if branchMap["origin/"+proj.RemoteBranch] {
+		origin := proj.GitRemoteName() + "/"
+		if branchMap[origin+proj.RemoteBranch] {
 			gc.FetchRef = "refs/heads/" + proj.RemoteBranch
 		} else {
 			for b, _ := range branchMap {
-				if strings.HasPrefix(b, "origin/HEAD ") {
+				if strings.HasPrefix(b, origin+"HEAD ") {
 					continue
 				}
-				if strings.HasPrefix(b, "origin") {
-					gc.FetchRef = "refs/heads/" + strings.TrimLeft(b, "origin/")
+				if strings.HasPrefix(b, origin) {
+					gc.FetchRef = "refs/heads/" + strings.TrimPrefix(b, origin)
 					break
 				}
 			}
@@ -31,6 +31,10 @@ type ProjectState struct {
 }
 
 func setProjectState(jirix *jiri.X, state *ProjectState, checkDirty bool, ch chan<- error) {
+	if !state.Project.usesGit() {
+		ch <- setSCMProjectState(jirix, state, checkDirty)
+		return
+	}
 	var err error
 	scm := gitutil.New(jirix, gitutil.RootDirOpt(state.Project.Path))
 	branches, err := scm.GetAllBranchesInfo()
@@ -84,6 +88,29 @@ func setProjectState(jirix *jiri.X, state *ProjectState, checkDirty bool, ch cha
 	ch <- nil
 }
 
+// setSCMProjectState sets the state of a project which does not use git. Such
+// projects have no local branches, so only their current revision and changes
+// are recorded.
+func setSCMProjectState(jirix *jiri.X, state *ProjectState, checkDirty bool) error {
+	scm := newSCM(jirix, state.Project)
+	revision, err := scm.CurrentRevision()
+	if err != nil {
+		return err
+	}
+	state.CurrentBranch = BranchState{&ReferenceState{Revision: revision}, nil}
+	if checkDirty {
+		files, err := scm.FilesWithUncommittedChanges()
+		if err != nil {
+			return fmt.Errorf("Cannot get uncommited changes for project %q: %v", state.Project.Name, err)
+		}
+		state.HasUncommitted = len(files) != 0
+		if state.HasUntracked, err = scm.HasUntrackedFiles(); err != nil {
+			return fmt.Errorf("Cannot get untracked changes for project %q: %v", state.Project.Name, err)
+		}
+	}
+	return nil
+}
+
 func GetProjectStates(jirix *jiri.X, projects Projects, checkDirty bool) (map[ProjectKey]*ProjectState, error) {
 	jirix.TimerPush("Get project states")
 	defer jirix.TimerPop()
@@ -8,10 +8,13 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/url"
 	"os"
 	"path/filepath"
 	"runtime"
 	"sort"
+	"strings"
+	"sync"
 
 	"github.com/dahlia-os/jiri"
 	"github.com/dahlia-os/jiri/gitutil"
@@ -83,6 +86,9 @@ func fmtRevision(r string) string {
 
 // clone is a wrapper that reattempts a git clone operation on failure.
 func clone(jirix *jiri.X, repo, path string, opts ...gitutil.CloneOpt) error {
+	if jirix.Offline {
+		return fmt.Errorf("cannot clone %s in offline mode, run without -offline", repo)
+	}
 	msg := fmt.Sprintf("Cloning %s", repo)
 	t := jirix.Logger.TrackTime(msg)
 	defer t.Done()
@@ -93,6 +99,9 @@ func clone(jirix *jiri.X, repo, path string, opts ...gitutil.CloneOpt) error {
 
 // fetch is a wrapper that reattempts a git fetch operation on failure.
 func fetch(jirix *jiri.X, path, remote string, opts ...gitutil.FetchOpt) error {
+	if jirix.Offline {
+		return fmt.Errorf("cannot fetch for %s in offline mode, run without -offline", path)
+	}
 	msg := fmt.Sprintf("Fetching for %s", path)
 	t := jirix.Logger.TrackTime(msg)
 	defer t.Done()
@@ -101,6 +110,63 @@ func fetch(jirix *jiri.X, path, remote string, opts ...gitutil.FetchOpt) error {
 	}, msg, retry.AttemptsOpt(jirix.Attempts))
 }
 
+// remoteHost returns the host of the given remote, or "" for remotes on the
+// local filesystem.  Both urls and scp-like "user@host:path" remotes are
+// understood.
+func remoteHost(remote string) string {
+	if strings.Contains(remote, "://") {
+		u, err := url.Parse(remote)
+		if err != nil {
+			return ""
+		}
+		return u.Hostname()
+	}
+	colon := strings.Index(remote, ":")
+	if colon < 0 || strings.Contains(remote[:colon], "/") {
+		return ""
+	}
+	host := remote[:colon]
+	if at := strings.LastIndex(host, "@"); at >= 0 {
+		host = host[at+1:]
+	}
+	return host
+}
+
+// hostLimiter limits the number of network operations run simultaneously
+// against a single remote host, so that servers don't rate limit us.
+type hostLimiter struct {
+	jirix *jiri.X
+	mu    sync.Mutex
+	sems  map[string]chan struct{}
+}
+
+func newHostLimiter(jirix *jiri.X) *hostLimiter {
+	return &hostLimiter{jirix: jirix, sems: make(map[string]chan struct{})}
+}
+
+// acquire blocks until an operation against the host of remote may run.  The
+// returned function must be called once the operation is done.
+func (l *hostLimiter) acquire(remote string) func() {
+	host := remoteHost(remote)
+	if host == "" {
+		return func() {}
+	}
+	l.mu.Lock()
+	sem, ok := l.sems[host]
+	if !ok {
+		if jobs := l.jirix.HostFetchJobs(host); jobs != 0 {
+			sem = make(chan struct{}, jobs)
+		}
+		l.sems[host] = sem
+	}
+	l.mu.Unlock()
+	if sem == nil {
+		return func() {}
+	}
+	sem <- struct{}{}
+	return func() { <-sem }
+}
+
 type MultiError []error
 
 func (m MultiError) Error() string {
@@ -8,6 +8,7 @@ package retry
 
 import (
 	"fmt"
+	"math/rand"
 	"time"
 
 	"github.com/dahlia-os/jiri"
@@ -25,21 +26,68 @@ type IntervalOpt time.Duration
 
 func (i IntervalOpt) retryOpt() {}
 
+// BackoffOpt sets the delay before the first retry.  The delay doubles for
+// every later retry, up to MaxBackoff.
+type BackoffOpt time.Duration
+
+func (b BackoffOpt) retryOpt() {}
+
 const (
 	defaultAttempts = 3
 	defaultInterval = 5 * time.Second
+
+	// MaxBackoff is the longest delay between two attempts with backoff.
+	MaxBackoff = time.Minute
 )
 
-// Function retries the given function for the given number of
-// attempts at the given interval.
+// permanentError is implemented by errors that know whether retrying the
+// operation that returned them can succeed, such as gitutil.GitError.
+type permanentError interface {
+	Permanent() bool
+}
+
+// IsPermanent reports whether err is a failure that retrying will not fix,
+// like denied authentication or a missing repository.  Errors which do not
+// classify themselves are treated as transient.
+func IsPermanent(err error) bool {
+	p, ok := err.(permanentError)
+	return ok && p.Permanent()
+}
+
+// Backoff returns the delay before the given retry, starting at 1, when the
+// first retry is delayed by initial.  The delay doubles for every retry up to
+// MaxBackoff, and is jittered to between half of it and all of it so that
+// clients failing together don't retry together.
+func Backoff(initial time.Duration, retry int) time.Duration {
+	delay := initial
+	for i := 1; i < retry && delay < MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > MaxBackoff {
+		delay = MaxBackoff
+	}
+	if delay <= 1 {
+		return delay
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// Function retries the given function for the given number of attempts.
+// Attempts are separated by exponential backoff starting at
+// jirix.RetryBackoff, or BackoffOpt if given.  With IntervalOpt or a zero
+// backoff, attempts are separated by a fixed interval instead.  Permanent
+// failures, as reported by IsPermanent, are returned without being retried.
 func Function(jirix *jiri.X, fn func() error, task string, opts ...RetryOpt) error {
-	attempts, interval := defaultAttempts, defaultInterval
+	attempts, interval, backoff := defaultAttempts, defaultInterval, jirix.RetryBackoff
 	for _, opt := range opts {
 		switch typedOpt := opt.(type) {
 		case AttemptsOpt:
 			attempts = int(typedOpt)
 		case IntervalOpt:
 			interval = time.Duration(typedOpt)
+			backoff = 0
+		case BackoffOpt:
+			backoff = time.Duration(typedOpt)
 		}
 	}
 
@@ -51,10 +99,21 @@ func Function(jirix *jiri.X, fn func() error, task string, opts ...RetryOpt) err
 		if err = fn(); err == nil {
 			return nil
 		}
+		if IsPermanent(err) {
+			if attempts > 1 {
+				jirix.Logger.Debugf("Not retrying %s: permanent failure", task)
+			}
+			return err
+		}
 		if i < attempts {
 			jirix.Logger.Errorf("%s\n\n", err)
-			jirix.Logger.Infof("Wait for %s before next attempt...: %s\n\n", interval, task)
-			time.Sleep(interval)
+			delay := interval
+			if backoff > 0 {
+				delay = Backoff(backoff, i)
+				jirix.Logger.Debugf("Retry %d/%d of %s after transient failure in %s", i, attempts-1, task, delay)
+			}
+			jirix.Logger.Infof("Wait for %s before next attempt...: %s\n\n", delay, task)
+			time.Sleep(delay)
 		}
 	}
 	if attempts > 1 {
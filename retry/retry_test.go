@@ -0,0 +1,105 @@
+// Copyright 2019 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package retry_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/dahlia-os/jiri/jiritest"
+	"github.com/dahlia-os/jiri/retry"
+)
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		initial time.Duration
+		retry   int
+		max     time.Duration
+	}{
+		{time.Second, 1, time.Second},
+		{time.Second, 2, 2 * time.Second},
+		{time.Second, 3, 4 * time.Second},
+		{time.Second, 10, retry.MaxBackoff},
+		{time.Second, 1000, retry.MaxBackoff},
+		{2 * retry.MaxBackoff, 1, retry.MaxBackoff},
+	}
+	for _, test := range tests {
+		for i := 0; i < 100; i++ {
+			got := retry.Backoff(test.initial, test.retry)
+			if got < test.max/2 || got > test.max {
+				t.Fatalf("Backoff(%s, %d): got %s, want between %s and %s", test.initial, test.retry, got, test.max/2, test.max)
+			}
+		}
+	}
+}
+
+func TestFunctionBackoff(t *testing.T) {
+	jirix, cleanup := jiritest.NewX(t)
+	defer cleanup()
+
+	var times []time.Time
+	fn := func() error {
+		times = append(times, time.Now())
+		return errors.New("failure")
+	}
+	if err := retry.Function(jirix, fn, "test", retry.AttemptsOpt(3), retry.BackoffOpt(20*time.Millisecond)); err == nil {
+		t.Fatal("expected an error")
+	}
+	if len(times) != 3 {
+		t.Fatalf("got %d attempts, want 3", len(times))
+	}
+	// The second retry waits for at least half of twice the initial delay.
+	if d := times[2].Sub(times[1]); d < 20*time.Millisecond {
+		t.Errorf("second retry after %s, want at least 20ms", d)
+	}
+
+	attempts := 0
+	fn = func() error {
+		if attempts++; attempts < 2 {
+			return errors.New("failure")
+		}
+		return nil
+	}
+	if err := retry.Function(jirix, fn, "test", retry.AttemptsOpt(3), retry.BackoffOpt(time.Millisecond)); err != nil {
+		t.Errorf("expected success on the second attempt, got %v", err)
+	}
+}
+
+type permanentError bool
+
+func (e permanentError) Error() string   { return "failure" }
+func (e permanentError) Permanent() bool { return bool(e) }
+
+func TestFunctionPermanentError(t *testing.T) {
+	jirix, cleanup := jiritest.NewX(t)
+	defer cleanup()
+
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{errors.New("failure"), 3},
+		{permanentError(false), 3},
+		{permanentError(true), 1},
+	}
+	for _, test := range tests {
+		attempts := 0
+		fn := func() error {
+			attempts++
+			return test.err
+		}
+		err := retry.Function(jirix, fn, "test", retry.AttemptsOpt(3), retry.BackoffOpt(time.Millisecond))
+		if err == nil {
+			t.Fatal("expected an error")
+		}
+		if attempts != test.want {
+			t.Errorf("%#v: got %d attempts, want %d", test.err, attempts, test.want)
+		}
+		if retry.IsPermanent(test.err) && err != test.err {
+			t.Errorf("got error %v, want the permanent error to be returned unchanged", err)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright 2020 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package table prints aligned tables of text, truncated to the width of the
+// terminal and colored according to the color setting of jiri.
+package table
+
+import (
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/dahlia-os/jiri/color"
+	"github.com/dahlia-os/jiri/isatty"
+	"github.com/dahlia-os/jiri/textutil"
+)
+
+const (
+	// padding is the number of spaces between columns.
+	padding = 2
+	// minWidth is the width below which cells are not truncated.
+	minWidth = 4
+	ellipsis = "..."
+)
+
+// Cell is a cell of a table.  Its text is colored with Color, if set, which
+// is typically a method of the color.Color of jiri so that the cell is only
+// colored when colors are enabled.
+type Cell struct {
+	Text  string
+	Color color.Colorfn
+}
+
+// Table is a table of text, written with its columns aligned.  As with
+// text/tabwriter, the last cell of each row is not aligned, so that rows with
+// fewer cells can hold a message spanning the following columns.
+type Table struct {
+	width int
+	rows  [][]Cell
+}
+
+// New returns a table with the given header.  Rows are truncated to width
+// runes, or not at all if width is not positive.
+func New(width int, header ...string) *Table {
+	t := &Table{width: width}
+	if len(header) != 0 {
+		t.AddRow(header...)
+	}
+	return t
+}
+
+// AddRow adds a row of uncolored cells.
+func (t *Table) AddRow(cells ...string) {
+	row := make([]Cell, len(cells))
+	for i, text := range cells {
+		row[i] = Cell{Text: text}
+	}
+	t.rows = append(t.rows, row)
+}
+
+// AddCells adds a row of cells.
+func (t *Table) AddCells(cells ...Cell) {
+	t.rows = append(t.rows, cells)
+}
+
+// Write writes the table to w.  When the rows are wider than the width of
+// the table, the last cells are truncated first, down to a few runes, and
+// then the widest columns, with truncated cells ending with "...".
+func (t *Table) Write(w io.Writer) error {
+	var widths []int
+	for _, row := range t.rows {
+		for i := 0; i < len(row)-1; i++ {
+			if i == len(widths) {
+				widths = append(widths, 0)
+			}
+			if n := utf8.RuneCountInString(row[i].Text); n > widths[i] {
+				widths[i] = n
+			}
+		}
+	}
+	if t.width > 0 {
+		// Shrink the widest column until the rows fit, with their last
+		// cells truncated to minWidth.
+		for t.minRowWidth(widths) > t.width {
+			widest := -1
+			for i, n := range widths {
+				if n > minWidth && (widest == -1 || n >= widths[widest]) {
+					widest = i
+				}
+			}
+			if widest == -1 {
+				break
+			}
+			widths[widest]--
+		}
+	}
+
+	var b strings.Builder
+	for _, row := range t.rows {
+		offset := 0
+		for i, cell := range row {
+			if i == len(row)-1 {
+				text := cell.Text
+				if t.width > 0 {
+					text = truncate(text, t.width-offset)
+				}
+				b.WriteString(colored(cell.Color, text))
+				break
+			}
+			text := truncate(cell.Text, widths[i])
+			b.WriteString(colored(cell.Color, text))
+			b.WriteString(strings.Repeat(" ", widths[i]-utf8.RuneCountInString(text)+padding))
+			offset += widths[i] + padding
+		}
+		b.WriteString("\n")
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// minRowWidth returns the width of the widest row when its columns have the
+// given widths and its last cell is truncated to minWidth.
+func (t *Table) minRowWidth(widths []int) int {
+	max := 0
+	for _, row := range t.rows {
+		n := 0
+		for i := 0; i < len(row)-1; i++ {
+			n += widths[i] + padding
+		}
+		if len(row) != 0 {
+			last := utf8.RuneCountInString(row[len(row)-1].Text)
+			if last > minWidth {
+				last = minWidth
+			}
+			n += last
+		}
+		if n > max {
+			max = n
+		}
+	}
+	return max
+}
+
+// truncate returns text truncated to width runes, ending with an ellipsis
+// when it is truncated.  Text is never truncated below minWidth.
+func truncate(text string, width int) string {
+	if width < minWidth {
+		width = minWidth
+	}
+	if utf8.RuneCountInString(text) <= width {
+		return text
+	}
+	runes := []rune(text)
+	return string(runes[:width-len(ellipsis)]) + ellipsis
+}
+
+func colored(fn color.Colorfn, text string) string {
+	if fn == nil || text == "" {
+		return text
+	}
+	return fn("%s", text)
+}
+
+// Width returns the width tables printed to stdout are truncated to.  As with
+// the -width flag of "jiri help", it is given by the CMDLINE_WIDTH variable of
+// env if set, and is otherwise the width of the terminal.  It is 0, for no
+// truncation, when stdout is not a terminal.
+func Width(env map[string]string) int {
+	if width, err := strconv.Atoi(env["CMDLINE_WIDTH"]); err == nil && width != 0 {
+		return width
+	}
+	if !isatty.IsTerminal() {
+		return 0
+	}
+	if _, width, err := textutil.TerminalSize(); err == nil {
+		return width
+	}
+	return 0
+}
@@ -0,0 +1,112 @@
+// Copyright 2020 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package table
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/dahlia-os/jiri/color"
+)
+
+func write(t *testing.T, tbl *Table) string {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := tbl.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestAlignment(t *testing.T) {
+	tbl := New(0, "PROJECT", "BRANCH", "STATUS")
+	tbl.AddRow("a", "master", "ok")
+	tbl.AddRow("long/path/b", "feature", "failed")
+	tbl.AddRow("c", "message spanning columns")
+	tbl.AddRow("ünïcode", "x", "ok")
+	want := strings.Join([]string{
+		"PROJECT      BRANCH   STATUS",
+		"a            master   ok",
+		"long/path/b  feature  failed",
+		"c            message spanning columns",
+		"ünïcode      x        ok",
+		"",
+	}, "\n")
+	if got := write(t, tbl); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestTruncation(t *testing.T) {
+	tbl := New(24, "PROJECT", "BRANCH", "DESCRIPTION")
+	tbl.AddRow("some/long/project/path", "main", "a long description")
+	tbl.AddRow("short", "main", "ok")
+	want := strings.Join([]string{
+		"PROJECT     BRANCH  D...",
+		"some/lo...  main    a...",
+		"short       main    ok",
+		"",
+	}, "\n")
+	got := write(t, tbl)
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	// The last cells are truncated first.
+	tbl = New(30, "PROJECT", "DESCRIPTION")
+	tbl.AddRow("a/b", "a description which is too long")
+	want = strings.Join([]string{
+		"PROJECT  DESCRIPTION",
+		"a/b      a description whic...",
+		"",
+	}, "\n")
+	if got := write(t, tbl); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	// Columns are not truncated below a few runes.
+	tbl = New(1, "PROJECT", "DESCRIPTION")
+	tbl.AddRow("project", "description")
+	want = strings.Join([]string{
+		"P...  D...",
+		"p...  d...",
+		"",
+	}, "\n")
+	if got := write(t, tbl); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestColor(t *testing.T) {
+	for _, c := range []color.EnableColor{color.ColorAlways, color.ColorNever} {
+		colors := color.NewColor(c)
+		tbl := New(0, "NAME", "STATUS", "NOTE")
+		tbl.AddCells(Cell{Text: "a"}, Cell{Text: "failed", Color: colors.Red}, Cell{Text: "x"})
+		tbl.AddCells(Cell{Text: "b"}, Cell{Text: "ok", Color: colors.Green}, Cell{Text: "y"})
+		want := strings.Join([]string{
+			"NAME  STATUS  NOTE",
+			"a     " + colors.Red("failed") + "  x",
+			"b     " + colors.Green("ok") + "      y",
+			"",
+		}, "\n")
+		got := write(t, tbl)
+		if got != want {
+			t.Errorf("color %s: got:\n%q\nwant:\n%q", c, got, want)
+		}
+		if colored := strings.Contains(got, "\033["); colored != colors.Enabled() {
+			t.Errorf("color %s: got colored output %v, want %v", c, colored, colors.Enabled())
+		}
+	}
+}
+
+func TestWidth(t *testing.T) {
+	if got := Width(map[string]string{"CMDLINE_WIDTH": "42"}); got != 42 {
+		t.Errorf("got width %d, want 42", got)
+	}
+	if got := Width(map[string]string{"CMDLINE_WIDTH": "-1"}); got != -1 {
+		t.Errorf("got width %d, want -1", got)
+	}
+}
@@ -0,0 +1,218 @@
+// Copyright 2020 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package jiri
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Status values of the entries of an UpdateResult.
+const (
+	ResultOK      = "ok"
+	ResultFailed  = "failed"
+	ResultSkipped = "skipped"
+)
+
+// UpdateResult is the end state of a "jiri update" run, as written to the
+// file given by its -result-file flag. Its fields are a stable format for
+// tools consuming that file.
+//
+// The Add methods may be called concurrently, and do nothing on a nil
+// UpdateResult, so that callers need not check whether results are recorded.
+// An update may retry its work, so they replace any entry recorded earlier
+// for the same project, hook or package.
+type UpdateResult struct {
+	mu         sync.Mutex
+	Success    bool            `json:"success"`
+	Error      string          `json:"error,omitempty"`
+	DurationMs int64           `json:"duration_ms"`
+	Projects   []ProjectResult `json:"projects"`
+	Hooks      []HookResult    `json:"hooks"`
+	Packages   []PackageResult `json:"packages"`
+}
+
+// ProjectResult is the outcome of the operation run on a project. Action is
+// one of "create", "update", "move", "change-remote" or "delete", or "null"
+// for a project which needed no change but failed to be checked.
+type ProjectResult struct {
+	Name        string `json:"name"`
+	Path        string `json:"path"`
+	Action      string `json:"action"`
+	Status      string `json:"status"`
+	Error       string `json:"error,omitempty"`
+	OldRevision string `json:"old_revision,omitempty"`
+	NewRevision string `json:"new_revision,omitempty"`
+	DurationMs  int64  `json:"duration_ms"`
+}
+
+// HookResult is the outcome of running a hook. A hook is skipped when a hook
+// it depends on failed.
+type HookResult struct {
+	Name       string `json:"name"`
+	Project    string `json:"project"`
+	Status     string `json:"status"`
+	Error      string `json:"error,omitempty"`
+	DurationMs int64  `json:"duration_ms"`
+}
+
+// PackageResult is the outcome of fetching a package. A package is skipped
+// when the user has no access to it.
+type PackageResult struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Path    string `json:"path,omitempty"`
+	Status  string `json:"status"`
+}
+
+// NewUpdateResult returns an empty UpdateResult.
+func NewUpdateResult() *UpdateResult {
+	return &UpdateResult{}
+}
+
+func durationMs(d time.Duration) int64 {
+	return d.Nanoseconds() / int64(time.Millisecond)
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+func status(err error) string {
+	if err == nil {
+		return ResultOK
+	}
+	return ResultFailed
+}
+
+// AddProject records the outcome err of the operation p.Action run on a
+// project, which took duration.
+func (r *UpdateResult) AddProject(p ProjectResult, duration time.Duration, err error) {
+	if r == nil {
+		return
+	}
+	p.DurationMs = durationMs(duration)
+	p.Status = status(err)
+	p.Error = errorString(err)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := range r.Projects {
+		if r.Projects[i].Path == p.Path {
+			r.Projects[i] = p
+			return
+		}
+	}
+	r.Projects = append(r.Projects, p)
+}
+
+// AddHook records the outcome err of running a hook, which took duration.
+// Use AddSkippedHook for hooks which were not run.
+func (r *UpdateResult) AddHook(name, project string, duration time.Duration, err error) {
+	if r == nil {
+		return
+	}
+	r.addHook(HookResult{
+		Name:       name,
+		Project:    project,
+		Status:     status(err),
+		Error:      errorString(err),
+		DurationMs: durationMs(duration),
+	})
+}
+
+// AddSkippedHook records that a hook was not run, for the reason given by
+// err.
+func (r *UpdateResult) AddSkippedHook(name, project string, err error) {
+	if r == nil {
+		return
+	}
+	r.addHook(HookResult{
+		Name:    name,
+		Project: project,
+		Status:  ResultSkipped,
+		Error:   errorString(err),
+	})
+}
+
+func (r *UpdateResult) addHook(h HookResult) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := range r.Hooks {
+		if r.Hooks[i].Project == h.Project && r.Hooks[i].Name == h.Name {
+			r.Hooks[i] = h
+			return
+		}
+	}
+	r.Hooks = append(r.Hooks, h)
+}
+
+// AddPackage records the outcome of fetching a package, with status one of
+// ResultOK, ResultFailed or ResultSkipped.
+func (r *UpdateResult) AddPackage(p PackageResult) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := range r.Packages {
+		if r.Packages[i].Name == p.Name && r.Packages[i].Path == p.Path {
+			r.Packages[i] = p
+			return
+		}
+	}
+	r.Packages = append(r.Packages, p)
+}
+
+// Finish records the overall outcome err of the run, which took duration.
+func (r *UpdateResult) Finish(duration time.Duration, err error) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Success = err == nil
+	r.Error = errorString(err)
+	r.DurationMs = durationMs(duration)
+}
+
+// ToFile writes r to filename in JSON format, with its entries sorted by
+// path, project and name so that the output of runs can be compared.
+func (r *UpdateResult) ToFile(filename string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sort.SliceStable(r.Projects, func(i, j int) bool { return r.Projects[i].Path < r.Projects[j].Path })
+	sort.SliceStable(r.Hooks, func(i, j int) bool {
+		if r.Hooks[i].Project != r.Hooks[j].Project {
+			return r.Hooks[i].Project < r.Hooks[j].Project
+		}
+		return r.Hooks[i].Name < r.Hooks[j].Name
+	})
+	sort.SliceStable(r.Packages, func(i, j int) bool { return r.Packages[i].Name < r.Packages[j].Name })
+	// Empty lists are written as [] rather than null.
+	if r.Projects == nil {
+		r.Projects = []ProjectResult{}
+	}
+	if r.Hooks == nil {
+		r.Hooks = []HookResult{}
+	}
+	if r.Packages == nil {
+		r.Packages = []PackageResult{}
+	}
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to serialize update result: %s", err)
+	}
+	if err := ioutil.WriteFile(filename, data, 0644); err != nil {
+		return fmt.Errorf("failed to write update result to %s: %s", filename, err)
+	}
+	return nil
+}
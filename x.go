@@ -15,6 +15,8 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strconv"
 	"sync/atomic"
 	"time"
 
@@ -28,14 +30,16 @@ import (
 )
 
 const (
-	RootMetaDir        = ".jiri_root"
-	ProjectMetaDir     = ".git/jiri"
-	OldProjectMetaDir  = ".jiri"
-	ConfigFile         = "config"
-	DefaultCacheSubdir = "cache"
-	ProjectMetaFile    = "metadata.v2"
-	ProjectConfigFile  = "config"
-	JiriManifestFile   = ".jiri_manifest"
+	RootMetaDir           = ".jiri_root"
+	ProjectMetaDir        = ".git/jiri"
+	HgProjectMetaDir      = ".hg/jiri"
+	OldProjectMetaDir     = ".jiri"
+	ConfigFile            = "config"
+	DefaultCacheSubdir    = "cache"
+	ProjectMetaFile       = "metadata.v2"
+	ProjectConfigFile     = "config"
+	JiriManifestFile      = ".jiri_manifest"
+	JiriLocalManifestFile = ".jiri_manifest.local"
 
 	// PreservePathEnv is the name of the environment variable that, when set to a
 	// non-empty value, causes jiri tools to use the existing PATH variable,
@@ -57,10 +61,23 @@ type Config struct {
 	// version user has opted-in to
 	AnalyticsVersion string `xml:"analytics>version,omitempty"`
 	KeepGitHooks     bool   `xml:"keepGitHooks,omitempty"`
+	// Jobs and FetchJobs override DefaultJobs and DefaultFetchJobs.
+	Jobs      uint `xml:"jobs,omitempty"`
+	FetchJobs uint `xml:"fetchJobs,omitempty"`
+	// FetchJobsPerHost overrides DefaultFetchJobsPerHost, Hosts sets the
+	// limit for individual hosts.
+	FetchJobsPerHost uint         `xml:"fetchJobsPerHost,omitempty"`
+	Hosts            []HostConfig `xml:"hosts>host,omitempty"`
 
 	XMLName struct{} `xml:"config"`
 }
 
+// HostConfig represents the config of a remote host.
+type HostConfig struct {
+	Name      string `xml:"name,attr"`
+	FetchJobs uint   `xml:"fetchJobs,attr,omitempty"`
+}
+
 func (c *Config) Write(filename string) error {
 	if c.CachePath != "" {
 		var err error
@@ -101,6 +118,9 @@ type X struct {
 	Cache               string
 	Shared              bool
 	Jobs                uint
+	FetchJobs           uint
+	FetchJobsPerHost    uint
+	hostFetchJobs       map[string]uint
 	KeepGitHooks        bool
 	RewriteSsoToHttps   bool
 	LockfileEnabled     bool
@@ -109,10 +129,21 @@ type X struct {
 	PrebuiltJSON        string
 	UsingSnapshot       bool
 	IgnoreLockConflicts bool
+	Offline             bool
+	Unshallow           bool
+	PruneTags           bool
+	Autostash           bool
+	ForceUpdate         bool
+	DryRun              bool
+	LocalManifests      []string
+	SkipPrecheck        bool
+	LogHooks            bool
+	UpdateResult        *UpdateResult
 	Color               color.Color
 	Logger              *log.Logger
 	failures            uint32
 	Attempts            uint
+	RetryBackoff        time.Duration
 	cleanupFuncs        []func()
 	AnalyticsSession    *analytics_util.AnalyticsSession
 }
@@ -140,8 +171,11 @@ func (jirix *X) RunCleanup() {
 
 var (
 	rootFlag              string
-	jobsFlag              uint
+	jobsFlag              = uintFlag{value: DefaultJobs}
+	fetchJobsFlag         = uintFlag{value: DefaultFetchJobs}
+	fetchJobsPerHostFlag  = uintFlag{value: DefaultFetchJobsPerHost}
 	colorFlag             string
+	logJSONFlag           bool
 	quietVerboseFlag      bool
 	debugVerboseFlag      bool
 	traceVerboseFlag      bool
@@ -169,9 +203,12 @@ func (showRootFlag) Set(string) error {
 
 func init() {
 	flag.StringVar(&rootFlag, "root", "", "Jiri root directory")
-	flag.UintVar(&jobsFlag, "j", DefaultJobs, "Number of jobs (commands) to run simultaneously")
+	flag.Var(&jobsFlag, "j", "Number of jobs (commands) to run simultaneously. Defaults to the number of CPUs, at least 25.")
+	flag.Var(&fetchJobsFlag, "fetch-jobs", "Number of network operations, such as fetches and clones, to run simultaneously. Defaults to twice the number of CPUs, at most 16, or to -j if that is set.")
+	flag.Var(&fetchJobsPerHostFlag, "fetch-jobs-per-host", "Number of network operations to run simultaneously against a single remote host, to avoid being rate limited. Defaults to no limit.")
 	flag.StringVar(&colorFlag, "color", "auto", "Use color to format output. Values can be always, never and auto")
 	flag.BoolVar(&showProgressFlag, "show-progress", true, "Show progress.")
+	flag.BoolVar(&logJSONFlag, "log-json", false, "Log messages as JSON objects, one per line, with the fields level, time, msg and project. Progress is not shown.")
 	flag.Var(showRootFlag{}, "show-root", "Displays jiri root and exits.")
 	flag.UintVar(&progessWindowSizeFlag, "progress-window", 5, "Number of progress messages to show simultaneously. Should be between 1 and 10")
 	flag.DurationVar(&timeLogThresholdFlag, "time-log-threshold", time.Second*10, "Log time taken by operations if more than the passed value (eg 5s). This only works with -v and -vv.")
@@ -203,7 +240,11 @@ func NewX(env *cmdline.Env) (*X, error) {
 	} else if progessWindowSizeFlag > 10 {
 		progessWindowSizeFlag = 10
 	}
-	logger := log.NewLogger(loggerLevel, color, showProgressFlag, progessWindowSizeFlag, timeLogThresholdFlag, nil, nil)
+	logFormat := log.TextFormat
+	if logJSONFlag {
+		logFormat = log.JSONFormat
+	}
+	logger := log.NewLogger(loggerLevel, color, logFormat, showProgressFlag, progessWindowSizeFlag, timeLogThresholdFlag, nil, nil)
 
 	ctx := tool.NewContextFromEnv(env)
 	root, err := findJiriRoot(ctx.Timer())
@@ -211,18 +252,14 @@ func NewX(env *cmdline.Env) (*X, error) {
 		return nil, err
 	}
 
-	if jobsFlag == 0 {
-		return nil, fmt.Errorf("No of concurrent jobs should be more than zero")
-	}
-
 	x := &X{
-		Context:  ctx,
-		Root:     root,
-		Usage:    env.UsageErrorf,
-		Jobs:     jobsFlag,
-		Color:    color,
-		Logger:   logger,
-		Attempts: 1,
+		Context:      ctx,
+		Root:         root,
+		Usage:        env.UsageErrorf,
+		Color:        color,
+		Logger:       logger,
+		Attempts:     1,
+		RetryBackoff: DefaultRetryBackoff,
 	}
 	configPath := filepath.Join(x.RootMetaDir(), ConfigFile)
 	if _, err := os.Stat(configPath); err == nil {
@@ -247,6 +284,9 @@ func NewX(env *cmdline.Env) (*X, error) {
 			x.PrebuiltJSON = "prebuilt.json"
 		}
 	}
+	if err := x.setJobs(); err != nil {
+		return nil, err
+	}
 	x.Cache, err = findCache(root, x.config)
 	if x.config != nil {
 		x.Shared = x.config.Shared
@@ -273,7 +313,112 @@ func NewX(env *cmdline.Env) (*X, error) {
 	return x, nil
 }
 
-const DefaultJobs = 25
+var (
+	// DefaultJobs is the default number of local jobs run simultaneously.
+	DefaultJobs = defaultJobs(runtime.NumCPU())
+	// DefaultFetchJobs is the default number of network operations run
+	// simultaneously.
+	DefaultFetchJobs = defaultFetchJobs(runtime.NumCPU())
+	// DefaultFetchJobsPerHost is the default number of network operations
+	// run simultaneously against a single remote host. Zero means no limit
+	// other than FetchJobs, hosts which rate limit clients can be given one
+	// in the config file.
+	DefaultFetchJobsPerHost = uint(0)
+	// DefaultRetryBackoff is the default delay before the first retry of a
+	// failed operation.
+	DefaultRetryBackoff = time.Second
+)
+
+// defaultJobs returns the number of cpus, at least 25.  Local jobs are
+// mostly git commands waiting on the disk rather than using a cpu, so small
+// machines still run as many of them as before while big ones run one per
+// cpu.
+func defaultJobs(cpus int) uint {
+	if cpus > 25 {
+		return uint(cpus)
+	}
+	return 25
+}
+
+// defaultFetchJobs returns twice the number of cpus, at most 16.  Network
+// operations mostly wait, but too many of them overload small machines and
+// remote servers alike.
+func defaultFetchJobs(cpus int) uint {
+	if jobs := 2 * cpus; jobs < 16 {
+		return uint(jobs)
+	}
+	return 16
+}
+
+// setJobs sets Jobs, FetchJobs and FetchJobsPerHost from the flags, the config file and the
+// defaults, in that order of precedence.  An explicit -j also limits the
+// fetch jobs, unless they are configured separately.
+func (x *X) setJobs() error {
+	x.Jobs, x.FetchJobs = DefaultJobs, DefaultFetchJobs
+	if x.config != nil && x.config.Jobs != 0 {
+		x.Jobs = x.config.Jobs
+	}
+	if jobsFlag.set {
+		x.Jobs = jobsFlag.value
+		x.FetchJobs = jobsFlag.value
+	}
+	if x.config != nil && x.config.FetchJobs != 0 {
+		x.FetchJobs = x.config.FetchJobs
+	}
+	if fetchJobsFlag.set {
+		x.FetchJobs = fetchJobsFlag.value
+	}
+	x.FetchJobsPerHost = DefaultFetchJobsPerHost
+	if x.config != nil && x.config.FetchJobsPerHost != 0 {
+		x.FetchJobsPerHost = x.config.FetchJobsPerHost
+	}
+	if fetchJobsPerHostFlag.set {
+		x.FetchJobsPerHost = fetchJobsPerHostFlag.value
+	}
+	if x.Jobs == 0 || x.FetchJobs == 0 {
+		return fmt.Errorf("No of concurrent jobs should be more than zero")
+	}
+	if x.config != nil {
+		for _, host := range x.config.Hosts {
+			if host.FetchJobs != 0 {
+				if x.hostFetchJobs == nil {
+					x.hostFetchJobs = make(map[string]uint)
+				}
+				x.hostFetchJobs[host.Name] = host.FetchJobs
+			}
+		}
+	}
+	x.Logger.Debugf("Running %d jobs and %d fetch jobs simultaneously, %d per host", x.Jobs, x.FetchJobs, x.FetchJobsPerHost)
+	return nil
+}
+
+// HostFetchJobs returns the number of network operations to run
+// simultaneously against the given remote host.  Zero means no limit.
+func (x *X) HostFetchJobs(host string) uint {
+	if jobs, ok := x.hostFetchJobs[host]; ok {
+		return jobs
+	}
+	return x.FetchJobsPerHost
+}
+
+// uintFlag is a uint flag which records whether it was set on the command line.
+type uintFlag struct {
+	value uint
+	set   bool
+}
+
+func (f *uintFlag) String() string {
+	return strconv.FormatUint(uint64(f.value), 10)
+}
+
+func (f *uintFlag) Set(s string) error {
+	v, err := strconv.ParseUint(s, 10, 0)
+	if err != nil {
+		return err
+	}
+	f.value, f.set = uint(v), true
+	return nil
+}
 
 func cleanPath(path string) (string, error) {
 	result, err := filepath.EvalSymlinks(path)
@@ -377,12 +522,26 @@ func (x *X) Clone(opts tool.ContextOpts) *X {
 		Root:              x.Root,
 		Usage:             x.Usage,
 		Jobs:              x.Jobs,
+		FetchJobs:         x.FetchJobs,
+		FetchJobsPerHost:  x.FetchJobsPerHost,
+		hostFetchJobs:     x.hostFetchJobs,
 		Cache:             x.Cache,
 		Color:             x.Color,
 		RewriteSsoToHttps: x.RewriteSsoToHttps,
+		Offline:           x.Offline,
+		Unshallow:         x.Unshallow,
+		PruneTags:         x.PruneTags,
+		Autostash:         x.Autostash,
+		ForceUpdate:       x.ForceUpdate,
+		DryRun:            x.DryRun,
+		LocalManifests:    x.LocalManifests,
+		SkipPrecheck:      x.SkipPrecheck,
+		LogHooks:          x.LogHooks,
+		UpdateResult:      x.UpdateResult,
 		Logger:            x.Logger,
 		failures:          x.failures,
 		Attempts:          x.Attempts,
+		RetryBackoff:      x.RetryBackoff,
 		cleanupFuncs:      x.cleanupFuncs,
 		AnalyticsSession:  x.AnalyticsSession,
 	}
@@ -408,6 +567,11 @@ func (x *X) JiriManifestFile() string {
 	return filepath.Join(x.Root, JiriManifestFile)
 }
 
+// JiriLocalManifestFile returns the path to the .jiri_manifest.local file.
+func (x *X) JiriLocalManifestFile() string {
+	return filepath.Join(x.Root, JiriLocalManifestFile)
+}
+
 // BinDir returns the path to the bin directory.
 func (x *X) BinDir() string {
 	return filepath.Join(x.RootMetaDir(), "bin")
@@ -418,6 +582,11 @@ func (x *X) ScriptsDir() string {
 	return filepath.Join(x.RootMetaDir(), "scripts")
 }
 
+// HookLogsDir returns the path to the directory hook output is logged to.
+func (x *X) HookLogsDir() string {
+	return filepath.Join(x.RootMetaDir(), "hook_logs")
+}
+
 // UpdateHistoryDir returns the path to the update history directory.
 func (x *X) UpdateHistoryDir() string {
 	return filepath.Join(x.RootMetaDir(), "update_history")
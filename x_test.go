@@ -9,6 +9,10 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
+
+	"github.com/dahlia-os/jiri/color"
+	"github.com/dahlia-os/jiri/log"
 )
 
 // TestFindRootEnvSymlink checks that FindRoot interprets the value of the
@@ -45,3 +49,102 @@ func TestFindRootEnvSymlink(t *testing.T) {
 		t.Fatalf("unexpected output: got %v, want %v", got, want)
 	}
 }
+
+func TestSetJobs(t *testing.T) {
+	defer func() {
+		jobsFlag = uintFlag{value: DefaultJobs}
+		fetchJobsFlag = uintFlag{value: DefaultFetchJobs}
+	}()
+	logger := log.NewLogger(log.InfoLevel, color.NewColor(color.ColorNever), log.TextFormat, false, 0, time.Second, nil, nil)
+	tests := []struct {
+		config                *Config
+		jobs, fetchJobs       string
+		wantJobs, wantFetches uint
+	}{
+		{nil, "", "", DefaultJobs, DefaultFetchJobs},
+		{&Config{Jobs: 3}, "", "", 3, DefaultFetchJobs},
+		{&Config{Jobs: 3, FetchJobs: 5}, "", "", 3, 5},
+		{nil, "2", "", 2, 2},
+		{&Config{FetchJobs: 5}, "2", "", 2, 5},
+		{&Config{Jobs: 3, FetchJobs: 5}, "2", "7", 2, 7},
+	}
+	for _, test := range tests {
+		jobsFlag = uintFlag{value: DefaultJobs}
+		fetchJobsFlag = uintFlag{value: DefaultFetchJobs}
+		if test.jobs != "" {
+			jobsFlag.Set(test.jobs)
+		}
+		if test.fetchJobs != "" {
+			fetchJobsFlag.Set(test.fetchJobs)
+		}
+		x := &X{config: test.config, Logger: logger}
+		if err := x.setJobs(); err != nil {
+			t.Fatal(err)
+		}
+		if x.Jobs != test.wantJobs || x.FetchJobs != test.wantFetches {
+			t.Errorf("config %+v, -j=%q, -fetch-jobs=%q: got %d, %d, want %d, %d", test.config, test.jobs, test.fetchJobs, x.Jobs, x.FetchJobs, test.wantJobs, test.wantFetches)
+		}
+	}
+
+	jobsFlag.Set("0")
+	if err := (&X{Logger: logger}).setJobs(); err == nil {
+		t.Errorf("expected an error for -j=0")
+	}
+}
+
+func TestHostFetchJobs(t *testing.T) {
+	defer func() {
+		fetchJobsPerHostFlag = uintFlag{value: DefaultFetchJobsPerHost}
+	}()
+	logger := log.NewLogger(log.InfoLevel, color.NewColor(color.ColorNever), log.TextFormat, false, 0, time.Second, nil, nil)
+	config := &Config{
+		FetchJobsPerHost: 2,
+		Hosts:            []HostConfig{{Name: "fast.example.com", FetchJobs: 8}},
+	}
+	x := &X{Logger: logger}
+	if err := x.setJobs(); err != nil {
+		t.Fatal(err)
+	}
+	if got := x.HostFetchJobs("example.com"); got != 0 {
+		t.Errorf("no config: got %d, want no limit", got)
+	}
+
+	x = &X{config: config, Logger: logger}
+	if err := x.setJobs(); err != nil {
+		t.Fatal(err)
+	}
+	if got := x.HostFetchJobs("example.com"); got != 2 {
+		t.Errorf("example.com: got %d, want 2", got)
+	}
+	if got := x.HostFetchJobs("fast.example.com"); got != 8 {
+		t.Errorf("fast.example.com: got %d, want 8", got)
+	}
+
+	fetchJobsPerHostFlag.Set("3")
+	x = &X{config: config, Logger: logger}
+	if err := x.setJobs(); err != nil {
+		t.Fatal(err)
+	}
+	if got := x.HostFetchJobs("example.com"); got != 3 {
+		t.Errorf("-fetch-jobs-per-host=3: got %d, want 3", got)
+	}
+	if got := x.HostFetchJobs("fast.example.com"); got != 8 {
+		t.Errorf("-fetch-jobs-per-host=3, fast.example.com: got %d, want 8", got)
+	}
+}
+
+func TestDefaultJobs(t *testing.T) {
+	for cpus, want := range map[int]uint{1: 25, 8: 25, 25: 25, 64: 64} {
+		if got := defaultJobs(cpus); got != want {
+			t.Errorf("defaultJobs(%d): got %d, want %d", cpus, got, want)
+		}
+	}
+}
+
+func TestDefaultFetchJobs(t *testing.T) {
+	for cpus, want := range map[int]uint{1: 2, 4: 8, 8: 16, 64: 16} {
+		if got := defaultFetchJobs(cpus); got != want {
+			t.Errorf("defaultFetchJobs(%d): got %d, want %d", cpus, got, want)
+		}
+	}
+}